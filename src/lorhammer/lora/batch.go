@@ -0,0 +1,105 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"lorhammer/src/model"
+	"net"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//maxBatchSize keeps a PUSH_DATA of rxpks with the biggest PHYPayloads under the max udp data size
+const maxBatchSize = 64
+
+//CheckBatch return an error if the batch config of the scenario is not valid
+func CheckBatch(batch *model.Batch) error {
+	if batch == nil {
+		return nil
+	}
+	if batch.Window != "" {
+		if d, err := time.ParseDuration(batch.Window); err != nil || d < 0 {
+			return errors.New("batch window must be a positive duration")
+		}
+	}
+	if batch.MaxSize < 0 || batch.MaxSize > maxBatchSize {
+		return errors.New("batch maxSize must be positive and not greater than 64")
+	}
+	return nil
+}
+
+//setBatch set the batching window and max size of the gateway
+func (gateway *LorhammerGateway) setBatch(batch *model.Batch) {
+	if batch == nil {
+		return
+	}
+	// batch is checked when the scenario is created
+	gateway.BatchWindow, _ = time.ParseDuration(batch.Window)
+	gateway.BatchMaxSize = batch.MaxSize
+}
+
+//batchSize return the max number of rxpk in one PUSH_DATA, one without batching
+func (gateway *LorhammerGateway) batchSize() int {
+	if gateway.BatchMaxSize <= 0 {
+		return 1
+	}
+	return gateway.BatchMaxSize
+}
+
+//nbPushData return the number of PUSH_DATA needed to send nbRxpks rxpks
+func (gateway *LorhammerGateway) nbPushData(nbRxpks int) int {
+	size := gateway.batchSize()
+	return (nbRxpks + size - 1) / size
+}
+
+//sendRxpks send the rxpks emitted by the nodes during a round in PUSH_DATA of at most batchSize rxpks
+//they are collected like the frames of nodes emitting at their own pace, full batches are sent at once and the last one at the end of its window
+func (gateway *LorhammerGateway) sendRxpks(conn net.Conn, rxpks []loraserver_structs.RXPK) {
+	emitted := make(chan loraserver_structs.RXPK, len(rxpks))
+	for _, rxpk := range rxpks {
+		emitted <- rxpk
+	}
+	close(emitted)
+	gateway.batchLoop(context.Background(), emitted, func(batch []loraserver_structs.RXPK) {
+		gateway.writeRxpks(conn, batch)
+	})
+}
+
+//batchLoop send the rxpks received on emitted until it is closed and the last batch is sent, or until the context is done
+//like a packet forwarder, rxpks received during the same batch window or waiting together on emitted are sent together, up to the batch max size
+func (gateway *LorhammerGateway) batchLoop(ctx context.Context, emitted <-chan loraserver_structs.RXPK, send func([]loraserver_structs.RXPK)) {
+	var batch []loraserver_structs.RXPK
+	var endWindow <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rxpk, ok := <-emitted:
+			if !ok {
+				// the last rxpks are sent at the end of their window
+				if emitted = nil; len(batch) == 0 {
+					return
+				}
+				continue
+			}
+			batch = append(batch, rxpk)
+			if len(batch) < gateway.batchSize() {
+				if len(emitted) > 0 {
+					continue
+				}
+				if gateway.BatchWindow > 0 {
+					if endWindow == nil {
+						endWindow = time.After(gateway.BatchWindow)
+					}
+					continue
+				}
+			}
+		case <-endWindow:
+		}
+		send(batch)
+		if batch, endWindow = nil, nil; emitted == nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lora
+
+import (
+	"context"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//recordConn keeps the packets written by the gateway
+type recordConn struct {
+	fakeConn
+	packets [][]byte
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	rc.packets = append(rc.packets, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestCheckBatch(t *testing.T) {
+	if CheckBatch(nil) != nil || CheckBatch(&model.Batch{Window: "100ms", MaxSize: 8}) != nil {
+		t.Fatal("Valid batch must not return an error")
+	}
+	if CheckBatch(&model.Batch{Window: "toto", MaxSize: 8}) == nil {
+		t.Fatal("Error expected on wrong batch window")
+	}
+	if CheckBatch(&model.Batch{MaxSize: 65}) == nil || CheckBatch(&model.Batch{MaxSize: -1}) == nil {
+		t.Fatal("Error expected on batch max size out of range")
+	}
+}
+
+func TestNbPushData(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	if gateway.nbPushData(5) != 5 {
+		t.Fatal("Without batch each rxpk must be sent in its own PUSH_DATA")
+	}
+	gateway.setBatch(&model.Batch{MaxSize: 2})
+	if gateway.nbPushData(5) != 3 || gateway.nbPushData(0) != 0 {
+		t.Fatal("Rxpks must be sent by batches of max size")
+	}
+}
+
+func TestSendPushPacketsBatch(t *testing.T) {
+	conn := &recordConn{}
+	gateway := &LorhammerGateway{}
+	gateway.setBatch(&model.Batch{Window: "20ms", MaxSize: 2})
+	for i := 0; i < 5; i++ {
+		gateway.Nodes = append(gateway.Nodes, newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false))
+	}
+
+	start := time.Now()
+	gateway.sendPushPackets(conn, &fakePrometheus{})
+
+	if len(conn.packets) != 3 {
+		t.Fatalf("5 uplinks by batches of 2 must be sent in 3 PUSH_DATA, got %d", len(conn.packets))
+	}
+	for i, expected := range []int{2, 2, 1} {
+		var pushData loraserver_structs.PushDataPacket
+		if err := pushData.UnmarshalBinary(conn.packets[i]); err != nil || len(pushData.Payload.RXPK) != expected {
+			t.Fatalf("PUSH_DATA %d must contain %d rxpk", i, expected)
+		}
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("The last PUSH_DATA must be sent at the end of its batch window")
+	}
+	if gateway.stats.rxnb != 5 || gateway.stats.pushData != 3 {
+		t.Fatal("Gateway stat must count uplinks and PUSH_DATA")
+	}
+}
+
+func TestBatchLoopWindow(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	gateway.setBatch(&model.Batch{Window: "30ms", MaxSize: 8})
+	emitted := make(chan loraserver_structs.RXPK)
+	go func() {
+		for _, delay := range []time.Duration{0, 5 * time.Millisecond, 60 * time.Millisecond} {
+			time.Sleep(delay)
+			emitted <- loraserver_structs.RXPK{}
+		}
+		close(emitted)
+	}()
+
+	var batches []int
+	gateway.batchLoop(context.Background(), emitted, func(batch []loraserver_structs.RXPK) {
+		batches = append(batches, len(batch))
+	})
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Fatalf("Rxpks emitted during the same window must be sent together, got batches %v", batches)
+	}
+}
+
+func TestSendJoinRequestPacketsBatch(t *testing.T) {
+	conn := &recordConn{}
+	gateway := &LorhammerGateway{BatchMaxSize: 8}
+	for i := 0; i < 3; i++ {
+		gateway.Nodes = append(gateway.Nodes, newNode("", "", "", nil, false))
+	}
+
+	gateway.sendJoinRequestPackets(conn, &fakePrometheus{})
+
+	var pushData loraserver_structs.PushDataPacket
+	if len(conn.packets) != 1 || pushData.UnmarshalBinary(conn.packets[0]) != nil || len(pushData.Payload.RXPK) != 3 {
+		t.Fatal("JoinRequests must be sent in one PUSH_DATA")
+	}
+}
@@ -0,0 +1,216 @@
+package lora
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/tools"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//newMqttClient is replaced in tests to avoid a real broker
+var newMqttClient = tools.NewMqttBasic
+
+//bridgeRXPacket is an uplink as published by lora-gateway-bridge on gateway/<mac>/rx
+type bridgeRXPacket struct {
+	RXInfo     bridgeRXInfo `json:"rxInfo"`
+	PHYPayload []byte       `json:"phyPayload"`
+}
+
+//bridgeRXInfo is the radio metadata of a bridge uplink
+type bridgeRXInfo struct {
+	MAC       string         `json:"mac"`
+	Time      *time.Time     `json:"time,omitempty"`
+	Timestamp uint32         `json:"timestamp"`
+	Frequency int            `json:"frequency"`
+	Channel   int            `json:"channel"`
+	RFChain   int            `json:"rfChain"`
+	CRCStatus int            `json:"crcStatus"`
+	CodeRate  string         `json:"codeRate"`
+	RSSI      int            `json:"rssi"`
+	LoRaSNR   float64        `json:"loRaSNR"`
+	Size      int            `json:"size"`
+	DataRate  bridgeDataRate `json:"dataRate"`
+	Board     int            `json:"board"`
+	Antenna   int            `json:"antenna"`
+}
+
+//bridgeDataRate is the data rate of a bridge uplink
+type bridgeDataRate struct {
+	Modulation   string `json:"modulation"`
+	SpreadFactor int    `json:"spreadFactor,omitempty"`
+	Bandwidth    int    `json:"bandwidth,omitempty"`
+	BitRate      int    `json:"bitRate,omitempty"`
+}
+
+//bridgeTXPacket is a downlink sent by the network server on gateway/<mac>/tx
+type bridgeTXPacket struct {
+	TXInfo     bridgeTXInfo `json:"txInfo"`
+	Token      uint16       `json:"token"`
+	PHYPayload []byte       `json:"phyPayload"`
+}
+
+//bridgeTXInfo is the part of the downlink TX info used by lorhammer
+type bridgeTXInfo struct {
+	Immediately bool           `json:"immediately"`
+	Timestamp   *uint32        `json:"timestamp,omitempty"` // emission time on the concentrator counter
+	Frequency   int            `json:"frequency"`
+	DataRate    bridgeDataRate `json:"dataRate"`
+	CodeRate    string         `json:"codeRate"`
+}
+
+//bridgeTXAck is the acknowledgement of a downlink published on gateway/<mac>/ack
+type bridgeTXAck struct {
+	MAC   string `json:"mac"`
+	Token uint16 `json:"token"`
+	Error string `json:"error,omitempty"`
+}
+
+func (gateway *LorhammerGateway) bridgeTopic(kind string) string {
+	return fmt.Sprintf("gateway/%s/%s", gateway.MacAddress.String(), kind)
+}
+
+//getBridge return the mqtt client of the gateway, connecting it and subscribing to its downlinks the first time
+func (gateway *LorhammerGateway) getBridge(prometheus metrics.Prometheus) (tools.Mqtt, error) {
+	gateway.connMutex.Lock()
+	defer gateway.connMutex.Unlock()
+	if gateway.bridge != nil {
+		return gateway.bridge, nil
+	}
+	client, err := newMqttClient(gateway.NsAddress, "lorhammer_"+gateway.MacAddress.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	if err := client.Handle([]string{gateway.bridgeTopic("tx")}, func(message []byte) {
+		gateway.handleBridgeDownlink(client, message, prometheus)
+	}); err != nil {
+		client.Disconnect()
+		return nil, err
+	}
+	gateway.bridge = client
+	return client, nil
+}
+
+//handleBridgeDownlink acknowledge the downlink as if it had been emitted, give its PHYPayload to the nodes
+//and check its timing and radio parameters, a downlink is emitted only if the gateway duty-cycle allows it
+func (gateway *LorhammerGateway) handleBridgeDownlink(client tools.Mqtt, message []byte, prometheus metrics.Prometheus) {
+	receivedAt := time.Now()
+	var txPacket bridgeTXPacket
+	if err := json.Unmarshal(message, &txPacket); err != nil || len(txPacket.PHYPayload) == 0 {
+		loggerGateway.WithField("message", string(message)).Error("Can't unmarshal bridge downlink")
+		return
+	}
+	downlink := txPacket.txpk()
+	if !gateway.emitDownlink(downlink.TXPK, prometheus) {
+		return
+	}
+	if ack, err := json.Marshal(bridgeTXAck{MAC: gateway.MacAddress.String(), Token: txPacket.Token}); err == nil {
+		if err := client.Publish(gateway.bridgeTopic("ack"), ack); err != nil {
+			loggerGateway.WithError(err).Error("Can't publish bridge ack")
+		}
+	}
+	class := classA
+	if txPacket.TXInfo.Immediately {
+		class = classC
+	}
+	gateway.applyDownlink(txPacket.PHYPayload, downlink, class, receivedAt, prometheus)
+}
+
+//txpk return the semtech txpk of the bridge downlink, emitted at its timestamp or immediately
+func (txPacket bridgeTXPacket) txpk() txpk {
+	info := txPacket.TXInfo
+	downlink := txpk{TXPK: loraserver_structs.TXPK{
+		Imme: info.Immediately,
+		Tmst: info.Timestamp,
+		Freq: float64(info.Frequency) / 1000000,
+		Modu: info.DataRate.Modulation,
+		CodR: info.CodeRate,
+		Size: uint16(len(txPacket.PHYPayload)),
+		IPol: true,
+		NCRC: true,
+	}}
+	if info.DataRate.Modulation == "FSK" {
+		downlink.DatR = loraserver_structs.DatR{FSK: uint32(info.DataRate.BitRate)}
+	} else {
+		downlink.DatR = loraserver_structs.DatR{LoRa: fmt.Sprintf("SF%dBW%d", info.DataRate.SpreadFactor, info.DataRate.Bandwidth)}
+	}
+	return downlink
+}
+
+//sendBridgeUplinks publish each rxpk on the rx topic of the gateway
+func (gateway *LorhammerGateway) sendBridgeUplinks(client tools.Mqtt, rxpks []loraserver_structs.RXPK) {
+	for _, rxpk := range rxpks {
+		message, err := newBridgeUplink(rxpk, gateway)
+		if err != nil {
+			loggerGateway.WithError(err).Error("Can't create bridge uplink")
+			continue
+		}
+		if err := client.Publish(gateway.bridgeTopic("rx"), message); err != nil {
+			loggerGateway.WithError(err).Error("Can't publish bridge uplink")
+			continue
+		}
+		gateway.addUplinks(1)
+	}
+}
+
+//newBridgeUplink return the json uplink of lora-gateway-bridge with the PHYPayload and the radio metadata of the rxpk
+func newBridgeUplink(rxpk loraserver_structs.RXPK, gateway *LorhammerGateway) ([]byte, error) {
+	phyPayload, err := base64.StdEncoding.DecodeString(rxpk.Data)
+	if err != nil {
+		return nil, err
+	}
+	reg := gateway.getRegion()
+	index := reg.DataRateIndex(rxpk.DatR.LoRa, int(rxpk.DatR.FSK))
+	if index < 0 {
+		return nil, fmt.Errorf("unknown data rate %v", rxpk.DatR)
+	}
+	dataRate := reg.DataRates[index]
+	var rxTime *time.Time
+	if rxpk.Time != nil {
+		t := time.Time(*rxpk.Time)
+		rxTime = &t
+	}
+	return json.Marshal(bridgeRXPacket{
+		RXInfo: bridgeRXInfo{
+			MAC:       gateway.MacAddress.String(),
+			Time:      rxTime,
+			Timestamp: rxpk.Tmst,
+			Frequency: int(rxpk.Freq*1000000 + 0.5),
+			Channel:   int(rxpk.Chan),
+			RFChain:   int(rxpk.RFCh),
+			CRCStatus: int(rxpk.Stat),
+			CodeRate:  rxpk.CodR,
+			RSSI:      int(rxpk.RSSI),
+			LoRaSNR:   rxpk.LSNR,
+			Size:      int(rxpk.Size),
+			DataRate: bridgeDataRate{
+				Modulation:   dataRate.Modulation(),
+				SpreadFactor: dataRate.SpreadingFactor,
+				Bandwidth:    dataRate.Bandwidth,
+				BitRate:      dataRate.BitRate,
+			},
+		},
+		PHYPayload: phyPayload,
+	})
+}
+
+//startBridge publish JoinRequests of nodes not joined yet and the next uplink of each node on the mqtt broker
+func (gateway *LorhammerGateway) startBridge(prometheus metrics.Prometheus, withJoin bool, withUplinks bool) error {
+	client, err := gateway.getBridge(prometheus)
+	if err != nil {
+		return err
+	}
+	if withJoin {
+		gateway.sendBridgeUplinks(client, gateway.nextJoinRequests(prometheus))
+	}
+	if withUplinks {
+		gateway.sendBridgeUplinks(client, gateway.nextUplinks(prometheus))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package lora
+
+import (
+	"encoding/json"
+	"errors"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"sync"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+//fakeBroker records the messages published by the gateway and gives it the downlinks of the test
+type fakeBroker struct {
+	mu           sync.Mutex
+	connectError error
+	published    map[string][][]byte
+	handlers     map[string]func(message []byte)
+}
+
+func (b *fakeBroker) GetAddress() string { return "" }
+func (b *fakeBroker) Connect() error     { return b.connectError }
+func (b *fakeBroker) Disconnect()        {}
+func (b *fakeBroker) Handle(topics []string, handle func(message []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		b.handlers[topic] = handle
+	}
+	return nil
+}
+func (b *fakeBroker) HandleCmd(topics []string, handle func(cmd model.CMD)) error { return nil }
+func (b *fakeBroker) Publish(topic string, message []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published[topic] = append(b.published[topic], message)
+	return nil
+}
+func (b *fakeBroker) PublishCmd(topic string, cmdName model.CommandName) error { return nil }
+func (b *fakeBroker) PublishSubCmd(topic string, cmdName model.CommandName, subCmd interface{}) error {
+	return nil
+}
+
+//newFakeBroker replace the mqtt client of gateways until the returned restore func is called
+func newFakeBroker() (*fakeBroker, func()) {
+	broker := &fakeBroker{published: make(map[string][][]byte), handlers: make(map[string]func(message []byte))}
+	newMqttClient = func(url string, clientID string) (tools.Mqtt, error) { return broker, nil }
+	return broker, func() { newMqttClient = tools.NewMqttBasic }
+}
+
+func TestCheckProtocolMqtt(t *testing.T) {
+	if CheckProtocol("mqtt", "tcp://127.0.0.1:1883") != nil {
+		t.Fatal("Mqtt gateway protocol with a broker url must be valid")
+	}
+	if CheckProtocol("mqtt", "127.0.0.1:1883") == nil {
+		t.Fatal("Error expected on mqtt without broker url")
+	}
+}
+
+func TestBridgeStart(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	gateway := &LorhammerGateway{
+		NsAddress:  "tcp://127.0.0.1:1883",
+		MacAddress: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Protocol:   mqttProtocol,
+		Nodes:      []*model.Node{node},
+	}
+	defer gateway.Close()
+
+	if err := gateway.Start(&fakePrometheus{}); err != nil {
+		t.Fatalf("Bridge gateway must connect to the broker : %s", err)
+	}
+	uplinks := broker.published["gateway/0102030405060708/rx"]
+	if len(uplinks) != 1 {
+		t.Fatalf("One uplink must be published on the rx topic of the gateway, got %d", len(uplinks))
+	}
+	var rxPacket bridgeRXPacket
+	if err := json.Unmarshal(uplinks[0], &rxPacket); err != nil {
+		t.Fatal("Uplink must be a bridge json packet")
+	}
+	if rxPacket.RXInfo.MAC != "0102030405060708" || rxPacket.RXInfo.Frequency < 863000000 || rxPacket.RXInfo.DataRate.Modulation != "LORA" || rxPacket.RXInfo.DataRate.Bandwidth != 125 {
+		t.Fatalf("Uplink must contain the radio metadata, got %+v", rxPacket.RXInfo)
+	}
+	var phyPayload lorawan.PHYPayload
+	if err := phyPayload.UnmarshalBinary(rxPacket.PHYPayload); err != nil || (phyPayload.MHDR.MType != lorawan.UnconfirmedDataUp && phyPayload.MHDR.MType != lorawan.ConfirmedDataUp) {
+		t.Fatal("Uplink must contain the PHYPayload of the node")
+	}
+
+	downlink := newDataDown(t, node, lorawan.UnconfirmedDataDown, false)
+	downlinkBytes, _ := downlink.MarshalBinary()
+	txPacket, _ := json.Marshal(bridgeTXPacket{Token: 12, PHYPayload: downlinkBytes})
+	broker.handlers["gateway/0102030405060708/tx"](txPacket)
+	acks := broker.published["gateway/0102030405060708/ack"]
+	if len(acks) != 1 {
+		t.Fatal("Downlink must be acknowledged on the ack topic")
+	}
+	var ack bridgeTXAck
+	if err := json.Unmarshal(acks[0], &ack); err != nil || ack.Token != 12 || ack.Error != "" {
+		t.Fatal("Ack must have the token of the downlink")
+	}
+	if gateway.stats.dwnb != 1 {
+		t.Fatal("Downlink must be given to the gateway")
+	}
+}
+
+func TestBridgeJoin(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	gateway := &LorhammerGateway{
+		Protocol: mqttProtocol,
+		Nodes:    []*model.Node{newNode("", "", "", nil, false)},
+	}
+	defer gateway.Close()
+
+	if err := gateway.Join(&fakePrometheus{}, true); err != nil {
+		t.Fatalf("Bridge gateway must connect to the broker : %s", err)
+	}
+	uplinks := broker.published[gateway.bridgeTopic("rx")]
+	if len(uplinks) != 1 {
+		t.Fatal("JoinRequest must be published")
+	}
+	var rxPacket bridgeRXPacket
+	json.Unmarshal(uplinks[0], &rxPacket)
+	if len(rxPacket.PHYPayload) != 23 || rxPacket.PHYPayload[0]>>5 != 0 {
+		t.Fatal("Uplink must be a JoinRequest")
+	}
+}
+
+func TestBridgeConnectError(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	broker.connectError = errors.New("broker unreachable")
+	gateway := &LorhammerGateway{Protocol: mqttProtocol}
+
+	if err := gateway.Start(&fakePrometheus{}); err == nil {
+		t.Fatal("Error expected when the broker is unreachable")
+	}
+}
+
+//newBridgeTXPacket return the bridge downlink of the PHYPayload in the RX1 window of the last uplink of the node
+func newBridgeTXPacket(t *testing.T, gateway *LorhammerGateway, node *model.Node, phyPayload []byte) []byte {
+	uplink, ok := gateway.lastUplink(node)
+	if !ok {
+		t.Fatal("Node must have sent an uplink")
+	}
+	dataRate := gateway.getRegion().DataRates[uplink.dataRate]
+	tmst := uplink.tmst + 1000000
+	txPacket, _ := json.Marshal(bridgeTXPacket{
+		TXInfo: bridgeTXInfo{
+			Timestamp: &tmst,
+			Frequency: uplink.frequency,
+			DataRate:  bridgeDataRate{Modulation: dataRate.Modulation(), SpreadFactor: dataRate.SpreadingFactor, Bandwidth: dataRate.Bandwidth},
+		},
+		PHYPayload: phyPayload,
+	})
+	return txPacket
+}
+
+func TestBridgeDownlinkTiming(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	gateway := &LorhammerGateway{Protocol: mqttProtocol, Nodes: []*model.Node{node}}
+	defer gateway.Close()
+	if err := gateway.Start(&fakePrometheus{}); err != nil {
+		t.Fatalf("Bridge gateway must connect to the broker : %s", err)
+	}
+
+	downlink, _ := newDataDown(t, node, lorawan.UnconfirmedDataDown, false).MarshalBinary()
+	fakePrometheus := &fakePrometheus{}
+	gateway.handleBridgeDownlink(broker, newBridgeTXPacket(t, gateway, node, downlink), fakePrometheus)
+	immediate, _ := json.Marshal(bridgeTXPacket{TXInfo: bridgeTXInfo{Immediately: true}, PHYPayload: downlink})
+	gateway.handleBridgeDownlink(broker, immediate, fakePrometheus)
+
+	if fakePrometheus.downlinkTimings["on_time"] != 1 || fakePrometheus.downlinkRxWindows["rx1"] != 1 {
+		t.Fatalf("Bridge downlink in the RX1 window of the node must be on time, got %v", fakePrometheus.downlinkTimings)
+	}
+	if fakePrometheus.downlinkTimings["wrong_parameters"] != 1 {
+		t.Fatalf("Immediate bridge downlink for a class A node must have wrong parameters, got %v", fakePrometheus.downlinkTimings)
+	}
+}
+
+func TestBridgeDownlinkDutyCycle(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	gateway := NewGateway(0, model.Init{GatewayProtocol: mqttProtocol, DutyCycle: &model.DutyCycle{Enforce: true}})
+	node := newNode("", "", "", nil, false)
+	gateway.Nodes = []*model.Node{node}
+	downlink, _ := newDataDown(t, node, lorawan.UnconfirmedDataDown, false).MarshalBinary()
+	rx2, _ := json.Marshal(bridgeTXPacket{
+		TXInfo:     bridgeTXInfo{Immediately: true, Frequency: 869525000, DataRate: bridgeDataRate{Modulation: "LORA", SpreadFactor: 12, Bandwidth: 125}, CodeRate: "4/5"},
+		Token:      1,
+		PHYPayload: downlink,
+	})
+
+	fakePrometheus := &fakePrometheus{}
+	gateway.handleBridgeDownlink(broker, rx2, fakePrometheus)
+	gateway.handleBridgeDownlink(broker, rx2, fakePrometheus)
+	if fakePrometheus.dutyCycles["gateway/within"] != 1 || fakePrometheus.dutyCycles["gateway/blocked"] != 1 {
+		t.Fatalf("Bridge downlink over the gateway duty-cycle must be blocked, got %v", fakePrometheus.dutyCycles)
+	}
+	if len(broker.published[gateway.bridgeTopic("ack")]) != 1 || gateway.stats.dwnb != 1 {
+		t.Fatal("Blocked bridge downlink must not be acknowledged nor given to the nodes")
+	}
+}
@@ -0,0 +1,170 @@
+package lora
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	beaconPeriod   = 128 * time.Second
+	beaconReserved = 2120 * time.Millisecond
+	pingSlotLen    = 30 * time.Millisecond
+	// number of ping slots in the beacon window
+	nbPingSlots = 4096
+)
+
+const (
+	classBValid           = "valid"
+	classBWrongTime       = "wrong_time"
+	classBWrongParameters = "wrong_parameters"
+)
+
+//CheckClassB return an error if the class B config of the scenario is not valid with its class C config
+func CheckClassB(classB *model.ClassB, classC *model.ClassC) error {
+	if classB == nil {
+		return nil
+	}
+	if classB.Ratio < 0 || classB.Ratio > 1 {
+		return errors.New("classB ratio must be between 0 and 1")
+	}
+	if classC != nil && classB.Ratio+classC.Ratio > 1 {
+		return errors.New("classB and classC ratios sum must not exceed 1")
+	}
+	if classB.PingSlotPeriodicity < 0 || classB.PingSlotPeriodicity > 7 {
+		return errors.New("classB pingSlotPeriodicity must be between 0 and 7")
+	}
+	return nil
+}
+
+//setClassB put the last nodes of the gateway in class B, according to the ratio, among the nodes which are not in class C
+//class C nodes are the first ones, with rounded ratios there may be less nodes left than the class B ratio asks for
+func (gateway *LorhammerGateway) setClassB(classB *model.ClassB) {
+	if classB == nil {
+		return
+	}
+	nbClassB := int(math.Floor(classB.Ratio*float64(len(gateway.Nodes)) + 0.5))
+	for i := len(gateway.Nodes) - 1; i >= 0 && nbClassB > 0; i-- {
+		node := gateway.Nodes[i]
+		if node.ClassC {
+			break
+		}
+		nbClassB--
+		node.ClassB = true
+		node.PingSlot.Periodicity = classB.PingSlotPeriodicity
+		node.PingSlot.DataRate = gateway.getRegion().BeaconDataRate
+	}
+}
+
+//isClassBReady return true if the node is in class B and has synchronized its time and its ping slots with the network server
+func isClassBReady(node *model.Node) bool {
+	return node.ClassB && node.PingSlot.DeviceTimeSynced && node.PingSlot.InfoAcked
+}
+
+//classBMacRequests return the DeviceTimeReq and PingSlotInfoReq a class B node sends in each uplink until the network server answers them
+func classBMacRequests(node *model.Node) [][]byte {
+	if !node.ClassB {
+		return nil
+	}
+	var requests [][]byte
+	if !node.PingSlot.DeviceTimeSynced {
+		requests = append(requests, []byte{byte(deviceTimeReq)})
+	}
+	if !node.PingSlot.InfoAcked {
+		requests = append(requests, []byte{byte(pingSlotInfoReq), byte(node.PingSlot.Periodicity & 0x07)})
+	}
+	return requests
+}
+
+//isBeacon return true if the txpk is a beacon : scheduled at a GPS time, without CRC and without inverted polarity
+func (t txpk) isBeacon() bool {
+	return t.Tmms != nil && t.NCRC && !t.IPol
+}
+
+//handleBeacon check the beacon the network server schedules at a GPS time
+//it must be sent at the start of a beacon period, contain this GPS time, and use the beacon frequency and data rate of the region
+func (gateway *LorhammerGateway) handleBeacon(beacon txpk, payload []byte, prometheus metrics.Prometheus) {
+	gateway.addDownlink()
+	reg := gateway.getRegion()
+	gpsTime := time.Duration(*beacon.Tmms) * time.Millisecond
+	beaconTime, ok := reg.BeaconTime(payload)
+
+	result := classBValid
+	switch {
+	case gpsTime%beaconPeriod != 0 || !ok || time.Duration(beaconTime)*time.Second != gpsTime:
+		result = classBWrongTime
+	case !hasParameters(reg, beacon.TXPK, reg.BeaconFrequency(beaconTime), reg.BeaconDataRate):
+		result = classBWrongParameters
+	}
+	if result != classBValid {
+		loggerGateway.WithFields(logrus.Fields{
+			"tmms":      *beacon.Tmms,
+			"time":      beaconTime,
+			"frequency": beacon.Freq,
+			"dataRate":  beacon.DatR,
+		}).Warn("Wrong beacon")
+	}
+	prometheus.AddClassBDownlink("beacon", result, 1)
+}
+
+//checkPingSlot count the downlink scheduled at a GPS time as valid if it is in a ping slot of the node
+//with the ping slot frequency and data rate, wrong time if it is out of its ping slots
+func (gateway *LorhammerGateway) checkPingSlot(node *model.Node, downlink txpk, prometheus metrics.Prometheus) {
+	node.Lock()
+	defer node.Unlock()
+	reg := gateway.getRegion()
+	gpsTime := time.Duration(*downlink.Tmms) * time.Millisecond
+	beaconTime := gpsTime - gpsTime%beaconPeriod
+	period := pingPeriod(node.PingSlot.Periodicity)
+	offset := pingOffset(uint32(beaconTime/time.Second), node, period)
+	slotTime := gpsTime - beaconTime - beaconReserved
+	slot := int(slotTime / pingSlotLen)
+
+	frequency := node.PingSlot.Frequency
+	if frequency == 0 {
+		frequency = reg.PingSlotFrequency(uint32(beaconTime/time.Second), binary.BigEndian.Uint32(node.DevAddr[:]))
+	}
+
+	result := classBValid
+	switch {
+	case !isClassBReady(node):
+		result = classBWrongParameters
+	case slotTime < 0 || slotTime%pingSlotLen != 0 || slot >= nbPingSlots || slot%period != offset:
+		result = classBWrongTime
+	case !hasParameters(reg, downlink.TXPK, frequency, node.PingSlot.DataRate):
+		result = classBWrongParameters
+	}
+	if result != classBValid {
+		loggerGateway.WithFields(logrus.Fields{
+			"DevEui":     node.DevEUI.String(),
+			"tmms":       *downlink.Tmms,
+			"pingOffset": offset,
+			"pingPeriod": period,
+			"ready":      isClassBReady(node),
+		}).Warn("Wrong ping slot downlink")
+	}
+	prometheus.AddClassBDownlink("ping_slot", result, 1)
+}
+
+//pingPeriod return the number of slots between two ping slots of a node
+func pingPeriod(periodicity int) int {
+	return 1 << uint(5+periodicity)
+}
+
+//pingOffset return the first ping slot of the node after the beacon sent at this GPS time in seconds
+//it is computed from the AES encryption with a null key of the beacon time and the DevAddr
+func pingOffset(beaconTime uint32, node *model.Node, period int) int {
+	var data [16]byte
+	binary.LittleEndian.PutUint32(data[0:4], beaconTime)
+	binary.LittleEndian.PutUint32(data[4:8], binary.BigEndian.Uint32(node.DevAddr[:]))
+	block, _ := aes.NewCipher(make([]byte, 16))
+	var rand [16]byte
+	block.Encrypt(rand[:], data[:])
+	return (int(rand[0]) + int(rand[1])*256) % period
+}
@@ -0,0 +1,182 @@
+package lora
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"lorhammer/src/model"
+	"testing"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+func newPullResp(t *testing.T, downlink txpk, payload []byte) []byte {
+	downlink.Data = base64.StdEncoding.EncodeToString(payload)
+	b, err := json.Marshal(struct {
+		TXPK txpk `json:"txpk"`
+	}{downlink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{loraserver_structs.ProtocolVersion2, 0, 0, byte(loraserver_structs.PullResp)}, b...)
+}
+
+func newClassBNode() *model.Node {
+	node := newMacNode(eu868)
+	node.DevAddr = lorawan.DevAddr{1, 2, 3, 4}
+	node.ClassB = true
+	node.PingSlot = model.PingSlot{DataRate: eu868.BeaconDataRate, DeviceTimeSynced: true, InfoAcked: true}
+	return node
+}
+
+func TestCheckClassB(t *testing.T) {
+	if CheckClassB(nil, nil) != nil || CheckClassB(&model.ClassB{Ratio: 0.5, PingSlotPeriodicity: 7}, &model.ClassC{Ratio: 0.5}) != nil {
+		t.Fatal("Valid class B must not return an error")
+	}
+	if CheckClassB(&model.ClassB{Ratio: 1.1}, nil) == nil || CheckClassB(&model.ClassB{Ratio: 0.6}, &model.ClassC{Ratio: 0.5}) == nil {
+		t.Fatal("Error expected on class B ratio out of range")
+	}
+	if CheckClassB(&model.ClassB{Ratio: 1, PingSlotPeriodicity: 8}, nil) == nil {
+		t.Fatal("Error expected on wrong ping slot periodicity")
+	}
+}
+
+func TestSetClassB(t *testing.T) {
+	gateway := NewGateway(4, model.Init{ClassC: &model.ClassC{Ratio: 0.5}, ClassB: &model.ClassB{Ratio: 0.5, PingSlotPeriodicity: 2}})
+	for i, node := range gateway.Nodes {
+		if node.ClassC != (i < 2) || node.ClassB != (i >= 2) {
+			t.Fatalf("Node %d must be in class C or in class B", i)
+		}
+	}
+	if gateway.Nodes[3].PingSlot.Periodicity != 2 || gateway.Nodes[3].PingSlot.DataRate != 3 {
+		t.Fatal("Class B nodes must use the periodicity and the default ping slot data rate")
+	}
+
+	// 2 nodes are in class C and the class B ratio also rounds to 2
+	gateway = NewGateway(3, model.Init{ClassC: &model.ClassC{Ratio: 0.5}, ClassB: &model.ClassB{Ratio: 0.5}})
+	for i, node := range gateway.Nodes {
+		if node.ClassC != (i < 2) || node.ClassB != (i == 2) {
+			t.Fatalf("Node %d must not be in both class B and class C", i)
+		}
+	}
+}
+
+func TestClassBMacCommands(t *testing.T) {
+	node := newMacNode(eu868)
+	node.ClassB = true
+	node.PingSlot.Periodicity = 3
+
+	fOpts := getUplinkFOpts(node)
+	if len(fOpts) != 2 || fOpts[0].CID != deviceTimeReq || fOpts[1].CID != pingSlotInfoReq {
+		t.Fatal("Class B node must send DeviceTimeReq and PingSlotInfoReq")
+	}
+	if b, _ := fOpts[1].MarshalBinary(); b[1] != 3 {
+		t.Fatal("PingSlotInfoReq must contain the ping slot periodicity")
+	}
+
+	handleMacCommands(node, eu868, []byte{byte(deviceTimeAns), 0, 0, 0, 0, 0, byte(pingSlotInfoAns)})
+	if !isClassBReady(node) || len(getUplinkFOpts(node)) != 0 {
+		t.Fatal("Class B requests must not be sent anymore once answered")
+	}
+	phyPayloadBytes, _, _ := GetPushDataPayload(node, eu868)
+	var phyPayload lorawan.PHYPayload
+	phyPayload.UnmarshalBinary(phyPayloadBytes)
+	if !phyPayload.MACPayload.(*lorawan.MACPayload).FHDR.FCtrl.FPending {
+		t.Fatal("Uplinks of a synchronized class B node must have the Class B bit")
+	}
+}
+
+func TestHandlePingSlotChannelReq(t *testing.T) {
+	node := newClassBNode()
+	// 869.1MHz DR5
+	handleMacCommands(node, eu868, []byte{byte(pingSlotChannelReq), 0x38, 0x9d, 0x84, 5})
+	checkMacAnswers(t, node.MacAnswers, []byte{byte(pingSlotChannelAns), 0x03})
+	if node.PingSlot.Frequency != 869100000 || node.PingSlot.DataRate != 5 {
+		t.Fatal("Ping slot frequency and data rate must be applied")
+	}
+
+	node.MacAnswers = nil
+	handleMacCommands(node, eu868, []byte{byte(pingSlotChannelReq), 0x38, 0x9d, 0x84, 9})
+	checkMacAnswers(t, node.MacAnswers, []byte{byte(pingSlotChannelAns), 0x01})
+	if node.PingSlot.DataRate != 5 {
+		t.Fatal("Ping slot data rate must not be applied if it is not valid")
+	}
+}
+
+func TestHandleBeacon(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	fakePrometheus := &fakePrometheus{}
+	gpsSeconds := uint32(1000 * 128)
+	beacon := make([]byte, eu868.BeaconSize())
+	binary.LittleEndian.PutUint32(beacon[2:], gpsSeconds)
+	tmms := int64(gpsSeconds) * 1000
+	next := tmms + 1000
+	valid := txpk{TXPK: loraserver_structs.TXPK{Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF9BW125"}, NCRC: true}, Tmms: &tmms}
+
+	gateway.handleDownlink(newPullResp(t, valid, beacon), fakePrometheus)
+	wrongTime := valid
+	wrongTime.Tmms = &next
+	gateway.handleDownlink(newPullResp(t, wrongTime, beacon), fakePrometheus)
+	wrongFrequency := valid
+	wrongFrequency.Freq = 868.1
+	gateway.handleDownlink(newPullResp(t, wrongFrequency, beacon), fakePrometheus)
+
+	if fakePrometheus.classBDownlinks["beacon/valid"] != 1 || fakePrometheus.classBDownlinks["beacon/wrong_time"] != 1 || fakePrometheus.classBDownlinks["beacon/wrong_parameters"] != 1 {
+		t.Fatalf("Beacons must be checked, got %v", fakePrometheus.classBDownlinks)
+	}
+	if gateway.stats.txnb != 3 {
+		t.Fatal("Beacons must be counted as emitted downlinks")
+	}
+}
+
+func TestCheckPingSlot(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	node := newClassBNode()
+	fakePrometheus := &fakePrometheus{}
+	beaconTime := uint32(1000 * 128)
+	offset := pingOffset(beaconTime, node, pingPeriod(0))
+	slotTmms := func(slot int) *int64 {
+		tmms := int64(beaconTime)*1000 + 2120 + int64(slot)*30
+		return &tmms
+	}
+	downlink := txpk{TXPK: loraserver_structs.TXPK{Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF9BW125"}, IPol: true}}
+
+	downlink.Tmms = slotTmms(offset + 3*32)
+	gateway.checkPingSlot(node, downlink, fakePrometheus)
+	downlink.Tmms = slotTmms(offset + 3*32 + 1)
+	gateway.checkPingSlot(node, downlink, fakePrometheus)
+	downlink.Tmms = slotTmms(offset + 4096)
+	gateway.checkPingSlot(node, downlink, fakePrometheus)
+	downlink.Tmms = slotTmms(offset)
+	downlink.DatR.LoRa = "SF12BW125"
+	gateway.checkPingSlot(node, downlink, fakePrometheus)
+
+	if fakePrometheus.classBDownlinks["ping_slot/valid"] != 1 || fakePrometheus.classBDownlinks["ping_slot/wrong_time"] != 2 || fakePrometheus.classBDownlinks["ping_slot/wrong_parameters"] != 1 {
+		t.Fatalf("Ping slot downlinks must be checked against the ping slots of the node, got %v", fakePrometheus.classBDownlinks)
+	}
+	if offset < 0 || offset >= 32 {
+		t.Fatal("Ping offset must be in the ping period")
+	}
+}
+
+func TestHandlePingSlotDownlink(t *testing.T) {
+	classBNode := newClassBNode()
+	classANode := newMacNode(eu868)
+	classANode.DevAddr = lorawan.DevAddr{5, 6, 7, 8}
+	gateway := &LorhammerGateway{Nodes: []*model.Node{classBNode, classANode}}
+	beaconTime := uint32(1000 * 128)
+	tmms := int64(beaconTime)*1000 + 2120 + int64(pingOffset(beaconTime, classBNode, pingPeriod(0)))*30
+	downlink := txpk{TXPK: loraserver_structs.TXPK{Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF9BW125"}, IPol: true}, Tmms: &tmms}
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.handleDownlink(newPullResp(t, downlink, newDataDownPayload(t, classBNode, 2, []byte{1})), fakePrometheus)
+	gateway.handleDownlink(newPullResp(t, downlink, newDataDownPayload(t, classANode, 2, []byte{1})), fakePrometheus)
+
+	if classBNode.PingSlot.NbDownlinks != 1 || fakePrometheus.classBDownlinks["ping_slot/valid"] != 1 {
+		t.Fatal("Ping slot downlink must be received by the class B node")
+	}
+	if classANode.PingSlot.NbDownlinks != 0 {
+		t.Fatal("Ping slot downlink must be lost by the class A node")
+	}
+}
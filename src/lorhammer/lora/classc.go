@@ -0,0 +1,66 @@
+package lora
+
+import (
+	"encoding/binary"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"math"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+//enqueueTimeSize is the size of the enqueue time, unix milliseconds big endian, at the start of the downlink payload
+const enqueueTimeSize = 8
+
+//CheckClassC return an error if the class C config of the scenario is not valid
+func CheckClassC(classC *model.ClassC) error {
+	if classC == nil {
+		return nil
+	}
+	if classC.Ratio < 0 || classC.Ratio > 1 {
+		return errors.New("classC ratio must be between 0 and 1")
+	}
+	if classC.EnqueueTimePort < 0 || classC.EnqueueTimePort > 223 {
+		return errors.New("classC enqueueTimePort must be an application port between 1 and 223, or 0")
+	}
+	return nil
+}
+
+//setClassC put the first nodes of the gateway in class C, according to the ratio
+func (gateway *LorhammerGateway) setClassC(classC *model.ClassC) {
+	if classC == nil {
+		return
+	}
+	gateway.EnqueueTimePort = classC.EnqueueTimePort
+	nbClassC := int(math.Floor(classC.Ratio*float64(len(gateway.Nodes)) + 0.5))
+	for i, node := range gateway.Nodes {
+		node.ClassC = i < nbClassC
+	}
+}
+
+//observeEnqueueDelay publish the delay between the application enqueueing the downlink and the gateway receiving it
+//the application writes the enqueue time at the start of the payloads sent on the enqueue time port
+func (gateway *LorhammerGateway) observeEnqueueDelay(node *model.Node, macPayload *lorawan.MACPayload, prometheus metrics.Prometheus) {
+	if gateway.EnqueueTimePort == 0 || macPayload.FPort == nil || int(*macPayload.FPort) != gateway.EnqueueTimePort || len(macPayload.FRMPayload) == 0 {
+		return
+	}
+	dataPayload, ok := macPayload.FRMPayload[0].(*lorawan.DataPayload)
+	if !ok {
+		return
+	}
+	payload, err := lorawan.EncryptFRMPayload(node.AppSKey, false, macPayload.FHDR.DevAddr, macPayload.FHDR.FCnt, dataPayload.Bytes)
+	if err != nil || len(payload) < enqueueTimeSize {
+		loggerGateway.WithField("DevEui", node.DevEUI.String()).Warn("Downlink on the enqueue time port without enqueue time")
+		return
+	}
+	enqueuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload))*int64(time.Millisecond))
+	delay := time.Since(enqueuedAt)
+	loggerGateway.WithFields(logrus.Fields{
+		"DevEui": node.DevEUI.String(),
+		"delay":  delay,
+	}).Debug("Downlink enqueue delay")
+	prometheus.ObserveDownlinkEnqueueDelay(delay)
+}
@@ -0,0 +1,91 @@
+package lora
+
+import (
+	"encoding/binary"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestCheckClassC(t *testing.T) {
+	if CheckClassC(nil) != nil || CheckClassC(&model.ClassC{Ratio: 0.5, EnqueueTimePort: 10}) != nil {
+		t.Fatal("Valid class C must not return an error")
+	}
+	if CheckClassC(&model.ClassC{Ratio: 1.1}) == nil || CheckClassC(&model.ClassC{Ratio: -0.1}) == nil {
+		t.Fatal("Error expected on class C ratio out of range")
+	}
+	if CheckClassC(&model.ClassC{Ratio: 1, EnqueueTimePort: 224}) == nil {
+		t.Fatal("Error expected on enqueue time port out of application ports")
+	}
+}
+
+func TestSetClassC(t *testing.T) {
+	gateway := NewGateway(4, model.Init{ClassC: &model.ClassC{Ratio: 0.5}})
+	nbClassC := 0
+	for _, node := range gateway.Nodes {
+		if node.ClassC {
+			nbClassC++
+		}
+	}
+	if nbClassC != 2 {
+		t.Fatalf("Half of the nodes must be in class C, got %d", nbClassC)
+	}
+	if NewGateway(1, model.Init{}).Nodes[0].ClassC {
+		t.Fatal("Nodes must be in class A by default")
+	}
+}
+
+func newDataDownPayload(t *testing.T, node *model.Node, fPort uint8, payload []byte) []byte {
+	phyPayload := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{
+			FHDR:       lorawan.FHDR{DevAddr: node.DevAddr},
+			FPort:      &fPort,
+			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: payload}},
+		},
+	}
+	if err := phyPayload.EncryptFRMPayload(node.AppSKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := phyPayload.SetMIC(node.NwSKey); err != nil {
+		t.Fatal(err)
+	}
+	phyPayloadBytes, _ := phyPayload.MarshalBinary()
+	return phyPayloadBytes
+}
+
+func TestHandleImmediateDownlink(t *testing.T) {
+	gateway := NewGateway(2, model.Init{ClassC: &model.ClassC{Ratio: 0.5}})
+	classCNode, classANode := gateway.Nodes[0], gateway.Nodes[1]
+
+	gateway.handleDownlinkPHYPayload(newDataDownPayload(t, classCNode, 2, []byte{1}), classC, nil, &fakePrometheus{})
+	gateway.handleDownlinkPHYPayload(newDataDownPayload(t, classANode, 2, []byte{1}), classC, nil, &fakePrometheus{})
+
+	if classCNode.NbClassCDownlinks != 1 {
+		t.Fatal("Immediate downlink must be received by the class C node")
+	}
+	if classANode.NbClassCDownlinks != 0 {
+		t.Fatal("Immediate downlink must be lost by the class A node")
+	}
+}
+
+func TestObserveEnqueueDelay(t *testing.T) {
+	gateway := NewGateway(1, model.Init{ClassC: &model.ClassC{Ratio: 1, EnqueueTimePort: 10}})
+	node := gateway.Nodes[0]
+	payload := make([]byte, enqueueTimeSize+2)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().Add(-time.Second).UnixNano()/int64(time.Millisecond)))
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.handleDownlinkPHYPayload(newDataDownPayload(t, node, 10, payload), classC, nil, fakePrometheus)
+	gateway.handleDownlinkPHYPayload(newDataDownPayload(t, node, 11, payload), classC, nil, fakePrometheus)
+	gateway.handleDownlinkPHYPayload(newDataDownPayload(t, node, 10, payload[:4]), classC, nil, fakePrometheus)
+
+	if len(fakePrometheus.downlinkEnqueueDelays) != 1 {
+		t.Fatalf("Only downlinks with an enqueue time on the enqueue time port must be observed, got %d", len(fakePrometheus.downlinkEnqueueDelays))
+	}
+	if delay := fakePrometheus.downlinkEnqueueDelays[0]; delay < time.Second || delay > 2*time.Second {
+		t.Fatalf("Enqueue delay must be the time since the enqueue time, got %s", delay)
+	}
+}
@@ -0,0 +1,149 @@
+package lora
+
+import (
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"math"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//coverage contains the other gateways hearing each node of a gateway and how they hear it
+type coverage struct {
+	listeners  map[*model.Node][]*LorhammerGateway
+	jitter     [2]time.Duration
+	rssiOffset [2]float64
+	snrOffset  [2]float64
+}
+
+//CheckCoverage return an error if the coverage config of the scenario is not valid for its number of gateways
+func CheckCoverage(coverage *model.Coverage, nbGateway int) error {
+	if coverage == nil {
+		return nil
+	}
+	if coverage.NbGateways[0] < 1 || coverage.NbGateways[0] > coverage.NbGateways[1] {
+		return errors.New("coverage nbGateways min must be positive and lower than max")
+	}
+	if coverage.NbGateways[1] > nbGateway {
+		return errors.New("coverage nbGateways max must not be greater than nbGatewayPerLorhammer")
+	}
+	jitter, err := parseJitter(coverage.Jitter)
+	if err != nil || jitter[0] < 0 || jitter[0] > jitter[1] {
+		return errors.New("coverage jitter must be positive durations with min lower than max")
+	}
+	if coverage.RssiOffset[0] > coverage.RssiOffset[1] || coverage.SnrOffset[0] > coverage.SnrOffset[1] {
+		return errors.New("coverage rssi and snr offset min must be lower than max")
+	}
+	return nil
+}
+
+func parseJitter(jitter [2]string) ([2]time.Duration, error) {
+	var durations [2]time.Duration
+	for i, d := range jitter {
+		if d == "" {
+			continue
+		}
+		var err error
+		if durations[i], err = time.ParseDuration(d); err != nil {
+			return durations, err
+		}
+	}
+	return durations, nil
+}
+
+//SetCoverage choose for each node the other gateways hearing its uplinks
+func SetCoverage(gateways []*LorhammerGateway, config *model.Coverage) {
+	if config == nil {
+		return
+	}
+	// coverage is checked when the scenario is created
+	jitter, _ := parseJitter(config.Jitter)
+	for i, gateway := range gateways {
+		gateway.coverage = &coverage{
+			listeners:  make(map[*model.Node][]*LorhammerGateway),
+			jitter:     jitter,
+			rssiOffset: config.RssiOffset,
+			snrOffset:  config.SnrOffset,
+		}
+		others := make([]*LorhammerGateway, 0, len(gateways)-1)
+		others = append(append(others, gateways[:i]...), gateways[i+1:]...)
+		for _, node := range gateway.Nodes {
+			nbListeners := int(tools.Random64(int64(config.NbGateways[0]), int64(config.NbGateways[1]))) - 1
+			// partial shuffle, the first nbListeners gateways are drawn without duplicates
+			for l := 0; l < nbListeners && l < len(others); l++ {
+				j := int(tools.Random64(int64(l), int64(len(others)-1)))
+				others[l], others[j] = others[j], others[l]
+				gateway.coverage.listeners[node] = append(gateway.coverage.listeners[node], others[l])
+				others[l].heardNodes = append(others[l].heardNodes, node)
+			}
+		}
+	}
+}
+
+//nodes return the nodes of the gateway and the nodes of other gateways it hears, they can receive downlinks by this gateway
+//while their own gateway emits, so they are locked like its own nodes
+func (gateway *LorhammerGateway) nodes() []*model.Node {
+	if len(gateway.heardNodes) == 0 {
+		return gateway.Nodes
+	}
+	nodes := make([]*model.Node, 0, len(gateway.Nodes)+len(gateway.heardNodes))
+	return append(append(nodes, gateway.Nodes...), gateway.heardNodes...)
+}
+
+//sendToListeners make each other gateway hearing the node send its own copy of the rxpk
+//with its RSSI, SNR and reception time on its own concentrator counter, after a jitter
+func (gateway *LorhammerGateway) sendToListeners(node *model.Node, rxpk loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	if gateway.coverage == nil {
+		return
+	}
+	uplink, _ := gateway.lastUplink(node)
+	for _, listener := range gateway.coverage.listeners[node] {
+		jitter := tools.RandomDuration(gateway.coverage.jitter[0], gateway.coverage.jitter[1])
+		heard := rxpk
+		heard.RSSI = int16(math.Floor(float64(rxpk.RSSI) + randomInRange(gateway.coverage.rssiOffset) + 0.5))
+		heard.LSNR = roundSnr(rxpk.LSNR + randomInRange(gateway.coverage.snrOffset))
+		heardUplink := uplink
+		heardUplink.receivedAt = time.Now().Add(jitter)
+		heardUplink.tmst = listener.tmstAt(heardUplink.receivedAt)
+		heard.Tmst = heardUplink.tmst
+		listener.setLastUplink(node, heardUplink)
+		if rxpk.Time != nil {
+			heardTime := loraserver_structs.CompactTime(time.Time(*rxpk.Time).Add(jitter))
+			heard.Time = &heardTime
+		}
+		go func(listener *LorhammerGateway, heard loraserver_structs.RXPK, jitter time.Duration) {
+			time.Sleep(jitter)
+			listener.forward([]loraserver_structs.RXPK{heard}, prometheus)
+		}(listener, heard, jitter)
+	}
+}
+
+//forward send rxpks with the gateway protocol without waiting their acks
+func (gateway *LorhammerGateway) forward(rxpks []loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	switch gateway.Protocol {
+	case basicStationProtocol:
+		station, err := gateway.getStation(prometheus)
+		if err != nil {
+			loggerGateway.WithError(err).Error("Can't forward uplinks on the station websocket")
+			return
+		}
+		gateway.sendStationUplinks(station, rxpks)
+	case mqttProtocol:
+		client, err := gateway.getBridge(prometheus)
+		if err != nil {
+			loggerGateway.WithError(err).Error("Can't forward uplinks on the mqtt broker")
+			return
+		}
+		gateway.sendBridgeUplinks(client, rxpks)
+	default:
+		socket, err := gateway.getSocket(prometheus)
+		if err != nil {
+			loggerGateway.WithError(err).Error("Can't forward uplinks on the gateway socket")
+			return
+		}
+		gateway.writeRxpks(socket.conn, rxpks)
+	}
+}
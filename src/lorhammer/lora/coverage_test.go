@@ -0,0 +1,110 @@
+package lora
+
+import (
+	"encoding/json"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestCheckCoverage(t *testing.T) {
+	if CheckCoverage(nil, 1) != nil || CheckCoverage(&model.Coverage{NbGateways: [2]int{1, 3}, Jitter: [2]string{"0", "20ms"}, RssiOffset: [2]float64{-20, 0}}, 3) != nil {
+		t.Fatal("Valid coverage must not return an error")
+	}
+	if CheckCoverage(&model.Coverage{NbGateways: [2]int{0, 2}}, 3) == nil || CheckCoverage(&model.Coverage{NbGateways: [2]int{3, 2}}, 3) == nil {
+		t.Fatal("Error expected on wrong nbGateways range")
+	}
+	if CheckCoverage(&model.Coverage{NbGateways: [2]int{1, 4}}, 3) == nil {
+		t.Fatal("Error expected when nodes are heard by more gateways than the scenario has")
+	}
+	if CheckCoverage(&model.Coverage{NbGateways: [2]int{1, 2}, Jitter: [2]string{"20ms", "toto"}}, 3) == nil {
+		t.Fatal("Error expected on wrong jitter")
+	}
+	if CheckCoverage(&model.Coverage{NbGateways: [2]int{1, 2}, SnrOffset: [2]float64{0, -5}}, 3) == nil {
+		t.Fatal("Error expected on wrong snr offset range")
+	}
+}
+
+func TestSetCoverage(t *testing.T) {
+	gateways := []*LorhammerGateway{NewGateway(2, model.Init{}), NewGateway(2, model.Init{}), NewGateway(2, model.Init{})}
+	SetCoverage(gateways, &model.Coverage{NbGateways: [2]int{3, 3}})
+
+	for _, gateway := range gateways {
+		for _, node := range gateway.Nodes {
+			listeners := gateway.coverage.listeners[node]
+			if len(listeners) != 2 || listeners[0] == listeners[1] || listeners[0] == gateway || listeners[1] == gateway {
+				t.Fatal("Each node must be heard by the 2 other gateways")
+			}
+		}
+		if len(gateway.heardNodes) != 4 || len(gateway.nodes()) != 6 {
+			t.Fatal("Each gateway must hear the nodes of the 2 other gateways")
+		}
+	}
+}
+
+func TestSendToListeners(t *testing.T) {
+	broker, restore := newFakeBroker()
+	defer restore()
+	gateways := []*LorhammerGateway{NewGateway(1, model.Init{GatewayProtocol: mqttProtocol}), NewGateway(0, model.Init{GatewayProtocol: mqttProtocol})}
+	SetCoverage(gateways, &model.Coverage{NbGateways: [2]int{2, 2}, Jitter: [2]string{"10ms", "10ms"}, RssiOffset: [2]float64{-10, -10}})
+	defer gateways[0].Close()
+	defer gateways[1].Close()
+
+	if err := gateways[0].Start(&fakePrometheus{}); err != nil {
+		t.Fatalf("Gateway must start : %s", err)
+	}
+	var heard [][]byte
+	for i := 0; i < 100 && len(heard) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		broker.mu.Lock()
+		heard = broker.published[gateways[1].bridgeTopic("rx")]
+		broker.mu.Unlock()
+	}
+	if len(heard) != 1 {
+		t.Fatal("The uplink must also be sent by the other gateway hearing the node")
+	}
+	var own, copy bridgeRXPacket
+	json.Unmarshal(broker.published[gateways[0].bridgeTopic("rx")][0], &own)
+	json.Unmarshal(heard[0], &copy)
+	if string(own.PHYPayload) != string(copy.PHYPayload) || copy.RXInfo.MAC != gateways[1].MacAddress.String() {
+		t.Fatal("The other gateway must send the same PHYPayload with its own MAC")
+	}
+	node := gateways[0].Nodes[0]
+	if uplink, ok := gateways[1].lastUplink(node); copy.RXInfo.RSSI != own.RXInfo.RSSI-10 || !ok || copy.RXInfo.Timestamp != uplink.tmst {
+		t.Fatal("The other gateway must have its own RSSI and reception time on its own counter")
+	}
+
+	downlink := newDataDown(t, node, lorawan.UnconfirmedDataDown, true)
+	downlinkBytes, _ := downlink.MarshalBinary()
+	gateways[1].handleDownlinkPHYPayload(downlinkBytes, classA, nil, &fakePrometheus{})
+	if node.PendingUplink != nil {
+		t.Fatal("Downlink sent by the other gateway must be given to the node")
+	}
+}
+
+func TestHeardNodesDownlinksWhileEmitting(t *testing.T) {
+	gateways := []*LorhammerGateway{NewGateway(2, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73"}), NewGateway(0, model.Init{})}
+	SetCoverage(gateways, &model.Coverage{NbGateways: [2]int{2, 2}})
+
+	downlinks := make([][]byte, len(gateways[0].Nodes))
+	for i, node := range gateways[0].Nodes {
+		downlinks[i], _ = newDataDown(t, node, lorawan.UnconfirmedDataDown, true).MarshalBinary()
+	}
+
+	// the listening gateway gives downlinks to the nodes while their own gateway emits their uplinks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			gateways[0].nextUplinks(&fakePrometheus{})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, downlink := range downlinks {
+			gateways[1].handleDownlinkPHYPayload(downlink, classA, nil, &fakePrometheus{})
+		}
+	}
+	<-done
+}
@@ -0,0 +1,122 @@
+package lora
+
+import (
+	"fmt"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
+	"math"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/sirupsen/logrus"
+)
+
+//txLeadTime is the time the packet forwarder needs a downlink before its tmst to emit it (TX_JIT_DELAY)
+const txLeadTime = 30 * time.Millisecond
+
+//deviceClass is the class a node must be in to receive a downlink, in the order of the basicstation dC field
+type deviceClass int
+
+const (
+	classA deviceClass = iota
+	classB             // scheduled in a ping slot at a GPS time
+	classC             // sent immediately
+)
+
+//isListening return true if the node receives the downlinks of this class
+func isListening(node *model.Node, class deviceClass) bool {
+	switch class {
+	case classB:
+		return node.ClassB
+	case classC:
+		return node.ClassC
+	}
+	return true
+}
+
+const (
+	downlinkOnTime          = "on_time"
+	downlinkLate            = "late"
+	downlinkWrongParameters = "wrong_parameters"
+)
+
+//checkDownlink count the downlink of the node as on time, late or with wrong parameters
+//a downlink is late if it is received by the gateway too late to be emitted at its tmst
+//it has wrong parameters if its tmst is out of the RX windows or its frequency or data rate are not the ones of its window
+func (gateway *LorhammerGateway) checkDownlink(node *model.Node, txpk loraserver_structs.TXPK, receivedAt time.Time, joinAccept bool, prometheus metrics.Prometheus) {
+	node.Lock()
+	defer node.Unlock()
+	uplink, ok := gateway.lastUplink(node)
+	logger := loggerGateway.WithFields(logrus.Fields{
+		"DevEui":    node.DevEUI.String(),
+		"frequency": txpk.Freq,
+		"dataRate":  txpk.DatR,
+	})
+
+	// class C downlinks are emitted immediately with the RX2 parameters
+	if txpk.Imme || txpk.Tmst == nil {
+		result := downlinkOnTime
+		if !node.ClassC {
+			logger.Warn("Immediate downlink for a class A node")
+			result = downlinkWrongParameters
+		} else if !gateway.hasWindowParameters(node, uplink, txpk, "rx2", joinAccept) {
+			logger.Warn("Immediate downlink frequency or data rate is not the RX2 one")
+			result = downlinkWrongParameters
+		}
+		prometheus.AddDownlinkTiming(result, 1)
+		return
+	}
+
+	window, delay := "miss", time.Duration(0)
+	if ok {
+		window, delay = rxWindow(node, uplink, *txpk.Tmst, joinAccept)
+	}
+	prometheus.AddDownlinkRxWindow(window, 1)
+	logger = logger.WithFields(logrus.Fields{"uplink": uplink.tmst, "downlink": *txpk.Tmst, "window": window})
+
+	result := downlinkOnTime
+	switch {
+	case ok && receivedAt.Add(txLeadTime).After(uplink.receivedAt.Add(delay)):
+		logger.WithField("lateness", receivedAt.Add(txLeadTime).Sub(uplink.receivedAt.Add(delay))).Warn("Downlink received too late to be emitted at its tmst")
+		result = downlinkLate
+	case window == "miss":
+		logger.Warn("Downlink tmst out of RX1 and RX2 windows")
+		result = downlinkWrongParameters
+	case !gateway.hasWindowParameters(node, uplink, txpk, window, joinAccept):
+		logger.Warn("Downlink frequency or data rate is not the one of its RX window")
+		result = downlinkWrongParameters
+	}
+	prometheus.AddDownlinkTiming(result, 1)
+}
+
+//hasWindowParameters return true if the txpk frequency and data rate are the ones of the RX1 or RX2 window opened by the uplink
+//JoinAccept are sent with the default parameters of the region, the node ones come from the JoinAccept itself
+func (gateway *LorhammerGateway) hasWindowParameters(node *model.Node, uplink uplinkReception, txpk loraserver_structs.TXPK, window string, joinAccept bool) bool {
+	region := gateway.getRegion()
+	var frequency, dataRate int
+	switch {
+	case window == "rx1" && joinAccept:
+		frequency, dataRate = region.RX1Frequency(uplink.channel, uplink.frequency), region.RX1DataRate(uplink.dataRate, 0)
+	case window == "rx1":
+		frequency, dataRate = region.RX1Frequency(uplink.channel, uplink.frequency), region.RX1DataRate(uplink.dataRate, node.RX1DROffset)
+	case joinAccept || node.RX2Frequency == 0:
+		frequency, dataRate = region.RX2Frequency, region.RX2DataRate
+	default:
+		frequency, dataRate = node.RX2Frequency, node.RX2DataRate
+	}
+	return hasParameters(region, txpk, frequency, dataRate)
+}
+
+//hasParameters return true if the txpk is sent at this frequency in Hz and data rate of the region
+func hasParameters(region *region.Region, txpk loraserver_structs.TXPK, frequency int, dataRate int) bool {
+	if !region.IsValidDataRate(dataRate) {
+		return false
+	}
+	txFrequency := int(math.Floor(txpk.Freq*1000000 + 0.5))
+	txDataRate := txpk.DatR.LoRa
+	if txDataRate == "" {
+		txDataRate = fmt.Sprintf("%d", txpk.DatR.FSK)
+	}
+	return txFrequency == frequency && txDataRate == region.DataRates[dataRate].String()
+}
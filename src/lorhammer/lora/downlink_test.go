@@ -0,0 +1,91 @@
+package lora
+
+import (
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+func newTxpk(tmst uint32, freq float64, datr string) loraserver_structs.TXPK {
+	return loraserver_structs.TXPK{Tmst: &tmst, Freq: freq, DatR: loraserver_structs.DatR{LoRa: datr}}
+}
+
+func TestCheckDownlink(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	node := &model.Node{RXDelay: 1, RX1DROffset: 1, RX2Frequency: 869525000, RX2DataRate: 0}
+	now := time.Now()
+	gateway.setLastUplink(node, uplinkReception{tmst: 1000, receivedAt: now, frequency: 868300000, channel: 1, dataRate: 5})
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.checkDownlink(node, newTxpk(1001000, 868.3, "SF8BW125"), now.Add(100*time.Millisecond), false, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(2001000, 869.525, "SF12BW125"), now.Add(1200*time.Millisecond), false, fakePrometheus)
+	if fakePrometheus.downlinkTimings["on_time"] != 2 {
+		t.Fatalf("Downlinks with the parameters of their window must be on time, got %v", fakePrometheus.downlinkTimings)
+	}
+
+	gateway.checkDownlink(node, newTxpk(1001000, 868.3, "SF8BW125"), now.Add(990*time.Millisecond), false, fakePrometheus)
+	if fakePrometheus.downlinkTimings["late"] != 1 {
+		t.Fatal("Downlink received less than the TX lead time before its tmst must be late")
+	}
+
+	gateway.checkDownlink(node, newTxpk(1001000, 868.1, "SF8BW125"), now, false, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(1001000, 868.3, "SF7BW125"), now, false, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(2001000, 868.3, "SF8BW125"), now, false, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(1501000, 868.3, "SF8BW125"), now, false, fakePrometheus)
+	gateway.checkDownlink(&model.Node{}, newTxpk(1001000, 868.3, "SF8BW125"), now, false, fakePrometheus)
+	if fakePrometheus.downlinkTimings["wrong_parameters"] != 5 {
+		t.Fatalf("Downlinks with wrong frequency, data rate or tmst must be counted, got %v", fakePrometheus.downlinkTimings)
+	}
+	if fakePrometheus.downlinkRxWindows["miss"] != 2 {
+		t.Fatal("Downlinks out of the RX windows must be counted as miss")
+	}
+}
+
+func TestCheckDownlinkJoinAccept(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	// parameters already changed by the JoinAccept DLSettings
+	node := &model.Node{RXDelay: 1, RX1DROffset: 2, RX2Frequency: 869100000, RX2DataRate: 3}
+	now := time.Now()
+	gateway.setLastUplink(node, uplinkReception{tmst: 0, receivedAt: now, frequency: 868100000, dataRate: 5})
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.checkDownlink(node, newTxpk(5000000, 868.1, "SF7BW125"), now, true, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(6000000, 869.525, "SF12BW125"), now, true, fakePrometheus)
+
+	if fakePrometheus.downlinkTimings["on_time"] != 2 {
+		t.Fatalf("JoinAccept must use the default parameters of the region, got %v", fakePrometheus.downlinkTimings)
+	}
+}
+
+func TestCheckDownlinkUS915(t *testing.T) {
+	us915, _ := region.Get("US915")
+	gateway := &LorhammerGateway{Region: us915}
+	node := &model.Node{RXDelay: 1, RX2Frequency: 923300000, RX2DataRate: 8}
+	now := time.Now()
+	gateway.setLastUplink(node, uplinkReception{tmst: 0, receivedAt: now, frequency: 904100000, channel: 9, dataRate: 3})
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.checkDownlink(node, newTxpk(1000000, 923.9, "SF7BW500"), now, false, fakePrometheus)
+	gateway.checkDownlink(node, newTxpk(1000000, 904.1, "SF7BW500"), now, false, fakePrometheus)
+
+	if fakePrometheus.downlinkTimings["on_time"] != 1 || fakePrometheus.downlinkTimings["wrong_parameters"] != 1 {
+		t.Fatalf("RX1 must use the downlink channel and 500kHz data rate in US915, got %v", fakePrometheus.downlinkTimings)
+	}
+}
+
+func TestCheckDownlinkImmediate(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	node := &model.Node{ClassC: true, RX2Frequency: 869525000, RX2DataRate: 0}
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.checkDownlink(node, loraserver_structs.TXPK{Imme: true, Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF12BW125"}}, time.Now(), false, fakePrometheus)
+	gateway.checkDownlink(node, loraserver_structs.TXPK{Imme: true, Freq: 868.1, DatR: loraserver_structs.DatR{LoRa: "SF12BW125"}}, time.Now(), false, fakePrometheus)
+	gateway.checkDownlink(&model.Node{RX2Frequency: 869525000}, loraserver_structs.TXPK{Imme: true, Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF12BW125"}}, time.Now(), false, fakePrometheus)
+
+	if fakePrometheus.downlinkTimings["on_time"] != 1 || fakePrometheus.downlinkTimings["wrong_parameters"] != 2 || len(fakePrometheus.downlinkRxWindows) != 0 {
+		t.Fatalf("Immediate downlinks must be for class C nodes with the RX2 parameters, got %v", fakePrometheus.downlinkTimings)
+	}
+}
@@ -0,0 +1,133 @@
+package lora
+
+import (
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"math"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dutyCycleWithin   = "within"
+	dutyCycleExceeded = "exceeded"
+	dutyCycleBlocked  = "blocked"
+)
+
+//setDutyCycle make the gateway account the time on air of its nodes and of its own downlinks in the duty-cycle bands of the region
+func (gateway *LorhammerGateway) setDutyCycle(dutyCycle *model.DutyCycle) {
+	if dutyCycle == nil {
+		return
+	}
+	gateway.DutyCycle = dutyCycle
+	gateway.txOff = make(map[int]time.Time)
+}
+
+func (gateway *LorhammerGateway) isDutyCycleEnforced() bool {
+	return gateway.DutyCycle != nil && gateway.DutyCycle.Enforce
+}
+
+//isNodeOff return true if the node has exceeded its aggregated duty-cycle or the one of the band of the frequency in Hz at this time
+func (gateway *LorhammerGateway) isNodeOff(node *model.Node, frequency int, now time.Time) bool {
+	if now.Before(node.AggregatedOff) {
+		return true
+	}
+	band := gateway.getRegion().DutyCycleBand(frequency)
+	return band >= 0 && now.Before(node.DutyCycleOff[band])
+}
+
+//usableChannel return a filter of the channels the node can emit on now, all channels if the duty-cycle is not enforced
+func (gateway *LorhammerGateway) usableChannel(node *model.Node) func(channel model.Channel) bool {
+	now := time.Now()
+	return func(channel model.Channel) bool {
+		return !gateway.isDutyCycleEnforced() || !gateway.isNodeOff(node, channel.Frequency, now)
+	}
+}
+
+//canEmit return false and count the uplink as blocked if the duty-cycle is enforced and no channel of the node is usable now
+func (gateway *LorhammerGateway) canEmit(node *model.Node, prometheus metrics.Prometheus) bool {
+	if !gateway.isDutyCycleEnforced() {
+		return true
+	}
+	if _, err := nextChannel(node, gateway.usableChannel(node)); err == nil {
+		return true
+	}
+	loggerGateway.WithField("DevEui", node.DevEUI.String()).Debug("Uplink not emitted, the node is over its duty-cycle")
+	prometheus.AddDutyCycle("node", dutyCycleBlocked, 1)
+	return false
+}
+
+//spendNodeAirtime count the uplink as within or over the node duty-cycle and start the time off of its band and of the aggregated duty-cycle
+func (gateway *LorhammerGateway) spendNodeAirtime(node *model.Node, rxpk loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	if gateway.DutyCycle == nil {
+		return
+	}
+	now := time.Now()
+	frequency := int(math.Floor(rxpk.Freq*1000000 + 0.5))
+	result := dutyCycleWithin
+	if gateway.isNodeOff(node, frequency, now) {
+		result = dutyCycleExceeded
+	}
+	prometheus.AddDutyCycle("node", result, 1)
+
+	airtime := gateway.timeOnAir(rxpk.DatR, rxpk.CodR, int(rxpk.Size), true)
+	if band := gateway.getRegion().DutyCycleBand(frequency); band >= 0 {
+		if node.DutyCycleOff == nil {
+			node.DutyCycleOff = make(map[int]time.Time)
+		}
+		node.DutyCycleOff[band] = timeOff(now, airtime, gateway.getRegion().DutyCycleBands[band].DutyCycle)
+	}
+	if node.MaxDutyCycle > 0 {
+		node.AggregatedOff = timeOff(now, airtime, 1/float64(int(1)<<uint(node.MaxDutyCycle)))
+	}
+}
+
+//emitDownlink count the downlink as within or over the gateway duty-cycle and start the time off of its band
+//it return false if the duty-cycle is enforced and the gateway can't emit the downlink now
+func (gateway *LorhammerGateway) emitDownlink(downlink loraserver_structs.TXPK, prometheus metrics.Prometheus) bool {
+	if gateway.DutyCycle == nil {
+		return true
+	}
+	gateway.txMutex.Lock()
+	defer gateway.txMutex.Unlock()
+	now := time.Now()
+	frequency := int(math.Floor(downlink.Freq*1000000 + 0.5))
+	band := gateway.getRegion().DutyCycleBand(frequency)
+	if band < 0 {
+		prometheus.AddDutyCycle("gateway", dutyCycleWithin, 1)
+		return true
+	}
+
+	result := dutyCycleWithin
+	if now.Before(gateway.txOff[band]) {
+		logger := loggerGateway.WithFields(logrus.Fields{"MacAddress": gateway.MacAddress.String(), "frequency": downlink.Freq})
+		if gateway.DutyCycle.Enforce {
+			logger.Warn("Downlink not emitted, the gateway is over its duty-cycle")
+			prometheus.AddDutyCycle("gateway", dutyCycleBlocked, 1)
+			return false
+		}
+		logger.Warn("Downlink emitted over the gateway duty-cycle")
+		result = dutyCycleExceeded
+	}
+	prometheus.AddDutyCycle("gateway", result, 1)
+	airtime := gateway.timeOnAir(downlink.DatR, downlink.CodR, int(downlink.Size), !downlink.NCRC)
+	gateway.txOff[band] = timeOff(now, airtime, gateway.getRegion().DutyCycleBands[band].DutyCycle)
+	return true
+}
+
+//timeOnAir return the time on air of a frame at a semtech data rate, 0 if it is not a data rate of the region
+func (gateway *LorhammerGateway) timeOnAir(datR loraserver_structs.DatR, codR string, size int, crc bool) time.Duration {
+	region := gateway.getRegion()
+	dataRate := region.DataRateIndex(datR.LoRa, int(datR.FSK))
+	if dataRate < 0 {
+		return 0
+	}
+	return region.DataRates[dataRate].TimeOnAir(size, codR, crc)
+}
+
+//timeOff return the time until which an emitter which has emitted at start during airtime can't emit again with this duty-cycle
+func timeOff(start time.Time, airtime time.Duration, dutyCycle float64) time.Time {
+	return start.Add(time.Duration(float64(airtime) / dutyCycle))
+}
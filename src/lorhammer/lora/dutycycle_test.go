@@ -0,0 +1,90 @@
+package lora
+
+import (
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+func TestNodeDutyCycleEnforced(t *testing.T) {
+	gateway := NewGateway(1, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", DutyCycle: &model.DutyCycle{Enforce: true}})
+	node := gateway.Nodes[0]
+	fakePrometheus := &fakePrometheus{}
+
+	if _, ok := gateway.nextUplink(node, fakePrometheus); !ok {
+		t.Fatal("Node within its duty-cycle must emit")
+	}
+	fCntUp := node.FCntUp
+	if _, ok := gateway.nextUplink(node, fakePrometheus); ok || node.FCntUp != fCntUp {
+		t.Fatal("Node over the duty-cycle of its band must not emit until its time off ends")
+	}
+	for band := range node.DutyCycleOff {
+		node.DutyCycleOff[band] = time.Now()
+	}
+	if _, ok := gateway.nextUplink(node, fakePrometheus); !ok {
+		t.Fatal("Node must emit again after its time off")
+	}
+	if fakePrometheus.dutyCycles["node/within"] != 2 || fakePrometheus.dutyCycles["node/blocked"] != 1 {
+		t.Fatal("Uplinks must be counted as within or blocked by the duty-cycle")
+	}
+}
+
+func TestNodeDutyCycleReported(t *testing.T) {
+	gateway := NewGateway(1, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", DutyCycle: &model.DutyCycle{}})
+	node := gateway.Nodes[0]
+	fakePrometheus := &fakePrometheus{}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := gateway.nextUplink(node, fakePrometheus); !ok {
+			t.Fatal("Node must emit when the duty-cycle is only reported")
+		}
+	}
+	if fakePrometheus.dutyCycles["node/within"] != 1 || fakePrometheus.dutyCycles["node/exceeded"] != 1 {
+		t.Fatal("Uplink over the duty-cycle must be reported")
+	}
+}
+
+func TestAggregatedDutyCycle(t *testing.T) {
+	gateway := NewGateway(1, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", Region: model.Region{Name: "US915"}, DutyCycle: &model.DutyCycle{Enforce: true}})
+	node := gateway.Nodes[0]
+	fakePrometheus := &fakePrometheus{}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := gateway.nextUplink(node, fakePrometheus); !ok {
+			t.Fatal("Region without duty-cycle must not limit the node")
+		}
+	}
+	// DutyCycleReq of the network server
+	node.MaxDutyCycle = 15
+	if _, ok := gateway.nextUplink(node, fakePrometheus); !ok {
+		t.Fatal("Node must emit before its first time off")
+	}
+	if _, ok := gateway.nextUplink(node, fakePrometheus); ok || node.AggregatedOff.Before(time.Now().Add(time.Minute)) {
+		t.Fatal("Node must respect the aggregated duty-cycle of the DutyCycleReq")
+	}
+}
+
+func TestEmitDownlink(t *testing.T) {
+	rx2 := loraserver_structs.TXPK{Freq: 869.525, DatR: loraserver_structs.DatR{LoRa: "SF12BW125"}, CodR: "4/5", Size: 20, NCRC: true}
+	fakePrometheus := &fakePrometheus{}
+	if !(&LorhammerGateway{}).emitDownlink(rx2, fakePrometheus) || fakePrometheus.dutyCycles != nil {
+		t.Fatal("Downlinks must not be accounted without duty-cycle")
+	}
+
+	enforced := NewGateway(0, model.Init{DutyCycle: &model.DutyCycle{Enforce: true}})
+	if !enforced.emitDownlink(rx2, fakePrometheus) || enforced.emitDownlink(rx2, fakePrometheus) {
+		t.Fatal("Gateway over the duty-cycle of the band must not emit when it is enforced")
+	}
+	if rx1 := (loraserver_structs.TXPK{Freq: 868.1, DatR: loraserver_structs.DatR{LoRa: "SF7BW125"}, Size: 20}); !enforced.emitDownlink(rx1, fakePrometheus) {
+		t.Fatal("Gateway must emit in another band")
+	}
+	reported := NewGateway(0, model.Init{DutyCycle: &model.DutyCycle{}})
+	if !reported.emitDownlink(rx2, fakePrometheus) || !reported.emitDownlink(rx2, fakePrometheus) {
+		t.Fatal("Gateway must emit when the duty-cycle is only reported")
+	}
+	if fakePrometheus.dutyCycles["gateway/within"] != 3 || fakePrometheus.dutyCycles["gateway/blocked"] != 1 || fakePrometheus.dutyCycles["gateway/exceeded"] != 1 {
+		t.Fatal("Downlinks must be counted by duty-cycle result")
+	}
+}
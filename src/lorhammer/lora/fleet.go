@@ -0,0 +1,132 @@
+package lora
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"lorhammer/src/model"
+
+	"github.com/brocaar/lorawan"
+)
+
+//CheckFleet return an error if a device of the fleet has not a valid devEui, key or devAddr, or if two devices have the same devEui
+func CheckFleet(fleet *model.Fleet) error {
+	if fleet == nil {
+		return nil
+	}
+	devEUIs := make(map[lorawan.EUI64]bool, len(fleet.Devices))
+	for i, device := range fleet.Devices {
+		node := &model.Node{}
+		if err := applyDevice(node, device); err != nil {
+			return fmt.Errorf("fleet device %d : %s", i, err)
+		}
+		if devEUIs[node.DevEUI] {
+			return fmt.Errorf("fleet device %d : devEui %s is already used by another device", i, node.DevEUI)
+		}
+		devEUIs[node.DevEUI] = true
+		if err := CheckPayloads(device.Payloads); err != nil {
+			return fmt.Errorf("fleet device %d : %s", i, err)
+		}
+	}
+	return nil
+}
+
+//GatewayFleet return the fleet with the share of its devices used by the gateway index among nbGateway gateways
+func GatewayFleet(fleet *model.Fleet, nbGateway int, index int) *model.Fleet {
+	if fleet == nil {
+		return nil
+	}
+	gatewayFleet := *fleet
+	gatewayFleet.Devices = fleet.Devices[index*len(fleet.Devices)/nbGateway : (index+1)*len(fleet.Devices)/nbGateway]
+	return &gatewayFleet
+}
+
+//setFleet give the identity, the keys and the session of the fleet devices to the nodes of the gateway, in order
+//a device with a LoRaWAN version put its node in this version instead of the one given by the ratio of the lorawan11 config
+func (gateway *LorhammerGateway) setFleet(fleet *model.Fleet, lorawan11 *model.LoRaWAN11) {
+	if fleet == nil {
+		return
+	}
+	for i, node := range gateway.Nodes {
+		if i >= len(fleet.Devices) {
+			break
+		}
+		if version := fleet.Devices[i].LoRaWAN11; version != nil && *version != node.LoRaWAN11 {
+			if *version {
+				setNodeLoRaWAN11(node, lorawan11)
+			} else {
+				node.LoRaWAN11, node.Rejoin = false, model.Rejoin{}
+			}
+		}
+		// devices are checked when the scenario is created
+		applyDevice(node, fleet.Devices[i])
+		// with join, a device with a devAddr continues its session instead of joining
+		node.JoinedNetwork = gateway.WithJoin && fleet.Devices[i].DevAddr != ""
+		node.Provisioned = fleet.SkipProvisioning
+	}
+}
+
+//applyDevice set the fields of the device to the node, the node keeps its own values for the fields not set
+//the NwkKey is the AppKey of the device and the LoRaWAN 1.1 network session keys are the NwSKey if not set,
+//except the keys a LoRaWAN 1.1 node got from the lorawan11 config
+func applyDevice(node *model.Node, device model.Device) error {
+	if err := node.DevEUI.UnmarshalText([]byte(device.DevEUI)); err != nil {
+		return fmt.Errorf("devEui %s", err)
+	}
+	node.DevAddr = getDevAddrFromDevEUI(node.DevEUI)
+	nwSKey := node.NwSKey
+	if err := unmarshalFields(map[string]field{
+		"joinEui": {&node.JoinEUI, device.JoinEUI},
+		"appKey":  {&node.AppKey, device.AppKey},
+		"devAddr": {&node.DevAddr, device.DevAddr},
+		"appSKey": {&node.AppSKey, device.AppSKey},
+		"nwkSKey": {&node.NwSKey, device.NwkSKey},
+	}); err != nil {
+		return err
+	}
+	if !node.LoRaWAN11 || device.AppKey != "" {
+		node.NwkKey = node.AppKey
+	}
+	// a key still equal to the NwSKey of the scenario is not set by the lorawan11 config
+	if !node.LoRaWAN11 || node.SNwkSIntKey == nwSKey {
+		node.SNwkSIntKey = node.NwSKey
+	}
+	if !node.LoRaWAN11 || node.NwkSEncKey == nwSKey {
+		node.NwkSEncKey = node.NwSKey
+	}
+	if err := unmarshalFields(map[string]field{
+		"nwkKey":      {&node.NwkKey, device.NwkKey},
+		"sNwkSIntKey": {&node.SNwkSIntKey, device.SNwkSIntKey},
+		"nwkSEncKey":  {&node.NwkSEncKey, device.NwkSEncKey},
+	}); err != nil {
+		return err
+	}
+	if device.FCntUp != nil {
+		node.FCntUp = *device.FCntUp
+	}
+	if device.DevNonce != nil {
+		binary.BigEndian.PutUint16(node.DevNonce[:], *device.DevNonce)
+	}
+	if len(device.Payloads) > 0 {
+		node.Payloads = device.Payloads
+	}
+	return nil
+}
+
+//field is a node field with the hex text of the device setting it, empty if not set
+type field struct {
+	value encoding.TextUnmarshaler
+	text  string
+}
+
+func unmarshalFields(fields map[string]field) error {
+	for name, f := range fields {
+		if f.text == "" {
+			continue
+		}
+		if err := f.value.UnmarshalText([]byte(f.text)); err != nil {
+			return fmt.Errorf("%s %s", name, err)
+		}
+	}
+	return nil
+}
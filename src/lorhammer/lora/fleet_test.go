@@ -0,0 +1,102 @@
+package lora
+
+import (
+	"lorhammer/src/model"
+	"testing"
+)
+
+func TestCheckFleet(t *testing.T) {
+	if CheckFleet(nil) != nil || CheckFleet(&model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", AppKey: "19842bd94743246b367c2e90942a1f73"}}}) != nil {
+		t.Fatal("Valid fleet must not return an error")
+	}
+	if CheckFleet(&model.Fleet{Devices: []model.Device{{}}}) == nil {
+		t.Fatal("Error expected on device without devEui")
+	}
+	if CheckFleet(&model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", DevAddr: "0102"}}}) == nil || CheckFleet(&model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", NwkKey: "zz"}}}) == nil {
+		t.Fatal("Error expected on wrong devAddr or key")
+	}
+	if CheckFleet(&model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708"}, {DevEUI: "0102030405060708"}}}) == nil {
+		t.Fatal("Error expected on devices with the same devEui")
+	}
+}
+
+func TestGatewayFleet(t *testing.T) {
+	fleet := &model.Fleet{Devices: make([]model.Device, 5), SkipProvisioning: true}
+	if GatewayFleet(nil, 2, 0) != nil {
+		t.Fatal("No fleet expected without fleet")
+	}
+	first, second := GatewayFleet(fleet, 2, 0), GatewayFleet(fleet, 2, 1)
+	if len(first.Devices) != 2 || len(second.Devices) != 3 || !second.SkipProvisioning {
+		t.Fatal("Devices must be split between the gateways")
+	}
+}
+
+func TestSetFleet(t *testing.T) {
+	fCntUp := uint32(42)
+	fleet := &model.Fleet{
+		Devices: []model.Device{
+			{DevEUI: "0102030405060708", JoinEUI: "0807060504030201", AppKey: "19842bd94743246b367c2e90942a1f73"},
+			{DevEUI: "0102030405060709", DevAddr: "01020304", NwkSKey: "19842bd94743246b367c2e90942a1f77", AppSKey: "19842bd94743246b367c2e90942a1f73", FCntUp: &fCntUp},
+		},
+		SkipProvisioning: true,
+	}
+	gateway := NewGateway(2, model.Init{WithJoin: true, Nwskey: "19842bd94743246b367c2e90942a1f70", Fleet: fleet})
+
+	toJoin, joined := gateway.Nodes[0], gateway.Nodes[1]
+	if toJoin.DevEUI.String() != "0102030405060708" || toJoin.JoinEUI.String() != "0807060504030201" || toJoin.AppKey.String() != "19842bd94743246b367c2e90942a1f73" {
+		t.Fatal("Node must have the identity and the keys of its device")
+	}
+	if toJoin.NwkKey != toJoin.AppKey || toJoin.JoinedNetwork || toJoin.NwSKey.String() != "19842bd94743246b367c2e90942a1f70" {
+		t.Fatal("Node without session must join with the AppKey as NwkKey")
+	}
+	if !joined.JoinedNetwork || joined.DevAddr.String() != "01020304" || joined.FCntUp != 42 {
+		t.Fatal("Node with a devAddr must continue the session of its device")
+	}
+	if joined.SNwkSIntKey != joined.NwSKey || joined.NwkSEncKey.String() != "19842bd94743246b367c2e90942a1f77" {
+		t.Fatal("LoRaWAN 1.1 network session keys must be the nwkSKey if not set")
+	}
+	if !toJoin.Provisioned || !joined.Provisioned {
+		t.Fatal("Nodes must not be provisioned when the fleet skips provisioning")
+	}
+}
+
+func TestSetFleetDevNonce(t *testing.T) {
+	devNonce := uint16(12)
+	fleet := &model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", DevNonce: &devNonce}, {DevEUI: "0102030405060709"}}}
+	gateway := NewGateway(2, model.Init{WithJoin: true, Fleet: fleet})
+	gateway.Nodes[0].LoRaWAN11, gateway.Nodes[1].LoRaWAN11 = true, true
+
+	if next := nextDevNonce(gateway.Nodes[0]); next != [2]byte{0, 13} {
+		t.Fatalf("Node must continue the DevNonce counter of its device, got %v", next)
+	}
+	if next := nextDevNonce(gateway.Nodes[1]); next != [2]byte{0, 1} {
+		t.Fatalf("Node must start the DevNonce counter at 0 if its device has no devNonce, got %v", next)
+	}
+}
+
+func TestSetFleetLoRaWAN11(t *testing.T) {
+	lorawan11, lorawan10 := true, false
+	fleet := &model.Fleet{
+		Devices: []model.Device{
+			{DevEUI: "0102030405060708", LoRaWAN11: &lorawan10},
+			{DevEUI: "0102030405060709", AppKey: "19842bd94743246b367c2e90942a1f73"},
+			{DevEUI: "010203040506070a", LoRaWAN11: &lorawan11, AppKey: "19842bd94743246b367c2e90942a1f74"},
+		},
+	}
+	config := &model.LoRaWAN11{Ratio: 0.5, SNwkSIntKey: "19842bd94743246b367c2e90942a1f75", RejoinEvery: 10}
+	gateway := NewGateway(4, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f70", LoRaWAN11: config, Fleet: fleet})
+
+	lorawan10Node, ratioNode, lorawan11Node := gateway.Nodes[0], gateway.Nodes[1], gateway.Nodes[2]
+	if lorawan10Node.LoRaWAN11 || lorawan10Node.Rejoin.Every != 0 || lorawan10Node.NwkKey != lorawan10Node.AppKey || lorawan10Node.SNwkSIntKey != lorawan10Node.NwSKey {
+		t.Fatal("Node of a LoRaWAN 1.0 device must use LoRaWAN 1.0 even if chosen by the ratio")
+	}
+	if !ratioNode.LoRaWAN11 || ratioNode.SNwkSIntKey.String() != config.SNwkSIntKey || ratioNode.NwkSEncKey != ratioNode.NwSKey || ratioNode.NwkKey != ratioNode.AppKey {
+		t.Fatal("Node chosen by the ratio must keep the keys of the lorawan11 config and use the AppKey of its device as NwkKey")
+	}
+	if !lorawan11Node.LoRaWAN11 || lorawan11Node.Rejoin.Every != 10 || lorawan11Node.SNwkSIntKey.String() != config.SNwkSIntKey || lorawan11Node.NwkKey.String() != "19842bd94743246b367c2e90942a1f74" {
+		t.Fatal("Node of a LoRaWAN 1.1 device must use LoRaWAN 1.1 with the lorawan11 config even if not chosen by the ratio")
+	}
+	if gateway.Nodes[3].LoRaWAN11 {
+		t.Fatal("Node without device must keep the version given by the ratio")
+	}
+}
@@ -1,20 +1,54 @@
 package lora
 
 import (
+	"errors"
+	"fmt"
 	"lorhammer/src/model"
 	"lorhammer/src/tools"
 	"math"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
 	"github.com/brocaar/lorawan"
 	"github.com/sirupsen/logrus"
 	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/lorhammer/region"
 )
 
 var loggerGateway = logrus.WithField("logger", "lorhammer/lora/gateway")
 
+//gateway protocols to talk with the network server
+const (
+	semtechProtocol      = "semtech"
+	basicStationProtocol = "basicstation"
+	mqttProtocol         = "mqtt"
+)
+
+//CheckProtocol return an error if the gateway protocol of the scenario is not valid for the network server address
+func CheckProtocol(protocol string, nsAddress string) error {
+	switch protocol {
+	case "", semtechProtocol:
+		return nil
+	case basicStationProtocol:
+		if !strings.HasPrefix(nsAddress, "ws://") && !strings.HasPrefix(nsAddress, "wss://") {
+			return errors.New("nsAddress must be a ws:// or wss:// url with the basicstation gateway protocol")
+		}
+		return nil
+	case mqttProtocol:
+		if !strings.Contains(nsAddress, "://") {
+			return errors.New("nsAddress must be the protocol://ip:port of the mqtt broker with the mqtt gateway protocol")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown gateway protocol %s", protocol)
+	}
+}
+
 //LorhammerGateway : internal gateway for pointer receiver usage
 type LorhammerGateway struct {
 	Nodes                 []*model.Node
@@ -24,6 +58,35 @@ type LorhammerGateway struct {
 	PayloadsReplayMaxLaps int
 	AllLapsCompleted      bool
 	ReceiveTimeoutTime    time.Duration
+	WithJoin              bool
+	Region                *region.Region
+	Radio                 *model.Radio
+	RadioConditions       model.RadioConditions
+	KeepaliveInterval     time.Duration
+	StatInterval          time.Duration
+	Latitude              *float64
+	Longitude             *float64
+	Altitude              *int32
+	stats                 gatewayStats
+	Protocol              string
+	socket                *udpSocket
+	station               *stationConn
+	bridge                tools.Mqtt
+	connMutex             sync.Mutex // protects the lazy creation of the socket, the station websocket and the mqtt client
+	BatchWindow           time.Duration
+	BatchMaxSize          int
+	coverage              *coverage
+	heardNodes            []*model.Node
+	GpsTime               bool
+	FineTimestamp         bool
+	tmstOffset            uint32
+	tmstMutex             sync.Mutex
+	uplinks               map[*model.Node]uplinkReception
+	EnqueueTimePort       int
+	DutyCycle             *model.DutyCycle
+	txOff                 map[int]time.Time // end of the time off of each duty-cycle band of the region
+	txMutex               sync.Mutex
+	nbEndedNodes          int32 // nodes which have sent all their laps, counted atomically by the goroutines emitting their uplinks
 }
 
 //NewGateway return a new gateway with node configured
@@ -34,22 +97,76 @@ func NewGateway(nbNode int, init model.Init) *LorhammerGateway {
 		MacAddress:            tools.Random8Bytes(),
 		ReceiveTimeoutTime:    parsedTime,
 		PayloadsReplayMaxLaps: init.NbScenarioReplayLaps,
+		WithJoin:              init.WithJoin,
+		Protocol:              init.GatewayProtocol,
+		GpsTime:               init.GpsTime,
+		FineTimestamp:         init.FineTimestamp,
+		tmstOffset:            uint32(tools.Random64(0, math.MaxUint32)),
 	}
 
 	if init.RxpkDate > 0 {
 		gateway.RxpkDate = init.RxpkDate
 	}
+	// region is checked when the scenario is created
+	gateway.Region, _ = region.Get(init.Region.Name)
+	if init.Radio != nil {
+		gateway.Radio = init.Radio
+		gateway.RadioConditions = drawRadioConditions(init.Radio)
+	}
+	gateway.setGatewayStatus(init.GatewayStatus)
+	gateway.setBatch(init.Batch)
 	for i := 0; i < nbNode; i++ {
-		gateway.Nodes = append(gateway.Nodes, newNode(init.Nwskey, init.AppsKey, init.Description, init.Payloads, init.RandomPayloads))
+		node := newNode(init.Nwskey, init.AppsKey, init.Description, init.Payloads, init.RandomPayloads)
+		node.FCnt = init.FCnt
+		node.FCntUp = init.FCnt.Start
+		if init.ConfirmedRatio != nil {
+			node.ConfirmedRatio, node.Retransmit = *init.ConfirmedRatio, true
+		}
+		node.Channels, _ = gateway.getRegion().NodeChannels(init.Region.SubBands)
+		node.DataRate = gateway.getRegion().DefaultDataRate
+		node.RX2DataRate = gateway.getRegion().RX2DataRate
+		node.RX2Frequency = gateway.getRegion().RX2Frequency
+		node.RXDelay = 1
+		node.NbTrans = 1
+		node.Adr = init.Adr
+		if len(init.Region.DataRates) > 0 {
+			node.DataRate = init.Region.DataRates[tools.Random(0, len(init.Region.DataRates)-1)]
+		}
+		if init.Radio != nil {
+			node.RadioConditions = drawRadioConditions(init.Radio)
+		}
+		gateway.Nodes = append(gateway.Nodes, node)
 	}
+	gateway.setClassC(init.ClassC)
+	gateway.setClassB(init.ClassB)
+	gateway.setLoRaWAN11(init.LoRaWAN11)
+	gateway.setFleet(init.Fleet, init.LoRaWAN11)
+	gateway.setReplay(init.Replay, init.Fleet)
+	gateway.setNodeSchedule(init.NodeSchedule)
+	gateway.setDutyCycle(init.DutyCycle)
 
 	return gateway
 }
 
+//getRegion return the region of the gateway, EU868 if not set
+func (gateway *LorhammerGateway) getRegion() *region.Region {
+	if gateway.Region == nil {
+		defaultRegion, _ := region.Get("")
+		return defaultRegion
+	}
+	return gateway.Region
+}
+
 //Join send first pull datata to be discovered by network server
 //Then send a JoinRequest packet if `withJoin` is set in scenario file
 func (gateway *LorhammerGateway) Join(prometheus metrics.Prometheus, withJoin bool) error {
-	conn, err := net.Dial("udp", gateway.NsAddress)
+	switch gateway.Protocol {
+	case basicStationProtocol:
+		return gateway.startStation(prometheus, withJoin, false)
+	case mqttProtocol:
+		return gateway.startBridge(prometheus, withJoin, false)
+	}
+	conn, err := gateway.newRoundConn(prometheus)
 	if err != nil {
 		return err
 	}
@@ -66,7 +183,7 @@ func (gateway *LorhammerGateway) Join(prometheus metrics.Prometheus, withJoin bo
 	gateway.sendPullData(conn)
 
 	if withJoin {
-		gateway.sendJoinRequestPackets(conn)
+		gateway.sendJoinRequestPackets(conn, prometheus)
 	}
 
 	threadListenUDP := make(chan []byte, 1)
@@ -82,8 +199,14 @@ func (gateway *LorhammerGateway) Join(prometheus metrics.Prometheus, withJoin bo
 }
 
 //Start send push data packet and listen for ack
-func (gateway *LorhammerGateway) Start(prometheus metrics.Prometheus, fcnt uint32) error {
-	conn, err := net.Dial("udp", gateway.NsAddress)
+func (gateway *LorhammerGateway) Start(prometheus metrics.Prometheus) error {
+	switch gateway.Protocol {
+	case basicStationProtocol:
+		return gateway.startStation(prometheus, gateway.WithJoin, true)
+	case mqttProtocol:
+		return gateway.startBridge(prometheus, gateway.WithJoin, true)
+	}
+	conn, err := gateway.newRoundConn(prometheus)
 	if err != nil {
 		return err
 	}
@@ -95,8 +218,13 @@ func (gateway *LorhammerGateway) Start(prometheus metrics.Prometheus, fcnt uint3
 
 	gateway.sendPullData(conn)
 
+	//Nodes which have not received their JoinAccept yet try to join again
+	if gateway.WithJoin {
+		gateway.sendJoinRequestPackets(conn, prometheus)
+	}
+
 	//Send pushDataPackets
-	gateway.sendPushPackets(conn, fcnt)
+	gateway.sendPushPackets(conn, prometheus)
 
 	//READ
 	threadListenUDP := make(chan []byte, 1)
@@ -129,52 +257,118 @@ func (gateway *LorhammerGateway) sendPullData(conn net.Conn) {
 	}
 }
 
-func (gateway *LorhammerGateway) sendJoinRequestPackets(conn net.Conn) {
+func (gateway *LorhammerGateway) sendJoinRequestPackets(conn net.Conn, prometheus metrics.Prometheus) {
 	loggerGateway.Info("Sending JoinRequest messages for all the nodes")
 
+	gateway.sendRxpks(conn, gateway.nextJoinRequests(prometheus))
+}
+
+//nextJoinRequests return the rxpk of a new JoinRequest of each node which has not joined yet
+func (gateway *LorhammerGateway) nextJoinRequests(prometheus metrics.Prometheus) []loraserver_structs.RXPK {
+	var rxpks []loraserver_structs.RXPK
 	for _, node := range gateway.Nodes {
+		node.Lock()
 		if !node.JoinedNetwork {
-			packet, err := packet{
-				Rxpk: []loraserver_structs.RXPK{
-					newRxpk(getJoinRequestDataPayload(node), 0, gateway),
-				},
-			}.prepare(gateway)
-
-			if err != nil {
-				loggerGateway.WithError(err).Error("Can't prepare lora packet in SendJoinRequest")
-			}
-			if _, err = conn.Write(packet); err != nil {
-				loggerGateway.WithError(err).Error("Can't write udp in SendJoinRequest")
+			if rxpk, ok := gateway.nextJoinRequest(node, prometheus); ok {
+				rxpks = append(rxpks, rxpk)
 			}
 		}
+		node.Unlock()
+	}
+	return rxpks
+}
+
+//nextJoinRequest return the rxpk of a new JoinRequest of the node, false if it can't be created or the node is over its enforced duty-cycle
+//the node must be locked
+func (gateway *LorhammerGateway) nextJoinRequest(node *model.Node, prometheus metrics.Prometheus) (loraserver_structs.RXPK, bool) {
+	if !gateway.canEmit(node, prometheus) {
+		return loraserver_structs.RXPK{}, false
+	}
+	dataRate := node.DataRate
+	rxpk, err := newRxpk(getJoinRequestDataPayload(node), 0, node, gateway)
+	updateDataRateMetric(prometheus, dataRate, node)
+	if err != nil {
+		loggerGateway.WithError(err).WithField("DevEui", node.DevEUI.String()).Error("Can't create rxpk in SendJoinRequest")
+		return rxpk, false
 	}
+	gateway.spendNodeAirtime(node, rxpk, prometheus)
+	gateway.sendToListeners(node, rxpk, prometheus)
+	return rxpk, true
 }
 
-func (gateway *LorhammerGateway) sendPushPackets(conn net.Conn, fcnt uint32) {
+func (gateway *LorhammerGateway) sendPushPackets(conn net.Conn, prometheus metrics.Prometheus) {
+	gateway.sendRxpks(conn, gateway.nextUplinks(prometheus))
+}
+
+//nextUplinks return the rxpk of the next uplink of each node, a retransmission for nodes waiting for an ACK
+func (gateway *LorhammerGateway) nextUplinks(prometheus metrics.Prometheus) []loraserver_structs.RXPK {
+	var rxpks []loraserver_structs.RXPK
 	for _, node := range gateway.Nodes {
-		if node.PayloadsReplayLap < gateway.PayloadsReplayMaxLaps || gateway.PayloadsReplayMaxLaps == 0 {
-			buf, date, err := GetPushDataPayload(node, fcnt)
-			if err != nil {
-				loggerGateway.WithError(err).Error("Can't get next lora packet to send")
+		node.Lock()
+		// session keys are not known before the JoinAccept
+		if !gateway.WithJoin || node.JoinedNetwork {
+			previousLap := node.PayloadsReplayLap
+			if previousLap < gateway.PayloadsReplayMaxLaps || gateway.PayloadsReplayMaxLaps == 0 {
+				if rxpk, ok := gateway.nextUplink(node, prometheus); ok {
+					rxpks = append(rxpks, rxpk)
+				}
+				gateway.countEndedNode(node, previousLap)
 			}
-			packet, err := packet{
-				Rxpk: []loraserver_structs.RXPK{
-					newRxpk(buf, date, gateway),
-				},
-			}.prepare(gateway)
+		}
+		node.Unlock()
+	}
+	if gateway.isGatewayScenarioCompleted() {
+		gateway.AllLapsCompleted = true
+	}
+	return rxpks
+}
 
+//nextUplink return the rxpk of the next uplink of the node, false if it can't be created or the node is over its enforced duty-cycle
+//the node must be locked
+func (gateway *LorhammerGateway) nextUplink(node *model.Node, prometheus metrics.Prometheus) (loraserver_structs.RXPK, bool) {
+	if !gateway.canEmit(node, prometheus) {
+		return loraserver_structs.RXPK{}, false
+	}
+	dataRate := node.DataRate
+	buf, date := getRetransmission(node)
+	if buf != nil {
+		prometheus.AddRetransmission(1)
+	} else if buf, date = getRepetition(node); buf == nil {
+		if buf = nextRejoinRequest(node); buf == nil {
+			var err error
+			buf, date, err = GetPushDataPayload(node, gateway.getRegion())
 			if err != nil {
-				loggerGateway.WithError(err).Error("Can't prepare lora packet in sendPushPackets")
+				loggerGateway.WithError(err).Error("Can't get next lora packet to send")
 			}
-			if _, err = conn.Write(packet); err != nil {
-				loggerGateway.WithError(err).Error("Can't write udp in sendPushPackets")
+			if node.PendingUplink != nil {
+				prometheus.AddConfirmedUplink(1)
 			}
 		}
 	}
-	if gateway.isGatewayScenarioCompleted() {
-		gateway.AllLapsCompleted = true
-		return
+	rxpk, err := newRxpk(buf, date, node, gateway)
+	updateDataRateMetric(prometheus, dataRate, node)
+	if err != nil {
+		loggerGateway.WithError(err).WithField("DevEui", node.DevEUI.String()).Error("Can't create rxpk in sendPushPackets")
+		return rxpk, false
+	}
+	gateway.spendNodeAirtime(node, rxpk, prometheus)
+	gateway.sendToListeners(node, rxpk, prometheus)
+	return rxpk, true
+}
+
+//writeRxpks send the rxpks in one PUSH_DATA packet
+func (gateway *LorhammerGateway) writeRxpks(conn net.Conn, rxpks []loraserver_structs.RXPK) {
+	packet, err := packet{
+		Rxpk: rxpks,
+	}.prepare(gateway)
+
+	if err != nil {
+		loggerGateway.WithError(err).Error("Can't prepare lora packet")
+	}
+	if _, err = conn.Write(packet); err != nil {
+		loggerGateway.WithError(err).Error("Can't write udp push data")
 	}
+	gateway.addUplinks(len(rxpks))
 }
 
 func (gateway *LorhammerGateway) readPackets(conn net.Conn, poison chan bool, next chan bool, threadListenUDP chan []byte) {
@@ -204,18 +398,19 @@ func (gateway *LorhammerGateway) readPackets(conn net.Conn, poison chan bool, ne
 }
 
 func (gateway *LorhammerGateway) readLoraJoinPackets(conn net.Conn, poison chan bool, next chan bool, threadListenUDP chan []byte, endPushAckTimer func(), endPullRespTimer func(), prometheus metrics.Prometheus, withJoin bool) {
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(conn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
-	nbEmittedMsg := 1 // One PullData request has been sent
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(conn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, prometheus)
+	nbEmittedMsg, nbEmittedPushData := 1, 1 // One PullData request has been sent
 	if withJoin {
 		nbEmittedMsg += len(gateway.Nodes)
+		nbEmittedPushData += gateway.nbPushData(len(gateway.Nodes))
 	}
 	loggerGateway.WithFields(logrus.Fields{
 		"ref":      "lora/gateway:Join()",
 		"withJoin": withJoin,
-		"nb":       nbEmittedMsg - nbReceivedAckMsg,
+		"nb":       nbEmittedPushData - nbReceivedAckMsg,
 		"msgType":  "Push Ack",
 	}).Warn("Receive PullData or Join Request ack after 2 seconds")
-	prometheus.AddPushAckLongRequest(nbEmittedMsg - nbReceivedAckMsg)
+	prometheus.AddPushAckLongRequest(nbEmittedPushData - nbReceivedAckMsg)
 
 	loggerGateway.WithFields(logrus.Fields{
 		"ref":      "lora/gateway:Join()",
@@ -227,14 +422,15 @@ func (gateway *LorhammerGateway) readLoraJoinPackets(conn net.Conn, poison chan
 }
 
 func (gateway *LorhammerGateway) readLoraPushPackets(conn net.Conn, poison chan bool, next chan bool, threadListenUDP chan []byte, endPushAckTimer func(), endPullRespTimer func(), prometheus metrics.Prometheus) {
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(conn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
-	if len(gateway.Nodes)-nbReceivedAckMsg > 0 {
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(conn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, prometheus)
+	nbEmittedPushData := gateway.nbPushData(len(gateway.Nodes))
+	if nbEmittedPushData-nbReceivedAckMsg > 0 {
 		loggerGateway.WithFields(logrus.Fields{
 			"ref":     "lora/gateway:Start()",
-			"nb":      len(gateway.Nodes) - nbReceivedAckMsg,
+			"nb":      nbEmittedPushData - nbReceivedAckMsg,
 			"msgType": "Push Ack",
 		}).Warn("Receive data after 2 second")
-		prometheus.AddPushAckLongRequest(len(gateway.Nodes) - nbReceivedAckMsg)
+		prometheus.AddPushAckLongRequest(nbEmittedPushData - nbReceivedAckMsg)
 	}
 	if len(gateway.Nodes)-nbReceivedPullRespMsg > 0 {
 		loggerGateway.WithFields(logrus.Fields{
@@ -246,7 +442,7 @@ func (gateway *LorhammerGateway) readLoraPushPackets(conn net.Conn, poison chan
 	}
 }
 
-func (gateway *LorhammerGateway) readLoraPackets(conn net.Conn, poison chan bool, next chan bool, threadListenUDP chan []byte, endPushAckTimer func(), endPullRespTimer func()) (int, int) {
+func (gateway *LorhammerGateway) readLoraPackets(conn net.Conn, poison chan bool, next chan bool, threadListenUDP chan []byte, endPushAckTimer func(), endPullRespTimer func(), prometheus metrics.Prometheus) (int, int) {
 	nbReceivedAckMsg, nbReceivedPullRespMsg := 0, 0
 	localPoison := make(chan bool)
 
@@ -272,6 +468,7 @@ func (gateway *LorhammerGateway) readLoraPackets(conn net.Conn, poison chan bool
 						endPullRespTimer()
 						nbReceivedPullRespMsg++
 						gateway.sendTxAckPacket(conn, res)
+						gateway.handleDownlink(res, prometheus)
 					}
 
 					loggerGateway.WithFields(logrus.Fields{
@@ -297,17 +494,201 @@ func (gateway *LorhammerGateway) readLoraPackets(conn net.Conn, poison chan bool
 	return nbReceivedAckMsg, nbReceivedPullRespMsg
 }
 
+//handleDownlink apply the PHYPayload of a PULL_RESP packet to the node it is addressed to
+func (gateway *LorhammerGateway) handleDownlink(data []byte, prometheus metrics.Prometheus) {
+	receivedAt := time.Now()
+	phyPayloadBytes, txpk, err := getPullRespTxpkData(data)
+	if err != nil {
+		loggerGateway.WithError(err).Error("Can't get downlink PHYPayload")
+		return
+	}
+	if !gateway.emitDownlink(txpk.TXPK, prometheus) {
+		return
+	}
+	if txpk.isBeacon() {
+		gateway.handleBeacon(txpk, phyPayloadBytes, prometheus)
+		return
+	}
+	class := classA
+	switch {
+	case txpk.Tmms != nil:
+		class = classB
+	case txpk.Imme:
+		class = classC
+	}
+	gateway.applyDownlink(phyPayloadBytes, txpk, class, receivedAt, prometheus)
+}
+
+//applyDownlink give the PHYPayload of an emitted downlink to its node and check the timing and radio parameters of the downlink
+func (gateway *LorhammerGateway) applyDownlink(phyPayloadBytes []byte, downlink txpk, class deviceClass, receivedAt time.Time, prometheus metrics.Prometheus) {
+	node, joinAccept := gateway.handleDownlinkPHYPayload(phyPayloadBytes, class, downlink.Tmst, prometheus)
+	switch {
+	case node == nil:
+	case class == classB:
+		gateway.checkPingSlot(node, downlink, prometheus)
+	default:
+		gateway.checkDownlink(node, downlink.TXPK, receivedAt, joinAccept, prometheus)
+	}
+}
+
+//handleDownlinkPHYPayload give the downlink PHYPayload to the node it is addressed to if it listens to downlinks of this class
+//txTmst is the emission time of the downlink on the concentrator counter, nil if the protocol doesn't give it
+//it return this node, nil if none, and true if the downlink is a JoinAccept
+func (gateway *LorhammerGateway) handleDownlinkPHYPayload(phyPayloadBytes []byte, class deviceClass, txTmst *uint32, prometheus metrics.Prometheus) (*model.Node, bool) {
+	gateway.addDownlink()
+	// the PHYPayload is unmarshalled by the node, LoRaWAN 1.1 FOpts must be decrypted first
+	if len(phyPayloadBytes) < 12 {
+		loggerGateway.WithField("size", len(phyPayloadBytes)).Error("Downlink PHYPayload too short")
+		return nil, false
+	}
+	switch lorawan.MType(phyPayloadBytes[0] >> 5) {
+	case lorawan.JoinAccept:
+		return gateway.handleJoinAccept(phyPayloadBytes, txTmst), true
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		return gateway.handleDataDown(phyPayloadBytes, class, prometheus), false
+	}
+	return nil, false
+}
+
+//handleDataDown give the data downlink to the node with the same DevAddr whose network session keys validate the MIC and return this node
+func (gateway *LorhammerGateway) handleDataDown(phyPayloadBytes []byte, class deviceClass, prometheus metrics.Prometheus) *model.Node {
+	var devAddr lorawan.DevAddr
+	if err := devAddr.UnmarshalBinary(phyPayloadBytes[1:5]); err != nil {
+		loggerGateway.WithError(err).Error("Can't unmarshal downlink DevAddr")
+		return nil
+	}
+	for _, node := range gateway.nodes() {
+		if gateway.handleNodeDataDown(node, devAddr, phyPayloadBytes, class, prometheus) {
+			return node
+		}
+	}
+	loggerGateway.WithField("DevAddr", devAddr.String()).Warn("Data downlink received for no node")
+	return nil
+}
+
+//handleNodeDataDown lock the node and give it the data downlink if it has the DevAddr and its network session keys validate the MIC
+//it return false if the downlink is not for this node
+func (gateway *LorhammerGateway) handleNodeDataDown(node *model.Node, devAddr lorawan.DevAddr, phyPayloadBytes []byte, class deviceClass, prometheus metrics.Prometheus) bool {
+	node.Lock()
+	defer node.Unlock()
+	if node.DevAddr != devAddr {
+		return false
+	}
+	phyPayload, ok := decodeDataDown(node, phyPayloadBytes)
+	if !ok {
+		return false
+	}
+	macPayload := phyPayload.MACPayload.(*lorawan.MACPayload)
+	if !isListening(node, class) {
+		loggerGateway.WithField("DevEui", node.DevEUI.String()).Warn("Downlink lost, the node is not listening in its class")
+		return true
+	}
+	switch class {
+	case classB:
+		node.PingSlot.NbDownlinks++
+	case classC:
+		node.NbClassCDownlinks++
+	}
+	gateway.observeEnqueueDelay(node, macPayload, prometheus)
+	dataRate := node.DataRate
+	acked, err := handleDataDown(node, gateway.getRegion(), phyPayload)
+	updateDataRateMetric(prometheus, dataRate, node)
+	if err != nil {
+		loggerGateway.WithError(err).WithField("DevEui", node.DevEUI.String()).Error("Can't handle data downlink")
+		return true
+	}
+	if acked {
+		prometheus.AddUplinkAck(1)
+	}
+	return true
+}
+
+//handleJoinAccept give the JoinAccept to the node whose JoinRequest it answers, the first one which can decrypt it with its AppKey
+//among the nodes whose last uplink opens an RX window at txTmst, the closest first, or among all the nodes without txTmst
+//nodes which have joined wait for a JoinAccept only after a LoRaWAN 1.1 rejoin request
+//the JoinAccept doesn't contain the DevNonce, so the node DevNonce of the matching JoinRequest is used to derive session keys
+//a node which can't decode the JoinAccept, decrypted with keys which are not its own, doesn't prevent the next ones from trying
+//it return the node which has joined
+func (gateway *LorhammerGateway) handleJoinAccept(phyPayloadBytes []byte, txTmst *uint32) *model.Node {
+	for _, node := range gateway.joinAcceptCandidates(txTmst) {
+		joined, err := lockedJoinAccept(node, phyPayloadBytes)
+		if err != nil {
+			loggerGateway.WithError(err).WithField("DevEui", node.DevEUI.String()).Debug("Can't handle JoinAccept with the node keys, trying the next node")
+			continue
+		}
+		if joined {
+			return node
+		}
+	}
+	loggerGateway.WithField("MacAddress", gateway.MacAddress.String()).Warn("JoinAccept received for no waiting node")
+	return nil
+}
+
+//joinAcceptCandidates return the nodes whose last uplink received by the gateway is answered in its RX1 or RX2 window
+//by a JoinAccept emitted at txTmst, sorted from the closest to the opening of the window, or all the nodes without txTmst
+//nodes share their AppKey, only the timing of the JoinAccept tells which JoinRequest it answers
+func (gateway *LorhammerGateway) joinAcceptCandidates(txTmst *uint32) []*model.Node {
+	if txTmst == nil {
+		return gateway.nodes()
+	}
+	var candidates []*model.Node
+	gaps := make(map[*model.Node]time.Duration)
+	for _, node := range gateway.nodes() {
+		uplink, ok := gateway.lastUplink(node)
+		if !ok {
+			continue
+		}
+		node.Lock()
+		window, delay := rxWindow(node, uplink, *txTmst, true)
+		node.Unlock()
+		gap := delay - joinAcceptDelay
+		switch window {
+		case "miss":
+			continue
+		case "rx2":
+			gap -= time.Second
+		}
+		if gap < 0 {
+			gap = -gap
+		}
+		candidates, gaps[node] = append(candidates, node), gap
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return gaps[candidates[i]] < gaps[candidates[j]] })
+	return candidates
+}
+
+//lockedJoinAccept lock the node and give it the JoinAccept if it waits for one, it return true if the node has joined
+func lockedJoinAccept(node *model.Node, phyPayloadBytes []byte) (bool, error) {
+	node.Lock()
+	defer node.Unlock()
+	if node.JoinedNetwork && !node.Rejoin.Pending {
+		return false, nil
+	}
+	return handleJoinAccept(node, phyPayloadBytes)
+}
+
+//updateDataRateMetric move the node in the data rate distribution if its data rate has changed
+func updateDataRateMetric(prometheus metrics.Prometheus, previous int, node *model.Node) {
+	if node.DataRate != previous {
+		prometheus.SubNodesDataRate(previous, 1)
+		prometheus.AddNodesDataRate(node.DataRate, 1)
+	}
+}
+
 func (gateway *LorhammerGateway) isGatewayScenarioCompleted() bool {
 	//infinite case when PayloadsReplayMaxRound is set to 0 or inferior
 	if gateway.PayloadsReplayMaxLaps <= 0 {
 		return false
 	}
 	for _, node := range gateway.Nodes {
+		node.Lock()
+		lap := node.PayloadsReplayLap
+		node.Unlock()
 		// if only one node has not reached the expected number of rounds, break the loop and return false
-		if node.PayloadsReplayLap < gateway.PayloadsReplayMaxLaps {
+		if lap < gateway.PayloadsReplayMaxLaps {
 			loggerGateway.WithFields(logrus.Fields{
 				"DevEui":                node.DevEUI.String(),
-				"PayloadsReplayLap":     node.PayloadsReplayLap,
+				"PayloadsReplayLap":     lap,
 				"PayloadsReplayMaxLaps": gateway.PayloadsReplayMaxLaps,
 			}).Debug("node has not finished yet")
 			return false
@@ -319,6 +700,32 @@ func (gateway *LorhammerGateway) isGatewayScenarioCompleted() bool {
 	return true
 }
 
+//countEndedNode count the node once, when its last uplink has made it reach the max number of laps, the node must be locked
+func (gateway *LorhammerGateway) countEndedNode(node *model.Node, previousLap int) {
+	maxLaps := gateway.PayloadsReplayMaxLaps
+	if maxLaps > 0 && previousLap < maxLaps && node.PayloadsReplayLap >= maxLaps {
+		atomic.AddInt32(&gateway.nbEndedNodes, 1)
+	}
+}
+
+//hasNodeEnded return true if the node has sent all the laps of the scenario, the node must be locked
+func (gateway *LorhammerGateway) hasNodeEnded(node *model.Node) bool {
+	return gateway.PayloadsReplayMaxLaps > 0 && node.PayloadsReplayLap >= gateway.PayloadsReplayMaxLaps
+}
+
+//lockedHasNodeEnded lock the node and return true if it has sent all the laps of the scenario
+func (gateway *LorhammerGateway) lockedHasNodeEnded(node *model.Node) bool {
+	node.Lock()
+	defer node.Unlock()
+	return gateway.hasNodeEnded(node)
+}
+
+//HasEnded return true if all the nodes of the gateway have sent all their laps, without looking at each node
+//it can be called while the nodes are emitting, in gateway rounds or at their own pace
+func (gateway *LorhammerGateway) HasEnded() bool {
+	return gateway.PayloadsReplayMaxLaps > 0 && int(atomic.LoadInt32(&gateway.nbEndedNodes)) >= len(gateway.Nodes)
+}
+
 func (gateway *LorhammerGateway) sendTxAckPacket(conn net.Conn, data []byte) {
 	var pullRespPacket loraserver_structs.PullRespPacket
 	if err := pullRespPacket.UnmarshalBinary(data); err == nil {
@@ -346,7 +753,7 @@ func (gateway *LorhammerGateway) sendTxAckPacket(conn net.Conn, data []byte) {
 }
 
 //ConvertToGateway : convert internal gateway to model gateway
-func (gateway LorhammerGateway) ConvertToGateway() model.Gateway {
+func (gateway *LorhammerGateway) ConvertToGateway() model.Gateway {
 	return model.Gateway{
 		Nodes:                 gateway.Nodes,
 		NsAddress:             gateway.NsAddress,
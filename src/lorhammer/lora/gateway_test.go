@@ -1,6 +1,7 @@
 package lora
 
 import (
+	"encoding/base64"
 	"errors"
 	"lorhammer/src/model"
 	"lorhammer/src/tools"
@@ -8,6 +9,9 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/brocaar/lorawan"
 )
 
 type fakeConn struct {
@@ -56,6 +60,17 @@ func (fc *fakeConnErrorReading) SetWriteDeadline(t time.Time) error { return nil
 type fakePrometheus struct {
 	nbPushAckLongRequest  int
 	nbPullRespLongRequest int
+	nbConfirmedUplink     int
+	nbUplinkAck           int
+	nbRetransmission      int
+	nodesDataRate         map[int]int
+	downlinkRxWindows     map[string]int
+	downlinkTimings       map[string]int
+	downlinkEnqueueDelays []time.Duration
+	classBDownlinks       map[string]int
+	dutyCycles            map[string]int
+	loadSkippedArrivals   int
+	mutex                 sync.Mutex // nodes of scheduled gateways emit from their own goroutines
 }
 
 func (fp *fakePrometheus) StartPushAckTimer() func()  { return nil }
@@ -65,11 +80,107 @@ func (fp *fakePrometheus) SubGateway(nb int)          {}
 func (fp *fakePrometheus) AddNodes(nb int)            {}
 func (fp *fakePrometheus) SubNodes(nb int)            {}
 func (fp *fakePrometheus) AddPushAckLongRequest(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
 	fp.nbPushAckLongRequest = nb
 }
 func (fp *fakePrometheus) AddPullRespLongRequest(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
 	fp.nbPullRespLongRequest = nb
 }
+func (fp *fakePrometheus) AddConfirmedUplink(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.nbConfirmedUplink += nb
+}
+func (fp *fakePrometheus) AddUplinkAck(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.nbUplinkAck += nb
+}
+func (fp *fakePrometheus) AddRetransmission(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.nbRetransmission += nb
+}
+func (fp *fakePrometheus) AddNodesDataRate(dataRate int, nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if fp.nodesDataRate == nil {
+		fp.nodesDataRate = make(map[int]int)
+	}
+	fp.nodesDataRate[dataRate] += nb
+}
+func (fp *fakePrometheus) SubNodesDataRate(dataRate int, nb int) {
+	fp.AddNodesDataRate(dataRate, -nb)
+}
+func (fp *fakePrometheus) AddDownlinkRxWindow(window string, nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if fp.downlinkRxWindows == nil {
+		fp.downlinkRxWindows = make(map[string]int)
+	}
+	fp.downlinkRxWindows[window] += nb
+}
+func (fp *fakePrometheus) AddDownlinkTiming(result string, nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if fp.downlinkTimings == nil {
+		fp.downlinkTimings = make(map[string]int)
+	}
+	fp.downlinkTimings[result] += nb
+}
+func (fp *fakePrometheus) ObserveDownlinkEnqueueDelay(delay time.Duration) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.downlinkEnqueueDelays = append(fp.downlinkEnqueueDelays, delay)
+}
+func (fp *fakePrometheus) AddClassBDownlink(kind string, result string, nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if fp.classBDownlinks == nil {
+		fp.classBDownlinks = make(map[string]int)
+	}
+	fp.classBDownlinks[kind+"/"+result] += nb
+}
+func (fp *fakePrometheus) AddDutyCycle(scope string, result string, nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if fp.dutyCycles == nil {
+		fp.dutyCycles = make(map[string]int)
+	}
+	fp.dutyCycles[scope+"/"+result] += nb
+}
+func (fp *fakePrometheus) AddLoadSkippedArrival(nb int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.loadSkippedArrivals += nb
+}
+
+func TestNewGatewayRegion(t *testing.T) {
+	gateway := NewGateway(2, model.Init{
+		Region: model.Region{Name: "US915", SubBands: []int{1}, DataRates: []int{4}},
+	})
+
+	if gateway.Region.Name != "US915" {
+		t.Fatal("Gateway must use the region of the scenario")
+	}
+	for _, node := range gateway.Nodes {
+		if node.DataRate != 4 {
+			t.Fatal("Node data rate must be one of the scenario data rates")
+		}
+		nbEnabled := 0
+		for _, channel := range node.Channels {
+			if channel.Enabled {
+				nbEnabled++
+			}
+		}
+		if nbEnabled != 9 {
+			t.Fatalf("Only the 9 channels of the sub-band must be enabled, got %d", nbEnabled)
+		}
+	}
+}
 
 func TestIsGatewayScenarioCompleted(t *testing.T) {
 
@@ -128,6 +239,25 @@ func TestIsGatewayScenarioCompleted(t *testing.T) {
 	}
 }
 
+func TestHasEnded(t *testing.T) {
+	confirmedRatio := 0.0
+	gateway := NewGateway(2, model.Init{NbScenarioReplayLaps: 1, Payloads: []model.Payload{{Value: "01"}}, ConfirmedRatio: &confirmedRatio})
+	if gateway.HasEnded() {
+		t.Fatal("Gateway must not end before its nodes have sent their laps")
+	}
+	gateway.nextUplinks(&fakePrometheus{})
+	if !gateway.HasEnded() || !gateway.AllLapsCompleted {
+		t.Fatal("Gateway must end once each node has sent its laps")
+	}
+	gateway.nextUplinks(&fakePrometheus{})
+	if gateway.nbEndedNodes != 2 {
+		t.Fatal("Each node must be counted once")
+	}
+	if (&LorhammerGateway{}).HasEnded() {
+		t.Fatal("Gateway without max laps must never end")
+	}
+}
+
 func TestConvertToGateway(t *testing.T) {
 	gateway := &LorhammerGateway{
 		Nodes: []*model.Node{
@@ -273,13 +403,13 @@ func TestSendJoinRequestPackets(t *testing.T) {
 		Nodes: []*model.Node{
 			{
 				PayloadsReplayLap: 0,
-				AppEUI:            tools.Random8Bytes(),
+				JoinEUI:           tools.Random8Bytes(),
 				DevEUI:            tools.Random8Bytes(),
 			},
 		},
 	}
 
-	gateway.sendJoinRequestPackets(fakeConnect)
+	gateway.sendJoinRequestPackets(fakeConnect, &fakePrometheus{})
 
 	if !fakeConnect.(*fakeConn).writed {
 		t.Fatal("No data writed")
@@ -290,7 +420,7 @@ func TestSendJoinRequestPacketsNoNode(t *testing.T) {
 	var fakeConnect net.Conn = &fakeConn{}
 	gateway := &LorhammerGateway{}
 
-	gateway.sendJoinRequestPackets(fakeConnect)
+	gateway.sendJoinRequestPackets(fakeConnect, &fakePrometheus{})
 
 	if fakeConnect.(*fakeConn).writed {
 		t.Fatal("Data writed")
@@ -303,7 +433,7 @@ func TestSendPushPacketNoNode(t *testing.T) {
 		PayloadsReplayMaxLaps: 1,
 	}
 
-	gateway.sendPushPackets(fakeConnect, 10)
+	gateway.sendPushPackets(fakeConnect, &fakePrometheus{})
 
 	if fakeConnect.(*fakeConn).writed {
 		t.Fatal("Data writed")
@@ -318,7 +448,7 @@ func TestSendPushPacket(t *testing.T) {
 	gateway := &LorhammerGateway{
 		Nodes: []*model.Node{
 			{
-				AppEUI:  tools.Random8Bytes(),
+				JoinEUI: tools.Random8Bytes(),
 				DevEUI:  tools.Random8Bytes(),
 				DevAddr: getDevAddrFromDevEUI(tools.Random8Bytes()),
 				NwSKey:  getGenericAES128Key(),
@@ -326,7 +456,7 @@ func TestSendPushPacket(t *testing.T) {
 		},
 	}
 
-	gateway.sendPushPackets(fakeConnect, 10)
+	gateway.sendPushPackets(fakeConnect, &fakePrometheus{})
 
 	if !fakeConnect.(*fakeConn).writed {
 		t.Fatal("Data not writed")
@@ -336,13 +466,156 @@ func TestSendPushPacket(t *testing.T) {
 	}
 }
 
+func TestSendPushPacketNodeNotJoined(t *testing.T) {
+	var fakeConnect net.Conn = &fakeConn{}
+	gateway := &LorhammerGateway{
+		WithJoin: true,
+		Nodes: []*model.Node{
+			{
+				JoinEUI: tools.Random8Bytes(),
+				DevEUI:  tools.Random8Bytes(),
+				DevAddr: getDevAddrFromDevEUI(tools.Random8Bytes()),
+				NwSKey:  getGenericAES128Key(),
+			},
+		},
+	}
+
+	gateway.sendPushPackets(fakeConnect, &fakePrometheus{})
+
+	if fakeConnect.(*fakeConn).writed {
+		t.Fatal("Data writed before JoinAccept")
+	}
+}
+
+func TestHandleDownlinkJoinAccept(t *testing.T) {
+	otherKey := lorawan.AES128Key{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	gateway := &LorhammerGateway{
+		WithJoin: true,
+		Nodes: []*model.Node{
+			{DevEUI: tools.Random8Bytes(), AppKey: getGenericAES128Key()},
+			{DevEUI: tools.Random8Bytes(), AppKey: otherKey},
+		},
+	}
+	for _, node := range gateway.Nodes {
+		getJoinRequestDataPayload(node)
+	}
+
+	devAddr := lorawan.DevAddr{1, 2, 3, 4}
+	pullResp, err := loraserver_structs.PullRespPacket{
+		ProtocolVersion: loraserver_structs.ProtocolVersion2,
+		Payload: loraserver_structs.PullRespPayload{
+			TXPK: loraserver_structs.TXPK{
+				Data: base64.StdEncoding.EncodeToString(newJoinAccept(t, otherKey, devAddr)),
+			},
+		},
+	}.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal pull resp")
+	}
+
+	gateway.handleDownlink(pullResp, &fakePrometheus{})
+
+	if gateway.Nodes[0].JoinedNetwork {
+		t.Fatal("JoinAccept encrypted with another AppKey must not be given to the first node")
+	}
+	if !gateway.Nodes[1].JoinedNetwork || gateway.Nodes[1].DevAddr != devAddr {
+		t.Fatal("JoinAccept must be given to the node which can decrypt it")
+	}
+}
+
+func TestHandleDownlinkJoinAcceptByTmst(t *testing.T) {
+	gateway := &LorhammerGateway{
+		WithJoin: true,
+		Nodes: []*model.Node{
+			{DevEUI: tools.Random8Bytes(), AppKey: getGenericAES128Key()},
+			{DevEUI: tools.Random8Bytes(), AppKey: getGenericAES128Key()},
+		},
+	}
+	for i, node := range gateway.Nodes {
+		getJoinRequestDataPayload(node)
+		gateway.setLastUplink(node, uplinkReception{tmst: uint32(1000000 + i*500000)})
+	}
+
+	// the JoinAccept of the second node in RX1 arrives before the JoinAccept of the first node in RX2
+	devAddrs := []lorawan.DevAddr{{1, 2, 3, 4}, {5, 6, 7, 8}}
+	for _, i := range []int{1, 0} {
+		tmst := uint32(6500000 + (1-i)*500000)
+		pullResp, err := loraserver_structs.PullRespPacket{
+			ProtocolVersion: loraserver_structs.ProtocolVersion2,
+			Payload: loraserver_structs.PullRespPayload{
+				TXPK: loraserver_structs.TXPK{
+					Tmst: &tmst,
+					Data: base64.StdEncoding.EncodeToString(newJoinAccept(t, getGenericAES128Key(), devAddrs[i])),
+				},
+			},
+		}.MarshalBinary()
+		if err != nil {
+			t.Fatal("Couldn't marshal pull resp")
+		}
+		gateway.handleDownlink(pullResp, &fakePrometheus{})
+	}
+
+	for i, node := range gateway.Nodes {
+		if !node.JoinedNetwork || node.DevAddr != devAddrs[i] {
+			t.Fatal("JoinAccept must be given to the node whose JoinRequest it answers in its RX1 or RX2 window")
+		}
+	}
+}
+
+func TestSendPushPacketRetransmission(t *testing.T) {
+	var fakeConnect net.Conn = &fakeConn{}
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	node.Retransmit = true
+	gateway := &LorhammerGateway{Nodes: []*model.Node{node}}
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.sendPushPackets(fakeConnect, fakePrometheus)
+	gateway.sendPushPackets(fakeConnect, fakePrometheus)
+
+	if fakePrometheus.nbConfirmedUplink != 1 || fakePrometheus.nbRetransmission != 1 {
+		t.Fatalf("Confirmed uplink without ACK must be retransmitted, got %d confirmed and %d retransmissions", fakePrometheus.nbConfirmedUplink, fakePrometheus.nbRetransmission)
+	}
+}
+
+func TestHandleDownlinkAck(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	gateway := &LorhammerGateway{Nodes: []*model.Node{node}}
+	if _, _, err := GetPushDataPayload(node, eu868); err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+
+	phyPayload := newDataDown(t, node, lorawan.UnconfirmedDataDown, true)
+	phyPayloadBytes, err := phyPayload.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal downlink")
+	}
+	pullResp, err := loraserver_structs.PullRespPacket{
+		ProtocolVersion: loraserver_structs.ProtocolVersion2,
+		Payload: loraserver_structs.PullRespPayload{
+			TXPK: loraserver_structs.TXPK{
+				Data: base64.StdEncoding.EncodeToString(phyPayloadBytes),
+			},
+		},
+	}.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal pull resp")
+	}
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.handleDownlink(pullResp, fakePrometheus)
+
+	if node.PendingUplink != nil || fakePrometheus.nbUplinkAck != 1 {
+		t.Fatal("Downlink with ACK bit must acknowledge the pending confirmed uplink")
+	}
+}
+
 func TestSendPushPacketEmptyNode(t *testing.T) {
 	var fakeConnect net.Conn = &fakeConn{}
 	gateway := &LorhammerGateway{
 		Nodes: []*model.Node{},
 	}
 
-	gateway.sendPushPackets(fakeConnect, 10)
+	gateway.sendPushPackets(fakeConnect, &fakePrometheus{})
 
 	if fakeConnect.(*fakeConn).writed {
 		t.Fatal("Data writed")
@@ -364,7 +637,7 @@ func TestReadLoraPacketsNoPacket(t *testing.T) {
 		endPullRespTimerFlag = true
 	}
 
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, &fakePrometheus{})
 
 	if nbReceivedAckMsg > 0 || nbReceivedPullRespMsg > 0 {
 		t.Fatal("Received messages different from 0")
@@ -400,7 +673,7 @@ func TestReadLoraPacketsPushAcks(t *testing.T) {
 	}
 
 	threadListenUDP <- []byte{2, 165, 210, 1}
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, &fakePrometheus{})
 
 	if nbReceivedAckMsg != 1 || nbReceivedPullRespMsg != 0 {
 		t.Fatal("Wrong number of received messages")
@@ -436,7 +709,7 @@ func TestReadLoraPacketsWrongPacket(t *testing.T) {
 	}
 
 	threadListenUDP <- []byte{0, 0}
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(nil, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, &fakePrometheus{})
 
 	if nbReceivedAckMsg != 0 || nbReceivedPullRespMsg != 0 {
 		t.Fatal("Wrong number of received messages")
@@ -473,7 +746,7 @@ func TestReadLoraPacketsPullResp(t *testing.T) {
 	}
 
 	threadListenUDP <- []byte{2, 0, 0, 3, 123, 34, 116, 120, 112, 107, 34, 58, 123, 34, 105, 109, 109, 101, 34, 58, 102, 97, 108, 115, 101, 44, 34, 116, 109, 115, 116, 34, 58, 49, 49, 50, 51, 52, 53, 54, 44, 34, 102, 114, 101, 113, 34, 58, 56, 54, 54, 46, 51, 52, 57, 56, 49, 50, 44, 34, 114, 102, 99, 104, 34, 58, 48, 44, 34, 112, 111, 119, 101, 34, 58, 49, 52, 44, 34, 109, 111, 100, 117, 34, 58, 34, 76, 79, 82, 65, 34, 44, 34, 100, 97, 116, 114, 34, 58, 34, 83, 70, 55, 66, 87, 49, 50, 53, 34, 44, 34, 99, 111, 100, 114, 34, 58, 34, 52, 47, 54, 34, 44, 34, 105, 112, 111, 108, 34, 58, 116, 114, 117, 101, 44, 34, 115, 105, 122, 101, 34, 58, 49, 50, 44, 34, 100, 97, 116, 97, 34, 58, 34, 89, 76, 72, 107, 89, 86, 48, 103, 65, 65, 67, 100, 103, 55, 118, 122, 34, 125, 125}
-	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(fakeConn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer)
+	nbReceivedAckMsg, nbReceivedPullRespMsg := gateway.readLoraPackets(fakeConn, poison, next, threadListenUDP, endPushAckTimer, endPullRespTimer, &fakePrometheus{})
 
 	if nbReceivedAckMsg != 0 || nbReceivedPullRespMsg != 1 {
 		t.Fatal("Wrong number of received messages")
@@ -732,3 +1005,23 @@ func TestReadLoraJoinPacketsPullRespWithJoin(t *testing.T) {
 	close(next)
 	close(threadListenUDP)
 }
+
+func TestSendPushPacketDataRateMetric(t *testing.T) {
+	var fakeConnect net.Conn = &fakeConn{}
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	node.DataRate = 5
+	gateway := &LorhammerGateway{
+		Nodes: []*model.Node{node},
+		Radio: &model.Radio{PathLoss: &model.PathLoss{Distance: [2]float64{20000, 20000}}},
+	}
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.sendPushPackets(fakeConnect, fakePrometheus)
+
+	if node.DataRate == 5 {
+		t.Fatal("Node far from the gateway must use a lower data rate")
+	}
+	if fakePrometheus.nodesDataRate[5] != -1 || fakePrometheus.nodesDataRate[node.DataRate] != 1 {
+		t.Fatalf("Node must be moved in the data rate distribution, got %v", fakePrometheus.nodesDataRate)
+	}
+}
@@ -0,0 +1,208 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"math"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//arrival models of the load profile
+const (
+	constantArrival = "constant"
+	poissonArrival  = "poisson"
+)
+
+//loadProfile is the parsed load profile of the scenario
+type loadProfile struct {
+	stages  []loadStage
+	poisson bool
+}
+
+type loadStage struct {
+	duration time.Duration
+	from     float64
+	to       float64
+}
+
+//scheduledNode is a node with the gateway forwarding its uplinks
+type scheduledNode struct {
+	gateway *LorhammerGateway
+	node    *model.Node
+}
+
+//CheckLoadProfile return an error if the load profile of the scenario is not valid or used with a node schedule
+func CheckLoadProfile(profile *model.LoadProfile, schedule *model.NodeSchedule) error {
+	if profile == nil {
+		return nil
+	}
+	if schedule != nil {
+		return errors.New("loadProfile and nodeSchedule can't be used together")
+	}
+	_, err := parseLoadProfile(profile)
+	return err
+}
+
+func parseLoadProfile(profile *model.LoadProfile) (loadProfile, error) {
+	parsed := loadProfile{}
+	switch profile.Arrival {
+	case "", constantArrival:
+	case poissonArrival:
+		parsed.poisson = true
+	default:
+		return parsed, errors.New("loadProfile arrival must be constant or poisson")
+	}
+	if len(profile.Stages) == 0 {
+		return parsed, errors.New("loadProfile must have at least one stage")
+	}
+	previous := 0.0
+	for _, stage := range profile.Stages {
+		duration, err := time.ParseDuration(stage.Duration)
+		if err != nil || duration < 0 {
+			return parsed, errors.New("loadProfile stage duration must be a positive duration")
+		}
+		from := previous
+		if stage.From != nil {
+			from = *stage.From
+		}
+		if from < 0 || stage.To < 0 {
+			return parsed, errors.New("loadProfile stage rates must be positive")
+		}
+		parsed.stages = append(parsed.stages, loadStage{duration: duration, from: from, to: stage.To})
+		previous = stage.To
+	}
+	return parsed, nil
+}
+
+//rate return the target uplinks per second after elapsed time, linear during each stage
+func (profile loadProfile) rate(elapsed time.Duration) float64 {
+	for _, stage := range profile.stages {
+		if elapsed < stage.duration {
+			return stage.from + (stage.to-stage.from)*float64(elapsed)/float64(stage.duration)
+		}
+		elapsed -= stage.duration
+	}
+	return profile.stages[len(profile.stages)-1].to
+}
+
+//arrivalTime return the elapsed time when the count of uplinks sent at the rate of the load profile, its integral, reaches count
+//it return false if the rate at the end of the last stage is 0 and count is never reached
+func (profile loadProfile) arrivalTime(count float64) (time.Duration, bool) {
+	var elapsed time.Duration
+	if count <= 0 {
+		return elapsed, true
+	}
+	for _, stage := range profile.stages {
+		duration := stage.duration.Seconds()
+		if stageCount := (stage.from + stage.to) / 2 * duration; count > stageCount {
+			count -= stageCount
+			elapsed += stage.duration
+			continue
+		}
+		// count = from*t + slope/2*t², the stable root of the quadratic also works with a constant rate or from 0
+		halfSlope := (stage.to - stage.from) / duration / 2
+		t := 2 * count / (stage.from + math.Sqrt(math.Max(0, stage.from*stage.from+4*halfSlope*count)))
+		return elapsed + time.Duration(t*float64(time.Second)), true
+	}
+	last := profile.stages[len(profile.stages)-1].to
+	if seconds := count / last; last > 0 && seconds < float64(math.MaxInt64-elapsed)/float64(time.Second) {
+		return elapsed + time.Duration(seconds*float64(time.Second)), true
+	}
+	return 0, false
+}
+
+//nextCount return the count of uplinks of the load profile when the next one is sent, the count of the previous one plus 1,
+//or plus an exponentially distributed increment for poisson arrivals, the rate of the arrivals following the rate of the profile
+func (profile loadProfile) nextCount(count float64) float64 {
+	if profile.poisson {
+		return count + tools.RandomExpFloat64()
+	}
+	return count + 1
+}
+
+//LoadLoop make the nodes of the gateways send in turn at the rate of the load profile until the context is done
+//each gateway forwards the frames of its nodes as they are emitted, nodes not joined yet send their JoinRequest
+//the uplink times come from the count of uplinks of the profile since the start, so a rate starting at 0 doesn't delay the next ones
+func LoadLoop(ctx context.Context, gateways []*LorhammerGateway, config *model.LoadProfile, prometheus metrics.Prometheus) {
+	// load profile is checked when the scenario is created
+	profile, _ := parseLoadProfile(config)
+	emitted := make(map[*LorhammerGateway]chan loraserver_structs.RXPK)
+	for _, gateway := range gateways {
+		// a turn of uplinks of its nodes waits for a gateway slow to forward without delaying the other gateways
+		emitted[gateway] = make(chan loraserver_structs.RXPK, len(gateway.Nodes))
+		go gateway.forwardLoop(ctx, emitted[gateway], prometheus)
+	}
+	turn := &loadTurn{nodes: interleaveNodes(gateways)}
+
+	start := time.Now()
+	count := 0.0
+	for len(turn.nodes) > 0 {
+		count = profile.nextCount(count)
+		elapsed, ok := profile.arrivalTime(count)
+		if !ok {
+			return
+		}
+		if wait := time.Until(start.Add(elapsed)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		gateway, rxpk, ok := turn.nextUplink(prometheus)
+		if !ok {
+			if len(turn.nodes) > 0 {
+				loggerGateway.Debug("Load profile arrival skipped, its node can't emit")
+				prometheus.AddLoadSkippedArrival(1)
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case emitted[gateway] <- rxpk:
+		}
+	}
+}
+
+//loadTurn is the turn of the nodes sending the uplinks of the load profile, the nodes which have sent all their laps leave it
+type loadTurn struct {
+	nodes []scheduledNode
+	next  int
+}
+
+//nextUplink return the uplink of the next node with its gateway, a node which has ended leaves its arrival to the next one
+//it return false if the node can't emit now, its duty-cycle is enforced, or if all the nodes have ended
+func (turn *loadTurn) nextUplink(prometheus metrics.Prometheus) (*LorhammerGateway, loraserver_structs.RXPK, bool) {
+	for len(turn.nodes) > 0 {
+		turn.next %= len(turn.nodes)
+		scheduled := turn.nodes[turn.next]
+		rxpk, ok := scheduled.gateway.nextScheduledUplink(scheduled.node, prometheus)
+		if ok || !scheduled.gateway.lockedHasNodeEnded(scheduled.node) {
+			turn.next++
+			return scheduled.gateway, rxpk, ok
+		}
+		turn.nodes = append(turn.nodes[:turn.next], turn.nodes[turn.next+1:]...)
+	}
+	return nil, loraserver_structs.RXPK{}, false
+}
+
+//interleaveNodes return the nodes of the gateways in turn, so consecutive uplinks are forwarded by different gateways
+func interleaveNodes(gateways []*LorhammerGateway) []scheduledNode {
+	var nodes []scheduledNode
+	for i, added := 0, true; added; i++ {
+		added = false
+		for _, gateway := range gateways {
+			if i < len(gateway.Nodes) {
+				nodes = append(nodes, scheduledNode{gateway: gateway, node: gateway.Nodes[i]})
+				added = true
+			}
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,207 @@
+package lora
+
+import (
+	"context"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+func loadRate(value float64) *float64 {
+	return &value
+}
+
+func TestCheckLoadProfile(t *testing.T) {
+	valid := &model.LoadProfile{Stages: []model.LoadStage{{Duration: "30m", From: loadRate(100), To: 10000}, {Duration: "10m", To: 10000}}, Arrival: "poisson"}
+	if CheckLoadProfile(nil, nil) != nil || CheckLoadProfile(valid, nil) != nil {
+		t.Fatal("Valid load profile must not return an error")
+	}
+	if CheckLoadProfile(valid, &model.NodeSchedule{Interval: [2]string{"30s", "60s"}}) == nil {
+		t.Fatal("Error expected on load profile with a node schedule")
+	}
+	if CheckLoadProfile(&model.LoadProfile{}, nil) == nil || CheckLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "a", To: 10}}}, nil) == nil {
+		t.Fatal("Error expected on missing stage or wrong duration")
+	}
+	if CheckLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "1m", From: loadRate(-1), To: 10}}}, nil) == nil {
+		t.Fatal("Error expected on negative rate")
+	}
+	if CheckLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "1m", To: 10}}, Arrival: "burst"}, nil) == nil {
+		t.Fatal("Error expected on unknown arrival")
+	}
+}
+
+func TestLoadProfileRate(t *testing.T) {
+	profile, _ := parseLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{
+		{Duration: "10s", To: 100},
+		{Duration: "10s", From: loadRate(500), To: 500},
+		{Duration: "1s", From: loadRate(50), To: 50},
+	}})
+	if profile.rate(0) != 0 || profile.rate(5*time.Second) != 50 {
+		t.Fatal("Rate must ramp linearly from 0 during the first stage")
+	}
+	if profile.rate(15*time.Second) != 500 {
+		t.Fatal("Rate must step to the from of the next stage")
+	}
+	if profile.rate(20*time.Second) != 50 || profile.rate(time.Hour) != 50 {
+		t.Fatal("Rate must keep the last rate after the last stage")
+	}
+}
+
+func TestLoadProfileArrivalTime(t *testing.T) {
+	profile, _ := parseLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{
+		{Duration: "30m", To: 100},
+		{Duration: "10s", From: loadRate(500), To: 500},
+	}})
+	if elapsed, ok := profile.arrivalTime(1); !ok || elapsed < 5999*time.Millisecond || elapsed > 6001*time.Millisecond {
+		t.Fatalf("First uplink of a ramp from 0 must be sent when the count of the ramp reaches 1, got %s", elapsed)
+	}
+	if elapsed, _ := profile.arrivalTime(90000); elapsed < 30*time.Minute-time.Millisecond || elapsed > 30*time.Minute+time.Millisecond {
+		t.Fatalf("Ramp must send the mean of its rates during its duration, got %s", elapsed)
+	}
+	if elapsed, _ := profile.arrivalTime(90000 + 500); elapsed < 30*time.Minute+999*time.Millisecond || elapsed > 30*time.Minute+1001*time.Millisecond {
+		t.Fatalf("Step must send at its rate, got %s", elapsed)
+	}
+	if elapsed, _ := profile.arrivalTime(90000 + 5000 + 1000); elapsed < 30*time.Minute+12*time.Second-time.Millisecond || elapsed > 30*time.Minute+12*time.Second+time.Millisecond {
+		t.Fatalf("Rate at the end of the last stage must be kept, got %s", elapsed)
+	}
+
+	down, _ := parseLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "10s", From: loadRate(10), To: 0}}})
+	if elapsed, ok := down.arrivalTime(50); !ok || elapsed < 10*time.Second-time.Millisecond || elapsed > 10*time.Second {
+		t.Fatalf("Ramp down must send its last uplink at its end, got %s", elapsed)
+	}
+	if _, ok := down.arrivalTime(51); ok {
+		t.Fatal("No uplink must be sent after a last stage ending at 0")
+	}
+}
+
+func TestLoadProfileNextCount(t *testing.T) {
+	constant, _ := parseLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", To: 10}}})
+	if constant.nextCount(2) != 3 {
+		t.Fatal("Constant arrival must send an uplink each time the count of the profile increases by 1")
+	}
+	poisson, _ := parseLoadProfile(&model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", To: 10}}, Arrival: "poisson"})
+	count := 0.0
+	for i := 0; i < 10000; i++ {
+		count = poisson.nextCount(count)
+	}
+	if mean := count / 10000; mean < 0.9 || mean > 1.1 {
+		t.Fatalf("Poisson arrival must increase the count by 1 in average, got %f", mean)
+	}
+}
+
+func TestInterleaveNodes(t *testing.T) {
+	first := &LorhammerGateway{Nodes: []*model.Node{{}, {}}}
+	second := &LorhammerGateway{Nodes: []*model.Node{{}}}
+	nodes := interleaveNodes([]*LorhammerGateway{first, second})
+	if len(nodes) != 3 || nodes[0].gateway != first || nodes[1].gateway != second || nodes[2].node != first.Nodes[1] {
+		t.Fatal("Nodes of the gateways must send in turn")
+	}
+}
+
+func TestLoadLoop(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(3, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73"})
+	defer gateway.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go LoadLoop(ctx, []*LorhammerGateway{gateway}, &model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", From: loadRate(100), To: 100}}}, &fakePrometheus{})
+
+	buf := make([]byte, 65507)
+	for nbUplinks := 0; nbUplinks < 9; nbUplinks++ {
+		n, err := ns.Read(buf)
+		if err != nil {
+			t.Fatalf("Nodes must send at the rate of the load profile, got %d uplinks", nbUplinks)
+		}
+		var pushData loraserver_structs.PushDataPacket
+		if err := pushData.UnmarshalBinary(buf[:n]); err != nil || len(pushData.Payload.RXPK) != 1 {
+			t.Fatal("Each uplink must be forwarded in its own PUSH_DATA without batch window")
+		}
+	}
+}
+
+func TestLoadLoopRampFromZero(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(3, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73"})
+	defer gateway.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the count of the ramp is 50*t², the 9 first uplinks are sent in 425ms
+	go LoadLoop(ctx, []*LorhammerGateway{gateway}, &model.LoadProfile{Stages: []model.LoadStage{{Duration: "10m", To: 60000}}}, &fakePrometheus{})
+
+	buf := make([]byte, 65507)
+	for nbUplinks := 0; nbUplinks < 9; {
+		n, err := ns.Read(buf)
+		if err != nil {
+			t.Fatalf("Nodes must follow a ramp starting at 0, got %d uplinks", nbUplinks)
+		}
+		var pushData loraserver_structs.PushDataPacket
+		if pushData.UnmarshalBinary(buf[:n]) == nil {
+			nbUplinks += len(pushData.Payload.RXPK)
+		}
+	}
+}
+
+func TestLoadLoopEndedNodes(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(3, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73", NbScenarioReplayLaps: 1})
+	defer gateway.Close()
+	// the 2 first nodes have sent their lap, the last one has no payloads so it never ends
+	gateway.Nodes[0].PayloadsReplayLap = 1
+	gateway.Nodes[1].PayloadsReplayLap = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// at 20 uplinks/s the 9 first ones are sent in 450ms, 1350ms if the ended nodes kept their arrivals
+	go LoadLoop(ctx, []*LorhammerGateway{gateway}, &model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", From: loadRate(20), To: 20}}}, &fakePrometheus{})
+
+	buf := make([]byte, 65507)
+	for nbUplinks := 0; nbUplinks < 9; nbUplinks++ {
+		if _, err := ns.Read(buf); err != nil {
+			t.Fatalf("The live node must take the arrivals of the ended nodes, got %d uplinks", nbUplinks)
+		}
+	}
+}
+
+func TestLoadTurnSkippedArrival(t *testing.T) {
+	gateway := NewGateway(1, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", DutyCycle: &model.DutyCycle{Enforce: true}})
+	prometheus := &fakePrometheus{}
+	turn := &loadTurn{nodes: interleaveNodes([]*LorhammerGateway{gateway})}
+	if _, _, ok := turn.nextUplink(prometheus); !ok {
+		t.Fatal("The first uplink of the node must be emitted")
+	}
+	if _, _, ok := turn.nextUplink(prometheus); ok || len(turn.nodes) != 1 {
+		t.Fatal("A node over its duty-cycle must not emit and must stay in the turn")
+	}
+
+	ended := NewGateway(2, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", NbScenarioReplayLaps: 1})
+	ended.Nodes[0].PayloadsReplayLap = 1
+	turn = &loadTurn{nodes: interleaveNodes([]*LorhammerGateway{ended})}
+	if _, _, ok := turn.nextUplink(prometheus); !ok || len(turn.nodes) != 1 || turn.nodes[0].node != ended.Nodes[1] {
+		t.Fatal("An ended node must leave the turn and its arrival to the next node")
+	}
+	ended.Nodes[1].PayloadsReplayLap = 1
+	if _, _, ok := turn.nextUplink(prometheus); ok || len(turn.nodes) != 0 {
+		t.Fatal("The turn must be empty when all the nodes have ended")
+	}
+}
+
+func TestLoadLoopSkippedArrival(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(1, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73", DutyCycle: &model.DutyCycle{Enforce: true}})
+	defer gateway.Close()
+	prometheus := &fakePrometheus{}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	LoadLoop(ctx, []*LorhammerGateway{gateway}, &model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", From: loadRate(100), To: 100}}}, prometheus)
+
+	prometheus.mutex.Lock()
+	defer prometheus.mutex.Unlock()
+	if prometheus.loadSkippedArrivals == 0 {
+		t.Fatal("Arrivals of a node over its duty-cycle must be counted as skipped")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"lorhammer/src/model"
 	"lorhammer/src/tools"
 	"math"
 	"time"
@@ -17,22 +18,44 @@ type packet struct {
 	Rxpk []loraserver_structs.RXPK `json:"rxpk,omitempty"`
 }
 
-func newRxpk(data []byte, date int64, gateway *LorhammerGateway) loraserver_structs.RXPK {
+func newRxpk(data []byte, date int64, node *model.Node, gateway *LorhammerGateway) (loraserver_structs.RXPK, error) {
+	region := gateway.getRegion()
+	if len(node.Channels) == 0 {
+		// node created without region uses all the channels of the gateway region
+		node.Channels, _ = region.NodeChannels(nil)
+	}
+	rssi, snr := gateway.getRadioMetadata(node)
+	node.LastSnr = snr
+	channel, err := nextChannel(node, gateway.usableChannel(node))
+	if err != nil {
+		return loraserver_structs.RXPK{}, err
+	}
+	if node.LoRaWAN11 {
+		if data, err = setUplinkMIC11(node, data, channel); err != nil {
+			return loraserver_structs.RXPK{}, err
+		}
+	}
+	dataRate := region.DataRates[node.DataRate]
+	receivedAt := time.Now()
 
 	rxpk := loraserver_structs.RXPK{
-		Tmst: 123456,
-		Freq: 866.349812,
-		Chan: 2,
+		Tmst: gateway.tmstAt(receivedAt),
+		Freq: float64(node.Channels[channel].Frequency) / 1000000,
+		Chan: uint8(channel % 8),
 		RFCh: 0,
 		Stat: 1,
-		Modu: "LORA",
-		DatR: loraserver_structs.DatR{LoRa: "SF7BW125"},
-		CodR: "4/6",
-		RSSI: -35,
-		LSNR: 5.1,
+		Modu: dataRate.Modulation(),
+		RSSI: rssi,
+		LSNR: snr,
 		Size: uint16(len(data)),
 		Data: base64.StdEncoding.EncodeToString(data),
 	}
+	if dataRate.IsFSK() {
+		rxpk.DatR = loraserver_structs.DatR{FSK: uint32(dataRate.BitRate)}
+	} else {
+		rxpk.DatR = loraserver_structs.DatR{LoRa: dataRate.String()}
+		rxpk.CodR = region.CodingRate
+	}
 
 	var compactTime loraserver_structs.CompactTime
 	if gateway.RxpkDate > 0 { // The date set to the gateway has the priority to set the RxpkDate
@@ -43,14 +66,23 @@ func newRxpk(data []byte, date int64, gateway *LorhammerGateway) loraserver_stru
 		compactTime = loraserver_structs.CompactTime(time.Now().UTC())
 	}
 	rxpk.Time = &compactTime
-
-	return rxpk
+	gateway.setLastUplink(node, uplinkReception{
+		tmst:       rxpk.Tmst,
+		receivedAt: receivedAt,
+		channel:    channel,
+		frequency:  node.Channels[channel].Frequency,
+		dataRate:   node.DataRate,
+	})
+
+	return rxpk, nil
 }
 
 func (p packet) prepare(gateway *LorhammerGateway) ([]byte, error) {
 
 	//payload
-	payload, err := json.Marshal(p)
+	payload, err := json.Marshal(struct {
+		Rxpk []rxpk `json:"rxpk,omitempty"`
+	}{gateway.withGpsTime(p.Rxpk)})
 	if err != nil {
 		return nil, err
 	}
@@ -98,22 +130,33 @@ func handlePullRespPacket(data []byte) error {
 		"type": "pullResp",
 	}).Info("gateway: received udp packet from NS")
 
+	_, _, err := getPullRespTxpkData(data)
+	return err
+}
+
+//getPullRespTxpkData return the PHYPayload bytes sent by the NS in a PULL_RESP packet and its txpk
+func getPullRespTxpkData(data []byte) ([]byte, txpk, error) {
 	var pullRespPacket loraserver_structs.PullRespPacket
 	err := pullRespPacket.UnmarshalBinary(data)
 	if err != nil {
-		return errors.New("Error marshalling ")
+		return nil, txpk{}, errors.New("Error marshalling ")
+	}
+	// the GPS time is not read by the PULL_RESP packet
+	var payload struct {
+		TXPK txpk `json:"txpk"`
+	}
+	if err := json.Unmarshal(data[4:], &payload); err != nil {
+		return nil, txpk{}, errors.New("Error marshalling ")
 	}
 
-	payloadBytes, err := base64.StdEncoding.DecodeString(pullRespPacket.Payload.TXPK.Data)
+	payloadBytes, err := base64.StdEncoding.DecodeString(payload.TXPK.Data)
 	if err != nil {
-		return errors.New("Can't Decode base64 JoinAccept Data")
+		return nil, txpk{}, errors.New("Can't Decode base64 JoinAccept Data")
 	}
 	if len(payloadBytes) == 0 {
-		return errors.New("Pull Resp TXPK length must not be null")
+		return nil, txpk{}, errors.New("Pull Resp TXPK length must not be null")
 	}
-
-	return nil
-
+	return payloadBytes, payload.TXPK, nil
 }
 
 func handlePushAck(data []byte) error {
@@ -2,6 +2,8 @@ package lora
 
 import (
 	"encoding/base64"
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
 	"lorhammer/src/tools"
 	"testing"
 	"time"
@@ -68,7 +70,10 @@ func TestPacket_Prepare(t *testing.T) {
 		MacAddress: tools.Random8Bytes(),
 	}
 
-	rxpk := newRxpk(data, 0, gw)
+	rxpk, err := newRxpk(data, 0, &model.Node{}, gw)
+	if err != nil {
+		t.Fatal("Couldn't create rxpk")
+	}
 
 	rxpks[0] = rxpk
 
@@ -96,7 +101,10 @@ func TestNewRxpk(t *testing.T) {
 		RxpkDate:   1488931200,
 	}
 
-	rxpk := newRxpk(data, 0, gw)
+	rxpk, err := newRxpk(data, 0, &model.Node{DataRate: 5}, gw)
+	if err != nil {
+		t.Fatal("Couldn't create rxpk")
+	}
 
 	seconds := time.Time(*rxpk.Time).UTC().Unix()
 	if seconds != 1488931200 {
@@ -113,4 +121,36 @@ func TestNewRxpk(t *testing.T) {
 		t.Fatal("Data parameter should represent the base64 encoding of data given")
 	}
 
+	if rxpk.Freq != 868.1 && rxpk.Freq != 868.3 && rxpk.Freq != 868.5 {
+		t.Fatalf("Frequency should be an EU868 default channel when no region is set, found %f", rxpk.Freq)
+	}
+
+	if rxpk.DatR.LoRa != "SF7BW125" || rxpk.CodR != "4/5" {
+		t.Fatal("Data rate should be the node data rate of the region")
+	}
+
+}
+
+func TestNewRxpkRegion(t *testing.T) {
+	us915, _ := region.Get("US915")
+	gw := &LorhammerGateway{
+		NsAddress:  "127.0.0.1",
+		MacAddress: tools.Random8Bytes(),
+		Region:     us915,
+	}
+	channels, _ := us915.NodeChannels([]int{2})
+	node := &model.Node{DataRate: 4, Channels: channels}
+
+	rxpk, err := newRxpk([]byte{2, 165, 210, 1}, 0, node, gw)
+	if err != nil {
+		t.Fatal("Couldn't create rxpk")
+	}
+	if rxpk.Freq != 904.6 || rxpk.DatR.LoRa != "SF8BW500" {
+		t.Fatalf("DR4 node in US915 sub-band 2 must use the 500kHz channel 904.6MHz, found %f %s", rxpk.Freq, rxpk.DatR.LoRa)
+	}
+
+	node.DataRate = 5
+	if _, err := newRxpk([]byte{2, 165, 210, 1}, 0, node, gw); err == nil {
+		t.Fatal("Error expected when no channel allows the node data rate")
+	}
 }
@@ -0,0 +1,399 @@
+package lora
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"math"
+
+	"github.com/brocaar/lorawan"
+	"github.com/jacobsa/crypto/cmac"
+	"github.com/sirupsen/logrus"
+)
+
+//rejoinRequest is the MType of LoRaWAN 1.1 rejoin requests, RFU in LoRaWAN 1.0
+const rejoinRequest lorawan.MType = 0x06
+
+//joinRequestType is the JoinReqType in the MIC of the JoinAccept answering a JoinRequest, rejoin requests use their own type
+const joinRequestType = 0xFF
+
+//key types of the LoRaWAN 1.1 key derivations
+const (
+	fNwkSIntKeyType = 0x01
+	appSKeyType     = 0x02
+	sNwkSIntKeyType = 0x03
+	nwkSEncKeyType  = 0x04
+	jsEncKeyType    = 0x05
+	jsIntKeyType    = 0x06
+)
+
+//lorawan11Minor is the LoRaWAN minor version sent by nodes in ResetInd and RekeyInd
+const lorawan11Minor = 0x01
+
+//CheckLoRaWAN11 return an error if the LoRaWAN 1.1 config of the scenario is not valid
+func CheckLoRaWAN11(config *model.LoRaWAN11) error {
+	if config == nil {
+		return nil
+	}
+	if config.Ratio < 0 || config.Ratio > 1 {
+		return errors.New("lorawan11 ratio must be between 0 and 1")
+	}
+	if config.RejoinType < 0 || config.RejoinType > 2 {
+		return errors.New("lorawan11 rejoinType must be 0, 1 or 2")
+	}
+	if config.RejoinEvery < 0 {
+		return errors.New("lorawan11 rejoinEvery must be positive, or 0 for no periodic rejoin request")
+	}
+	for _, key := range []string{config.SNwkSIntKey, config.NwkSEncKey} {
+		var aesKey lorawan.AES128Key
+		if key != "" && aesKey.UnmarshalText([]byte(key)) != nil {
+			return errors.New("lorawan11 sNwkSIntKey and nwkSEncKey must be 16 bytes hex keys")
+		}
+	}
+	return nil
+}
+
+//setLoRaWAN11 put the first nodes of the gateway in LoRaWAN 1.1, according to the ratio
+func (gateway *LorhammerGateway) setLoRaWAN11(config *model.LoRaWAN11) {
+	if config == nil {
+		return
+	}
+	nbLoRaWAN11 := int(math.Floor(config.Ratio*float64(len(gateway.Nodes)) + 0.5))
+	for _, node := range gateway.Nodes[:nbLoRaWAN11] {
+		setNodeLoRaWAN11(node, config)
+	}
+}
+
+//setNodeLoRaWAN11 put the node in LoRaWAN 1.1 with its own NwkKey and the rejoin requests of the config, if any
+//ABP nodes get the network session keys of the config, the NwSKey if not set
+func setNodeLoRaWAN11(node *model.Node, config *model.LoRaWAN11) {
+	node.LoRaWAN11 = true
+	node.NwkKey = tools.Random16Bytes()
+	if config == nil {
+		return
+	}
+	if config.SNwkSIntKey != "" {
+		node.SNwkSIntKey.UnmarshalText([]byte(config.SNwkSIntKey))
+	}
+	if config.NwkSEncKey != "" {
+		node.NwkSEncKey.UnmarshalText([]byte(config.NwkSEncKey))
+	}
+	node.Rejoin.Type = config.RejoinType
+	node.Rejoin.Every = config.RejoinEvery
+}
+
+//sessionMacRequests return the RekeyInd of a LoRaWAN 1.1 node which has joined, or the ResetInd of an ABP one,
+//sent in each uplink until the network server confirms the session
+func sessionMacRequests(node *model.Node) [][]byte {
+	if !node.LoRaWAN11 || node.SessionConfirmed {
+		return nil
+	}
+	if node.JoinedNetwork {
+		return [][]byte{{byte(rekeyInd), lorawan11Minor}}
+	}
+	return [][]byte{{byte(resetInd), lorawan11Minor}}
+}
+
+//computeMIC return the 4 first bytes of the AES-CMAC of the message parts
+func computeMIC(key lorawan.AES128Key, parts ...[]byte) ([]byte, error) {
+	hash, err := cmac.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		if _, err := hash.Write(part); err != nil {
+			return nil, err
+		}
+	}
+	return hash.Sum(nil)[0:4], nil
+}
+
+//micBlock return the B0 block of the MIC of a data frame, devAddr is little endian as in the frame
+func micBlock(confFCnt uint16, uplink bool, devAddr []byte, fCnt uint32, msgLen int) []byte {
+	b := make([]byte, 16)
+	b[0] = 0x49
+	binary.LittleEndian.PutUint16(b[1:3], confFCnt)
+	if !uplink {
+		b[5] = 0x01
+	}
+	copy(b[6:10], devAddr)
+	binary.LittleEndian.PutUint32(b[10:14], fCnt)
+	b[15] = byte(msgLen)
+	return b
+}
+
+//uplinkFCnt return the 32 bits frame counter of an uplink of the node from the 16 least significant bits sent in the frame
+func uplinkFCnt(node *model.Node, fCnt uint16) uint32 {
+	full := node.FCntUp&^0xFFFF | uint32(fCnt)
+	if full > node.FCntUp && full >= 0x10000 {
+		full -= 0x10000
+	}
+	return full
+}
+
+//setUplinkMIC11 return the data uplink with its LoRaWAN 1.1 MIC, which depends on the data rate and the channel used to send it
+//its 2 first bytes come from the SNwkSIntKey with the ConfFCnt, TxDr and TxCh, the 2 last ones from the FNwkSIntKey
+func setUplinkMIC11(node *model.Node, data []byte, channel int) ([]byte, error) {
+	mType := lorawan.MType(data[0] >> 5)
+	if (mType != lorawan.UnconfirmedDataUp && mType != lorawan.ConfirmedDataUp) || len(data) < 12 {
+		return data, nil
+	}
+	msg := data[:len(data)-4]
+	fCnt := uplinkFCnt(node, binary.LittleEndian.Uint16(data[6:8]))
+	var confFCnt uint16
+	if data[5]&0x20 != 0 {
+		// the ACK bit is set, the confirmed downlink counter is in the MIC
+		confFCnt = uint16(node.ConfFCntDown)
+	}
+	b1 := micBlock(confFCnt, true, data[1:5], fCnt, len(msg))
+	b1[3] = byte(node.DataRate)
+	b1[4] = byte(channel)
+
+	cmacS, err := computeMIC(node.SNwkSIntKey, b1, msg)
+	if err != nil {
+		return nil, err
+	}
+	cmacF, err := computeMIC(node.NwSKey, micBlock(0, true, data[1:5], fCnt, len(msg)), msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, msg...), cmacS[0], cmacS[1], cmacF[0], cmacF[1]), nil
+}
+
+//encryptFOpts encrypt, or decrypt, the FOpts of a LoRaWAN 1.1 data frame with the NwkSEncKey
+//downlinks with an application FPort use the AFCntDown, the other ones the NFCntDown
+func encryptFOpts(key lorawan.AES128Key, uplink bool, aFCntDown bool, devAddr []byte, fCnt uint32, fOpts []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	a := make([]byte, 16)
+	a[0] = 0x01
+	if !uplink {
+		a[4] = 0x01
+		if aFCntDown {
+			a[4] = 0x02
+		}
+		a[5] = 0x01
+	}
+	copy(a[6:10], devAddr)
+	binary.LittleEndian.PutUint32(a[10:14], fCnt)
+	a[15] = 0x01
+	s := make([]byte, 16)
+	block.Encrypt(s, a)
+
+	encrypted := make([]byte, len(fOpts))
+	for i := range fOpts {
+		encrypted[i] = fOpts[i] ^ s[i]
+	}
+	return encrypted, nil
+}
+
+//encryptUplinkFOpts encrypt the FOpts of the marshalled data uplink of a LoRaWAN 1.1 node
+func encryptUplinkFOpts(node *model.Node, data []byte) error {
+	fOptsEnd := 8 + int(data[5]&0x0f)
+	fCnt := uplinkFCnt(node, binary.LittleEndian.Uint16(data[6:8]))
+	fOpts, err := encryptFOpts(node.NwkSEncKey, true, false, data[1:5], fCnt, data[8:fOptsEnd])
+	if err != nil {
+		return err
+	}
+	copy(data[8:fOptsEnd], fOpts)
+	return nil
+}
+
+//decodeDataDown unmarshal the data downlink if its MIC is valid with the network session keys of the node
+//LoRaWAN 1.1 FOpts are encrypted, they are removed from the frame before it is unmarshalled and added back decrypted
+func decodeDataDown(node *model.Node, data []byte) (lorawan.PHYPayload, bool) {
+	phyPayload := lorawan.PHYPayload{}
+	if !node.LoRaWAN11 {
+		if err := phyPayload.UnmarshalBinary(data); err != nil {
+			return phyPayload, false
+		}
+		ok, err := phyPayload.ValidateMIC(node.NwSKey)
+		return phyPayload, err == nil && ok
+	}
+
+	fOptsEnd := 8 + int(data[5]&0x0f)
+	if fOptsEnd+4 > len(data) || !isValidDownlinkMIC11(node, data) {
+		return phyPayload, false
+	}
+	fCnt := uint32(binary.LittleEndian.Uint16(data[6:8]))
+	aFCntDown := fOptsEnd+4 < len(data) && data[fOptsEnd] != 0
+	fOpts, err := encryptFOpts(node.NwkSEncKey, false, aFCntDown, data[1:5], fCnt, data[8:fOptsEnd])
+	if err != nil {
+		return phyPayload, false
+	}
+	withoutFOpts := append(append([]byte{}, data[:8]...), data[fOptsEnd:]...)
+	withoutFOpts[5] &^= 0x0f
+	if err := phyPayload.UnmarshalBinary(withoutFOpts); err != nil {
+		return phyPayload, false
+	}
+	macPayload, ok := phyPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return phyPayload, false
+	}
+	for _, command := range parseMacCommands(fOpts) {
+		payload := rawMACCommandPayload(command.payload)
+		macPayload.FHDR.FOpts = append(macPayload.FHDR.FOpts, lorawan.MACCommand{CID: command.cid, Payload: &payload})
+	}
+	return phyPayload, true
+}
+
+//isValidDownlinkMIC11 return true if the LoRaWAN 1.1 MIC of the data downlink is valid with the SNwkSIntKey
+//if the ACK bit is set, the counter of the confirmed uplink waiting for an ACK is in the MIC
+func isValidDownlinkMIC11(node *model.Node, data []byte) bool {
+	msg := data[:len(data)-4]
+	var confFCnt uint16
+	if data[5]&0x20 != 0 && len(node.PendingUplink) >= 8 {
+		confFCnt = binary.LittleEndian.Uint16(node.PendingUplink[6:8])
+	}
+	mic, err := computeMIC(node.SNwkSIntKey, micBlock(confFCnt, false, data[1:5], uint32(binary.LittleEndian.Uint16(data[6:8])), len(msg)), msg)
+	return err == nil && bytes.Equal(mic, data[len(data)-4:])
+}
+
+//decryptJoinAccept return the JoinAccept with its payload and its MIC decrypted
+func decryptJoinAccept(key lorawan.AES128Key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	decrypted := append([]byte{}, data...)
+	// the network server encrypts with aes128_decrypt
+	for i := 1; i+aes.BlockSize <= len(data); i += aes.BlockSize {
+		block.Encrypt(decrypted[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+	}
+	return decrypted, nil
+}
+
+//handleJoinAccept11 decrypt the JoinAccept answering the JoinRequest with the NwkKey, or the pending rejoin request with the JSEncKey,
+//and derive the LoRaWAN 1.1 session keys if the MIC is valid. It return false if the JoinAccept is not for this node
+//it return an error if the network server answers as a LoRaWAN 1.0 one, without the OptNeg bit
+func handleJoinAccept11(node *model.Node, data []byte) (bool, error) {
+	if len(data) != 17 && len(data) != 33 {
+		return false, errors.New("JoinAccept must be 17 or 33 bytes long")
+	}
+	joinReqType, devNonce, key := byte(joinRequestType), node.DevNonce, node.NwkKey
+	if node.Rejoin.Pending {
+		jsEncKey, err := deriveKey(node.NwkKey, jsEncKeyType, node.DevEUI[:])
+		if err != nil {
+			return false, err
+		}
+		joinReqType, key = byte(node.Rejoin.PendingType), jsEncKey
+		binary.BigEndian.PutUint16(devNonce[:], node.Rejoin.PendingCount)
+	}
+	decrypted, err := decryptJoinAccept(key, data)
+	if err != nil {
+		return false, err
+	}
+
+	// MHDR | JoinNonce | NetID | DevAddr | DLSettings | RxDelay | CFList | MIC
+	optNeg := decrypted[11]&0x80 != 0
+	msg := decrypted[:len(decrypted)-4]
+	micKey := node.NwkKey
+	if optNeg {
+		if micKey, err = deriveKey(node.NwkKey, jsIntKeyType, node.DevEUI[:]); err != nil {
+			return false, err
+		}
+		msg = append(append(append([]byte{joinReqType}, reverse(node.JoinEUI[:])...), devNonce[1], devNonce[0]), msg...)
+	}
+	mic, err := computeMIC(micKey, msg)
+	if err != nil || !bytes.Equal(mic, decrypted[len(decrypted)-4:]) {
+		return false, err
+	}
+	if !optNeg {
+		return false, errors.New("JoinAccept without OptNeg, the network server must support LoRaWAN 1.1")
+	}
+
+	var joinNonce [3]byte
+	copy(joinNonce[:], reverse(decrypted[1:4]))
+	copy(node.NetID[:], reverse(decrypted[4:7]))
+	if err := node.DevAddr.UnmarshalBinary(decrypted[7:11]); err != nil {
+		return false, err
+	}
+	for keyType, sessionKey := range map[byte]*lorawan.AES128Key{
+		fNwkSIntKeyType: &node.NwSKey,
+		sNwkSIntKeyType: &node.SNwkSIntKey,
+		nwkSEncKeyType:  &node.NwkSEncKey,
+		appSKeyType:     &node.AppSKey,
+	} {
+		rootKey := node.NwkKey
+		if keyType == appSKeyType {
+			rootKey = node.AppKey
+		}
+		if *sessionKey, err = deriveKey(rootKey, keyType, joinNonce[:], node.JoinEUI[:], devNonce[:]); err != nil {
+			return false, err
+		}
+	}
+
+	if node.Rejoin.Pending {
+		// the frame counters of the new session start again
+		node.FCntUp = node.FCnt.Start
+	}
+	node.Rejoin.Pending = false
+	node.Rejoin.Count0 = 0
+	node.SessionConfirmed = false
+	node.JoinedNetwork = true
+
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui":  node.DevEUI.String(),
+		"DevAddr": node.DevAddr.String(),
+	}).Info("Node joined the network with LoRaWAN 1.1")
+
+	return true, nil
+}
+
+//nextRejoinRequest return the rejoin request the LoRaWAN 1.1 node sends instead of its next uplink, nil if none
+//rejoin requests are sent every Rejoin.Every uplinks, and once when the network server forces it
+func nextRejoinRequest(node *model.Node) []byte {
+	if !node.LoRaWAN11 {
+		return nil
+	}
+	node.Rejoin.NbUplinks++
+	if !node.Rejoin.Forced && (node.Rejoin.Every == 0 || node.Rejoin.NbUplinks < node.Rejoin.Every) {
+		return nil
+	}
+	node.Rejoin.NbUplinks = 0
+	node.Rejoin.Forced = false
+	rejoin, err := getRejoinRequest(node)
+	if err != nil {
+		loggerNode.WithError(err).WithField("DevEui", node.DevEUI.String()).Error("Can't create rejoin request")
+		return nil
+	}
+	return rejoin
+}
+
+//getRejoinRequest return a rejoin request of the node rejoin type and wait for its JoinAccept
+//types 0 and 2 contain the NetID and RJcount0 with a MIC of the SNwkSIntKey, type 1 the JoinEUI and RJcount1 with a MIC of the JSIntKey
+func getRejoinRequest(node *model.Node) ([]byte, error) {
+	rejoin := []byte{byte(rejoinRequest) << 5, byte(node.Rejoin.Type)}
+	micKey, count := node.SNwkSIntKey, &node.Rejoin.Count0
+	if node.Rejoin.Type == 1 {
+		jsIntKey, err := deriveKey(node.NwkKey, jsIntKeyType, node.DevEUI[:])
+		if err != nil {
+			return nil, err
+		}
+		micKey, count = jsIntKey, &node.Rejoin.Count1
+		rejoin = append(rejoin, reverse(node.JoinEUI[:])...)
+	} else {
+		rejoin = append(rejoin, reverse(node.NetID[:])...)
+	}
+	rejoin = append(rejoin, reverse(node.DevEUI[:])...)
+	rejoin = append(rejoin, byte(*count), byte(*count>>8))
+	mic, err := computeMIC(micKey, rejoin)
+	if err != nil {
+		return nil, err
+	}
+
+	node.Rejoin.Pending = true
+	node.Rejoin.PendingType = node.Rejoin.Type
+	node.Rejoin.PendingCount = *count
+	*count++
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui": node.DevEUI.String(),
+		"type":   node.Rejoin.Type,
+	}).Debug("Rejoin request")
+	return append(rejoin, mic...), nil
+}
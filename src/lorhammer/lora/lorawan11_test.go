@@ -0,0 +1,236 @@
+package lora
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+func newLoRaWAN11Node() *model.Node {
+	node := newNode("19842bd94743246b367c2e90942a1f73", "19842bd94743246b367c2e90942a1f77", "", []model.Payload{{Value: "01"}}, false)
+	node.LoRaWAN11 = true
+	node.NwkKey = tools.Random16Bytes()
+	node.SNwkSIntKey = tools.Random16Bytes()
+	node.NwkSEncKey = tools.Random16Bytes()
+	node.ConfirmedRatio = 0
+	return node
+}
+
+//newJoinAccept11 return a JoinAccept with the JoinNonce 010203, the NetID 040506 and the DevAddr 01020304 encrypted with the key
+func newJoinAccept11(t *testing.T, node *model.Node, key lorawan.AES128Key, joinReqType byte, devNonce [2]byte, optNeg bool) []byte {
+	// MHDR | JoinNonce | NetID | DevAddr | DLSettings | RxDelay
+	msg := []byte{byte(lorawan.JoinAccept) << 5, 3, 2, 1, 6, 5, 4, 4, 3, 2, 1, 0, 1}
+	micKey, micMsg := node.NwkKey, msg
+	if optNeg {
+		msg[11] = 0x80
+		micKey, _ = deriveKey(node.NwkKey, jsIntKeyType, node.DevEUI[:])
+		micMsg = append(append(append([]byte{joinReqType}, reverse(node.JoinEUI[:])...), devNonce[1], devNonce[0]), msg...)
+	}
+	mic, err := computeMIC(micKey, micMsg)
+	if err != nil {
+		t.Fatal("Couldn't compute JoinAccept MIC")
+	}
+	plain := append(msg, mic...)
+	block, _ := aes.NewCipher(key[:])
+	encrypted := append([]byte{}, plain...)
+	block.Decrypt(encrypted[1:17], plain[1:17])
+	return encrypted
+}
+
+//newDataDown11 return a LoRaWAN 1.1 data downlink with the FOpts encrypted and the MIC of the SNwkSIntKey
+func newDataDown11(t *testing.T, node *model.Node, fOpts []byte, confFCnt uint16) []byte {
+	payload := rawMACCommandPayload(fOpts[1:])
+	phyPayload := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: node.DevAddr,
+				FCtrl:   lorawan.FCtrl{ACK: confFCnt != 0},
+				FCnt:    7,
+				FOpts:   []lorawan.MACCommand{{CID: lorawan.CID(fOpts[0]), Payload: &payload}},
+			},
+		},
+	}
+	data, err := phyPayload.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal downlink")
+	}
+	encrypted, _ := encryptFOpts(node.NwkSEncKey, false, false, data[1:5], 7, data[8:8+len(fOpts)])
+	copy(data[8:], encrypted)
+	mic, _ := computeMIC(node.SNwkSIntKey, micBlock(confFCnt, false, data[1:5], 7, len(data)-4), data[:len(data)-4])
+	copy(data[len(data)-4:], mic)
+	return data
+}
+
+func TestCheckLoRaWAN11(t *testing.T) {
+	if CheckLoRaWAN11(nil) != nil || CheckLoRaWAN11(&model.LoRaWAN11{Ratio: 0.5, RejoinType: 2, RejoinEvery: 10, NwkSEncKey: "19842bd94743246b367c2e90942a1f73"}) != nil {
+		t.Fatal("Valid LoRaWAN 1.1 config must not return an error")
+	}
+	if CheckLoRaWAN11(&model.LoRaWAN11{Ratio: 1.1}) == nil || CheckLoRaWAN11(&model.LoRaWAN11{RejoinType: 3}) == nil || CheckLoRaWAN11(&model.LoRaWAN11{RejoinEvery: -1}) == nil {
+		t.Fatal("Error expected on wrong ratio, rejoin type or rejoin period")
+	}
+	if CheckLoRaWAN11(&model.LoRaWAN11{SNwkSIntKey: "1984"}) == nil {
+		t.Fatal("Error expected on wrong key")
+	}
+}
+
+func TestSetLoRaWAN11(t *testing.T) {
+	gateway := NewGateway(4, model.Init{Nwskey: "19842bd94743246b367c2e90942a1f73", LoRaWAN11: &model.LoRaWAN11{Ratio: 0.5, NwkSEncKey: "19842bd94743246b367c2e90942a1f77", RejoinType: 1, RejoinEvery: 10}})
+	for i, node := range gateway.Nodes {
+		if node.LoRaWAN11 != (i < 2) {
+			t.Fatalf("Node %d must be in LoRaWAN 1.1 according to the ratio", i)
+		}
+	}
+	node := gateway.Nodes[0]
+	if node.NwkKey == node.AppKey || node.NwkSEncKey.String() != "19842bd94743246b367c2e90942a1f77" || node.SNwkSIntKey != node.NwSKey {
+		t.Fatal("LoRaWAN 1.1 nodes must have their own NwkKey and the network session keys of the config")
+	}
+	if node.Rejoin.Type != 1 || node.Rejoin.Every != 10 {
+		t.Fatal("LoRaWAN 1.1 nodes must use the rejoin config")
+	}
+	if other := gateway.Nodes[3]; other.NwkKey != other.AppKey || other.NwkSEncKey != other.NwSKey {
+		t.Fatal("LoRaWAN 1.0 nodes must use the same keys")
+	}
+}
+
+func TestHandleJoinAccept11(t *testing.T) {
+	node := newLoRaWAN11Node()
+	getJoinRequestDataPayload(node)
+	if node.DevNonce != [2]byte{0, 1} {
+		t.Fatal("LoRaWAN 1.1 DevNonce must be a counter")
+	}
+
+	if joined, err := handleJoinAccept(node, newJoinAccept11(t, node, node.AppKey, joinRequestType, node.DevNonce, true)); joined || err != nil {
+		t.Fatal("JoinAccept not encrypted with the NwkKey must be ignored")
+	}
+	joined, err := handleJoinAccept(node, newJoinAccept11(t, node, node.NwkKey, joinRequestType, node.DevNonce, true))
+	if err != nil || !joined {
+		t.Fatal("Node should have joined the network")
+	}
+	if node.DevAddr != (lorawan.DevAddr{1, 2, 3, 4}) || node.NetID != (lorawan.NetID{4, 5, 6}) {
+		t.Fatal("DevAddr and NetID must be the ones given by the JoinAccept")
+	}
+
+	sNwkSIntKey, _ := deriveKey(node.NwkKey, sNwkSIntKeyType, []byte{1, 2, 3}, node.JoinEUI[:], node.DevNonce[:])
+	appSKey, _ := deriveKey(node.AppKey, appSKeyType, []byte{1, 2, 3}, node.JoinEUI[:], node.DevNonce[:])
+	if node.SNwkSIntKey != sNwkSIntKey || node.AppSKey != appSKey {
+		t.Fatal("Session keys must be derived from the NwkKey, the AppKey, the JoinNonce, the JoinEUI and the DevNonce")
+	}
+	if node.NwSKey == node.SNwkSIntKey || node.NwSKey == node.NwkSEncKey || node.SNwkSIntKey == node.NwkSEncKey {
+		t.Fatal("Network session keys must be different")
+	}
+	if requests := sessionMacRequests(node); len(requests) != 1 || !bytes.Equal(requests[0], []byte{byte(rekeyInd), lorawan11Minor}) {
+		t.Fatal("Node must send RekeyInd after joining")
+	}
+}
+
+func TestHandleJoinAccept11WithoutOptNeg(t *testing.T) {
+	node := newLoRaWAN11Node()
+	getJoinRequestDataPayload(node)
+
+	if joined, err := handleJoinAccept(node, newJoinAccept11(t, node, node.NwkKey, joinRequestType, node.DevNonce, false)); joined || err == nil {
+		t.Fatal("JoinAccept of a LoRaWAN 1.0 network server must return an error")
+	}
+}
+
+func TestRejoinRequest(t *testing.T) {
+	node := newLoRaWAN11Node()
+	node.JoinedNetwork = true
+	node.NetID = lorawan.NetID{4, 5, 6}
+	node.Rejoin = model.Rejoin{Type: 2, Every: 3}
+
+	if nextRejoinRequest(node) != nil || nextRejoinRequest(node) != nil {
+		t.Fatal("Rejoin request must not be sent before rejoinEvery uplinks")
+	}
+	rejoin := nextRejoinRequest(node)
+	if len(rejoin) != 19 || rejoin[0] != 0xC0 || rejoin[1] != 2 || !bytes.Equal(rejoin[2:5], []byte{6, 5, 4}) {
+		t.Fatalf("Rejoin request of type 2 must contain the NetID, got %x", rejoin)
+	}
+	if mic, _ := computeMIC(node.SNwkSIntKey, rejoin[:15]); !bytes.Equal(mic, rejoin[15:]) {
+		t.Fatal("Rejoin request of type 2 must have a MIC of the SNwkSIntKey")
+	}
+	if !node.Rejoin.Pending || node.Rejoin.Count0 != 1 {
+		t.Fatal("Node must wait for the JoinAccept and increment RJcount0")
+	}
+
+	jsEncKey, _ := deriveKey(node.NwkKey, jsEncKeyType, node.DevEUI[:])
+	node.FCntUp = 10
+	joined, err := handleJoinAccept(node, newJoinAccept11(t, node, jsEncKey, 2, [2]byte{0, 0}, true))
+	if err != nil || !joined {
+		t.Fatal("JoinAccept answering the rejoin request must be encrypted with the JSEncKey")
+	}
+	if node.Rejoin.Pending || node.FCntUp != 0 || node.Rejoin.Count0 != 0 {
+		t.Fatal("Rejoin must start a new session")
+	}
+
+	node.Rejoin.Type = 1
+	node.Rejoin.Forced = true
+	rejoin = nextRejoinRequest(node)
+	jsIntKey, _ := deriveKey(node.NwkKey, jsIntKeyType, node.DevEUI[:])
+	if mic, _ := computeMIC(jsIntKey, rejoin[:20]); len(rejoin) != 24 || !bytes.Equal(mic, rejoin[20:]) {
+		t.Fatal("Forced rejoin request of type 1 must be sent with a MIC of the JSIntKey")
+	}
+}
+
+func TestUplink11(t *testing.T) {
+	node := newLoRaWAN11Node()
+	data, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Valid uplink must not return an error")
+	}
+	fCnt := uint32(binary.LittleEndian.Uint16(data[6:8]))
+	if fOpts, _ := encryptFOpts(node.NwkSEncKey, true, false, data[1:5], fCnt, data[8:10]); !bytes.Equal(fOpts, []byte{byte(resetInd), lorawan11Minor}) {
+		t.Fatal("ABP node must send an encrypted ResetInd")
+	}
+
+	onChannel0, _ := setUplinkMIC11(node, data, 0)
+	onChannel1, _ := setUplinkMIC11(node, data, 1)
+	if bytes.Equal(onChannel0[len(data)-4:len(data)-2], onChannel1[len(data)-4:len(data)-2]) {
+		t.Fatal("MIC of the SNwkSIntKey must depend on the channel")
+	}
+	if !bytes.Equal(onChannel0[len(data)-2:], onChannel1[len(data)-2:]) {
+		t.Fatal("MIC of the FNwkSIntKey must not depend on the channel")
+	}
+}
+
+func TestHandleDataDown11(t *testing.T) {
+	node := newLoRaWAN11Node()
+	other := newNode("19842bd94743246b367c2e90942a1f73", "", "", nil, false)
+	other.DevAddr = node.DevAddr
+	gateway := &LorhammerGateway{Nodes: []*model.Node{other, node}}
+
+	if got, _ := gateway.handleDownlinkPHYPayload(newDataDown11(t, node, []byte{byte(resetConf), 1}, 0), classA, nil, &fakePrometheus{}); got != node {
+		t.Fatal("Downlink must be given to the node whose SNwkSIntKey validates the MIC")
+	}
+	if !node.SessionConfirmed || len(sessionMacRequests(node)) != 0 {
+		t.Fatal("Encrypted ResetConf must confirm the session")
+	}
+
+	node.PendingUplink, _, _ = GetPushDataPayload(node, eu868)
+	node.PendingUplink[6] = 42
+	if _, ok := decodeDataDown(node, newDataDown11(t, node, []byte{byte(resetConf), 1}, 41)); ok {
+		t.Fatal("ACK must have the counter of the confirmed uplink in its MIC")
+	}
+	if _, ok := decodeDataDown(node, newDataDown11(t, node, []byte{byte(resetConf), 1}, 42)); !ok {
+		t.Fatal("ACK of the confirmed uplink must be valid")
+	}
+}
+
+func TestLoRaWAN11MacCommands(t *testing.T) {
+	node := newMacNode(eu868)
+	node.LoRaWAN11 = true
+
+	handleMacCommands(node, eu868, []byte{byte(forceRejoinReq), 0x20, 0x00, byte(rejoinParamSetupReq), 0x02})
+	if !node.Rejoin.Forced || node.Rejoin.Type != 2 {
+		t.Fatal("ForceRejoinReq must force a rejoin request of its type")
+	}
+	if node.Rejoin.Every != 64 {
+		t.Fatal("RejoinParamSetupReq must set the rejoin requests period")
+	}
+	checkMacAnswers(t, node.MacAnswers, []byte{byte(rejoinParamSetupAns), 0x00})
+}
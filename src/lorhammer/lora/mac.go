@@ -0,0 +1,363 @@
+package lora
+
+import (
+	"encoding/binary"
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
+	"math"
+
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+//maxFOptsLen is the maximal size of the FOpts field of an uplink
+const maxFOptsLen = 15
+
+//class B MAC commands of LoRaWAN 1.0.3, not defined by the lorawan package
+const (
+	deviceTimeReq      lorawan.CID = 0x0D
+	deviceTimeAns      lorawan.CID = 0x0D
+	pingSlotInfoReq    lorawan.CID = 0x10
+	pingSlotInfoAns    lorawan.CID = 0x10
+	pingSlotChannelReq lorawan.CID = 0x11
+	pingSlotChannelAns lorawan.CID = 0x11
+)
+
+//LoRaWAN 1.1 MAC commands, not defined by the lorawan package
+const (
+	resetInd            lorawan.CID = 0x01
+	resetConf           lorawan.CID = 0x01
+	rekeyInd            lorawan.CID = 0x0B
+	rekeyConf           lorawan.CID = 0x0B
+	forceRejoinReq      lorawan.CID = 0x0E
+	rejoinParamSetupReq lorawan.CID = 0x0F
+	rejoinParamSetupAns lorawan.CID = 0x0F
+)
+
+//downlinkMacCommandSizes is the payload size of MAC commands sent by the network server, by CID
+var downlinkMacCommandSizes = map[lorawan.CID]int{
+	lorawan.LinkCheckAns:     2,
+	lorawan.LinkADRReq:       4,
+	lorawan.DutyCycleReq:     1,
+	lorawan.RXParamSetupReq:  4,
+	lorawan.DevStatusReq:     0,
+	lorawan.NewChannelReq:    5,
+	lorawan.RXTimingSetupReq: 1,
+	deviceTimeAns:            5,
+	pingSlotInfoAns:          0,
+	pingSlotChannelReq:       4,
+	resetConf:                1,
+	rekeyConf:                1,
+	forceRejoinReq:           2,
+	rejoinParamSetupReq:      1,
+}
+
+//macCommand is a MAC command with its raw payload
+type macCommand struct {
+	cid     lorawan.CID
+	payload []byte
+}
+
+//rawMACCommandPayload is an already encoded MAC command payload, used to send answers in FOpts
+type rawMACCommandPayload []byte
+
+func (p rawMACCommandPayload) MarshalBinary() ([]byte, error) {
+	return p, nil
+}
+
+func (p *rawMACCommandPayload) UnmarshalBinary(data []byte) error {
+	*p = append((*p)[:0], data...)
+	return nil
+}
+
+//getDownlinkMacCommands return the MAC commands of the FOpts, or of the FRMPayload when the FPort is 0
+func getDownlinkMacCommands(node *model.Node, macPayload *lorawan.MACPayload) ([]byte, error) {
+	var data []byte
+	for _, command := range macPayload.FHDR.FOpts {
+		b, err := command.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	if macPayload.FPort == nil || *macPayload.FPort != 0 || len(macPayload.FRMPayload) == 0 {
+		return data, nil
+	}
+	dataPayload, ok := macPayload.FRMPayload[0].(*lorawan.DataPayload)
+	if !ok {
+		return data, nil
+	}
+	// FRMPayload of port 0 is encrypted with the NwkSKey
+	decrypted, err := lorawan.EncryptFRMPayload(node.NwkSEncKey, false, macPayload.FHDR.DevAddr, macPayload.FHDR.FCnt, dataPayload.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, decrypted...), nil
+}
+
+//parseMacCommands split raw MAC commands, parsing stops at the first unknown command because its size is unknown
+func parseMacCommands(data []byte) []macCommand {
+	var commands []macCommand
+	for i := 0; i < len(data); {
+		cid := lorawan.CID(data[i])
+		size, ok := downlinkMacCommandSizes[cid]
+		if !ok || i+1+size > len(data) {
+			loggerNode.WithField("cid", cid).Warn("Unknown or truncated MAC command, next ones are ignored")
+			break
+		}
+		commands = append(commands, macCommand{cid: cid, payload: data[i+1 : i+1+size]})
+		i += 1 + size
+	}
+	return commands
+}
+
+//handleMacCommands apply the MAC commands sent by the network server and queue their answers for the next uplink
+func handleMacCommands(node *model.Node, reg *region.Region, data []byte) {
+	commands := parseMacCommands(data)
+	for i := 0; i < len(commands); i++ {
+		switch commands[i].cid {
+		case lorawan.LinkADRReq:
+			// a block of contiguous LinkADRReq is applied at once
+			end := i + 1
+			for end < len(commands) && commands[end].cid == lorawan.LinkADRReq {
+				end++
+			}
+			handleLinkADRReq(node, reg, commands[i:end])
+			i = end - 1
+		case lorawan.DutyCycleReq:
+			node.MaxDutyCycle = int(commands[i].payload[0] & 0x0f)
+			queueMacAnswer(node, lorawan.DutyCycleAns)
+		case lorawan.RXParamSetupReq:
+			handleRXParamSetupReq(node, reg, commands[i].payload)
+		case lorawan.DevStatusReq:
+			handleDevStatusReq(node)
+		case lorawan.NewChannelReq:
+			handleNewChannelReq(node, reg, commands[i].payload)
+		case lorawan.RXTimingSetupReq:
+			node.RXDelay = int(commands[i].payload[0] & 0x0f)
+			if node.RXDelay == 0 {
+				node.RXDelay = 1
+			}
+			// answer is sent in every uplink until a downlink is received
+			node.StickyMacAnswers = append(node.StickyMacAnswers, []byte{byte(lorawan.RXTimingSetupAns)})
+		case deviceTimeAns:
+			node.PingSlot.DeviceTimeSynced = true
+		case pingSlotInfoAns:
+			node.PingSlot.InfoAcked = true
+		case pingSlotChannelReq:
+			handlePingSlotChannelReq(node, reg, commands[i].payload)
+		case resetConf, rekeyConf:
+			node.SessionConfirmed = true
+		case forceRejoinReq:
+			// the rejoin type is in bits 4 to 6, retries and period are not simulated
+			node.Rejoin.Type = int(commands[i].payload[0]>>4) & 0x07
+			node.Rejoin.Forced = node.LoRaWAN11
+		case rejoinParamSetupReq:
+			handleRejoinParamSetupReq(node, commands[i].payload)
+		}
+	}
+}
+
+func queueMacAnswer(node *model.Node, cid lorawan.CID, payload ...byte) {
+	node.MacAnswers = append(node.MacAnswers, append([]byte{byte(cid)}, payload...))
+}
+
+//handleLinkADRReq apply the data rate, tx power, channel mask and number of transmissions of a LinkADRReq block
+//nothing is applied if one of them is not valid
+func handleLinkADRReq(node *model.Node, reg *region.Region, commands []macCommand) {
+	channels := node.Channels
+	chMaskOk := true
+	for _, command := range commands {
+		chMask := binary.LittleEndian.Uint16(command.payload[1:3])
+		chMaskCntl := int(command.payload[3]>>4) & 0x07
+		var ok bool
+		if channels, ok = reg.ApplyChannelMask(channels, chMaskCntl, chMask); !ok {
+			chMaskOk = false
+		}
+	}
+	// a mask disabling all channels is not valid
+	if chMaskOk && !hasEnabledChannel(channels) {
+		chMaskOk = false
+	}
+	if !chMaskOk {
+		channels = node.Channels
+	}
+	last := commands[len(commands)-1].payload
+	dataRate := int(last[0] >> 4)
+	txPower := int(last[0] & 0x0f)
+	nbTrans := int(last[3] & 0x0f)
+	// 0xF asks the node to keep its current data rate or tx power
+	if dataRate == 0x0f {
+		dataRate = node.DataRate
+	}
+	if txPower == 0x0f {
+		txPower = node.TxPower
+	}
+
+	dataRateOk := reg.CheckDataRate(dataRate, channels) == nil
+	txPowerOk := txPower <= reg.MaxTxPower
+
+	status := byte(0)
+	if txPowerOk {
+		status |= 0x04
+	}
+	if dataRateOk {
+		status |= 0x02
+	}
+	if chMaskOk {
+		status |= 0x01
+	}
+	if status == 0x07 {
+		node.Channels = channels
+		node.DataRate = dataRate
+		node.TxPower = txPower
+		if nbTrans > 0 {
+			node.NbTrans = nbTrans
+		}
+	}
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui": node.DevEUI.String(),
+		"status": status,
+	}).Debug("LinkADRReq received")
+	for range commands {
+		queueMacAnswer(node, lorawan.LinkADRAns, status)
+	}
+}
+
+func hasEnabledChannel(channels []model.Channel) bool {
+	for _, channel := range channels {
+		if channel.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+//handleRXParamSetupReq apply the RX1 data rate offset, RX2 data rate and RX2 frequency if they are all valid
+func handleRXParamSetupReq(node *model.Node, reg *region.Region, payload []byte) {
+	rx1DROffset := int(payload[0]>>4) & 0x07
+	rx2DataRate := int(payload[0] & 0x0f)
+	frequency := getMacCommandFrequency(payload[1:4])
+
+	status := byte(0)
+	if rx1DROffset <= reg.MaxRX1DROffset {
+		status |= 0x04
+	}
+	if reg.IsValidDataRate(rx2DataRate) {
+		status |= 0x02
+	}
+	if reg.IsValidFrequency(frequency) {
+		status |= 0x01
+	}
+	if status == 0x07 {
+		node.RX1DROffset = rx1DROffset
+		node.RX2DataRate = rx2DataRate
+		node.RX2Frequency = frequency
+	}
+	// answer is sent in every uplink until a downlink is received
+	node.StickyMacAnswers = append(node.StickyMacAnswers, []byte{byte(lorawan.RXParamSetupAns), status})
+}
+
+//handleDevStatusReq answer the battery level (255, not able to measure) and the SNR of the last uplink as demodulation margin
+func handleDevStatusReq(node *model.Node) {
+	margin := int(math.Floor(node.LastSnr + 0.5))
+	if margin < -32 {
+		margin = -32
+	} else if margin > 31 {
+		margin = 31
+	}
+	queueMacAnswer(node, lorawan.DevStatusAns, 255, byte(margin)&0x3f)
+}
+
+//handleNewChannelReq create, modify or disable (frequency 0) a channel, default channels can't be modified
+func handleNewChannelReq(node *model.Node, reg *region.Region, payload []byte) {
+	index := int(payload[0])
+	frequency := getMacCommandFrequency(payload[1:4])
+	minDR, maxDR := int(payload[4]&0x0f), int(payload[4]>>4)
+
+	status := byte(0)
+	// channels of regions with sub-bands are fixed
+	if reg.IsDynamicChannelPlan() && index >= len(reg.Channels) && index < 16 {
+		if frequency == 0 || reg.IsValidFrequency(frequency) {
+			status |= 0x01
+		}
+		if minDR <= maxDR && reg.IsValidDataRate(minDR) && reg.IsValidDataRate(maxDR) {
+			status |= 0x02
+		}
+	}
+	if status == 0x03 {
+		for len(node.Channels) <= index {
+			node.Channels = append(node.Channels, model.Channel{})
+		}
+		node.Channels[index] = model.Channel{Frequency: frequency, MinDR: minDR, MaxDR: maxDR, Enabled: frequency != 0}
+	}
+	queueMacAnswer(node, lorawan.NewChannelAns, status)
+}
+
+//handlePingSlotChannelReq apply the ping slots frequency (0 for the region default ones) and data rate if they are both valid
+func handlePingSlotChannelReq(node *model.Node, reg *region.Region, payload []byte) {
+	frequency := getMacCommandFrequency(payload[0:3])
+	dataRate := int(payload[3] & 0x0f)
+
+	status := byte(0)
+	if reg.IsValidDataRate(dataRate) {
+		status |= 0x02
+	}
+	if frequency == 0 || reg.IsValidFrequency(frequency) {
+		status |= 0x01
+	}
+	if status == 0x03 {
+		node.PingSlot.Frequency = frequency
+		node.PingSlot.DataRate = dataRate
+	}
+	queueMacAnswer(node, pingSlotChannelAns, status)
+}
+
+//handleRejoinParamSetupReq send rejoin requests every 2^(MaxCountN+4) uplinks, the periodic rejoin requests by time are not supported
+func handleRejoinParamSetupReq(node *model.Node, payload []byte) {
+	node.Rejoin.Every = 1 << uint(payload[0]&0x0f+4)
+	queueMacAnswer(node, rejoinParamSetupAns, 0x00)
+}
+
+//getMacCommandFrequency return the frequency in Hz of a 3 bytes little endian MAC command frequency (in 100Hz)
+func getMacCommandFrequency(b []byte) int {
+	return (int(b[0]) | int(b[1])<<8 | int(b[2])<<16) * 100
+}
+
+//getUplinkFOpts return the MAC answers which fit in the FOpts of the next uplink
+//sticky answers are kept until a downlink is received, LoRaWAN 1.1 and class B requests until they are answered, other ones are sent once
+func getUplinkFOpts(node *model.Node) []lorawan.MACCommand {
+	var fOpts []lorawan.MACCommand
+	size := 0
+	add := func(answer []byte) bool {
+		if size+len(answer) > maxFOptsLen {
+			return false
+		}
+		size += len(answer)
+		command := lorawan.MACCommand{CID: lorawan.CID(answer[0])}
+		if len(answer) > 1 {
+			payload := rawMACCommandPayload(answer[1:])
+			command.Payload = &payload
+		}
+		fOpts = append(fOpts, command)
+		return true
+	}
+	for _, request := range sessionMacRequests(node) {
+		add(request)
+	}
+	for _, answer := range node.StickyMacAnswers {
+		add(answer)
+	}
+	for _, request := range classBMacRequests(node) {
+		add(request)
+	}
+	sent := 0
+	for _, answer := range node.MacAnswers {
+		if !add(answer) {
+			break
+		}
+		sent++
+	}
+	node.MacAnswers = node.MacAnswers[sent:]
+	return fOpts
+}
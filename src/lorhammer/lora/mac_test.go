@@ -0,0 +1,232 @@
+package lora
+
+import (
+	"bytes"
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+var eu868, _ = region.Get("EU868")
+var us915, _ = region.Get("US915")
+
+func newMacNode(reg *region.Region) *model.Node {
+	channels, _ := reg.NodeChannels(nil)
+	return &model.Node{
+		DevEUI:       [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DataRate:     reg.DefaultDataRate,
+		Channels:     channels,
+		RX2DataRate:  reg.RX2DataRate,
+		RX2Frequency: reg.RX2Frequency,
+		RXDelay:      1,
+		NbTrans:      1,
+	}
+}
+
+func checkMacAnswers(t *testing.T, answers [][]byte, expected ...[]byte) {
+	if len(answers) != len(expected) {
+		t.Fatalf("%d MAC answers expected, got %d", len(expected), len(answers))
+	}
+	for i := range answers {
+		if !bytes.Equal(answers[i], expected[i]) {
+			t.Fatalf("MAC answer %x expected, got %x", expected[i], answers[i])
+		}
+	}
+}
+
+func TestHandleLinkADRReq(t *testing.T) {
+	node := newMacNode(eu868)
+
+	// DR3, TXPower 2, channels 0 and 1, NbTrans 2
+	handleMacCommands(node, eu868, []byte{0x03, 0x32, 0x03, 0x00, 0x02})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x03, 0x07})
+	if node.DataRate != 3 || node.TxPower != 2 || node.NbTrans != 2 {
+		t.Fatal("LinkADRReq must set data rate, tx power and number of transmissions")
+	}
+	if !node.Channels[0].Enabled || !node.Channels[1].Enabled || node.Channels[2].Enabled {
+		t.Fatal("LinkADRReq must apply the channel mask")
+	}
+}
+
+func TestHandleLinkADRReqKeepCurrent(t *testing.T) {
+	node := newMacNode(eu868)
+	node.DataRate, node.TxPower = 4, 3
+
+	// DR and TXPower 0xF, channels 0 and 1, NbTrans 1
+	handleMacCommands(node, eu868, []byte{0x03, 0xff, 0x03, 0x00, 0x01})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x03, 0x07})
+	if node.DataRate != 4 || node.TxPower != 3 || node.Channels[2].Enabled {
+		t.Fatal("LinkADRReq with DR and TXPower 0xF must keep the current ones and apply the channel mask")
+	}
+}
+
+func TestHandleLinkADRReqUndefinedChannel(t *testing.T) {
+	node := newMacNode(eu868)
+
+	// channel 5 is not defined
+	handleMacCommands(node, eu868, []byte{0x03, 0x32, 0x20, 0x00, 0x01})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x03, 0x06})
+	if node.DataRate != 5 || node.TxPower != 0 {
+		t.Fatal("LinkADRReq must not be applied if the channel mask is not valid")
+	}
+}
+
+func TestHandleLinkADRReqBlock(t *testing.T) {
+	node := newMacNode(us915)
+
+	// all 125kHz channels off, then channels 8 to 15 on
+	handleMacCommands(node, us915, []byte{0x03, 0x20, 0x00, 0x00, 0x70, 0x03, 0x20, 0x00, 0xff, 0x01})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x03, 0x07}, []byte{0x03, 0x07})
+	for i, channel := range node.Channels {
+		if channel.Enabled != (i >= 8 && i < 16) {
+			t.Fatalf("Only channels 8 to 15 must be enabled, channel %d enabled : %t", i, channel.Enabled)
+		}
+	}
+	if node.DataRate != 2 {
+		t.Fatal("Data rate of the last LinkADRReq of the block must be applied")
+	}
+}
+
+func TestHandleDutyCycleAndRXTimingSetupReq(t *testing.T) {
+	node := newMacNode(eu868)
+
+	handleMacCommands(node, eu868, []byte{0x04, 0x03, 0x08, 0x05})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x04})
+	checkMacAnswers(t, node.StickyMacAnswers, []byte{0x08})
+	if node.MaxDutyCycle != 3 || node.RXDelay != 5 {
+		t.Fatal("DutyCycleReq and RXTimingSetupReq must be applied")
+	}
+
+	handleMacCommands(node, eu868, []byte{0x08, 0x00})
+	if node.RXDelay != 1 {
+		t.Fatal("RX delay 0 means 1 second")
+	}
+}
+
+func TestHandleRXParamSetupReq(t *testing.T) {
+	node := newMacNode(eu868)
+
+	// RX1DROffset 2, RX2 DR3, 869.525MHz
+	handleMacCommands(node, eu868, []byte{0x05, 0x23, 0xd2, 0xad, 0x84})
+
+	checkMacAnswers(t, node.StickyMacAnswers, []byte{0x05, 0x07})
+	if node.RX1DROffset != 2 || node.RX2DataRate != 3 || node.RX2Frequency != 869525000 {
+		t.Fatal("RXParamSetupReq must be applied")
+	}
+
+	// 915MHz is not in EU868 band
+	node = newMacNode(eu868)
+	handleMacCommands(node, eu868, []byte{0x05, 0x23, 0x30, 0x9e, 0x8b})
+	checkMacAnswers(t, node.StickyMacAnswers, []byte{0x05, 0x06})
+	if node.RX2DataRate != 0 {
+		t.Fatal("RXParamSetupReq must not be applied if the frequency is not valid")
+	}
+}
+
+func TestHandleDevStatusReq(t *testing.T) {
+	node := newMacNode(eu868)
+	node.LastSnr = -5.4
+
+	handleMacCommands(node, eu868, []byte{0x06})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x06, 0xff, 0x3b})
+}
+
+func TestHandleNewChannelReq(t *testing.T) {
+	node := newMacNode(eu868)
+
+	// channel 3 at 867.1MHz DR0 to DR5, then channel 0 which can't be modified
+	handleMacCommands(node, eu868, []byte{0x07, 0x03, 0x18, 0x4f, 0x84, 0x50, 0x07, 0x00, 0x18, 0x4f, 0x84, 0x50})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x07, 0x03}, []byte{0x07, 0x00})
+	if len(node.Channels) != 4 || node.Channels[3] != (model.Channel{Frequency: 867100000, MinDR: 0, MaxDR: 5, Enabled: true}) {
+		t.Fatal("NewChannelReq must create the channel")
+	}
+	if node.Channels[0].Frequency != 868100000 {
+		t.Fatal("Default channel must not be modified")
+	}
+
+	node = newMacNode(us915)
+	handleMacCommands(node, us915, []byte{0x07, 0x03, 0x18, 0x4f, 0x84, 0x50})
+	checkMacAnswers(t, node.MacAnswers, []byte{0x07, 0x00})
+}
+
+func TestHandleMacCommandsUnknown(t *testing.T) {
+	node := newMacNode(eu868)
+
+	handleMacCommands(node, eu868, []byte{0x06, 0x7f, 0x01, 0x06})
+
+	checkMacAnswers(t, node.MacAnswers, []byte{0x06, 0xff, 0x00})
+}
+
+func TestGetUplinkFOpts(t *testing.T) {
+	node := newMacNode(eu868)
+	node.StickyMacAnswers = [][]byte{{0x05, 0x07}}
+	for i := 0; i < 5; i++ {
+		node.MacAnswers = append(node.MacAnswers, []byte{0x06, 0xff, byte(i)})
+	}
+
+	fOpts := getUplinkFOpts(node)
+
+	if len(fOpts) != 5 || len(node.MacAnswers) != 1 {
+		t.Fatalf("FOpts must contain only the answers fitting in 15 bytes, got %d answers", len(fOpts))
+	}
+	if fOpts = getUplinkFOpts(node); len(fOpts) != 2 || fOpts[0].CID != lorawan.RXParamSetupAns {
+		t.Fatal("Sticky answers must be sent until a downlink is received")
+	}
+}
+
+func TestHandleDataDownMacCommands(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233"},
+		},
+		false,
+	)
+	node.StickyMacAnswers = [][]byte{{0x08}}
+	fport := uint8(0)
+	encrypted, err := lorawan.EncryptFRMPayload(node.NwSKey, false, node.DevAddr, 0, []byte{0x06})
+	if err != nil {
+		t.Fatal("Couldn't encrypt FRMPayload")
+	}
+	dutyCycle := rawMACCommandPayload{0x02}
+	phyPayload := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: node.DevAddr,
+				FOpts:   []lorawan.MACCommand{{CID: lorawan.DutyCycleReq, Payload: &dutyCycle}},
+			},
+			FPort:      &fport,
+			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: encrypted}},
+		},
+	}
+
+	if _, err := handleDataDown(node, eu868, phyPayload); err != nil {
+		t.Fatal("Couldn't handle downlink with MAC commands")
+	}
+	if node.MaxDutyCycle != 2 || len(node.MacAnswers) != 2 || len(node.StickyMacAnswers) != 0 {
+		t.Fatal("MAC commands of FOpts and FRMPayload of port 0 must be handled")
+	}
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	uplink := lorawan.PHYPayload{}
+	if err := uplink.UnmarshalBinary(dataPayload); err != nil {
+		t.Fatal("Couldn't unmarshall PHYPayload Binary")
+	}
+	if fOpts := uplink.MACPayload.(*lorawan.MACPayload).FHDR.FOpts; len(fOpts) != 2 || fOpts[0].CID != lorawan.DutyCycleAns || fOpts[1].CID != lorawan.DevStatusAns {
+		t.Fatal("MAC answers must be sent in the FOpts of the next uplink")
+	}
+}
@@ -1,8 +1,12 @@
 package lora
 
 import (
+	"crypto/aes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"lorhammer/src/lorhammer/region"
 	"lorhammer/src/model"
 	"lorhammer/src/tools"
 
@@ -12,6 +16,16 @@ import (
 
 var loggerNode = logrus.WithFields(logrus.Fields{"logger": "lorhammer/lora/node"})
 
+//maxConfirmedUplinkTransmissions is the number of times a confirmed uplink is sent without ACK before giving up,
+//as in the retransmission procedure of the LoRaWAN specification
+const maxConfirmedUplinkTransmissions = 8
+
+//adrAckLimit and adrAckDelay are the ADR_ACK_LIMIT and ADR_ACK_DELAY of the LoRaWAN specification
+const (
+	adrAckLimit = 64
+	adrAckDelay = 32
+)
+
 func newNode(nwsKeyStr string, appsKeyStr string, description string, payloads []model.Payload, randomPayloads bool) *model.Node {
 
 	devEui := tools.Random8Bytes()
@@ -28,19 +42,25 @@ func newNode(nwsKeyStr string, appsKeyStr string, description string, payloads [
 
 	return &model.Node{
 		DevEUI:         devEui,
-		AppEUI:         tools.Random8Bytes(),
+		JoinEUI:        tools.Random8Bytes(),
 		AppKey:         getGenericAES128Key(),
+		NwkKey:         getGenericAES128Key(),
 		DevAddr:        getDevAddrFromDevEUI(devEui),
 		AppSKey:        appsKey,
 		NwSKey:         nwsKey,
+		SNwkSIntKey:    nwsKey,
+		NwkSEncKey:     nwsKey,
 		Payloads:       payloads,
 		NextPayload:    0,
 		RandomPayloads: randomPayloads,
 		Description:    description,
+		ConfirmedRatio: 1,
 	}
 }
 
 func getJoinRequestDataPayload(node *model.Node) []byte {
+	// a new DevNonce is used for each JoinRequest, the JoinAccept session keys are derived from it
+	node.DevNonce = nextDevNonce(node)
 
 	phyPayload := lorawan.PHYPayload{
 		MHDR: lorawan.MHDR{
@@ -49,13 +69,17 @@ func getJoinRequestDataPayload(node *model.Node) []byte {
 		},
 
 		MACPayload: &lorawan.JoinRequestPayload{
-			AppEUI:   node.AppEUI,
+			AppEUI:   node.JoinEUI,
 			DevEUI:   node.DevEUI,
-			DevNonce: tools.Random2Bytes(),
+			DevNonce: node.DevNonce,
 		},
 	}
 
-	err := phyPayload.SetMIC(node.AppKey)
+	micKey := node.AppKey
+	if node.LoRaWAN11 {
+		micKey = node.NwkKey
+	}
+	err := phyPayload.SetMIC(micKey)
 	if err != nil {
 		loggerNode.WithFields(logrus.Fields{
 			"ref": "lorhammer/lora/payloadFactory:NewJoinRequestPHYPayload()",
@@ -71,8 +95,160 @@ func getJoinRequestDataPayload(node *model.Node) []byte {
 	return b
 }
 
+//nextDevNonce return a random DevNonce in LoRaWAN 1.0, the next value of the DevNonce counter in LoRaWAN 1.1
+func nextDevNonce(node *model.Node) [2]byte {
+	if !node.LoRaWAN11 {
+		return tools.Random2Bytes()
+	}
+	var devNonce [2]byte
+	binary.BigEndian.PutUint16(devNonce[:], binary.BigEndian.Uint16(node.DevNonce[:])+1)
+	return devNonce
+}
+
+//handleJoinAccept decrypt the JoinAccept with the node AppKey and, if the MIC is valid,
+//set the DevAddr and session keys given by the network server. It return false if the JoinAccept is not for this node
+func handleJoinAccept(node *model.Node, data []byte) (bool, error) {
+	if node.LoRaWAN11 {
+		return handleJoinAccept11(node, data)
+	}
+	phyPayload := lorawan.PHYPayload{}
+	if err := phyPayload.UnmarshalBinary(data); err != nil {
+		return false, err
+	}
+	if phyPayload.MHDR.MType != lorawan.JoinAccept {
+		return false, errors.New("PHYPayload is not a JoinAccept")
+	}
+	if err := phyPayload.DecryptJoinAcceptPayload(node.AppKey); err != nil {
+		return false, err
+	}
+	if ok, err := phyPayload.ValidateMIC(node.AppKey); err != nil || !ok {
+		return false, err
+	}
+
+	joinAcceptPayload, ok := phyPayload.MACPayload.(*lorawan.JoinAcceptPayload)
+	if !ok {
+		return false, errors.New("MACPayload is not a JoinAcceptPayload")
+	}
+
+	nwSKey, err := getSessionKey(0x01, node.AppKey, joinAcceptPayload.NetID, joinAcceptPayload.AppNonce, node.DevNonce)
+	if err != nil {
+		return false, err
+	}
+	appSKey, err := getSessionKey(0x02, node.AppKey, joinAcceptPayload.NetID, joinAcceptPayload.AppNonce, node.DevNonce)
+	if err != nil {
+		return false, err
+	}
+
+	node.DevAddr = joinAcceptPayload.DevAddr
+	node.NetID = joinAcceptPayload.NetID
+	node.NwSKey = nwSKey
+	node.SNwkSIntKey = nwSKey
+	node.NwkSEncKey = nwSKey
+	node.AppSKey = appSKey
+	node.JoinedNetwork = true
+
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui":  node.DevEUI.String(),
+		"DevAddr": node.DevAddr.String(),
+	}).Info("Node joined the network")
+
+	return true, nil
+}
+
+//getSessionKey derive a session key (0x01 for NwkSKey, 0x02 for AppSKey) as defined in LoRaWAN 1.0 :
+//aes128_encrypt(AppKey, keyType | AppNonce | NetID | DevNonce | pad16)
+func getSessionKey(keyType byte, appKey lorawan.AES128Key, netID lorawan.NetID, appNonce [3]byte, devNonce [2]byte) (lorawan.AES128Key, error) {
+	return deriveKey(appKey, keyType, appNonce[:], netID[:], devNonce[:])
+}
+
+//deriveKey return aes128_encrypt(rootKey, keyType | fields | pad16), fields are reversed as they are sent little endian on the air
+func deriveKey(rootKey lorawan.AES128Key, keyType byte, fields ...[]byte) (lorawan.AES128Key, error) {
+	var key lorawan.AES128Key
+
+	b := make([]byte, 0, len(key))
+	b = append(b, keyType)
+	for _, field := range fields {
+		for i := len(field) - 1; i >= 0; i-- {
+			b = append(b, field[i])
+		}
+	}
+	b = append(b, make([]byte, len(key)-len(b))...)
+
+	block, err := aes.NewCipher(rootKey[:])
+	if err != nil {
+		return key, err
+	}
+	block.Encrypt(key[:], b)
+	return key, nil
+}
+
+//nextFCntUp return the frame counter of the next uplink and increment the node counter
+//resets, replays and rollover are applied as defined in the scenario
+func nextFCntUp(node *model.Node) uint32 {
+	node.NbUplinks++
+
+	if node.FCnt.ReplayEvery > 0 && node.NbUplinks > 1 && node.NbUplinks%node.FCnt.ReplayEvery == 0 {
+		// the previous counter is sent again, the network server should drop this frame
+		return rollFCnt(node.FCntUp-1, node.FCnt.Rollover)
+	}
+	if node.FCnt.ResetEvery > 0 && node.NbUplinks%node.FCnt.ResetEvery == 0 {
+		loggerNode.WithField("DevEui", node.DevEUI.String()).Debug("Reset uplink frame counter")
+		node.FCntUp = node.FCnt.Start
+	}
+
+	fcnt := rollFCnt(node.FCntUp, node.FCnt.Rollover)
+	node.FCntUp = rollFCnt(fcnt+1, node.FCnt.Rollover)
+	return fcnt
+}
+
+//rollFCnt keep only the rollover least significant bits of the frame counter
+func rollFCnt(fcnt uint32, rollover int) uint32 {
+	if rollover == 16 {
+		return fcnt & 0xFFFF
+	}
+	return fcnt
+}
+
+//nextAdrAckReq increment the ADR_ACK_CNT of an ADR node and return the ADRACKReq bit of the next uplink
+//without downlink since ADR_ACK_LIMIT + ADR_ACK_DELAY uplinks, the node steps back every ADR_ACK_DELAY uplinks to regain connectivity
+func nextAdrAckReq(node *model.Node, reg *region.Region) bool {
+	if !node.Adr {
+		return false
+	}
+	node.AdrAckCnt++
+	if node.AdrAckCnt >= adrAckLimit+adrAckDelay && (node.AdrAckCnt-adrAckLimit)%adrAckDelay == 0 {
+		adrBackoff(node, reg)
+	}
+	return node.AdrAckCnt >= adrAckLimit
+}
+
+//adrBackoff set the maximal tx power, then the next lower data rate, then enable the default channels again
+func adrBackoff(node *model.Node, reg *region.Region) {
+	defer loggerNode.WithFields(logrus.Fields{
+		"DevEui":   node.DevEUI.String(),
+		"DataRate": node.DataRate,
+		"TxPower":  node.TxPower,
+	}).Debug("No downlink received, ADR backoff")
+
+	if node.TxPower > 0 {
+		node.TxPower = 0
+		return
+	}
+	for dataRate := node.DataRate - 1; dataRate >= 0; dataRate-- {
+		if reg.CheckDataRate(dataRate, node.Channels) == nil {
+			node.DataRate = dataRate
+			return
+		}
+	}
+	for i := range node.Channels {
+		if i < len(reg.Channels) {
+			node.Channels[i].Enabled = true
+		}
+	}
+}
+
 // GetPushDataPayload return the nextbyte arraypush data
-func GetPushDataPayload(node *model.Node, fcnt uint32) ([]byte, int64, error) {
+func GetPushDataPayload(node *model.Node, reg *region.Region) ([]byte, int64, error) {
 	fport := uint8(1)
 
 	var frmPayloadByteArray []byte
@@ -112,12 +288,30 @@ func GetPushDataPayload(node *model.Node, fcnt uint32) ([]byte, int64, error) {
 			"Payload : ":         node.Payloads[i].Value,
 			"Date : ":            node.Payloads[i].Date,
 		}).Debug("Payload sent")
-		frmPayloadByteArray, _ = hex.DecodeString(node.Payloads[i].Value)
+		if len(node.Payloads[i].Template) > 0 {
+			frmPayloadByteArray = templatePayload(node, node.Payloads[i].Template)
+		} else {
+			frmPayloadByteArray, _ = hex.DecodeString(node.Payloads[i].Value)
+		}
+		if node.Payloads[i].FPort != nil {
+			fport = *node.Payloads[i].FPort
+		}
+	}
+
+	mType := lorawan.UnconfirmedDataUp
+	if tools.RandomFloat64() < node.ConfirmedRatio {
+		mType = lorawan.ConfirmedDataUp
+	}
+
+	// MAC answers can't be sent in FOpts with a FRMPayload of port 0
+	var fOpts []lorawan.MACCommand
+	if fport != 0 {
+		fOpts = getUplinkFOpts(node)
 	}
 
 	phyPayload := lorawan.PHYPayload{
 		MHDR: lorawan.MHDR{
-			MType: lorawan.MType(lorawan.ConfirmedDataUp),
+			MType: mType,
 			Major: lorawan.LoRaWANR1,
 		},
 
@@ -125,17 +319,29 @@ func GetPushDataPayload(node *model.Node, fcnt uint32) ([]byte, int64, error) {
 			FHDR: lorawan.FHDR{
 				DevAddr: node.DevAddr,
 				FCtrl: lorawan.FCtrl{
-					ADR:       false,
-					ADRACKReq: false,
-					ACK:       false,
+					ADR:       node.Adr,
+					ADRACKReq: nextAdrAckReq(node, reg),
+					ACK:       node.AckDownlink,
+					// the FPending bit of downlinks is the Class B bit of uplinks
+					FPending: isClassBReady(node),
 				},
-				FCnt: fcnt,
+				FCnt:  nextFCntUp(node),
+				FOpts: fOpts,
 			},
 			FPort:      &fport,
 			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: frmPayloadByteArray}},
 		},
 	}
 
+	// FRMPayload of port 0 contains only mac commands, encrypted with the NwkSKey instead of the AppSKey
+	frmPayloadKey := node.AppSKey
+	if fport == 0 {
+		frmPayloadKey = node.NwkSEncKey
+	}
+	if err := phyPayload.EncryptFRMPayload(frmPayloadKey); err != nil {
+		return nil, 0, errors.New("unable to encrypt FRMPayload")
+	}
+
 	err := phyPayload.SetMIC(node.NwSKey)
 
 	if err != nil {
@@ -149,9 +355,101 @@ func GetPushDataPayload(node *model.Node, fcnt uint32) ([]byte, int64, error) {
 	if err != nil {
 		return nil, 0, errors.New("unable to marshal physical payload")
 	}
+	if node.LoRaWAN11 {
+		// the LoRaWAN 1.1 MIC depends on the channel, it is set when the uplink is sent
+		if err := encryptUplinkFOpts(node, b); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// the confirmed downlink has been acknowledged by this uplink
+	node.AckDownlink = false
+	if mType == lorawan.ConfirmedDataUp {
+		// kept to be sent again until the network server acknowledges it
+		node.PendingUplink = b
+		node.PendingUplinkDate = date
+		node.PendingUplinkTx = 1
+		node.RepeatedUplink = nil
+	} else {
+		node.PendingUplink = nil
+		// sent again at the next emissions of the node until it has been sent NbTrans times
+		node.RepeatedUplink = b
+		node.RepeatedUplinkDate = date
+		node.RepeatedUplinkTx = 1
+	}
 	return b, date, nil
 }
 
+//getRepetition return the unconfirmed uplink, with the same frame counter, if it has been sent less than NbTrans times
+//it return nil if there is nothing to repeat
+func getRepetition(node *model.Node) ([]byte, int64) {
+	if node.RepeatedUplink == nil || node.RepeatedUplinkTx >= node.NbTrans {
+		return nil, 0
+	}
+	node.RepeatedUplinkTx++
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui": node.DevEUI.String(),
+		"nbTx":   node.RepeatedUplinkTx,
+	}).Debug("Repeat unconfirmed uplink")
+	return node.RepeatedUplink, node.RepeatedUplinkDate
+}
+
+//getRetransmission return the confirmed uplink waiting for an ACK, with the same frame counter, if it can be sent again
+//it return nil if there is nothing to retransmit or if the node doesn't retransmit
+func getRetransmission(node *model.Node) ([]byte, int64) {
+	if !node.Retransmit || node.PendingUplink == nil || node.PendingUplinkTx >= maxConfirmedUplinkTransmissions {
+		return nil, 0
+	}
+	node.PendingUplinkTx++
+	loggerNode.WithFields(logrus.Fields{
+		"DevEui": node.DevEUI.String(),
+		"nbTx":   node.PendingUplinkTx,
+	}).Debug("Retransmit confirmed uplink")
+	return node.PendingUplink, node.PendingUplinkDate
+}
+
+//handleDataDown read the FCtrl and the MAC commands of a data downlink addressed to the node
+//it return true if the downlink acknowledges the confirmed uplink waiting for an ACK
+func handleDataDown(node *model.Node, reg *region.Region, phyPayload lorawan.PHYPayload) (bool, error) {
+	macPayload, ok := phyPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return false, errors.New("MACPayload is not a data MACPayload")
+	}
+	if phyPayload.MHDR.MType == lorawan.ConfirmedDataDown {
+		// the next uplink must have the ACK bit set
+		node.AckDownlink = true
+		node.ConfFCntDown = macPayload.FHDR.FCnt
+	}
+	// a downlink has been received, answers sent until then are not needed anymore and the uplink is not repeated
+	node.StickyMacAnswers = nil
+	node.RepeatedUplink = nil
+	node.AdrAckCnt = 0
+	macCommands, err := getDownlinkMacCommands(node, macPayload)
+	if err != nil {
+		return false, err
+	}
+	handleMacCommands(node, reg, macCommands)
+	if !macPayload.FHDR.FCtrl.ACK || node.PendingUplink == nil {
+		return false, nil
+	}
+	node.PendingUplink = nil
+	return true, nil
+}
+
+//nextChannel return the index of a random enabled and usable channel allowing the node data rate
+func nextChannel(node *model.Node, usable func(channel model.Channel) bool) (int, error) {
+	var channels []int
+	for i, channel := range node.Channels {
+		if channel.Enabled && channel.MinDR <= node.DataRate && node.DataRate <= channel.MaxDR && usable(channel) {
+			channels = append(channels, i)
+		}
+	}
+	if len(channels) == 0 {
+		return 0, fmt.Errorf("no enabled channel allows data rate %d", node.DataRate)
+	}
+	return channels[tools.Random(0, len(channels)-1)], nil
+}
+
 func getDevAddrFromDevEUI(devEUI lorawan.EUI64) lorawan.DevAddr {
 	devAddr := lorawan.DevAddr{}
 	devEuiStr := devEUI.String()
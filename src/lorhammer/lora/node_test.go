@@ -1,6 +1,8 @@
 package lora
 
 import (
+	"bytes"
+	"encoding/hex"
 	"lorhammer/src/model"
 	"testing"
 
@@ -33,8 +35,7 @@ func TestNode_GetPushDataPayload(t *testing.T) {
 		true,
 	)
 
-	fcnt := uint32(1)
-	dataPayload, date, err := GetPushDataPayload(node, fcnt)
+	dataPayload, date, err := GetPushDataPayload(node, eu868)
 	if err != nil {
 		t.Fatal("Couldn't get PushData payload")
 	}
@@ -82,8 +83,7 @@ func TestNode_GetPushDataPayloadWithoutRandomAccessOnPayloadArray(t *testing.T)
 		false,
 	)
 	for index := 0; index < len(node.Payloads); index++ {
-		fcnt := uint32(1)
-		dataPayload, date, err := GetPushDataPayload(node, fcnt)
+		dataPayload, date, err := GetPushDataPayload(node, eu868)
 		if err != nil {
 			t.Fatal("Couldn't get PushData payload")
 		}
@@ -133,8 +133,7 @@ func TestNode_GetPushDataPayloadWithoutRandomAccessOnPayloadArrayAndReload(t *te
 		false,
 	)
 	for index := 0; index < 8; index++ {
-		fcnt := uint32(1)
-		dataPayload, date, err := GetPushDataPayload(node, fcnt)
+		dataPayload, date, err := GetPushDataPayload(node, eu868)
 		if err != nil {
 			t.Fatal("Couldn't get PushData payload")
 		}
@@ -180,8 +179,7 @@ func TestNode_GetPushDataPayloadWithEmptyPayloadArray(t *testing.T) {
 		true,
 	)
 
-	fcnt := uint32(1)
-	dataPayload, date, err := GetPushDataPayload(node, fcnt)
+	dataPayload, date, err := GetPushDataPayload(node, eu868)
 	if err != nil {
 		t.Fatal("Couldn't get PushData payload")
 	}
@@ -243,3 +241,461 @@ func TestNewJoinRequestPHYPayload(t *testing.T) {
 	}
 
 }
+
+func newJoinAccept(t *testing.T, appKey lorawan.AES128Key, devAddr lorawan.DevAddr) []byte {
+	phyPayload := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinAccept,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinAcceptPayload{
+			AppNonce: [3]byte{1, 2, 3},
+			NetID:    lorawan.NetID{4, 5, 6},
+			DevAddr:  devAddr,
+		},
+	}
+	if err := phyPayload.SetMIC(appKey); err != nil {
+		t.Fatal("Couldn't set JoinAccept MIC")
+	}
+	if err := phyPayload.EncryptJoinAcceptPayload(appKey); err != nil {
+		t.Fatal("Couldn't encrypt JoinAccept")
+	}
+	data, err := phyPayload.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal JoinAccept")
+	}
+	return data
+}
+
+func TestHandleJoinAccept(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{}, false)
+	getJoinRequestDataPayload(node)
+
+	devAddr := lorawan.DevAddr{1, 2, 3, 4}
+	joined, err := handleJoinAccept(node, newJoinAccept(t, node.AppKey, devAddr))
+	if err != nil {
+		t.Fatal("A valid JoinAccept should not return error")
+	}
+	if !joined || !node.JoinedNetwork {
+		t.Fatal("Node should have joined the network")
+	}
+	if node.DevAddr != devAddr {
+		t.Fatal("DevAddr must be the one given by the JoinAccept")
+	}
+
+	nwSKey, _ := getSessionKey(0x01, node.AppKey, lorawan.NetID{4, 5, 6}, [3]byte{1, 2, 3}, node.DevNonce)
+	appSKey, _ := getSessionKey(0x02, node.AppKey, lorawan.NetID{4, 5, 6}, [3]byte{1, 2, 3}, node.DevNonce)
+	if node.NwSKey != nwSKey || node.AppSKey != appSKey {
+		t.Fatal("Session keys must be derived from the JoinAccept and the DevNonce")
+	}
+	if node.NwSKey == node.AppSKey {
+		t.Fatal("NwSKey and AppSKey must be different")
+	}
+}
+
+func TestHandleJoinAcceptWrongAppKey(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{}, false)
+	getJoinRequestDataPayload(node)
+	devAddr := node.DevAddr
+
+	joined, err := handleJoinAccept(node, newJoinAccept(t, lorawan.AES128Key{}, lorawan.DevAddr{1, 2, 3, 4}))
+	if err != nil {
+		t.Fatal("A JoinAccept for another node should not return error")
+	}
+	if joined || node.JoinedNetwork {
+		t.Fatal("Node should not have joined the network with another AppKey")
+	}
+	if node.DevAddr != devAddr {
+		t.Fatal("DevAddr must not change")
+	}
+}
+
+func TestGetSessionKeyDependsOnDevNonce(t *testing.T) {
+	key1, err := getSessionKey(0x01, getGenericAES128Key(), lorawan.NetID{4, 5, 6}, [3]byte{1, 2, 3}, [2]byte{0, 1})
+	if err != nil {
+		t.Fatal("Session key derivation should not return error")
+	}
+	key2, _ := getSessionKey(0x01, getGenericAES128Key(), lorawan.NetID{4, 5, 6}, [3]byte{1, 2, 3}, [2]byte{0, 2})
+	if key1 == key2 {
+		t.Fatal("Session keys must depend on the DevNonce")
+	}
+}
+
+func TestNextFCntUpPerNode(t *testing.T) {
+	node1 := newNode("", "", "", []model.Payload{}, false)
+	node2 := newNode("", "", "", []model.Payload{}, false)
+
+	for i := uint32(0); i < 3; i++ {
+		if fcnt := nextFCntUp(node1); fcnt != i {
+			t.Fatalf("Node frame counter must be %d, found %d", i, fcnt)
+		}
+	}
+	if fcnt := nextFCntUp(node2); fcnt != 0 {
+		t.Fatal("Each node must have its own frame counter")
+	}
+	if node1.FCntUp != 3 {
+		t.Fatal("FCntUp must be the next frame counter to send")
+	}
+}
+
+func TestNextFCntUpRollover(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{}, false)
+	node.FCnt = model.FCnt{Rollover: 16}
+	node.FCntUp = 0xFFFF
+
+	if fcnt := nextFCntUp(node); fcnt != 0xFFFF {
+		t.Fatal("Last 16 bits frame counter must be sent before rollover")
+	}
+	if fcnt := nextFCntUp(node); fcnt != 0 {
+		t.Fatal("16 bits frame counter must rollover to 0")
+	}
+
+	node.FCnt = model.FCnt{Rollover: 32}
+	node.FCntUp = 0xFFFF
+	nextFCntUp(node)
+	if fcnt := nextFCntUp(node); fcnt != 0x10000 {
+		t.Fatal("32 bits frame counter must not rollover at 16 bits")
+	}
+
+	node.FCntUp = 0xFFFFFFFF
+	nextFCntUp(node)
+	if fcnt := nextFCntUp(node); fcnt != 0 {
+		t.Fatal("32 bits frame counter must rollover to 0")
+	}
+}
+
+func TestNextFCntUpReset(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{}, false)
+	node.FCnt = model.FCnt{Start: 10, ResetEvery: 3}
+	node.FCntUp = 10
+
+	expected := []uint32{10, 11, 10, 11, 12, 10}
+	for i, e := range expected {
+		if fcnt := nextFCntUp(node); fcnt != e {
+			t.Fatalf("Uplink %d must have frame counter %d, found %d", i, e, fcnt)
+		}
+	}
+}
+
+func TestNextFCntUpReplay(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{}, false)
+	node.FCnt = model.FCnt{ReplayEvery: 2}
+
+	expected := []uint32{0, 0, 1, 1, 2}
+	for i, e := range expected {
+		if fcnt := nextFCntUp(node); fcnt != e {
+			t.Fatalf("Uplink %d must have frame counter %d, found %d", i, e, fcnt)
+		}
+	}
+}
+
+func decryptPushDataFRMPayload(t *testing.T, data []byte, key lorawan.AES128Key) (uint8, []byte) {
+	phyPayload := lorawan.PHYPayload{}
+	if err := phyPayload.UnmarshalBinary(data); err != nil {
+		t.Fatal("Couldn't unmarshall PHYPayload Binary")
+	}
+	macPayload, ok := phyPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok || macPayload.FPort == nil || len(macPayload.FRMPayload) != 1 {
+		t.Fatal("the MacPayload should be of Type MACPayload with a FPort and a FRMPayload")
+	}
+	dataPayload, ok := macPayload.FRMPayload[0].(*lorawan.DataPayload)
+	if !ok {
+		t.Fatal("the FRMPayload should be of Type DataPayload")
+	}
+	decrypted, err := lorawan.EncryptFRMPayload(key, true, macPayload.FHDR.DevAddr, macPayload.FHDR.FCnt, dataPayload.Bytes)
+	if err != nil {
+		t.Fatal("Couldn't decrypt FRMPayload")
+	}
+	return *macPayload.FPort, decrypted
+}
+
+func TestNode_GetPushDataPayloadEncryptedWithAppSKey(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233"},
+		},
+		false,
+	)
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+
+	fport, frmPayload := decryptPushDataFRMPayload(t, dataPayload, node.AppSKey)
+	if fport != 1 {
+		t.Fatal("FPort must be 1 when not set in payload")
+	}
+	if hex.EncodeToString(frmPayload) != "01b501002919000006018403131313121233" {
+		t.Fatal("FRMPayload must be encrypted with the AppSKey")
+	}
+}
+
+func TestNode_GetPushDataPayloadWithFPort(t *testing.T) {
+	fport2, fport0 := uint8(2), uint8(0)
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233", FPort: &fport2},
+			{Value: "0605", FPort: &fport0},
+		},
+		false,
+	)
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	fport, frmPayload := decryptPushDataFRMPayload(t, dataPayload, node.AppSKey)
+	if fport != 2 || hex.EncodeToString(frmPayload) != "01b501002919000006018403131313121233" {
+		t.Fatal("FPort of the payload must be used and FRMPayload encrypted with the AppSKey")
+	}
+
+	dataPayload, _, err = GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	fport, frmPayload = decryptPushDataFRMPayload(t, dataPayload, node.NwSKey)
+	if fport != 0 || hex.EncodeToString(frmPayload) != "0605" {
+		t.Fatal("FRMPayload of FPort 0 must be encrypted with the NwSKey")
+	}
+}
+
+func TestNode_GetPushDataPayloadUnconfirmed(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233"},
+		},
+		false,
+	)
+	node.ConfirmedRatio = 0
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	phyPayload := lorawan.PHYPayload{}
+	if err := phyPayload.UnmarshalBinary(dataPayload); err != nil {
+		t.Fatal("Couldn't unmarshall PHYPayload Binary")
+	}
+	if phyPayload.MHDR.MType != lorawan.UnconfirmedDataUp {
+		t.Fatal("Push data messages must be unconfirmed when confirmed ratio is 0")
+	}
+	if node.PendingUplink != nil {
+		t.Fatal("Unconfirmed uplink must not wait for an ACK")
+	}
+}
+
+func TestGetRetransmission(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233", Date: 42},
+		},
+		false,
+	)
+
+	node.Retransmit = true
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	for i := 1; i < maxConfirmedUplinkTransmissions; i++ {
+		retransmission, date := getRetransmission(node)
+		if !bytes.Equal(retransmission, dataPayload) || date != 42 {
+			t.Fatal("Confirmed uplink without ACK must be sent again with the same frame counter")
+		}
+	}
+	if retransmission, _ := getRetransmission(node); retransmission != nil {
+		t.Fatalf("Confirmed uplink must not be sent more than %d times", maxConfirmedUplinkTransmissions)
+	}
+}
+
+func TestGetRepetition(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73", "19842bd94743246b367c2e90942a1f77", "", []model.Payload{{Value: "01", Date: 42}}, false)
+	node.ConfirmedRatio, node.NbTrans = 0, 3
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	for i := 1; i < node.NbTrans; i++ {
+		repetition, date := getRepetition(node)
+		if !bytes.Equal(repetition, dataPayload) || date != 42 {
+			t.Fatal("Unconfirmed uplink must be sent again with the same frame counter")
+		}
+	}
+	if repetition, _ := getRepetition(node); repetition != nil {
+		t.Fatalf("Unconfirmed uplink must not be sent more than %d times", node.NbTrans)
+	}
+
+	GetPushDataPayload(node, eu868)
+	if _, err := handleDataDown(node, eu868, newDataDown(t, node, lorawan.UnconfirmedDataDown, false)); err != nil {
+		t.Fatal("Couldn't handle data downlink")
+	}
+	if repetition, _ := getRepetition(node); repetition != nil {
+		t.Fatal("Unconfirmed uplink must not be repeated once a downlink is received")
+	}
+}
+
+func TestGetRetransmissionNotSet(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01"}}, false)
+	if _, _, err := GetPushDataPayload(node, eu868); err != nil || node.PendingUplink == nil {
+		t.Fatal("Nodes must send confirmed uplinks by default")
+	}
+	if retransmission, _ := getRetransmission(node); retransmission != nil {
+		t.Fatal("Confirmed uplink must not be sent again when the scenario doesn't set the confirmed ratio")
+	}
+}
+
+func newDataDown(t *testing.T, node *model.Node, mType lorawan.MType, ack bool) lorawan.PHYPayload {
+	phyPayload := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: mType, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: node.DevAddr,
+				FCtrl:   lorawan.FCtrl{ACK: ack},
+			},
+		},
+	}
+	if err := phyPayload.SetMIC(node.NwSKey); err != nil {
+		t.Fatal("Couldn't set downlink MIC")
+	}
+	return phyPayload
+}
+
+func TestHandleDataDownAck(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233"},
+		},
+		false,
+	)
+	if _, _, err := GetPushDataPayload(node, eu868); err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+
+	if acked, err := handleDataDown(node, eu868, newDataDown(t, node, lorawan.UnconfirmedDataDown, false)); err != nil || acked {
+		t.Fatal("Downlink without ACK bit must not acknowledge the uplink")
+	}
+	if acked, err := handleDataDown(node, eu868, newDataDown(t, node, lorawan.UnconfirmedDataDown, true)); err != nil || !acked {
+		t.Fatal("Downlink with ACK bit must acknowledge the uplink")
+	}
+	if retransmission, _ := getRetransmission(node); retransmission != nil {
+		t.Fatal("Acknowledged uplink must not be sent again")
+	}
+}
+
+func TestHandleDataDownConfirmed(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73",
+		"19842bd94743246b367c2e90942a1f77",
+		"",
+		[]model.Payload{
+			{Value: "01B501002919000006018403131313121233"},
+		},
+		false,
+	)
+	if _, err := handleDataDown(node, eu868, newDataDown(t, node, lorawan.ConfirmedDataDown, false)); err != nil {
+		t.Fatal("Couldn't handle confirmed downlink")
+	}
+
+	dataPayload, _, err := GetPushDataPayload(node, eu868)
+	if err != nil {
+		t.Fatal("Couldn't get PushData payload")
+	}
+	phyPayload := lorawan.PHYPayload{}
+	if err := phyPayload.UnmarshalBinary(dataPayload); err != nil {
+		t.Fatal("Couldn't unmarshall PHYPayload Binary")
+	}
+	if !phyPayload.MACPayload.(*lorawan.MACPayload).FHDR.FCtrl.ACK {
+		t.Fatal("Uplink following a confirmed downlink must have the ACK bit set")
+	}
+	if node.AckDownlink {
+		t.Fatal("Confirmed downlink must be acknowledged only once")
+	}
+}
+
+func getPushDataFCtrl(t *testing.T, data []byte) lorawan.FCtrl {
+	phyPayload := lorawan.PHYPayload{}
+	if err := phyPayload.UnmarshalBinary(data); err != nil {
+		t.Fatal("Couldn't unmarshall PHYPayload Binary")
+	}
+	macPayload, ok := phyPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		t.Fatal("the MacPayload should be of Type MACPayload")
+	}
+	return macPayload.FHDR.FCtrl
+}
+
+func TestNode_GetPushDataPayloadAdrAckReq(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	node.ConfirmedRatio = 0
+	node.Adr = true
+
+	for i := 1; i <= adrAckLimit; i++ {
+		dataPayload, _, err := GetPushDataPayload(node, eu868)
+		if err != nil {
+			t.Fatal("Couldn't get PushData payload")
+		}
+		fCtrl := getPushDataFCtrl(t, dataPayload)
+		if !fCtrl.ADR {
+			t.Fatal("ADR bit must be set for ADR nodes")
+		}
+		if fCtrl.ADRACKReq != (i == adrAckLimit) {
+			t.Fatalf("ADRACKReq must be set from the uplink %d, got %t at uplink %d", adrAckLimit, fCtrl.ADRACKReq, i)
+		}
+	}
+
+	handleDataDown(node, eu868, newDataDown(t, node, lorawan.UnconfirmedDataDown, false))
+	dataPayload, _, _ := GetPushDataPayload(node, eu868)
+	if getPushDataFCtrl(t, dataPayload).ADRACKReq {
+		t.Fatal("A downlink must reset the ADR_ACK_CNT")
+	}
+}
+
+func TestNode_GetPushDataPayloadWithoutAdr(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	node.AdrAckCnt = adrAckLimit
+
+	dataPayload, _, _ := GetPushDataPayload(node, eu868)
+	fCtrl := getPushDataFCtrl(t, dataPayload)
+	if fCtrl.ADR || fCtrl.ADRACKReq {
+		t.Fatal("ADR and ADRACKReq bits must not be set for nodes without ADR")
+	}
+}
+
+func TestAdrBackoff(t *testing.T) {
+	channels, _ := eu868.NodeChannels(nil)
+	channels[1].Enabled = false
+	node := &model.Node{Adr: true, DataRate: 2, TxPower: 3, Channels: channels, AdrAckCnt: adrAckLimit + adrAckDelay - 1}
+
+	nextAdrAckReq(node, eu868)
+	if node.TxPower != 0 || node.DataRate != 2 {
+		t.Fatal("Tx power must be set to its maximum first")
+	}
+	for i := 0; i < adrAckDelay-1; i++ {
+		nextAdrAckReq(node, eu868)
+	}
+	if node.DataRate != 2 {
+		t.Fatal("Data rate must not change before ADR_ACK_DELAY uplinks")
+	}
+	nextAdrAckReq(node, eu868)
+	if node.DataRate != 1 {
+		t.Fatalf("Data rate must step down every ADR_ACK_DELAY uplinks, got DR%d", node.DataRate)
+	}
+
+	node.DataRate = 0
+	node.AdrAckCnt = adrAckLimit + adrAckDelay - 1
+	nextAdrAckReq(node, eu868)
+	if !node.Channels[1].Enabled {
+		t.Fatal("Default channels must be enabled again at the lowest data rate")
+	}
+}
@@ -0,0 +1,143 @@
+package lora
+
+import (
+	"errors"
+	"lorhammer/src/lorhammer/region"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"math"
+)
+
+const (
+	defaultRssi          = -35
+	defaultSnr           = 5.1
+	defaultTxPower       = 14
+	defaultReferenceLoss = 32
+	defaultExponent      = 2.7
+	// noise figure of the gateway receiver in dB
+	noiseFigure = 6
+	// range of the SNR reported by concentrators, in dB
+	minSnr = -20
+	maxSnr = 15
+)
+
+//CheckRadio return an error if the radio model of the scenario is not valid
+func CheckRadio(radio *model.Radio) error {
+	if radio == nil {
+		return nil
+	}
+	if radio.Scope != "" && radio.Scope != "uplink" && radio.Scope != "node" && radio.Scope != "gateway" {
+		return errors.New("radio scope must be uplink, node or gateway")
+	}
+	if radio.Rssi[0] > radio.Rssi[1] || radio.Snr[0] > radio.Snr[1] {
+		return errors.New("radio rssi and snr min must be lower than max")
+	}
+	if radio.PathLoss != nil {
+		if radio.PathLoss.Distance[0] <= 0 || radio.PathLoss.Distance[0] > radio.PathLoss.Distance[1] {
+			return errors.New("radio path loss distance min must be positive and lower than max")
+		}
+		if radio.PathLoss.Shadowing < 0 {
+			return errors.New("radio path loss shadowing must be positive")
+		}
+	}
+	return nil
+}
+
+//drawRadioConditions draw the RSSI, SNR and distance of uplinks from the ranges of the radio model
+func drawRadioConditions(radio *model.Radio) model.RadioConditions {
+	conditions := model.RadioConditions{
+		Rssi: randomInRange(radio.Rssi),
+		Snr:  randomInRange(radio.Snr),
+	}
+	if radio.PathLoss != nil {
+		conditions.Distance = randomInRange(radio.PathLoss.Distance)
+	}
+	return conditions
+}
+
+func randomInRange(r [2]float64) float64 {
+	return r[0] + tools.RandomFloat64()*(r[1]-r[0])
+}
+
+//getRadioConditions return the conditions of the next uplink of the node according to the radio model scope
+func (gateway *LorhammerGateway) getRadioConditions(node *model.Node) model.RadioConditions {
+	switch gateway.Radio.Scope {
+	case "node":
+		return node.RadioConditions
+	case "gateway":
+		return gateway.RadioConditions
+	default:
+		return drawRadioConditions(gateway.Radio)
+	}
+}
+
+//getRadioMetadata return the RSSI and SNR of the next uplink of the node
+//with a path loss model, the node data rate is set to the fastest one allowed by the link budget
+//except for ADR nodes once they have sent their first data uplink, the network server controls their data rate
+func (gateway *LorhammerGateway) getRadioMetadata(node *model.Node) (int16, float64) {
+	if gateway.Radio == nil {
+		return defaultRssi, defaultSnr
+	}
+	conditions := gateway.getRadioConditions(node)
+	if gateway.Radio.PathLoss == nil {
+		return int16(math.Floor(conditions.Rssi + 0.5)), roundSnr(conditions.Snr)
+	}
+
+	reg := gateway.getRegion()
+	// each TXPower step lower the transmit power of 2dB
+	rssi := pathLossRssi(*gateway.Radio.PathLoss, conditions.Distance) - 2*float64(node.TxPower)
+	if !node.Adr || node.NbUplinks <= 1 {
+		node.DataRate = linkBudgetDataRate(reg, node, rssi)
+	}
+	// shadowing changes each uplink but is not known by the node choosing its data rate
+	rssi += tools.RandomNormFloat64() * gateway.Radio.PathLoss.Shadowing
+	snr := rssi - noiseFloor(reg.DataRates[node.DataRate].Bandwidth)
+	return int16(math.Floor(rssi + 0.5)), roundSnr(snr)
+}
+
+//pathLossRssi return the RSSI in dBm of a node at distance meters of the gateway with the log-distance path loss model
+func pathLossRssi(pathLoss model.PathLoss, distance float64) float64 {
+	txPower, referenceLoss, exponent := pathLoss.TxPower, pathLoss.ReferenceLoss, pathLoss.Exponent
+	if txPower == 0 {
+		txPower = defaultTxPower
+	}
+	if referenceLoss == 0 {
+		referenceLoss = defaultReferenceLoss
+	}
+	if exponent == 0 {
+		exponent = defaultExponent
+	}
+	return txPower - referenceLoss - 10*exponent*math.Log10(distance)
+}
+
+//noiseFloor return the noise in dBm received by the gateway on a bandwidth in kHz
+func noiseFloor(bandwidth int) float64 {
+	return -174 + 10*math.Log10(float64(bandwidth)*1000) + noiseFigure
+}
+
+//requiredSnr return the minimal SNR in dB to demodulate a LoRa spreading factor
+func requiredSnr(spreadingFactor int) float64 {
+	return -20 + float64(12-spreadingFactor)*2.5
+}
+
+//linkBudgetDataRate return the fastest LoRa data rate of the node channels that can be demodulated with this RSSI
+//the slowest one if none can be demodulated
+func linkBudgetDataRate(reg *region.Region, node *model.Node, rssi float64) int {
+	slowest := node.DataRate
+	for dr := len(reg.DataRates) - 1; dr >= 0; dr-- {
+		dataRate := reg.DataRates[dr]
+		if dataRate.IsFSK() || reg.CheckDataRate(dr, node.Channels) != nil {
+			continue
+		}
+		if rssi-noiseFloor(dataRate.Bandwidth) >= requiredSnr(dataRate.SpreadingFactor) {
+			return dr
+		}
+		slowest = dr
+	}
+	return slowest
+}
+
+//roundSnr return the SNR rounded to 0.1dB and clamped to the range reported by concentrators
+func roundSnr(snr float64) float64 {
+	return math.Floor(math.Max(minSnr, math.Min(maxSnr, snr))*10+0.5) / 10
+}
@@ -0,0 +1,87 @@
+package lora
+
+import (
+	"lorhammer/src/model"
+	"testing"
+)
+
+var wrongRadios = []*model.Radio{
+	{Scope: "everywhere"},
+	{Rssi: [2]float64{-40, -120}},
+	{Snr: [2]float64{10, -10}},
+	{PathLoss: &model.PathLoss{Distance: [2]float64{0, 100}}},
+	{PathLoss: &model.PathLoss{Distance: [2]float64{200, 100}}},
+	{PathLoss: &model.PathLoss{Distance: [2]float64{100, 200}, Shadowing: -1}},
+}
+
+func TestCheckRadio(t *testing.T) {
+	if err := CheckRadio(nil); err != nil {
+		t.Fatal("No radio model must be valid")
+	}
+	if err := CheckRadio(&model.Radio{Scope: "node", Rssi: [2]float64{-120, -40}, Snr: [2]float64{-10, 10}}); err != nil {
+		t.Fatal("Radio model with ranges must be valid")
+	}
+	for _, radio := range wrongRadios {
+		if err := CheckRadio(radio); err == nil {
+			t.Fatalf("Error expected on wrong radio model %+v", radio)
+		}
+	}
+}
+
+func TestGetRadioMetadataDefault(t *testing.T) {
+	gateway := &LorhammerGateway{}
+
+	rssi, snr := gateway.getRadioMetadata(&model.Node{})
+
+	if rssi != -35 || snr != 5.1 {
+		t.Fatal("RSSI must be -35 and SNR 5.1 when no radio model is set")
+	}
+}
+
+func TestGetRadioMetadataRange(t *testing.T) {
+	gateway := &LorhammerGateway{Radio: &model.Radio{Rssi: [2]float64{-120, -40}, Snr: [2]float64{-10, 10}}}
+
+	for i := 0; i < 20; i++ {
+		rssi, snr := gateway.getRadioMetadata(&model.Node{})
+		if rssi < -120 || rssi > -40 || snr < -10 || snr > 10 {
+			t.Fatalf("RSSI %d and SNR %f must be in the radio model ranges", rssi, snr)
+		}
+	}
+}
+
+func TestGetRadioMetadataScope(t *testing.T) {
+	radio := &model.Radio{Scope: "node", Rssi: [2]float64{-120, -40}, Snr: [2]float64{-10, 10}}
+	gateway := &LorhammerGateway{
+		Radio:           radio,
+		RadioConditions: model.RadioConditions{Rssi: -50, Snr: 8},
+	}
+	node := &model.Node{RadioConditions: model.RadioConditions{Rssi: -100, Snr: -2.5}}
+
+	if rssi, snr := gateway.getRadioMetadata(node); rssi != -100 || snr != -2.5 {
+		t.Fatal("RSSI and SNR must be the node ones with node scope")
+	}
+	radio.Scope = "gateway"
+	if rssi, snr := gateway.getRadioMetadata(node); rssi != -50 || snr != 8 {
+		t.Fatal("RSSI and SNR must be the gateway ones with gateway scope")
+	}
+}
+
+func TestGetRadioMetadataPathLoss(t *testing.T) {
+	gateway := &LorhammerGateway{Radio: &model.Radio{Scope: "node", PathLoss: &model.PathLoss{Distance: [2]float64{100, 100000}}}}
+	channels, _ := gateway.getRegion().NodeChannels(nil)
+
+	near := &model.Node{Channels: channels, RadioConditions: model.RadioConditions{Distance: 100}}
+	if rssi, snr := gateway.getRadioMetadata(near); rssi != -72 || near.DataRate != 5 || snr != maxSnr {
+		t.Fatalf("Node at 100m must have -72dBm RSSI, use DR5 and the highest SNR, got %d, DR%d and %f", rssi, near.DataRate, snr)
+	}
+
+	far := &model.Node{Channels: channels, DataRate: 5, RadioConditions: model.RadioConditions{Distance: 20000}}
+	if _, snr := gateway.getRadioMetadata(far); far.DataRate != 1 || snr > -17 || snr < -17.5 {
+		t.Fatalf("Node at 20km must use DR1 (SF11) with a SNR around -17dB, got DR%d and %f", far.DataRate, snr)
+	}
+
+	tooFar := &model.Node{Channels: channels, DataRate: 5, RadioConditions: model.RadioConditions{Distance: 100000}}
+	if _, snr := gateway.getRadioMetadata(tooFar); tooFar.DataRate != 0 || snr != minSnr {
+		t.Fatal("Node out of range must use the slowest data rate with the lowest SNR")
+	}
+}
@@ -0,0 +1,142 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//CheckReplay return an error if the replay of the scenario is not valid or used with a node schedule or a load profile
+func CheckReplay(replay *model.Replay, schedule *model.NodeSchedule, profile *model.LoadProfile) error {
+	if replay == nil {
+		return nil
+	}
+	if schedule != nil || profile != nil {
+		return errors.New("replay can't be used with nodeSchedule or loadProfile")
+	}
+	if replay.Speed < 0 {
+		return errors.New("replay speed must be positive")
+	}
+	if replay.From > replay.To {
+		return errors.New("replay from must be before to")
+	}
+	return nil
+}
+
+//ReplayWindow return the replay with the times of the first and last payloads of the fleet devices, if they are not set by the orchestrator
+func ReplayWindow(replay *model.Replay, fleet *model.Fleet) *model.Replay {
+	if replay == nil || replay.From != 0 || replay.To != 0 || fleet == nil {
+		return replay
+	}
+	window := *replay
+	first := true
+	for _, device := range fleet.Devices {
+		for _, payload := range device.Payloads {
+			if first || recordedTime(payload) < window.From {
+				window.From = recordedTime(payload)
+			}
+			if first || recordedTime(payload) > window.To {
+				window.To = recordedTime(payload)
+			}
+			first = false
+		}
+	}
+	return &window
+}
+
+//recordedTime return the unix time in milliseconds of the recorded payload, from its date in seconds if its time is not set
+func recordedTime(payload model.Payload) int64 {
+	if payload.Time != 0 {
+		return payload.Time
+	}
+	return payload.Date * 1000
+}
+
+//setReplay make the nodes whose fleet device has no recorded series idle, they have nothing to replay
+//the other nodes replay their payloads at their recorded times, dated with the time they are emitted
+func (gateway *LorhammerGateway) setReplay(replay *model.Replay, fleet *model.Fleet) {
+	if replay == nil {
+		return
+	}
+	for i, node := range gateway.Nodes {
+		if fleet == nil || i >= len(fleet.Devices) || len(fleet.Devices[i].Payloads) == 0 {
+			node.Payloads = nil
+			// idle nodes must not prevent the scenario from ending
+			previousLap := node.PayloadsReplayLap
+			node.PayloadsReplayLap = gateway.PayloadsReplayMaxLaps
+			gateway.countEndedNode(node, previousLap)
+			continue
+		}
+		// the network server must not see uplinks dated from the recording while their tmst is the current one
+		payloads := make([]model.Payload, len(node.Payloads))
+		for j, payload := range node.Payloads {
+			payload.Time, payload.Date = recordedTime(payload), 0
+			payloads[j] = payload
+		}
+		node.Payloads = payloads
+	}
+}
+
+//ReplayLoop send the payloads of each node at their recorded times from start, compressed by the replay speed, until the context is done
+//the gateway forwards the frames as nodes emit them
+func (gateway *LorhammerGateway) ReplayLoop(ctx context.Context, replay *model.Replay, start time.Time, prometheus metrics.Prometheus) {
+	emitted := make(chan loraserver_structs.RXPK)
+	for _, node := range gateway.Nodes {
+		if len(node.Payloads) > 0 {
+			go gateway.replayNodeLoop(ctx, node, replay, start, emitted, prometheus)
+		}
+	}
+	gateway.forwardLoop(ctx, emitted, prometheus)
+}
+
+//replayNodeLoop emit each payload of the node at its time until its laps are done or the context is done
+//a node not joined yet sends its JoinRequest instead of the payload, the next payloads keep their times
+func (gateway *LorhammerGateway) replayNodeLoop(ctx context.Context, node *model.Node, replay *model.Replay, start time.Time, emitted chan<- loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	nbPayloads := len(node.Payloads)
+	for sent := 0; gateway.PayloadsReplayMaxLaps <= 0 || sent < gateway.PayloadsReplayMaxLaps*nbPayloads; sent++ {
+		timer := time.NewTimer(time.Until(replayTime(replay, start, sent/nbPayloads, node.Payloads[sent%nbPayloads].Time)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		rxpk, ok := gateway.nextReplayedUplink(node, sent, prometheus)
+		if ok {
+			select {
+			case <-ctx.Done():
+				return
+			case emitted <- rxpk:
+			}
+		}
+	}
+}
+
+//nextReplayedUplink lock the node and return the uplink of its payload sent at this rank, or its JoinRequest if it has not joined yet
+//the payload is skipped if it has not been sent, the node is counted as ended once it has sent all its laps
+func (gateway *LorhammerGateway) nextReplayedUplink(node *model.Node, sent int, prometheus metrics.Prometheus) (loraserver_structs.RXPK, bool) {
+	node.Lock()
+	defer node.Unlock()
+	nbPayloads := len(node.Payloads)
+	node.NextPayload, node.PayloadsReplayLap = sent%nbPayloads, sent/nbPayloads
+	rxpk, ok := gateway.nextNodeUplink(node, prometheus)
+	node.NextPayload, node.PayloadsReplayLap = (sent+1)%nbPayloads, (sent+1)/nbPayloads
+	gateway.countEndedNode(node, sent/nbPayloads)
+	return rxpk, ok
+}
+
+//replayTime return when the payload recorded at the unix time in milliseconds is sent during a lap,
+//each lap lasts from the first record to one second after the last one
+func replayTime(replay *model.Replay, start time.Time, lap int, recorded int64) time.Time {
+	speed := replay.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	lapDuration := time.Duration(replay.To-replay.From+1000) * time.Millisecond
+	offset := time.Duration(lap)*lapDuration + time.Duration(recorded-replay.From)*time.Millisecond
+	return start.Add(time.Duration(float64(offset) / speed))
+}
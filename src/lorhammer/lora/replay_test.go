@@ -0,0 +1,118 @@
+package lora
+
+import (
+	"context"
+	"encoding/base64"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+func TestCheckReplay(t *testing.T) {
+	if CheckReplay(nil, nil, nil) != nil || CheckReplay(&model.Replay{Speed: 60, From: 1, To: 2}, nil, nil) != nil {
+		t.Fatal("Valid replay must not return an error")
+	}
+	if CheckReplay(&model.Replay{}, &model.NodeSchedule{}, nil) == nil || CheckReplay(&model.Replay{}, nil, &model.LoadProfile{}) == nil {
+		t.Fatal("Error expected on replay with a node schedule or a load profile")
+	}
+	if CheckReplay(&model.Replay{Speed: -1}, nil, nil) == nil || CheckReplay(&model.Replay{From: 2, To: 1}, nil, nil) == nil {
+		t.Fatal("Error expected on wrong speed or window")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	fleet := &model.Fleet{Devices: []model.Device{
+		{Payloads: []model.Payload{{Date: 1010}, {Time: 1020500}}},
+		{Payloads: []model.Payload{{Date: 1000}}},
+	}}
+	if window := ReplayWindow(&model.Replay{Speed: 2}, fleet); window.From != 1000000 || window.To != 1020500 || window.Speed != 2 {
+		t.Fatal("Replay window must be the times of the first and last payloads")
+	}
+	if window := ReplayWindow(&model.Replay{From: 1, To: 2}, fleet); window.From != 1 || window.To != 2 {
+		t.Fatal("Replay window set by the orchestrator must be kept")
+	}
+}
+
+func TestReplayTime(t *testing.T) {
+	start := time.Now()
+	replay := &model.Replay{From: 1000000, To: 1059000}
+	if at := replayTime(replay, start, 0, 1030250); at != start.Add(30250*time.Millisecond) {
+		t.Fatal("Payload must be sent at its recorded time from the start")
+	}
+	if at := replayTime(replay, start, 1, 1000000); at != start.Add(time.Minute) {
+		t.Fatal("Next lap must start one second after the last record")
+	}
+	replay.Speed = 60
+	if at := replayTime(replay, start, 1, 1030000); at != start.Add(1500*time.Millisecond) {
+		t.Fatal("Replay must be compressed by its speed")
+	}
+}
+
+func TestSetReplay(t *testing.T) {
+	fleet := &model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", Payloads: []model.Payload{{Value: "01", Date: 1000}}}, {DevEUI: "0102030405060709"}}}
+	gateway := NewGateway(2, model.Init{NbScenarioReplayLaps: 1, Payloads: []model.Payload{{Value: "02"}}, Fleet: fleet, Replay: &model.Replay{}})
+	if payload := gateway.Nodes[0].Payloads[0]; payload.Value != "01" || payload.Time != 1000000 || payload.Date != 0 {
+		t.Fatal("Node must replay the series of its device at its recorded times, without their dates")
+	}
+	if fleet.Devices[0].Payloads[0].Date != 1000 {
+		t.Fatal("Series of the device must not be modified")
+	}
+	if gateway.Nodes[1].Payloads != nil || gateway.Nodes[1].PayloadsReplayLap != 1 {
+		t.Fatal("Node without series must be idle")
+	}
+}
+
+func TestReplayLoop(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	fleet := &model.Fleet{Devices: []model.Device{
+		{DevEUI: "0102030405060708", Payloads: []model.Payload{{Value: "01", Time: 1000000}, {Value: "02", Time: 1010000}}},
+		{DevEUI: "0102030405060709", Payloads: []model.Payload{{Value: "03", Time: 1005000}}},
+	}}
+	replay := &model.Replay{Speed: 100, From: 1000000, To: 1010000}
+	unconfirmed := 0.0
+	gateway := NewGateway(2, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73", NbScenarioReplayLaps: 1, ConfirmedRatio: &unconfirmed, Fleet: fleet, Replay: replay})
+	defer gateway.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go gateway.ReplayLoop(ctx, replay, start, &fakePrometheus{})
+
+	buf := make([]byte, 65507)
+	var dates []time.Time
+	var data []string
+	for len(dates) < 3 {
+		n, err := ns.Read(buf)
+		if err != nil {
+			t.Fatalf("Nodes must replay their payloads, got %d uplinks", len(dates))
+		}
+		var pushData loraserver_structs.PushDataPacket
+		if err := pushData.UnmarshalBinary(buf[:n]); err != nil || len(pushData.Payload.RXPK) != 1 {
+			t.Fatal("Each uplink must be forwarded in its own PUSH_DATA without batch window")
+		}
+		dates = append(dates, time.Time(*pushData.Payload.RXPK[0].Time))
+		data = append(data, pushData.Payload.RXPK[0].Data)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("Payloads must be sent at their compressed recorded times")
+	}
+	for i, date := range dates {
+		if date.Before(start) || date.After(time.Now()) || (i > 0 && date.Before(dates[i-1])) {
+			t.Fatal("Uplinks must be dated with the time they are emitted, not their recorded dates")
+		}
+	}
+	devAddrs := make([]string, len(data))
+	for i := range data {
+		phyPayload, _ := base64.StdEncoding.DecodeString(data[i])
+		devAddrs[i] = string(phyPayload[1:5])
+	}
+	if devAddrs[0] != devAddrs[2] || devAddrs[0] == devAddrs[1] {
+		t.Fatal("Uplinks must be sent in the order of their recorded times")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !gateway.HasEnded() {
+		t.Fatal("Gateway must end after the laps of the replay")
+	}
+}
@@ -0,0 +1,116 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//CheckNodeSchedule return an error if the node schedule of the scenario is not valid
+func CheckNodeSchedule(schedule *model.NodeSchedule) error {
+	if schedule == nil {
+		return nil
+	}
+	interval, err := parseJitter(schedule.Interval)
+	if err != nil || interval[0] <= 0 || interval[0] > interval[1] {
+		return errors.New("nodeSchedule interval must be strictly positive durations with min lower than max")
+	}
+	jitter, err := parseScheduleJitter(schedule)
+	if err != nil || jitter < 0 || jitter >= interval[0] {
+		return errors.New("nodeSchedule jitter must be a positive duration lower than the min interval")
+	}
+	return nil
+}
+
+//setNodeSchedule give each node of the gateway its own uplink interval drawn in the range
+func (gateway *LorhammerGateway) setNodeSchedule(schedule *model.NodeSchedule) {
+	if schedule == nil {
+		return
+	}
+	// node schedule is checked when the scenario is created
+	interval, _ := parseJitter(schedule.Interval)
+	jitter, _ := parseScheduleJitter(schedule)
+	for _, node := range gateway.Nodes {
+		node.UplinkInterval = tools.RandomDuration(interval[0], interval[1])
+		node.UplinkJitter = jitter
+	}
+}
+
+func parseScheduleJitter(schedule *model.NodeSchedule) (time.Duration, error) {
+	if schedule.Jitter == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(schedule.Jitter)
+}
+
+//ScheduleLoop send the uplinks of each node at its own pace until the context is done, like a real fleet spread over time
+//the gateway forwards the frames as nodes emit them
+func (gateway *LorhammerGateway) ScheduleLoop(ctx context.Context, prometheus metrics.Prometheus) {
+	emitted := make(chan loraserver_structs.RXPK)
+	for _, node := range gateway.Nodes {
+		go gateway.nodeLoop(ctx, node, emitted, prometheus)
+	}
+	gateway.forwardLoop(ctx, emitted, prometheus)
+}
+
+//forwardLoop forward the frames emitted by the nodes until the context is done, together if they are emitted during the same batch window
+func (gateway *LorhammerGateway) forwardLoop(ctx context.Context, emitted <-chan loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	gateway.batchLoop(ctx, emitted, func(batch []loraserver_structs.RXPK) {
+		gateway.forward(batch, prometheus)
+	})
+}
+
+//nodeLoop emit the JoinRequest or the next uplink of the node at each of its uplink times until the context is done
+//the first uplink is drawn in the first interval so nodes don't start together
+func (gateway *LorhammerGateway) nodeLoop(ctx context.Context, node *model.Node, emitted chan<- loraserver_structs.RXPK, prometheus metrics.Prometheus) {
+	timer := time.NewTimer(tools.RandomDuration(0, node.UplinkInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if rxpk, ok := gateway.nextScheduledUplink(node, prometheus); ok {
+			select {
+			case <-ctx.Done():
+				return
+			case emitted <- rxpk:
+			}
+		}
+		timer.Reset(nextUplinkDelay(node))
+	}
+}
+
+//nextScheduledUplink lock the node and return its JoinRequest if it has not joined yet or its next uplink, false if there is none
+//the node is counted as ended once it has sent all its laps
+func (gateway *LorhammerGateway) nextScheduledUplink(node *model.Node, prometheus metrics.Prometheus) (loraserver_structs.RXPK, bool) {
+	node.Lock()
+	defer node.Unlock()
+	previousLap := node.PayloadsReplayLap
+	rxpk, ok := gateway.nextNodeUplink(node, prometheus)
+	gateway.countEndedNode(node, previousLap)
+	return rxpk, ok
+}
+
+//nextNodeUplink return the JoinRequest of a node which has not joined yet or its next uplink, false if there is none
+//the node must be locked
+func (gateway *LorhammerGateway) nextNodeUplink(node *model.Node, prometheus metrics.Prometheus) (loraserver_structs.RXPK, bool) {
+	if gateway.WithJoin && !node.JoinedNetwork {
+		return gateway.nextJoinRequest(node, prometheus)
+	}
+	if gateway.hasNodeEnded(node) {
+		return loraserver_structs.RXPK{}, false
+	}
+	return gateway.nextUplink(node, prometheus)
+}
+
+//nextUplinkDelay return the node interval with a random jitter before or after it
+func nextUplinkDelay(node *model.Node) time.Duration {
+	return node.UplinkInterval + tools.RandomDuration(-node.UplinkJitter, node.UplinkJitter)
+}
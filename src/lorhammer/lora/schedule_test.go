@@ -0,0 +1,131 @@
+package lora
+
+import (
+	"context"
+	"encoding/base64"
+	"lorhammer/src/model"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCheckNodeSchedule(t *testing.T) {
+	if CheckNodeSchedule(nil) != nil || CheckNodeSchedule(&model.NodeSchedule{Interval: [2]string{"30s", "60s"}, Jitter: "5s"}) != nil {
+		t.Fatal("Valid node schedule must not return an error")
+	}
+	if CheckNodeSchedule(&model.NodeSchedule{Interval: [2]string{"0", "60s"}}) == nil || CheckNodeSchedule(&model.NodeSchedule{Interval: [2]string{"60s", "30s"}}) == nil {
+		t.Fatal("Error expected on wrong interval")
+	}
+	if CheckNodeSchedule(&model.NodeSchedule{Interval: [2]string{"30s", "60s"}, Jitter: "30s"}) == nil || CheckNodeSchedule(&model.NodeSchedule{Interval: [2]string{"30s", "60s"}, Jitter: "a"}) == nil {
+		t.Fatal("Error expected on wrong jitter")
+	}
+}
+
+func TestSetNodeSchedule(t *testing.T) {
+	gateway := NewGateway(10, model.Init{NodeSchedule: &model.NodeSchedule{Interval: [2]string{"30s", "60s"}, Jitter: "5s"}})
+	for _, node := range gateway.Nodes {
+		if node.UplinkInterval < 30*time.Second || node.UplinkInterval > 60*time.Second || node.UplinkJitter != 5*time.Second {
+			t.Fatal("Each node must draw its uplink interval in the range")
+		}
+		if delay := nextUplinkDelay(node); delay < node.UplinkInterval-5*time.Second || delay > node.UplinkInterval+5*time.Second {
+			t.Fatal("Uplink delay must be the node interval with the jitter")
+		}
+	}
+}
+
+func TestNextScheduledUplink(t *testing.T) {
+	node := newNode("19842bd94743246b367c2e90942a1f73", "19842bd94743246b367c2e90942a1f77", "", []model.Payload{{Value: "01"}}, false)
+	gateway := &LorhammerGateway{Nodes: []*model.Node{node}, WithJoin: true, PayloadsReplayMaxLaps: 1}
+
+	if rxpk, ok := gateway.nextScheduledUplink(node, &fakePrometheus{}); !ok || rxpk.Size != 23 {
+		t.Fatal("Node which has not joined must send a JoinRequest")
+	}
+	node.JoinedNetwork = true
+	node.ConfirmedRatio = 0
+	if _, ok := gateway.nextScheduledUplink(node, &fakePrometheus{}); !ok || !gateway.HasEnded() {
+		t.Fatal("Node must send its uplink and the gateway must end after its laps")
+	}
+	if _, ok := gateway.nextScheduledUplink(node, &fakePrometheus{}); ok {
+		t.Fatal("Node must not send uplinks after its laps")
+	}
+}
+
+func TestScheduleLoop(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(3, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73", NodeSchedule: &model.NodeSchedule{Interval: [2]string{"20ms", "40ms"}}})
+	defer gateway.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gateway.ScheduleLoop(ctx, &fakePrometheus{})
+
+	buf := make([]byte, 65507)
+	for nbUplinks := 0; nbUplinks < 9; {
+		n, err := ns.Read(buf)
+		if err != nil {
+			t.Fatalf("Nodes must send their uplinks at their own pace, got %d uplinks", nbUplinks)
+		}
+		var pushData loraserver_structs.PushDataPacket
+		if err := pushData.UnmarshalBinary(buf[:n]); err != nil || len(pushData.Payload.RXPK) != 1 {
+			t.Fatal("Each uplink must be forwarded in its own PUSH_DATA without batch window")
+		}
+		nbUplinks++
+	}
+}
+
+func TestScheduleLoopDownlinks(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(3, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73", NodeSchedule: &model.NodeSchedule{Interval: [2]string{"5ms", "10ms"}}})
+	defer gateway.Close()
+	nodes := make(map[lorawan.DevAddr]*model.Node)
+	for _, node := range gateway.Nodes {
+		nodes[node.DevAddr] = node
+	}
+	// the socket reader has its own metrics and nothing is logged, their locks must not order the node accesses
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.PanicLevel)
+	prometheus := &fakePrometheus{}
+	if _, err := gateway.getSocket(prometheus); err != nil {
+		t.Fatal("Gateway socket expected")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gateway.ScheduleLoop(ctx, &fakePrometheus{})
+
+	// each uplink is acknowledged by a downlink handled by the socket reader while nodes keep emitting
+	buf := make([]byte, 65507)
+	for nbDownlinks := 0; nbDownlinks < 30; {
+		n, addr, err := ns.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Nodes must send their uplinks at their own pace, got %d downlinks", nbDownlinks)
+		}
+		var pushData loraserver_structs.PushDataPacket
+		if pushData.UnmarshalBinary(buf[:n]) != nil || len(pushData.Payload.RXPK) == 0 {
+			continue
+		}
+		rxpk := pushData.Payload.RXPK[0]
+		data, _ := base64.StdEncoding.DecodeString(rxpk.Data)
+		var uplink lorawan.PHYPayload
+		if err := uplink.UnmarshalBinary(data); err != nil {
+			t.Fatal("Uplink PHYPayload expected")
+		}
+		downlink, _ := newDataDown(t, nodes[uplink.MACPayload.(*lorawan.MACPayload).FHDR.DevAddr], lorawan.UnconfirmedDataDown, true).MarshalBinary()
+		tmst := rxpk.Tmst + 1000000
+		ns.WriteToUDP(newPullResp(t, txpk{TXPK: loraserver_structs.TXPK{Tmst: &tmst, Freq: rxpk.Freq, DatR: rxpk.DatR}}, downlink), addr)
+		nbDownlinks++
+	}
+	for i := 0; i < 100; i++ {
+		prometheus.mutex.Lock()
+		nbUplinkAck := prometheus.nbUplinkAck
+		prometheus.mutex.Unlock()
+		if nbUplinkAck > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Downlinks must be given to the nodes while they emit")
+}
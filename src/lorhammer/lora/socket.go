@@ -0,0 +1,207 @@
+package lora
+
+import (
+	"encoding/binary"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"net"
+	"sync"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//udpSocket is the long lived udp socket of a gateway, used by all its rounds so the source port never changes
+//its reader goroutine gives PUSH_ACK and PULL_ACK to the round which sent the packet with the same token,
+//and PULL_RESP to the current round, or handles them itself when no round is listening, locking the nodes as rounds do
+type udpSocket struct {
+	conn       net.Conn
+	gateway    *LorhammerGateway
+	prometheus metrics.Prometheus
+	mutex      sync.Mutex
+	rounds     map[uint16]*roundConn // waiting round by token of the sent packets
+	current    *roundConn            // last opened round, receiving PULL_RESP
+}
+
+//roundConn is the connection of one Start or Join round : it writes on the gateway socket
+//and reads the packets given by the socket reader until it is closed
+type roundConn struct {
+	socket  *udpSocket
+	packets chan []byte
+	closed  chan struct{}
+}
+
+//getSocket return the socket of the gateway, dialing it and launching its reader the first time
+func (gateway *LorhammerGateway) getSocket(prometheus metrics.Prometheus) (*udpSocket, error) {
+	gateway.connMutex.Lock()
+	defer gateway.connMutex.Unlock()
+	if gateway.socket != nil {
+		return gateway.socket, nil
+	}
+	conn, err := net.Dial("udp", gateway.NsAddress)
+	if err != nil {
+		return nil, err
+	}
+	gateway.socket = &udpSocket{
+		conn:       conn,
+		gateway:    gateway,
+		prometheus: prometheus,
+		rounds:     make(map[uint16]*roundConn),
+	}
+	go gateway.socket.read()
+	return gateway.socket, nil
+}
+
+//Close close the socket, the station websocket or the mqtt bridge client of the gateway, its reader goroutine stops
+func (gateway *LorhammerGateway) Close() error {
+	gateway.connMutex.Lock()
+	defer gateway.connMutex.Unlock()
+	var err error
+	if gateway.socket != nil {
+		err = gateway.socket.conn.Close()
+		gateway.socket = nil
+	}
+	if gateway.station != nil {
+		err = gateway.station.ws.Close()
+		gateway.station = nil
+	}
+	if gateway.bridge != nil {
+		gateway.bridge.Disconnect()
+		gateway.bridge = nil
+	}
+	return err
+}
+
+//newRoundConn return a new round connection on the gateway socket
+func (gateway *LorhammerGateway) newRoundConn(prometheus metrics.Prometheus) (*roundConn, error) {
+	socket, err := gateway.getSocket(prometheus)
+	if err != nil {
+		return nil, err
+	}
+	round := &roundConn{
+		socket: socket,
+		// PUSH_ACK of every uplink, PULL_ACK and some PULL_RESP
+		packets: make(chan []byte, 2*len(gateway.Nodes)+16),
+		closed:  make(chan struct{}),
+	}
+	socket.mutex.Lock()
+	socket.current = round
+	socket.mutex.Unlock()
+	return round, nil
+}
+
+//read dispatch the packets received until the socket is closed
+func (socket *udpSocket) read() {
+	buf := make([]byte, 65507) // max udp data size
+	for {
+		n, err := socket.conn.Read(buf)
+		if err != nil {
+			loggerGateway.WithError(err).Debug("Gateway socket closed")
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		socket.dispatch(data)
+	}
+}
+
+//dispatch give the packet to the round waiting for it, a PULL_RESP without round is handled by the socket
+func (socket *udpSocket) dispatch(data []byte) {
+	packetType, err := loraserver_structs.GetPacketType(data)
+	if err != nil {
+		loggerGateway.WithError(err).Error("Can't handle packet type")
+		return
+	}
+	switch packetType {
+	case loraserver_structs.PushACK, loraserver_structs.PullACK:
+		if packetType == loraserver_structs.PushACK {
+			socket.gateway.addPushAck()
+		}
+		token := getToken(data)
+		socket.mutex.Lock()
+		round, ok := socket.rounds[token]
+		delete(socket.rounds, token)
+		given := ok && round.give(data)
+		socket.mutex.Unlock()
+		if !given {
+			loggerGateway.WithField("Token", token).Debug("Ack received for no waiting round")
+		}
+	case loraserver_structs.PullResp:
+		socket.mutex.Lock()
+		given := socket.current != nil && socket.current.give(data)
+		socket.mutex.Unlock()
+		if !given {
+			// downlink received after the receive timeout is not lost
+			if err := handlePacket(data); err != nil {
+				loggerGateway.WithError(err).Error("Can't handle packet")
+				return
+			}
+			socket.gateway.sendTxAckPacket(socket.conn, data)
+			socket.gateway.handleDownlink(data, socket.prometheus)
+		}
+	default:
+		loggerGateway.WithField("packetType", packetType).Warn("Unexpected packet received by gateway")
+	}
+}
+
+//getToken return the random token of a semtech packet
+func getToken(data []byte) uint16 {
+	return binary.LittleEndian.Uint16(data[1:3])
+}
+
+//give send the packet to the round if it is still open and not full, the socket mutex must be held
+func (round *roundConn) give(data []byte) bool {
+	select {
+	case <-round.closed:
+		return false
+	default:
+	}
+	select {
+	case round.packets <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+//Read return the next packet given to the round
+func (round *roundConn) Read(b []byte) (int, error) {
+	select {
+	case data := <-round.packets:
+		return copy(b, data), nil
+	case <-round.closed:
+		return 0, errors.New("round connection closed")
+	}
+}
+
+//Write send the packet on the gateway socket, acks of PUSH_DATA and PULL_DATA will be given to this round
+func (round *roundConn) Write(b []byte) (int, error) {
+	if packetType, err := loraserver_structs.GetPacketType(b); err == nil && (packetType == loraserver_structs.PushData || packetType == loraserver_structs.PullData) {
+		round.socket.mutex.Lock()
+		round.socket.rounds[getToken(b)] = round
+		round.socket.mutex.Unlock()
+	}
+	return round.socket.conn.Write(b)
+}
+
+//Close stop the round, next packets for it are handled by the socket
+func (round *roundConn) Close() error {
+	round.socket.mutex.Lock()
+	defer round.socket.mutex.Unlock()
+	for token, r := range round.socket.rounds {
+		if r == round {
+			delete(round.socket.rounds, token)
+		}
+	}
+	if round.socket.current == round {
+		round.socket.current = nil
+	}
+	close(round.closed)
+	return nil
+}
+
+func (round *roundConn) LocalAddr() net.Addr                { return round.socket.conn.LocalAddr() }
+func (round *roundConn) RemoteAddr() net.Addr               { return round.socket.conn.RemoteAddr() }
+func (round *roundConn) SetDeadline(t time.Time) error      { return nil }
+func (round *roundConn) SetReadDeadline(t time.Time) error  { return nil }
+func (round *roundConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,176 @@
+package lora
+
+import (
+	"lorhammer/src/model"
+	"net"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+func newFakeNs(t *testing.T) *net.UDPConn {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Can't listen udp")
+	}
+	ns.SetReadDeadline(time.Now().Add(time.Second))
+	return ns
+}
+
+//answerPullData read a PULL_DATA and answer a PULL_ACK with the same token, it return the gateway address
+func answerPullData(t *testing.T, ns *net.UDPConn) *net.UDPAddr {
+	buf := make([]byte, 65507)
+	n, addr, err := ns.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal("PULL_DATA not received")
+	}
+	var pullData loraserver_structs.PullDataPacket
+	if err := pullData.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal("PULL_DATA expected")
+	}
+	pullAck, _ := loraserver_structs.PullACKPacket{ProtocolVersion: 2, RandomToken: pullData.RandomToken}.MarshalBinary()
+	ns.WriteToUDP(pullAck, addr)
+	return addr
+}
+
+func TestRoundConnReceiveAck(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := &LorhammerGateway{NsAddress: ns.LocalAddr().String()}
+	defer gateway.Close()
+
+	round, err := gateway.newRoundConn(&fakePrometheus{})
+	if err != nil {
+		t.Fatal("Can't open gateway socket")
+	}
+	gateway.sendPullData(round)
+	answerPullData(t, ns)
+
+	buf := make([]byte, 65507)
+	n, err := round.Read(buf)
+	if err != nil {
+		t.Fatal("Round must receive the ack of its packet")
+	}
+	if packetType, _ := loraserver_structs.GetPacketType(buf[:n]); packetType != loraserver_structs.PullACK {
+		t.Fatal("PULL_ACK expected")
+	}
+	round.Close()
+	if _, err := round.Read(buf); err == nil {
+		t.Fatal("Closed round must not be readable")
+	}
+}
+
+func TestSocketKeptBetweenRounds(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := &LorhammerGateway{NsAddress: ns.LocalAddr().String()}
+	defer gateway.Close()
+
+	addresses := make([]string, 2)
+	for i := range addresses {
+		round, err := gateway.newRoundConn(&fakePrometheus{})
+		if err != nil {
+			t.Fatal("Can't open gateway socket")
+		}
+		gateway.sendPullData(round)
+		addresses[i] = answerPullData(t, ns).String()
+		round.Close()
+	}
+	if addresses[0] != addresses[1] {
+		t.Fatalf("Gateway source address must not change between rounds, got %s and %s", addresses[0], addresses[1])
+	}
+}
+
+func TestSocketHandleLatePullResp(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	node := &model.Node{}
+	gateway := &LorhammerGateway{NsAddress: ns.LocalAddr().String(), Nodes: []*model.Node{node}}
+	defer gateway.Close()
+
+	round, err := gateway.newRoundConn(&fakePrometheus{})
+	if err != nil {
+		t.Fatal("Can't open gateway socket")
+	}
+	gateway.sendPullData(round)
+	addr := answerPullData(t, ns)
+	round.Close()
+
+	// PULL_RESP received when no round is listening
+	ns.WriteToUDP([]byte{2, 0, 0, 3, 123, 34, 116, 120, 112, 107, 34, 58, 123, 34, 105, 109, 109, 101, 34, 58, 102, 97, 108, 115, 101, 44, 34, 116, 109, 115, 116, 34, 58, 49, 49, 50, 51, 52, 53, 54, 44, 34, 102, 114, 101, 113, 34, 58, 56, 54, 54, 46, 51, 52, 57, 56, 49, 50, 44, 34, 114, 102, 99, 104, 34, 58, 48, 44, 34, 112, 111, 119, 101, 34, 58, 49, 52, 44, 34, 109, 111, 100, 117, 34, 58, 34, 76, 79, 82, 65, 34, 44, 34, 100, 97, 116, 114, 34, 58, 34, 83, 70, 55, 66, 87, 49, 50, 53, 34, 44, 34, 99, 111, 100, 114, 34, 58, 34, 52, 47, 54, 34, 44, 34, 105, 112, 111, 108, 34, 58, 116, 114, 117, 101, 44, 34, 115, 105, 122, 101, 34, 58, 49, 50, 44, 34, 100, 97, 116, 97, 34, 58, 34, 89, 76, 72, 107, 89, 86, 48, 103, 65, 65, 67, 100, 103, 55, 118, 122, 34, 125, 125}, addr)
+
+	buf := make([]byte, 65507)
+	n, err := ns.Read(buf)
+	if err != nil {
+		t.Fatal("Late PULL_RESP must be acknowledged with a TX_ACK")
+	}
+	if packetType, _ := loraserver_structs.GetPacketType(buf[:n]); packetType != loraserver_structs.TXACK {
+		t.Fatal("TX_ACK expected")
+	}
+}
+
+func TestSocketLatePullRespWhileEmitting(t *testing.T) {
+	ns := newFakeNs(t)
+	defer ns.Close()
+	gateway := NewGateway(1, model.Init{NsAddress: ns.LocalAddr().String(), Nwskey: "19842bd94743246b367c2e90942a1f73"})
+	defer gateway.Close()
+	node := gateway.Nodes[0]
+	// the socket reader has its own metrics and nothing is logged, their locks must not order the node accesses
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.PanicLevel)
+	if _, err := gateway.getSocket(&fakePrometheus{}); err != nil {
+		t.Fatal("Gateway socket expected")
+	}
+	round, err := gateway.newRoundConn(&fakePrometheus{})
+	if err != nil {
+		t.Fatal("Can't open gateway socket")
+	}
+	gateway.sendPullData(round)
+	addr := answerPullData(t, ns)
+	round.Close()
+
+	// PULL_RESP handled by the socket reader while the node emits its uplinks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			gateway.nextUplinks(&fakePrometheus{})
+		}
+	}()
+	downlink, _ := newDataDown(t, node, lorawan.UnconfirmedDataDown, true).MarshalBinary()
+	tmst := uint32(1000000)
+	for i := 0; i < 20; i++ {
+		ns.WriteToUDP(newPullResp(t, txpk{TXPK: loraserver_structs.TXPK{Tmst: &tmst, Freq: 868.1, DatR: loraserver_structs.DatR{LoRa: "SF7BW125"}}}, downlink), addr)
+	}
+	<-done
+
+	buf := make([]byte, 65507)
+	for i := 0; i < 20; i++ {
+		if _, err := ns.Read(buf); err != nil {
+			t.Fatal("Each late PULL_RESP must be acknowledged with a TX_ACK")
+		}
+	}
+}
+
+func TestSocketDispatchAckByToken(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	socket := &udpSocket{gateway: gateway, rounds: make(map[uint16]*roundConn)}
+	first := &roundConn{socket: socket, packets: make(chan []byte, 1), closed: make(chan struct{})}
+	second := &roundConn{socket: socket, packets: make(chan []byte, 1), closed: make(chan struct{})}
+	socket.rounds[1] = first
+	socket.rounds[2] = second
+
+	socket.dispatch([]byte{2, 2, 0, 1})
+	if len(first.packets) != 0 || len(second.packets) != 1 {
+		t.Fatal("PUSH_ACK must be given to the round which sent the packet with the same token")
+	}
+	if _, ok := socket.rounds[2]; ok {
+		t.Fatal("Token must be forgotten once acknowledged")
+	}
+	if gateway.stats.pushAck != 1 {
+		t.Fatal("PUSH_ACK must be counted in gateway stats")
+	}
+}
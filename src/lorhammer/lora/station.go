@@ -0,0 +1,322 @@
+package lora
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/lorhammer/region"
+	"strings"
+	"sync"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"golang.org/x/net/websocket"
+)
+
+//stationConn is the LNS websocket of a LoRa Basics Station gateway
+type stationConn struct {
+	ws    *websocket.Conn
+	mutex sync.Mutex // websocket messages must not be interleaved
+}
+
+//routerInfo is the answer of the network server to the router-info discovery
+type routerInfo struct {
+	URI   string `json:"uri"`
+	Error string `json:"error"`
+}
+
+//stationMessage contains the fields of the messages sent by the network server to the station
+type stationMessage struct {
+	MsgType string `json:"msgtype"`
+	DevEui  string `json:"DevEui"`
+	Diid    int64  `json:"diid"`
+	Pdu     string `json:"pdu"`
+	Xtime   int64  `json:"xtime"` // xtime of the uplink answered by a class A downlink
+	RxDelay int    `json:"RxDelay"`
+	RX1DR   int    `json:"RX1DR"`
+	RX1Freq int    `json:"RX1Freq"` // in Hz, 0 if the class A downlink is sent in RX2
+	RX2DR   int    `json:"RX2DR"`
+	RX2Freq int    `json:"RX2Freq"`
+	DR      int    `json:"DR"`      // data rate of a class B ping slot
+	Freq    int    `json:"Freq"`    // frequency of a class B ping slot
+	GpsTime int64  `json:"gpstime"` // GPS time of a class B ping slot, in microseconds
+	Rctx    int64  `json:"rctx"`
+	DC      int    `json:"dC"` // device class, 1 for class B ping slots, 2 for class C downlinks sent immediately on RX2
+	Error   string `json:"error"`
+}
+
+//stationUpInfo is the radio metadata of a station uplink
+type stationUpInfo struct {
+	Rctx    int64   `json:"rctx"`
+	Xtime   int64   `json:"xtime"`
+	GpsTime int64   `json:"gpstime"`
+	Rssi    float64 `json:"rssi"`
+	Snr     float64 `json:"snr"`
+}
+
+//getStation return the LNS websocket of the gateway, doing the router-info discovery the first time
+func (gateway *LorhammerGateway) getStation(prometheus metrics.Prometheus) (*stationConn, error) {
+	gateway.connMutex.Lock()
+	defer gateway.connMutex.Unlock()
+	if gateway.station != nil {
+		return gateway.station, nil
+	}
+	uri, err := gateway.discoverRouter()
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.Dial(uri, "", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	station := &stationConn{ws: ws}
+	if err := station.send(map[string]interface{}{
+		"msgtype":  "version",
+		"station":  "lorhammer",
+		"firmware": "lorhammer",
+		"package":  "lorhammer",
+		"model":    "lorhammer",
+		"protocol": 2,
+		"features": "",
+	}); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	gateway.station = station
+	go gateway.readStation(station, prometheus)
+	return station, nil
+}
+
+//discoverRouter ask the network server the uri of the LNS websocket of the gateway
+func (gateway *LorhammerGateway) discoverRouter() (string, error) {
+	ws, err := websocket.Dial(strings.TrimSuffix(gateway.NsAddress, "/")+"/router-info", "", "http://localhost/")
+	if err != nil {
+		return "", err
+	}
+	defer ws.Close()
+	if err := websocket.JSON.Send(ws, map[string]string{"router": stationEui(gateway.MacAddress[:])}); err != nil {
+		return "", err
+	}
+	var info routerInfo
+	if err := websocket.JSON.Receive(ws, &info); err != nil {
+		return "", err
+	}
+	if info.Error != "" {
+		return "", fmt.Errorf("router-info discovery failed : %s", info.Error)
+	}
+	if info.URI == "" {
+		return "", errors.New("router-info discovery returned no uri")
+	}
+	return info.URI, nil
+}
+
+//readStation handle the messages of the network server until the websocket is closed
+func (gateway *LorhammerGateway) readStation(station *stationConn, prometheus metrics.Prometheus) {
+	for {
+		var message stationMessage
+		if err := websocket.JSON.Receive(station.ws, &message); err != nil {
+			loggerGateway.WithError(err).Debug("Station websocket closed")
+			return
+		}
+		switch message.MsgType {
+		case "router_config":
+			loggerGateway.WithField("MacAddress", gateway.MacAddress.String()).Info("Station router config received")
+		case "dnmsg":
+			gateway.handleStationDownlink(station, message, prometheus)
+		case "error":
+			loggerGateway.WithField("error", message.Error).Error("Station error received")
+		default:
+			loggerGateway.WithField("msgtype", message.MsgType).Debug("Station message ignored")
+		}
+	}
+}
+
+//handleStationDownlink give the dnmsg PHYPayload to the nodes and answer a dntxed as if it had been emitted
+//a dnmsg is emitted only if its pdu and radio parameters are valid and the gateway duty-cycle allows it
+func (gateway *LorhammerGateway) handleStationDownlink(station *stationConn, message stationMessage, prometheus metrics.Prometheus) {
+	receivedAt := time.Now()
+	phyPayloadBytes, err := hex.DecodeString(message.Pdu)
+	if err != nil || len(phyPayloadBytes) == 0 {
+		loggerGateway.WithField("pdu", message.Pdu).Error("Can't decode dnmsg pdu")
+		return
+	}
+	downlink, err := message.txpk(gateway.getRegion(), len(phyPayloadBytes))
+	if err != nil {
+		loggerGateway.WithError(err).WithField("diid", message.Diid).Error("Can't emit dnmsg")
+		return
+	}
+	if !gateway.emitDownlink(downlink.TXPK, prometheus) {
+		return
+	}
+	gateway.applyDownlink(phyPayloadBytes, downlink, deviceClass(message.DC), receivedAt, prometheus)
+	if err := station.send(map[string]interface{}{
+		"msgtype": "dntxed",
+		"diid":    message.Diid,
+		"DevEui":  message.DevEui,
+		"rctx":    message.Rctx,
+		"xtime":   message.Xtime,
+		"txtime":  float64(time.Now().UnixNano()) / 1e9,
+		"gpstime": 0,
+	}); err != nil {
+		loggerGateway.WithError(err).Error("Can't send dntxed")
+	}
+}
+
+//txpk return the semtech txpk of the dnmsg as the station emits it, with an error if its radio parameters are not valid
+//class A downlinks are emitted in RX1 if its parameters are given, RxDelay seconds after the xtime of the uplink they answer,
+//else in RX2 one second later, the lower bits of the xtime are the uplink tmst
+//class B downlinks are emitted at their GPS time and class C ones immediately with the RX2 parameters
+func (message stationMessage) txpk(reg *region.Region, size int) (txpk, error) {
+	downlink := txpk{TXPK: loraserver_structs.TXPK{Size: uint16(size), IPol: true, NCRC: true}}
+	frequency, dataRate := message.RX2Freq, message.RX2DR
+	switch deviceClass(message.DC) {
+	case classA:
+		rxDelay := message.RxDelay
+		if rxDelay == 0 {
+			rxDelay = 1
+		}
+		delay := time.Duration(rxDelay) * time.Second
+		if message.RX1Freq != 0 {
+			frequency, dataRate = message.RX1Freq, message.RX1DR
+		} else {
+			delay += time.Second
+		}
+		tmst := uint32(message.Xtime) + uint32(delay/time.Microsecond)
+		downlink.Tmst = &tmst
+	case classB:
+		frequency, dataRate = message.Freq, message.DR
+		tmms := message.GpsTime / 1000
+		downlink.Tmms = &tmms
+	default:
+		downlink.Imme = true
+	}
+	if frequency <= 0 || !reg.IsValidDataRate(dataRate) {
+		return downlink, fmt.Errorf("frequency %d or data rate %d not valid", frequency, dataRate)
+	}
+	downlink.Freq = float64(frequency) / 1000000
+	if dr := reg.DataRates[dataRate]; dr.IsFSK() {
+		downlink.Modu, downlink.DatR = dr.Modulation(), loraserver_structs.DatR{FSK: uint32(dr.BitRate)}
+	} else {
+		downlink.Modu, downlink.DatR, downlink.CodR = dr.Modulation(), loraserver_structs.DatR{LoRa: dr.String()}, reg.CodingRate
+	}
+	return downlink, nil
+}
+
+func (station *stationConn) send(message interface{}) error {
+	station.mutex.Lock()
+	defer station.mutex.Unlock()
+	return websocket.JSON.Send(station.ws, message)
+}
+
+//sendStationUplinks send each rxpk as a jreq or updf message
+func (gateway *LorhammerGateway) sendStationUplinks(station *stationConn, rxpks []loraserver_structs.RXPK) {
+	for _, rxpk := range rxpks {
+		message, err := newStationUplink(rxpk, gateway)
+		if err != nil {
+			loggerGateway.WithError(err).Error("Can't create station uplink")
+			continue
+		}
+		if err := station.send(message); err != nil {
+			loggerGateway.WithError(err).Error("Can't send station uplink")
+			continue
+		}
+		gateway.addUplinks(1)
+	}
+}
+
+//newStationUplink return the jreq or updf message with the PHYPayload fields and the radio metadata of the rxpk
+func newStationUplink(rxpk loraserver_structs.RXPK, gateway *LorhammerGateway) (map[string]interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(rxpk.Data)
+	if err != nil {
+		return nil, err
+	}
+	dataRate := gateway.getRegion().DataRateIndex(rxpk.DatR.LoRa, int(rxpk.DatR.FSK))
+	if dataRate < 0 {
+		return nil, fmt.Errorf("unknown data rate %v", rxpk.DatR)
+	}
+	upInfo := stationUpInfo{
+		Xtime: int64(rxpk.Tmst),
+		Rssi:  float64(rxpk.RSSI),
+		Snr:   rxpk.LSNR,
+	}
+	if gateway.GpsTime && rxpk.Time != nil {
+		upInfo.GpsTime = gpsTime(time.Time(*rxpk.Time)).Nanoseconds() / int64(time.Microsecond)
+	}
+	message := map[string]interface{}{
+		"MHdr":    int(data[0]),
+		"DR":      dataRate,
+		"Freq":    int(rxpk.Freq*1000000 + 0.5),
+		"RefTime": float64(time.Now().UnixNano()) / 1e9,
+		"upinfo":  upInfo,
+	}
+	switch {
+	case data[0]>>5 == 0 && len(data) == 23:
+		// JoinRequest : MHDR | JoinEUI | DevEUI | DevNonce | MIC
+		message["msgtype"] = "jreq"
+		message["JoinEui"] = stationEui(reverse(data[1:9]))
+		message["DevEui"] = stationEui(reverse(data[9:17]))
+		message["DevNonce"] = int(binary.LittleEndian.Uint16(data[17:19]))
+		message["MIC"] = int32(binary.LittleEndian.Uint32(data[19:23]))
+	case data[0]>>5 == byte(rejoinRequest):
+		// the station doesn't parse rejoin requests, they are sent as proprietary frames
+		message["msgtype"] = "propdf"
+		message["FRMPayload"] = hex.EncodeToString(data)
+	case len(data) >= 12:
+		// data uplink : MHDR | DevAddr | FCtrl | FCnt | FOpts | FPort | FRMPayload | MIC
+		fOptsEnd := 8 + int(data[5]&0x0f)
+		if fOptsEnd+4 > len(data) {
+			return nil, errors.New("PHYPayload too short for its FOpts")
+		}
+		message["msgtype"] = "updf"
+		message["DevAddr"] = int32(binary.LittleEndian.Uint32(data[1:5]))
+		message["FCtrl"] = int(data[5])
+		message["FCnt"] = int(binary.LittleEndian.Uint16(data[6:8]))
+		message["FOpts"] = hex.EncodeToString(data[8:fOptsEnd])
+		message["FPort"] = -1
+		message["FRMPayload"] = ""
+		if fOptsEnd+4 < len(data) {
+			message["FPort"] = int(data[fOptsEnd])
+			message["FRMPayload"] = hex.EncodeToString(data[fOptsEnd+1 : len(data)-4])
+		}
+		message["MIC"] = int32(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	default:
+		return nil, errors.New("PHYPayload too short")
+	}
+	return message, nil
+}
+
+//stationEui return the EUI as written in station messages : 01-02-03-04-05-06-07-08
+func stationEui(eui []byte) string {
+	parts := make([]string, len(eui))
+	for i, b := range eui {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(parts, "-")
+}
+
+//reverse return a reversed copy of little endian bytes
+func reverse(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
+
+//startStation send JoinRequests of nodes not joined yet and the next uplink of each node on the LNS websocket
+func (gateway *LorhammerGateway) startStation(prometheus metrics.Prometheus, withJoin bool, withUplinks bool) error {
+	station, err := gateway.getStation(prometheus)
+	if err != nil {
+		return err
+	}
+	if withJoin {
+		gateway.sendStationUplinks(station, gateway.nextJoinRequests(prometheus))
+	}
+	if withUplinks {
+		gateway.sendStationUplinks(station, gateway.nextUplinks(prometheus))
+	}
+	return nil
+}
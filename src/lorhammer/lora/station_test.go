@@ -0,0 +1,196 @@
+package lora
+
+import (
+	"encoding/hex"
+	"lorhammer/src/model"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"golang.org/x/net/websocket"
+)
+
+//newFakeLns return a local LNS stand-in giving the messages received on the router websocket
+//it answers each updf with the downlinks returned by dnmsg in RX1
+func newFakeLns(t *testing.T, dnmsg func(message map[string]interface{}) []byte) (*httptest.Server, chan map[string]interface{}) {
+	messages := make(chan map[string]interface{}, 16)
+	mux := websocket.Server{Handler: func(ws *websocket.Conn) {
+		if ws.Request().URL.Path == "/router-info" {
+			var request map[string]interface{}
+			websocket.JSON.Receive(ws, &request)
+			websocket.JSON.Send(ws, map[string]interface{}{
+				"router": request["router"],
+				"muxs":   "00-00-00-00-00-00-00-00",
+				"uri":    "ws://" + ws.Request().Host + "/router-1",
+			})
+			return
+		}
+		websocket.JSON.Send(ws, map[string]interface{}{"msgtype": "router_config", "region": "EU863"})
+		for {
+			var message map[string]interface{}
+			if err := websocket.JSON.Receive(ws, &message); err != nil {
+				return
+			}
+			messages <- message
+			if message["msgtype"] == "updf" && dnmsg != nil {
+				websocket.JSON.Send(ws, map[string]interface{}{
+					"msgtype": "dnmsg",
+					"DevEui":  "01-02-03-04-05-06-07-08",
+					"diid":    42,
+					"pdu":     hex.EncodeToString(dnmsg(message)),
+					"xtime":   message["upinfo"].(map[string]interface{})["xtime"],
+					"RxDelay": 1,
+					"RX1DR":   message["DR"],
+					"RX1Freq": message["Freq"],
+					"rctx":    0,
+				})
+			}
+		}
+	}}
+	return httptest.NewServer(mux), messages
+}
+
+func nextStationMessage(t *testing.T, messages chan map[string]interface{}) map[string]interface{} {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("Station message expected")
+		return nil
+	}
+}
+
+func TestCheckProtocol(t *testing.T) {
+	if CheckProtocol("", "127.0.0.1:1700") != nil || CheckProtocol("basicstation", "ws://127.0.0.1:3001") != nil {
+		t.Fatal("Valid gateway protocols must not return an error")
+	}
+	if CheckProtocol("basicstation", "127.0.0.1:3001") == nil {
+		t.Fatal("Error expected on basicstation without websocket url")
+	}
+	if CheckProtocol("carrier-pigeon", "127.0.0.1:1700") == nil {
+		t.Fatal("Error expected on unknown protocol")
+	}
+}
+
+func TestStationStart(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01B501002919000006018403131313121233"}}, false)
+	ns, messages := newFakeLns(t, func(message map[string]interface{}) []byte {
+		phyPayload := newDataDown(t, node, lorawan.UnconfirmedDataDown, true)
+		b, _ := phyPayload.MarshalBinary()
+		return b
+	})
+	defer ns.Close()
+	gateway := &LorhammerGateway{
+		NsAddress: "ws://" + strings.TrimPrefix(ns.URL, "http://"),
+		Protocol:  basicStationProtocol,
+		Nodes:     []*model.Node{node},
+	}
+	defer gateway.Close()
+	fakePrometheus := &fakePrometheus{}
+
+	if err := gateway.Start(fakePrometheus); err != nil {
+		t.Fatalf("Station must connect after router-info discovery : %s", err)
+	}
+	if version := nextStationMessage(t, messages); version["msgtype"] != "version" {
+		t.Fatal("Station must send its version first")
+	}
+	updf := nextStationMessage(t, messages)
+	if updf["msgtype"] != "updf" || updf["FPort"] != float64(1) || updf["FRMPayload"] == "" || updf["DR"] == nil {
+		t.Fatalf("Station uplink expected, got %v", updf)
+	}
+	if updf["DevAddr"] != float64(int32(node.DevAddr[0])<<24|int32(node.DevAddr[1])<<16|int32(node.DevAddr[2])<<8|int32(node.DevAddr[3])) {
+		t.Fatal("DevAddr must be sent as an integer")
+	}
+	dntxed := nextStationMessage(t, messages)
+	if dntxed["msgtype"] != "dntxed" || dntxed["diid"] != float64(42) {
+		t.Fatalf("dntxed expected with the diid of the dnmsg, got %v", dntxed)
+	}
+	fakePrometheus.mutex.Lock()
+	onTime := fakePrometheus.downlinkTimings[downlinkOnTime]
+	fakePrometheus.mutex.Unlock()
+	if onTime != 1 {
+		t.Fatal("dnmsg timing must be checked from its xtime and RX1 parameters before the dntxed")
+	}
+	for i := 0; i < 100; i++ {
+		node.Lock()
+		acked := node.PendingUplink == nil
+		node.Unlock()
+		if acked {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("dnmsg must be given to the node")
+}
+
+func TestStationDownlinkNotValid(t *testing.T) {
+	node := newNode("", "", "", []model.Payload{{Value: "01"}}, false)
+	ns, messages := newFakeLns(t, func(message map[string]interface{}) []byte { return nil })
+	defer ns.Close()
+	gateway := &LorhammerGateway{
+		NsAddress: "ws://" + strings.TrimPrefix(ns.URL, "http://"),
+		Protocol:  basicStationProtocol,
+		Nodes:     []*model.Node{node},
+	}
+	defer gateway.Close()
+
+	if err := gateway.Start(&fakePrometheus{}); err != nil {
+		t.Fatalf("Station must connect after router-info discovery : %s", err)
+	}
+	nextStationMessage(t, messages)
+	nextStationMessage(t, messages)
+	select {
+	case message := <-messages:
+		t.Fatalf("dnmsg without pdu must not be acknowledged, got %v", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := (stationMessage{RxDelay: 1}).txpk(eu868, 12); err == nil {
+		t.Fatal("Error expected on class A dnmsg without RX1 and RX2 parameters")
+	}
+	downlink, err := (stationMessage{Xtime: 1000000, RxDelay: 1, RX2DR: 0, RX2Freq: 869525000}).txpk(eu868, 12)
+	if err != nil || *downlink.Tmst != 3000000 || downlink.Freq != 869.525 || downlink.DatR.LoRa != "SF12BW125" {
+		t.Fatal("Class A dnmsg without RX1 parameters must be emitted in RX2")
+	}
+}
+
+func TestStationJoin(t *testing.T) {
+	ns, messages := newFakeLns(t, nil)
+	defer ns.Close()
+	node := newNode("", "", "", nil, false)
+	node.DevEUI = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	gateway := &LorhammerGateway{
+		NsAddress: "ws://" + strings.TrimPrefix(ns.URL, "http://"),
+		Protocol:  basicStationProtocol,
+		Nodes:     []*model.Node{node},
+	}
+	defer gateway.Close()
+
+	if err := gateway.Join(&fakePrometheus{}, true); err != nil {
+		t.Fatalf("Station must connect after router-info discovery : %s", err)
+	}
+	nextStationMessage(t, messages)
+	jreq := nextStationMessage(t, messages)
+	if jreq["msgtype"] != "jreq" || jreq["DevEui"] != "01-02-03-04-05-06-07-08" {
+		t.Fatalf("JoinRequest expected with the node DevEui, got %v", jreq)
+	}
+	if jreq["DevNonce"] != float64(int(node.DevNonce[0])<<8|int(node.DevNonce[1])) {
+		t.Fatal("DevNonce must be sent as an integer")
+	}
+}
+
+func TestStationRouterInfoError(t *testing.T) {
+	ns := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var request map[string]interface{}
+		websocket.JSON.Receive(ws, &request)
+		websocket.JSON.Send(ws, map[string]interface{}{"router": request["router"], "error": "unknown router"})
+	}))
+	defer ns.Close()
+	gateway := &LorhammerGateway{NsAddress: "ws://" + strings.TrimPrefix(ns.URL, "http://"), Protocol: basicStationProtocol}
+
+	if err := gateway.Start(&fakePrometheus{}); err == nil {
+		t.Fatal("Error expected when the router-info discovery fails")
+	}
+}
@@ -0,0 +1,159 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/model"
+	"lorhammer/src/tools"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+//gatewayStats counts the packets of a gateway since its last stat message, as a packet forwarder does
+type gatewayStats struct {
+	rxnb     uint32 // radio packets received
+	dwnb     uint32 // downlinks received from the network server
+	txnb     uint32 // packets emitted
+	pushData uint32 // PUSH_DATA sent
+	pushAck  uint32 // PUSH_ACK received
+}
+
+//CheckGatewayStatus return an error if the gateway status config of the scenario is not valid
+func CheckGatewayStatus(status *model.GatewayStatus) error {
+	if status == nil {
+		return nil
+	}
+	for _, interval := range []string{status.KeepaliveInterval, status.StatInterval} {
+		if interval == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(interval); err != nil || d <= 0 {
+			return errors.New("gateway status intervals must be positive durations")
+		}
+	}
+	if status.Latitude[0] > status.Latitude[1] || status.Longitude[0] > status.Longitude[1] {
+		return errors.New("gateway status latitude and longitude min must be lower than max")
+	}
+	if status.Latitude[0] < -90 || status.Latitude[1] > 90 || status.Longitude[0] < -180 || status.Longitude[1] > 180 {
+		return errors.New("gateway status latitude must be in [-90, 90] and longitude in [-180, 180]")
+	}
+	return nil
+}
+
+//setGatewayStatus set the status intervals and draw the GPS coordinates of the gateway
+func (gateway *LorhammerGateway) setGatewayStatus(status *model.GatewayStatus) {
+	if status == nil {
+		return
+	}
+	// status is checked when the scenario is created
+	gateway.KeepaliveInterval, _ = time.ParseDuration(status.KeepaliveInterval)
+	gateway.StatInterval, _ = time.ParseDuration(status.StatInterval)
+	if status.Latitude != [2]float64{} || status.Longitude != [2]float64{} {
+		latitude, longitude, altitude := randomInRange(status.Latitude), randomInRange(status.Longitude), status.Altitude
+		gateway.Latitude, gateway.Longitude, gateway.Altitude = &latitude, &longitude, &altitude
+	}
+}
+
+//StatusLoop send keepalive PULL_DATA and stat PUSH_DATA on the gateway socket every configured interval until the context is done
+//stations and mqtt bridges have no keepalive and stat messages
+func (gateway *LorhammerGateway) StatusLoop(ctx context.Context, prometheus metrics.Prometheus) error {
+	if gateway.Protocol == basicStationProtocol || gateway.Protocol == mqttProtocol || (gateway.KeepaliveInterval <= 0 && gateway.StatInterval <= 0) {
+		return nil
+	}
+	socket, err := gateway.getSocket(prometheus)
+	if err != nil {
+		return err
+	}
+	conn := socket.conn
+
+	var keepalive, stat <-chan time.Time
+	if gateway.KeepaliveInterval > 0 {
+		keepaliveTicker := time.NewTicker(gateway.KeepaliveInterval)
+		defer keepaliveTicker.Stop()
+		keepalive = keepaliveTicker.C
+		gateway.sendPullData(conn)
+	}
+	if gateway.StatInterval > 0 {
+		statTicker := time.NewTicker(gateway.StatInterval)
+		defer statTicker.Stop()
+		stat = statTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepalive:
+			gateway.sendPullData(conn)
+		case <-stat:
+			gateway.sendStat(conn)
+		}
+	}
+}
+
+//sendStat send a PUSH_DATA with the gateway stat and reset its counters
+func (gateway *LorhammerGateway) sendStat(conn net.Conn) {
+	packet, err := loraserver_structs.PushDataPacket{
+		ProtocolVersion: loraserver_structs.ProtocolVersion2,
+		RandomToken:     uint16(tools.Random64(int64(math.MinInt16), int64(math.MaxUint16))),
+		GatewayMAC:      gateway.MacAddress,
+		Payload: loraserver_structs.PushDataPayload{
+			Stat: gateway.nextStat(),
+		},
+	}.MarshalBinary()
+	if err != nil {
+		loggerGateway.WithError(err).Error("Can't marshal stat message")
+		return
+	}
+	gateway.addPushData()
+	if _, err := conn.Write(packet); err != nil {
+		loggerGateway.WithError(err).Error("Can't write stat udp")
+	}
+}
+
+//nextStat return the stat of the gateway since the previous one
+//all received packets are valid and forwarded, and all downlinks are emitted
+func (gateway *LorhammerGateway) nextStat() *loraserver_structs.Stat {
+	rxnb := atomic.SwapUint32(&gateway.stats.rxnb, 0)
+	pushData := atomic.SwapUint32(&gateway.stats.pushData, 0)
+	pushAck := atomic.SwapUint32(&gateway.stats.pushAck, 0)
+	ackr := float64(100)
+	if pushData > 0 {
+		ackr = math.Min(100, float64(pushAck)*100/float64(pushData))
+	}
+	return &loraserver_structs.Stat{
+		Time: loraserver_structs.ExpandedTime(time.Now().UTC()),
+		Lati: gateway.Latitude,
+		Long: gateway.Longitude,
+		Alti: gateway.Altitude,
+		RXNb: rxnb,
+		RXOK: rxnb,
+		RXFW: rxnb,
+		ACKR: ackr,
+		DWNb: atomic.SwapUint32(&gateway.stats.dwnb, 0),
+		TXNb: atomic.SwapUint32(&gateway.stats.txnb, 0),
+	}
+}
+
+//addUplinks count the uplinks sent in one PUSH_DATA
+func (gateway *LorhammerGateway) addUplinks(nb int) {
+	atomic.AddUint32(&gateway.stats.rxnb, uint32(nb))
+	atomic.AddUint32(&gateway.stats.pushData, 1)
+}
+
+func (gateway *LorhammerGateway) addDownlink() {
+	atomic.AddUint32(&gateway.stats.dwnb, 1)
+	atomic.AddUint32(&gateway.stats.txnb, 1)
+}
+
+func (gateway *LorhammerGateway) addPushData() {
+	atomic.AddUint32(&gateway.stats.pushData, 1)
+}
+
+func (gateway *LorhammerGateway) addPushAck() {
+	atomic.AddUint32(&gateway.stats.pushAck, 1)
+}
@@ -0,0 +1,126 @@
+package lora
+
+import (
+	"context"
+	"lorhammer/src/model"
+	"net"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+func TestCheckGatewayStatus(t *testing.T) {
+	if err := CheckGatewayStatus(nil); err != nil {
+		t.Fatal("Gateway status is optional")
+	}
+	if err := CheckGatewayStatus(&model.GatewayStatus{KeepaliveInterval: "5s", Latitude: [2]float64{48.8, 48.9}, Longitude: [2]float64{2.2, 2.4}}); err != nil {
+		t.Fatal("Valid gateway status must not return an error")
+	}
+	if err := CheckGatewayStatus(&model.GatewayStatus{StatInterval: "toto"}); err == nil {
+		t.Fatal("Error expected on wrong stat interval")
+	}
+	if err := CheckGatewayStatus(&model.GatewayStatus{KeepaliveInterval: "0s"}); err == nil {
+		t.Fatal("Error expected on null keepalive interval")
+	}
+	if err := CheckGatewayStatus(&model.GatewayStatus{Latitude: [2]float64{91, 92}}); err == nil {
+		t.Fatal("Error expected on latitude out of range")
+	}
+	if err := CheckGatewayStatus(&model.GatewayStatus{Longitude: [2]float64{3, 2}}); err == nil {
+		t.Fatal("Error expected on longitude min greater than max")
+	}
+}
+
+func TestNewGatewayStatus(t *testing.T) {
+	gateway := NewGateway(0, model.Init{
+		GatewayStatus: &model.GatewayStatus{KeepaliveInterval: "5s", StatInterval: "30s", Latitude: [2]float64{48.8, 48.9}, Longitude: [2]float64{2.2, 2.4}, Altitude: 35},
+	})
+	if gateway.KeepaliveInterval != 5*time.Second || gateway.StatInterval != 30*time.Second {
+		t.Fatal("Gateway status intervals must be set")
+	}
+	if gateway.Latitude == nil || *gateway.Latitude < 48.8 || *gateway.Latitude > 48.9 || *gateway.Longitude < 2.2 || *gateway.Longitude > 2.4 || *gateway.Altitude != 35 {
+		t.Fatal("Gateway position must be in the configured ranges")
+	}
+
+	gateway = NewGateway(0, model.Init{GatewayStatus: &model.GatewayStatus{StatInterval: "30s"}})
+	if gateway.Latitude != nil || gateway.Longitude != nil || gateway.Altitude != nil {
+		t.Fatal("Gateway without configured position must not send GPS coordinates")
+	}
+}
+
+func TestNextStat(t *testing.T) {
+	gateway := &LorhammerGateway{}
+	for i := 0; i < 4; i++ {
+		gateway.addUplinks(1)
+	}
+	gateway.addPushAck()
+	gateway.addPushAck()
+	gateway.addPushAck()
+	gateway.addDownlink()
+
+	stat := gateway.nextStat()
+	if stat.RXNb != 4 || stat.RXOK != 4 || stat.RXFW != 4 {
+		t.Fatalf("Stat must count received packets, got rxnb %d", stat.RXNb)
+	}
+	if stat.ACKR != 75 {
+		t.Fatalf("Stat must give the percentage of acknowledged PUSH_DATA, got %f", stat.ACKR)
+	}
+	if stat.DWNb != 1 || stat.TXNb != 1 {
+		t.Fatal("Stat must count downlinks")
+	}
+
+	stat = gateway.nextStat()
+	if stat.RXNb != 0 || stat.DWNb != 0 || stat.ACKR != 100 {
+		t.Fatal("Stat counters must be reset after each stat")
+	}
+}
+
+func TestStatusLoop(t *testing.T) {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Can't listen udp")
+	}
+	defer ns.Close()
+	latitude := 48.85
+	gateway := &LorhammerGateway{
+		NsAddress:         ns.LocalAddr().String(),
+		MacAddress:        [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		KeepaliveInterval: 10 * time.Millisecond,
+		StatInterval:      10 * time.Millisecond,
+		Latitude:          &latitude,
+	}
+	defer gateway.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gateway.StatusLoop(ctx, &fakePrometheus{})
+
+	receivedPullData, receivedStat := false, false
+	buf := make([]byte, 65507)
+	ns.SetReadDeadline(time.Now().Add(time.Second))
+	for !receivedPullData || !receivedStat {
+		n, err := ns.Read(buf)
+		if err != nil {
+			t.Fatalf("Keepalive and stat must be sent, got pull data %t and stat %t", receivedPullData, receivedStat)
+		}
+		switch packetType, _ := loraserver_structs.GetPacketType(buf[:n]); packetType {
+		case loraserver_structs.PullData:
+			receivedPullData = true
+		case loraserver_structs.PushData:
+			var pushData loraserver_structs.PushDataPacket
+			if err := pushData.UnmarshalBinary(buf[:n]); err != nil || pushData.Payload.Stat == nil {
+				t.Fatal("PUSH_DATA must contain the gateway stat")
+			}
+			if pushData.GatewayMAC != gateway.MacAddress || *pushData.Payload.Stat.Lati != latitude {
+				t.Fatal("Stat must be sent with the gateway MAC and position")
+			}
+			receivedStat = true
+		}
+	}
+}
+
+func TestStatusLoopDisabled(t *testing.T) {
+	gateway := &LorhammerGateway{NsAddress: "127.0.0.1:0"}
+	if err := gateway.StatusLoop(context.Background(), &fakePrometheus{}); err != nil {
+		t.Fatal("Gateway without keepalive and stat must return immediately")
+	}
+}
@@ -0,0 +1,142 @@
+package lora
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"lorhammer/src/model"
+	"math"
+	"time"
+)
+
+//lppType is a CayenneLPP data type, each axis is a big endian value of size bytes in resolution units
+type lppType struct {
+	id         byte
+	size       int
+	resolution float64
+	axes       int
+}
+
+var lppTypes = map[string]lppType{
+	"digitalInput":  {id: 0, size: 1, resolution: 1, axes: 1},
+	"digitalOutput": {id: 1, size: 1, resolution: 1, axes: 1},
+	"analogInput":   {id: 2, size: 2, resolution: 0.01, axes: 1},
+	"analogOutput":  {id: 3, size: 2, resolution: 0.01, axes: 1},
+	"illuminance":   {id: 101, size: 2, resolution: 1, axes: 1},
+	"presence":      {id: 102, size: 1, resolution: 1, axes: 1},
+	"temperature":   {id: 103, size: 2, resolution: 0.1, axes: 1},
+	"humidity":      {id: 104, size: 1, resolution: 0.5, axes: 1},
+	"accelerometer": {id: 113, size: 2, resolution: 0.001, axes: 3},
+	"barometer":     {id: 115, size: 2, resolution: 0.1, axes: 1},
+	"gyrometer":     {id: 134, size: 2, resolution: 0.01, axes: 3},
+}
+
+//CheckPayloads return an error if a payload template of the scenario is not valid
+func CheckPayloads(payloads []model.Payload) error {
+	for i, payload := range payloads {
+		for _, field := range payload.Template {
+			if err := checkPayloadField(field); err != nil {
+				return fmt.Errorf("payload %d template : %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkPayloadField(field model.PayloadField) error {
+	if field.Range[0] > field.Range[1] {
+		return fmt.Errorf("%s range min must be lower than max", field.Kind)
+	}
+	switch field.Kind {
+	case "hex":
+		if _, err := hex.DecodeString(field.Value); err != nil {
+			return err
+		}
+	case "counter", "random":
+		if field.Size < 1 || field.Size > 8 {
+			return fmt.Errorf("%s size must be between 1 and 8 bytes", field.Kind)
+		}
+	case "timestamp":
+		if field.Size < 1 || field.Size > 8 {
+			return fmt.Errorf("%s size must be between 1 and 8 bytes", field.Kind)
+		}
+		if field.Unit != "" && field.Unit != "s" && field.Unit != "ms" {
+			return fmt.Errorf("timestamp unit must be s or ms")
+		}
+	case "float":
+		if field.Size != 4 && field.Size != 8 {
+			return fmt.Errorf("float size must be 4 or 8 bytes")
+		}
+	case "devEui", "devAddr":
+	case "lpp":
+		if _, ok := lppTypes[field.Type]; !ok {
+			return fmt.Errorf("unknown lpp type %s", field.Type)
+		}
+	default:
+		return fmt.Errorf("unknown field kind %s", field.Kind)
+	}
+	return nil
+}
+
+//templatePayload generate the payload of the node from the fields of the template, templates are checked when the scenario is created
+func templatePayload(node *model.Node, template []model.PayloadField) []byte {
+	now := time.Now()
+	var payload []byte
+	for _, field := range template {
+		switch field.Kind {
+		case "hex":
+			value, _ := hex.DecodeString(field.Value)
+			payload = append(payload, value...)
+		case "counter":
+			payload = appendUint(payload, node.PayloadCounter, field.Size, field.LittleEndian)
+		case "timestamp":
+			timestamp := uint64(now.Unix())
+			if field.Unit == "ms" {
+				timestamp = uint64(now.UnixNano() / int64(time.Millisecond))
+			}
+			payload = appendUint(payload, timestamp, field.Size, field.LittleEndian)
+		case "random":
+			value := math.Floor(randomInRange(field.Range) + 0.5)
+			payload = appendUint(payload, uint64(int64(value)), field.Size, field.LittleEndian)
+		case "float":
+			payload = appendFloat(payload, randomInRange(field.Range), field.Size, field.LittleEndian)
+		case "devEui":
+			payload = append(payload, node.DevEUI[:]...)
+		case "devAddr":
+			payload = append(payload, node.DevAddr[:]...)
+		case "lpp":
+			payload = appendLpp(payload, field)
+		}
+	}
+	node.PayloadCounter++
+	return payload
+}
+
+//appendUint append the size lowest bytes of the value, two's complement for negative values
+func appendUint(payload []byte, value uint64, size int, littleEndian bool) []byte {
+	b := make([]byte, 8)
+	if littleEndian {
+		binary.LittleEndian.PutUint64(b, value)
+		return append(payload, b[:size]...)
+	}
+	binary.BigEndian.PutUint64(b, value)
+	return append(payload, b[8-size:]...)
+}
+
+func appendFloat(payload []byte, value float64, size int, littleEndian bool) []byte {
+	if size == 4 {
+		return appendUint(payload, uint64(math.Float32bits(float32(value))), 4, littleEndian)
+	}
+	return appendUint(payload, math.Float64bits(value), 8, littleEndian)
+}
+
+//appendLpp append the CayenneLPP channel, type and value of each axis drawn in the range of the field
+func appendLpp(payload []byte, field model.PayloadField) []byte {
+	lpp := lppTypes[field.Type]
+	payload = append(payload, field.Channel, lpp.id)
+	for i := 0; i < lpp.axes; i++ {
+		value := math.Floor(randomInRange(field.Range)/lpp.resolution + 0.5)
+		payload = appendUint(payload, uint64(int64(value)), lpp.size, false)
+	}
+	return payload
+}
@@ -0,0 +1,109 @@
+package lora
+
+import (
+	"bytes"
+	"encoding/binary"
+	"lorhammer/src/model"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCheckPayloads(t *testing.T) {
+	valid := []model.Payload{{Template: []model.PayloadField{
+		{Kind: "hex", Value: "01"},
+		{Kind: "counter", Size: 2},
+		{Kind: "timestamp", Size: 8, Unit: "ms"},
+		{Kind: "random", Size: 2, Range: [2]float64{-10, 10}},
+		{Kind: "float", Size: 4},
+		{Kind: "devEui"},
+		{Kind: "lpp", Channel: 1, Type: "temperature", Range: [2]float64{-10, 40}},
+	}}}
+	if CheckPayloads(nil) != nil || CheckPayloads(valid) != nil {
+		t.Fatal("Valid payload template must not return an error")
+	}
+	wrongFields := []model.PayloadField{
+		{Kind: "unknown"},
+		{Kind: "hex", Value: "zz"},
+		{Kind: "counter", Size: 9},
+		{Kind: "timestamp", Size: 4, Unit: "h"},
+		{Kind: "random", Size: 2, Range: [2]float64{10, -10}},
+		{Kind: "float", Size: 2},
+		{Kind: "lpp", Type: "unknown"},
+	}
+	for _, field := range wrongFields {
+		if CheckPayloads([]model.Payload{{Template: []model.PayloadField{field}}}) == nil {
+			t.Fatalf("Error expected on wrong %s field", field.Kind)
+		}
+	}
+}
+
+func TestTemplatePayload(t *testing.T) {
+	node := newNode("", "", "", nil, false)
+	template := []model.PayloadField{
+		{Kind: "hex", Value: "ff"},
+		{Kind: "counter", Size: 2},
+		{Kind: "devAddr"},
+		{Kind: "random", Size: 2, Range: [2]float64{-2, -2}, LittleEndian: true},
+		{Kind: "float", Size: 4, Range: [2]float64{1.5, 1.5}},
+	}
+	expected := append(append([]byte{0xff, 0x00, 0x01}, node.DevAddr[:]...), 0xfe, 0xff, 0x3f, 0xc0, 0x00, 0x00)
+	templatePayload(node, template)
+	if payload := templatePayload(node, template); !bytes.Equal(payload, expected) {
+		t.Fatalf("Templated payload must be %x, got %x", expected, payload)
+	}
+}
+
+func TestTemplatePayloadTimestamp(t *testing.T) {
+	node := newNode("", "", "", nil, false)
+	before := time.Now().Unix()
+	payload := templatePayload(node, []model.PayloadField{{Kind: "timestamp", Size: 4}, {Kind: "timestamp", Size: 8, Unit: "ms", LittleEndian: true}})
+	if seconds := int64(binary.BigEndian.Uint32(payload)); seconds < before || seconds > time.Now().Unix() {
+		t.Fatal("Timestamp must be the uplink time in seconds")
+	}
+	if ms := int64(binary.LittleEndian.Uint64(payload[4:])); ms/1000 < before || ms/1000 > time.Now().Unix() {
+		t.Fatal("Timestamp must be the uplink time in milliseconds")
+	}
+}
+
+func TestTemplatePayloadRandom(t *testing.T) {
+	node := newNode("", "", "", nil, false)
+	for i := 0; i < 100; i++ {
+		payload := templatePayload(node, []model.PayloadField{{Kind: "random", Size: 2, Range: [2]float64{-100, 1000}}})
+		if value := int16(binary.BigEndian.Uint16(payload)); value < -100 || value > 1000 {
+			t.Fatalf("Random value must be in the range, got %d", value)
+		}
+	}
+	payload := templatePayload(node, []model.PayloadField{{Kind: "float", Size: 8, Range: [2]float64{0, 1}}})
+	if value := math.Float64frombits(binary.BigEndian.Uint64(payload)); value < 0 || value > 1 {
+		t.Fatalf("Random float must be in the range, got %f", value)
+	}
+}
+
+func TestTemplatePayloadLpp(t *testing.T) {
+	node := newNode("", "", "", nil, false)
+	payload := templatePayload(node, []model.PayloadField{
+		{Kind: "lpp", Channel: 1, Type: "temperature", Range: [2]float64{-4.1, -4.1}},
+		{Kind: "lpp", Channel: 2, Type: "humidity", Range: [2]float64{60, 60}},
+		{Kind: "lpp", Channel: 3, Type: "accelerometer", Range: [2]float64{1, 1}},
+	})
+	expected := []byte{0x01, 0x67, 0xff, 0xd7, 0x02, 0x68, 0x78, 0x03, 0x71, 0x03, 0xe8, 0x03, 0xe8, 0x03, 0xe8}
+	if !bytes.Equal(payload, expected) {
+		t.Fatalf("CayenneLPP payload must be %x, got %x", expected, payload)
+	}
+}
+
+func TestGetPushDataPayloadTemplate(t *testing.T) {
+	fport := uint8(2)
+	node := newNode("19842bd94743246b367c2e90942a1f73", "19842bd94743246b367c2e90942a1f77", "", []model.Payload{{Value: "01", FPort: &fport, Template: []model.PayloadField{{Kind: "counter", Size: 1}}}}, false)
+
+	for i := byte(0); i < 2; i++ {
+		dataPayload, _, err := GetPushDataPayload(node, eu868)
+		if err != nil {
+			t.Fatal("Couldn't get PushData payload")
+		}
+		if port, frmPayload := decryptPushDataFRMPayload(t, dataPayload, node.AppSKey); port != 2 || !bytes.Equal(frmPayload, []byte{i}) {
+			t.Fatal("Payload must be generated from the template at each uplink instead of its value")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package lora
+
+import (
+	"lorhammer/src/model"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+)
+
+const (
+	// tolerance of the downlink tmst around the RX1 and RX2 windows opening
+	rxWindowTolerance = time.Millisecond
+	// JOIN_ACCEPT_DELAY1, RX1 of JoinAccept
+	joinAcceptDelay = 5 * time.Second
+	// GPS time is ahead of UTC by the leap seconds since the GPS epoch
+	gpsLeapSeconds = 18 * time.Second
+)
+
+//gpsEpoch is the origin of the GPS time
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+//tmstStart is the origin of the concentrator counters, each gateway counter starts from its own random offset
+var tmstStart = time.Now()
+
+//rxpk is a semtech rxpk with the GPS time and fine timestamp of the gateways having a GPS
+type rxpk struct {
+	loraserver_structs.RXPK
+	Tmms *int64 `json:"tmms,omitempty"` // GPS time in milliseconds since the GPS epoch
+	Fts  *int64 `json:"fts,omitempty"`  // fine timestamp, nanoseconds since the last second
+}
+
+//txpk is a semtech txpk with the GPS time of the downlinks scheduled at a GPS time, class B beacons and ping slots
+type txpk struct {
+	loraserver_structs.TXPK
+	Tmms *int64 `json:"tmms,omitempty"` // GPS time in milliseconds since the GPS epoch
+}
+
+//tmstAt return the value of the free running microsecond counter of the gateway concentrator at t, it wraps around every 72 minutes
+func (gateway *LorhammerGateway) tmstAt(t time.Time) uint32 {
+	return gateway.tmstOffset + uint32(t.Sub(tmstStart)/time.Microsecond)
+}
+
+//uplinkReception is the last uplink of a node received by a gateway, the downlinks answering it are checked against it
+type uplinkReception struct {
+	tmst       uint32
+	receivedAt time.Time
+	channel    int // index in the node channels
+	frequency  int // in Hz
+	dataRate   int
+}
+
+//setLastUplink keep the last uplink of the node received by the gateway, to check the timing of its downlink
+func (gateway *LorhammerGateway) setLastUplink(node *model.Node, uplink uplinkReception) {
+	gateway.tmstMutex.Lock()
+	defer gateway.tmstMutex.Unlock()
+	if gateway.uplinks == nil {
+		gateway.uplinks = make(map[*model.Node]uplinkReception)
+	}
+	gateway.uplinks[node] = uplink
+}
+
+func (gateway *LorhammerGateway) lastUplink(node *model.Node) (uplinkReception, bool) {
+	gateway.tmstMutex.Lock()
+	defer gateway.tmstMutex.Unlock()
+	uplink, ok := gateway.uplinks[node]
+	return uplink, ok
+}
+
+//withGpsTime return the rxpks with their GPS time and fine timestamp if the gateway sends them
+func (gateway *LorhammerGateway) withGpsTime(rxpks []loraserver_structs.RXPK) []rxpk {
+	withGps := make([]rxpk, len(rxpks))
+	for i, r := range rxpks {
+		withGps[i].RXPK = r
+		if r.Time == nil {
+			continue
+		}
+		t := time.Time(*r.Time)
+		if gateway.GpsTime {
+			tmms := gpsTime(t).Nanoseconds() / int64(time.Millisecond)
+			withGps[i].Tmms = &tmms
+		}
+		if gateway.FineTimestamp {
+			fts := int64(t.Nanosecond())
+			withGps[i].Fts = &fts
+		}
+	}
+	return withGps
+}
+
+//gpsTime return the duration since the GPS epoch of an UTC time
+func gpsTime(t time.Time) time.Duration {
+	return t.Sub(gpsEpoch) + gpsLeapSeconds
+}
+
+//rxWindow return the RX1 or RX2 window of the downlink tmst after the uplink, or miss, and the delay of the downlink after the uplink
+//the uint32 difference of the counters stays right when the counter wraps around between the uplink and the downlink
+func rxWindow(node *model.Node, uplink uplinkReception, txTmst uint32, joinAccept bool) (string, time.Duration) {
+	rx1 := time.Duration(node.RXDelay) * time.Second
+	if rx1 == 0 {
+		rx1 = time.Second
+	}
+	if joinAccept {
+		rx1 = joinAcceptDelay
+	}
+	delay := time.Duration(txTmst-uplink.tmst) * time.Microsecond
+	switch {
+	case delay >= rx1-rxWindowTolerance && delay <= rx1+rxWindowTolerance:
+		return "rx1", delay
+	case delay >= rx1+time.Second-rxWindowTolerance && delay <= rx1+time.Second+rxWindowTolerance:
+		return "rx2", delay
+	}
+	return "miss", delay
+}
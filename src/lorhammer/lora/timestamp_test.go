@@ -0,0 +1,116 @@
+package lora
+
+import (
+	"encoding/base64"
+	"lorhammer/src/model"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	loraserver_structs "github.com/brocaar/lora-gateway-bridge/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+func TestTmstAt(t *testing.T) {
+	gateway := &LorhammerGateway{tmstOffset: math.MaxUint32 - 9}
+	if gateway.tmstAt(tmstStart) != math.MaxUint32-9 {
+		t.Fatal("Counter must start from the gateway offset")
+	}
+	if gateway.tmstAt(tmstStart.Add(20*time.Microsecond)) != 10 {
+		t.Fatal("Counter must count microseconds and wrap around")
+	}
+	other := &LorhammerGateway{tmstOffset: 42}
+	if other.tmstAt(tmstStart.Add(time.Second)) != 1000042 {
+		t.Fatal("Each gateway must have its own counter")
+	}
+}
+
+func TestNewRxpkTmst(t *testing.T) {
+	gateway := &LorhammerGateway{tmstOffset: 1000}
+	node := newNode("", "", "", nil, false)
+	before := gateway.tmstAt(time.Now())
+	rxpk, err := newRxpk([]byte{1, 2, 3}, 0, node, gateway)
+	if err != nil {
+		t.Fatal("Valid rxpk must not return an error")
+	}
+	if rxpk.Tmst-before > uint32(time.Second/time.Microsecond) {
+		t.Fatal("Rxpk tmst must be the gateway counter at reception")
+	}
+	if uplink, ok := gateway.lastUplink(node); !ok || uplink.tmst != rxpk.Tmst || float64(uplink.frequency)/1000000 != rxpk.Freq {
+		t.Fatal("Uplink of the node must be kept to check the downlink timing")
+	}
+}
+
+func TestWithGpsTime(t *testing.T) {
+	date := loraserver_structs.CompactTime(gpsEpoch.Add(1500 * time.Millisecond))
+	rxpks := []loraserver_structs.RXPK{{Time: &date}, {}}
+
+	withGps := (&LorhammerGateway{}).withGpsTime(rxpks)
+	if withGps[0].Tmms != nil || withGps[0].Fts != nil {
+		t.Fatal("Gateway without GPS must not send GPS time and fine timestamp")
+	}
+
+	withGps = (&LorhammerGateway{GpsTime: true, FineTimestamp: true}).withGpsTime(rxpks)
+	if withGps[0].Tmms == nil || *withGps[0].Tmms != 19500 {
+		t.Fatal("GPS time must be the milliseconds since the GPS epoch with leap seconds")
+	}
+	if withGps[0].Fts == nil || *withGps[0].Fts != 500000000 {
+		t.Fatal("Fine timestamp must be the nanoseconds since the last second")
+	}
+	if withGps[1].Tmms != nil {
+		t.Fatal("Rxpk without time must not have GPS time")
+	}
+
+	packet, err := packet{Rxpk: rxpks}.prepare(&LorhammerGateway{GpsTime: true})
+	if err != nil || !strings.Contains(string(packet), `"tmms":19500`) {
+		t.Fatal("PUSH_DATA must contain the GPS time")
+	}
+}
+
+func TestRxWindow(t *testing.T) {
+	node := &model.Node{RXDelay: 1}
+	// uplink just before the counter wraps around
+	uplink := uplinkReception{tmst: math.MaxUint32 - 100}
+
+	if window, _ := rxWindow(node, uplink, uplink.tmst+1000000, false); window != "rx1" {
+		t.Fatal("Downlink 1s after the uplink must be in RX1")
+	}
+	if window, delay := rxWindow(node, uplink, uplink.tmst+2000000, false); window != "rx2" || delay != 2*time.Second {
+		t.Fatal("Downlink 2s after the uplink must be in RX2")
+	}
+	if window, _ := rxWindow(node, uplink, uplink.tmst+5000000, true); window != "rx1" {
+		t.Fatal("JoinAccept 5s after the JoinRequest must be in RX1")
+	}
+	if window, _ := rxWindow(node, uplink, uplink.tmst+3000000, false); window != "miss" {
+		t.Fatal("Downlink out of the RX windows must be a miss")
+	}
+}
+
+func TestHandleDownlinkRxWindow(t *testing.T) {
+	gateway := &LorhammerGateway{Nodes: []*model.Node{newNode("", "", "", nil, false)}}
+	node := gateway.Nodes[0]
+	node.RXDelay = 1
+	gateway.setLastUplink(node, uplinkReception{tmst: 123, receivedAt: time.Now(), frequency: 868100000, dataRate: 5})
+	phyPayload := newDataDown(t, node, lorawan.UnconfirmedDataDown, false)
+	phyPayloadBytes, _ := phyPayload.MarshalBinary()
+	tmst := uint32(123 + 1000000)
+	pullResp, _ := loraserver_structs.PullRespPacket{
+		ProtocolVersion: loraserver_structs.ProtocolVersion2,
+		Payload: loraserver_structs.PullRespPayload{
+			TXPK: loraserver_structs.TXPK{
+				Tmst: &tmst,
+				Freq: 868.1,
+				DatR: loraserver_structs.DatR{LoRa: "SF7BW125"},
+				Data: base64.StdEncoding.EncodeToString(phyPayloadBytes),
+			},
+		},
+	}.MarshalBinary()
+	fakePrometheus := &fakePrometheus{}
+
+	gateway.handleDownlink(pullResp, fakePrometheus)
+
+	if fakePrometheus.downlinkRxWindows["rx1"] != 1 || fakePrometheus.downlinkTimings["on_time"] != 1 {
+		t.Fatal("Downlink in RX1 must be counted")
+	}
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,6 +20,17 @@ type Prometheus interface {
 	SubNodes(nb int)
 	AddPushAckLongRequest(nb int)
 	AddPullRespLongRequest(nb int)
+	AddConfirmedUplink(nb int)
+	AddUplinkAck(nb int)
+	AddRetransmission(nb int)
+	AddNodesDataRate(dataRate int, nb int)
+	SubNodesDataRate(dataRate int, nb int)
+	AddDownlinkRxWindow(window string, nb int)
+	AddDownlinkTiming(result string, nb int)
+	ObserveDownlinkEnqueueDelay(delay time.Duration)
+	AddClassBDownlink(kind string, result string, nb int)
+	AddDutyCycle(scope string, result string, nb int)
+	AddLoadSkippedArrival(nb int)
 }
 
 type prometheusImpl struct {
@@ -28,6 +40,16 @@ type prometheusImpl struct {
 	nbNodes               prometheus.Gauge
 	nbPushAckLongRequest  prometheus.Counter
 	nbPullRespLongRequest prometheus.Counter
+	nbConfirmedUplink     prometheus.Counter
+	nbUplinkAck           prometheus.Counter
+	nbRetransmission      prometheus.Counter
+	nbNodesDataRate       *prometheus.GaugeVec
+	nbDownlinkRxWindow    *prometheus.CounterVec
+	nbDownlinkTiming      *prometheus.CounterVec
+	downlinkEnqueueDelay  prometheus.Histogram
+	nbClassBDownlink      *prometheus.CounterVec
+	nbDutyCycle           *prometheus.CounterVec
+	nbLoadSkippedArrival  prometheus.Counter
 }
 
 //NewPrometheus return a Prometheus instance
@@ -64,6 +86,57 @@ func NewPrometheus() Prometheus {
 		Help: "Lora nb lora pull resp request witch take more than 2sc.",
 	})
 	prometheus.MustRegister(nbPullRespLongRequest)
+	nbConfirmedUplink := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lorhammer_uplink_confirmed",
+		Help: "Lora nb confirmed uplinks sent, retransmissions excluded.",
+	})
+	prometheus.MustRegister(nbConfirmedUplink)
+	nbUplinkAck := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lorhammer_uplink_ack",
+		Help: "Lora nb confirmed uplinks acknowledged by a downlink, the ACK hit rate is lorhammer_uplink_ack / lorhammer_uplink_confirmed.",
+	})
+	prometheus.MustRegister(nbUplinkAck)
+	nbRetransmission := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lorhammer_uplink_retransmission",
+		Help: "Lora nb confirmed uplinks sent again because no ACK has been received.",
+	})
+	prometheus.MustRegister(nbRetransmission)
+	nbNodesDataRate := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lorhammer_node_datarate",
+		Help: "Lora simulated nodes by data rate.",
+	}, []string{"datarate"})
+	prometheus.MustRegister(nbNodesDataRate)
+	nbDownlinkRxWindow := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lorhammer_downlink_rx_window",
+		Help: "Lora nb downlinks by RX window of their tmst : rx1, rx2 or miss.",
+	}, []string{"window"})
+	prometheus.MustRegister(nbDownlinkRxWindow)
+	nbDownlinkTiming := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lorhammer_downlink_timing",
+		Help: "Lora nb downlinks by timing : on_time, late (received too late to be emitted at their tmst) or wrong_parameters (tmst, frequency or data rate out of the RX windows).",
+	}, []string{"result"})
+	prometheus.MustRegister(nbDownlinkTiming)
+	downlinkEnqueueDelay := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lorhammer_downlink_enqueue_durations",
+		Help:    "Lora delay distributions from the application enqueueing a downlink to the gateway receiving it.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 12), // 12 buckets, from 10msc to 20sc.
+	})
+	prometheus.MustRegister(downlinkEnqueueDelay)
+	nbClassBDownlink := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lorhammer_class_b_downlink",
+		Help: "Lora nb class B beacons and ping slot downlinks by result : valid, wrong_time or wrong_parameters.",
+	}, []string{"kind", "result"})
+	prometheus.MustRegister(nbClassBDownlink)
+	nbDutyCycle := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lorhammer_duty_cycle",
+		Help: "Lora nb uplinks of nodes and downlinks of gateways by duty-cycle result : within, exceeded (emitted over the duty-cycle) or blocked (not emitted, the duty-cycle is enforced).",
+	}, []string{"scope", "result"})
+	prometheus.MustRegister(nbDutyCycle)
+	nbLoadSkippedArrival := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lorhammer_load_skipped_arrival",
+		Help: "Lora nb arrivals of the load profile without uplink, their node can't emit (duty-cycle enforced).",
+	})
+	prometheus.MustRegister(nbLoadSkippedArrival)
 	return &prometheusImpl{
 		udpPullRespDuration:   udpPullRespDuration,
 		udpPushAckDuration:    udpPushAckDuration,
@@ -71,6 +144,16 @@ func NewPrometheus() Prometheus {
 		nbNodes:               nbNodes,
 		nbPushAckLongRequest:  nbPushAckLongRequest,
 		nbPullRespLongRequest: nbPullRespLongRequest,
+		nbConfirmedUplink:     nbConfirmedUplink,
+		nbUplinkAck:           nbUplinkAck,
+		nbRetransmission:      nbRetransmission,
+		nbNodesDataRate:       nbNodesDataRate,
+		nbDownlinkRxWindow:    nbDownlinkRxWindow,
+		nbDownlinkTiming:      nbDownlinkTiming,
+		downlinkEnqueueDelay:  downlinkEnqueueDelay,
+		nbClassBDownlink:      nbClassBDownlink,
+		nbDutyCycle:           nbDutyCycle,
+		nbLoadSkippedArrival:  nbLoadSkippedArrival,
 	}
 }
 
@@ -115,3 +198,47 @@ func (prom *prometheusImpl) AddPushAckLongRequest(nb int) {
 func (prom *prometheusImpl) AddPullRespLongRequest(nb int) {
 	prom.nbPullRespLongRequest.Add(float64(nb))
 }
+
+func (prom *prometheusImpl) AddConfirmedUplink(nb int) {
+	prom.nbConfirmedUplink.Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddUplinkAck(nb int) {
+	prom.nbUplinkAck.Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddRetransmission(nb int) {
+	prom.nbRetransmission.Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddNodesDataRate(dataRate int, nb int) {
+	prom.nbNodesDataRate.WithLabelValues(strconv.Itoa(dataRate)).Add(float64(nb))
+}
+
+func (prom *prometheusImpl) SubNodesDataRate(dataRate int, nb int) {
+	prom.nbNodesDataRate.WithLabelValues(strconv.Itoa(dataRate)).Sub(float64(nb))
+}
+
+func (prom *prometheusImpl) AddDownlinkRxWindow(window string, nb int) {
+	prom.nbDownlinkRxWindow.WithLabelValues(window).Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddDownlinkTiming(result string, nb int) {
+	prom.nbDownlinkTiming.WithLabelValues(result).Add(float64(nb))
+}
+
+func (prom *prometheusImpl) ObserveDownlinkEnqueueDelay(delay time.Duration) {
+	prom.downlinkEnqueueDelay.Observe(delay.Seconds() * 1000)
+}
+
+func (prom *prometheusImpl) AddClassBDownlink(kind string, result string, nb int) {
+	prom.nbClassBDownlink.WithLabelValues(kind, result).Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddDutyCycle(scope string, result string, nb int) {
+	prom.nbDutyCycle.WithLabelValues(scope, result).Add(float64(nb))
+}
+
+func (prom *prometheusImpl) AddLoadSkippedArrival(nb int) {
+	prom.nbLoadSkippedArrival.Add(float64(nb))
+}
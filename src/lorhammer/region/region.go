@@ -0,0 +1,461 @@
+package region
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lorhammer/src/model"
+	"math"
+	"time"
+)
+
+//loraPreamble is the number of preamble symbols of LoRaWAN frames
+const loraPreamble = 8
+
+//DataRate is a LoRa spreading factor and bandwidth (in kHz) or a FSK bit rate (in bits/s)
+type DataRate struct {
+	SpreadingFactor int
+	Bandwidth       int
+	BitRate         int
+}
+
+//IsFSK return true if the data rate use the FSK modulation
+func (dr DataRate) IsFSK() bool {
+	return dr.BitRate > 0
+}
+
+//Modulation return the modulation as written in semtech packets : LORA or FSK
+func (dr DataRate) Modulation() string {
+	if dr.IsFSK() {
+		return "FSK"
+	}
+	return "LORA"
+}
+
+//String return the LoRa data rate as written in semtech packets (SF7BW125) or the FSK bit rate
+func (dr DataRate) String() string {
+	if dr.IsFSK() {
+		return fmt.Sprintf("%d", dr.BitRate)
+	}
+	return fmt.Sprintf("SF%dBW%d", dr.SpreadingFactor, dr.Bandwidth)
+}
+
+//TimeOnAir return the time to emit a frame of size bytes at this data rate with a coding rate from 4/5 to 4/8
+//LoRa frames have an explicit header and a CRC if crc is true, LoRaWAN downlinks have none
+func (dr DataRate) TimeOnAir(size int, codingRate string, crc bool) time.Duration {
+	if dr.IsFSK() {
+		// preamble (5), sync word (3), length (1), payload and CRC (2)
+		return time.Duration(float64((5+3+1+size+2)*8) / float64(dr.BitRate) * float64(time.Second))
+	}
+	symbol := float64(int(1)<<uint(dr.SpreadingFactor)) / float64(dr.Bandwidth*1000)
+	lowDataRateOptimize := 0
+	if symbol >= 0.016 {
+		lowDataRateOptimize = 1
+	}
+	cr := 1
+	fmt.Sscanf(codingRate, "4/%d", &cr)
+	if cr > 4 {
+		cr -= 4
+	}
+	crcBits := 0
+	if crc {
+		crcBits = 16
+	}
+	payloadBits := float64(8*size - 4*dr.SpreadingFactor + 28 + crcBits)
+	payloadSymbols := math.Max(math.Ceil(payloadBits/float64(4*(dr.SpreadingFactor-2*lowDataRateOptimize)))*float64(cr+4), 0)
+	return time.Duration((loraPreamble + 4.25 + 8 + payloadSymbols) * symbol * float64(time.Second))
+}
+
+//DutyCycleBand is a frequency band where each emitter can only emit a ratio of the time
+type DutyCycleBand struct {
+	MinFrequency int // in Hz
+	MaxFrequency int
+	DutyCycle    float64
+}
+
+//Region contains the regional parameters of a LoRaWAN band
+type Region struct {
+	Name            string
+	DataRates       []DataRate      // indexed by data rate, reserved data rates are empty
+	Channels        []model.Channel // uplink channels of the band
+	DefaultDataRate int
+	NbSubBands      int // sub-bands of 8 channels, the 500kHz channels (one per sub-band) are after them
+	CodingRate      string
+	MinFrequency    int // band limits in Hz
+	MaxFrequency    int
+	MaxTxPower      int
+	MaxRX1DROffset  int
+	RX2Frequency    int
+	RX2DataRate     int
+	// RX1 channels when they are not the uplink channel, RX1 uses the uplink channel modulo their number
+	DownlinkChannels []model.Channel
+	// RX1 data rate by uplink data rate and RX1 data rate offset, the uplink data rate minus the offset if empty
+	RX1DataRates [][]int
+	// class B beacons and default ping slots frequencies, they hop over them when there are several
+	BeaconFrequencies []int
+	BeaconDataRate    int
+	BeaconRFU         [2]int // RFU bytes before the time and after the gateway specific part of the beacon
+	// regulatory sub-bands limiting the time on air, none if the region has no duty-cycle
+	DutyCycleBands []DutyCycleBand
+}
+
+var regions = map[string]*Region{
+	"EU868": {
+		Name:              "EU868",
+		DataRates:         append(loraDataRates(125, 12, 11, 10, 9, 8, 7), DataRate{SpreadingFactor: 7, Bandwidth: 250}, DataRate{BitRate: 50000}),
+		Channels:          []model.Channel{newChannel(868100000, 0, 5), newChannel(868300000, 0, 5), newChannel(868500000, 0, 5)},
+		DefaultDataRate:   5,
+		CodingRate:        "4/5",
+		MinFrequency:      863000000,
+		MaxFrequency:      870000000,
+		MaxTxPower:        7,
+		MaxRX1DROffset:    5,
+		RX2Frequency:      869525000,
+		RX2DataRate:       0,
+		BeaconFrequencies: []int{869525000},
+		BeaconDataRate:    3,
+		BeaconRFU:         [2]int{2, 0},
+		DutyCycleBands: []DutyCycleBand{
+			{MinFrequency: 863000000, MaxFrequency: 865000000, DutyCycle: 0.001},
+			{MinFrequency: 865000000, MaxFrequency: 868000000, DutyCycle: 0.01},
+			{MinFrequency: 868000000, MaxFrequency: 868600000, DutyCycle: 0.01},
+			{MinFrequency: 868700000, MaxFrequency: 869200000, DutyCycle: 0.001},
+			{MinFrequency: 869400000, MaxFrequency: 869650000, DutyCycle: 0.1},
+			{MinFrequency: 869700000, MaxFrequency: 870000000, DutyCycle: 0.01},
+		},
+	},
+	"US915": {
+		Name:             "US915",
+		DataRates:        append(append(loraDataRates(125, 10, 9, 8, 7), DataRate{SpreadingFactor: 8, Bandwidth: 500}, DataRate{}, DataRate{}, DataRate{}), loraDataRates(500, 12, 11, 10, 9, 8, 7)...),
+		Channels:         append(newChannels(64, 902300000, 200000, 0, 3), newChannels(8, 903000000, 1600000, 4, 4)...),
+		DefaultDataRate:  3,
+		NbSubBands:       8,
+		CodingRate:       "4/5",
+		MinFrequency:     902000000,
+		MaxFrequency:     928000000,
+		MaxTxPower:       10,
+		MaxRX1DROffset:   3,
+		RX2Frequency:     923300000,
+		RX2DataRate:      8,
+		DownlinkChannels: newChannels(8, 923300000, 600000, 8, 13),
+		RX1DataRates: [][]int{
+			{10, 9, 8, 8},
+			{11, 10, 9, 8},
+			{12, 11, 10, 9},
+			{13, 12, 11, 10},
+			{13, 13, 12, 11},
+		},
+		BeaconFrequencies: newFrequencies(8, 923300000, 600000),
+		BeaconDataRate:    8,
+		BeaconRFU:         [2]int{5, 3},
+	},
+	"AS923": {
+		Name:              "AS923",
+		DataRates:         append(loraDataRates(125, 12, 11, 10, 9, 8, 7), DataRate{SpreadingFactor: 7, Bandwidth: 250}, DataRate{BitRate: 50000}),
+		Channels:          []model.Channel{newChannel(923200000, 0, 5), newChannel(923400000, 0, 5)},
+		DefaultDataRate:   5,
+		CodingRate:        "4/5",
+		MinFrequency:      915000000,
+		MaxFrequency:      928000000,
+		MaxTxPower:        7,
+		MaxRX1DROffset:    7,
+		RX2Frequency:      923200000,
+		RX2DataRate:       2,
+		BeaconFrequencies: []int{923400000},
+		BeaconDataRate:    3,
+		BeaconRFU:         [2]int{2, 0},
+	},
+	"AU915": {
+		Name:             "AU915",
+		DataRates:        append(append(loraDataRates(125, 12, 11, 10, 9, 8, 7), DataRate{SpreadingFactor: 8, Bandwidth: 500}, DataRate{}), loraDataRates(500, 12, 11, 10, 9, 8, 7)...),
+		Channels:         append(newChannels(64, 915200000, 200000, 0, 5), newChannels(8, 915900000, 1600000, 6, 6)...),
+		DefaultDataRate:  5,
+		NbSubBands:       8,
+		CodingRate:       "4/5",
+		MinFrequency:     915000000,
+		MaxFrequency:     928000000,
+		MaxTxPower:       10,
+		MaxRX1DROffset:   5,
+		RX2Frequency:     923300000,
+		RX2DataRate:      8,
+		DownlinkChannels: newChannels(8, 923300000, 600000, 8, 13),
+		RX1DataRates: [][]int{
+			{8, 8, 8, 8, 8, 8},
+			{9, 8, 8, 8, 8, 8},
+			{10, 9, 8, 8, 8, 8},
+			{11, 10, 9, 8, 8, 8},
+			{12, 11, 10, 9, 8, 8},
+			{13, 12, 11, 10, 9, 8},
+			{13, 13, 12, 11, 10, 9},
+		},
+		BeaconFrequencies: newFrequencies(8, 923300000, 600000),
+		BeaconDataRate:    8,
+		BeaconRFU:         [2]int{5, 3},
+	},
+	"CN470": {
+		Name:              "CN470",
+		DataRates:         loraDataRates(125, 12, 11, 10, 9, 8, 7),
+		Channels:          newChannels(96, 470300000, 200000, 0, 5),
+		DefaultDataRate:   5,
+		NbSubBands:        12,
+		CodingRate:        "4/5",
+		MinFrequency:      470000000,
+		MaxFrequency:      510000000,
+		MaxTxPower:        7,
+		MaxRX1DROffset:    5,
+		RX2Frequency:      505300000,
+		RX2DataRate:       0,
+		DownlinkChannels:  newChannels(48, 500300000, 200000, 0, 5),
+		BeaconFrequencies: newFrequencies(8, 508300000, 200000),
+		BeaconDataRate:    2,
+		BeaconRFU:         [2]int{3, 1},
+	},
+	"IN865": {
+		Name:              "IN865",
+		DataRates:         append(loraDataRates(125, 12, 11, 10, 9, 8, 7), DataRate{}, DataRate{BitRate: 50000}),
+		Channels:          []model.Channel{newChannel(865062500, 0, 5), newChannel(865402500, 0, 5), newChannel(865985000, 0, 5)},
+		DefaultDataRate:   5,
+		CodingRate:        "4/5",
+		MinFrequency:      865000000,
+		MaxFrequency:      867000000,
+		MaxTxPower:        10,
+		MaxRX1DROffset:    7,
+		RX2Frequency:      866550000,
+		RX2DataRate:       2,
+		BeaconFrequencies: []int{866550000},
+		BeaconDataRate:    4,
+		BeaconRFU:         [2]int{1, 3},
+	},
+}
+
+func loraDataRates(bandwidth int, spreadingFactors ...int) []DataRate {
+	dataRates := make([]DataRate, 0, len(spreadingFactors))
+	for _, sf := range spreadingFactors {
+		dataRates = append(dataRates, DataRate{SpreadingFactor: sf, Bandwidth: bandwidth})
+	}
+	return dataRates
+}
+
+func newChannel(frequency int, minDR int, maxDR int) model.Channel {
+	return model.Channel{Frequency: frequency, MinDR: minDR, MaxDR: maxDR, Enabled: true}
+}
+
+func newChannels(nb int, firstFrequency int, step int, minDR int, maxDR int) []model.Channel {
+	channels := make([]model.Channel, 0, nb)
+	for i := 0; i < nb; i++ {
+		channels = append(channels, newChannel(firstFrequency+i*step, minDR, maxDR))
+	}
+	return channels
+}
+
+func newFrequencies(nb int, first int, step int) []int {
+	frequencies := make([]int, 0, nb)
+	for i := 0; i < nb; i++ {
+		frequencies = append(frequencies, first+i*step)
+	}
+	return frequencies
+}
+
+//Get return the regional parameters of the named region, EU868 if name is empty
+func Get(name string) (*Region, error) {
+	if name == "" {
+		name = "EU868"
+	}
+	region, ok := regions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown region %s", name)
+	}
+	return region, nil
+}
+
+//NodeChannels return a copy of the region channels where only the channels of the sub-bands are enabled
+//all channels are enabled if no sub-band is given
+func (r *Region) NodeChannels(subBands []int) ([]model.Channel, error) {
+	channels := make([]model.Channel, len(r.Channels))
+	copy(channels, r.Channels)
+	if len(subBands) == 0 {
+		return channels, nil
+	}
+	if r.NbSubBands == 0 {
+		return nil, fmt.Errorf("region %s has no sub-bands", r.Name)
+	}
+	enabled := make(map[int]bool)
+	for _, subBand := range subBands {
+		if subBand < 1 || subBand > r.NbSubBands {
+			return nil, fmt.Errorf("sub-band %d doesn't exist in region %s", subBand, r.Name)
+		}
+		enabled[subBand] = true
+	}
+	for i := range channels {
+		channels[i].Enabled = enabled[r.subBand(i)]
+	}
+	return channels, nil
+}
+
+//subBand return the sub-band (from 1) of the channel
+func (r *Region) subBand(channel int) int {
+	if channel < r.NbSubBands*8 {
+		return channel/8 + 1
+	}
+	return channel - r.NbSubBands*8 + 1
+}
+
+//IsDynamicChannelPlan return true if channels can be added by the network server (regions without sub-bands)
+func (r *Region) IsDynamicChannelPlan() bool {
+	return r.NbSubBands == 0
+}
+
+//DataRateIndex return the first data rate of the region with this LoRa data rate (SF7BW125) or FSK bit rate, -1 if none
+func (r *Region) DataRateIndex(lora string, bitRate int) int {
+	for i, dataRate := range r.DataRates {
+		if dataRate == (DataRate{}) {
+			continue
+		}
+		if (dataRate.IsFSK() && dataRate.BitRate == bitRate) || (!dataRate.IsFSK() && dataRate.String() == lora) {
+			return i
+		}
+	}
+	return -1
+}
+
+//IsValidFrequency return true if the frequency in Hz is in the band of the region
+func (r *Region) IsValidFrequency(frequency int) bool {
+	return r.MinFrequency <= frequency && frequency <= r.MaxFrequency
+}
+
+//DutyCycleBand return the index of the duty-cycle band of the frequency in Hz, -1 if the frequency has no duty-cycle
+func (r *Region) DutyCycleBand(frequency int) int {
+	for i, band := range r.DutyCycleBands {
+		if band.MinFrequency <= frequency && frequency < band.MaxFrequency {
+			return i
+		}
+	}
+	return -1
+}
+
+//IsValidDataRate return true if the data rate exists in the region
+func (r *Region) IsValidDataRate(dataRate int) bool {
+	return dataRate >= 0 && dataRate < len(r.DataRates) && r.DataRates[dataRate] != (DataRate{})
+}
+
+//ApplyChannelMask return a copy of the channels with the channel mask of a LinkADRReq applied
+//it return false if the mask is not valid for the region or enables an undefined channel
+func (r *Region) ApplyChannelMask(channels []model.Channel, chMaskCntl int, chMask uint16) ([]model.Channel, bool) {
+	masked := make([]model.Channel, len(channels))
+	copy(masked, channels)
+	nb125kHz := r.NbSubBands * 8
+
+	ok := false
+	switch {
+	case chMaskCntl == 6 && (r.IsDynamicChannelPlan() || len(channels) == nb125kHz):
+		// all defined channels on
+		for i := range masked {
+			masked[i].Enabled = masked[i].Frequency != 0
+		}
+		ok = true
+	case (chMaskCntl == 6 || chMaskCntl == 7) && !r.IsDynamicChannelPlan():
+		// all 125kHz channels on (6) or off (7), the mask applies to 500kHz channels
+		for i := 0; i < nb125kHz && i < len(masked); i++ {
+			masked[i].Enabled = chMaskCntl == 6
+		}
+		ok = applyChannelMaskBlock(masked, nb125kHz, chMask)
+	case chMaskCntl == 0 && r.IsDynamicChannelPlan(), !r.IsDynamicChannelPlan() && chMaskCntl*16 < len(channels):
+		ok = applyChannelMaskBlock(masked, chMaskCntl*16, chMask)
+	}
+	if !ok {
+		return channels, false
+	}
+	return masked, true
+}
+
+//applyChannelMaskBlock apply the 16 bits mask to the channels from first
+func applyChannelMaskBlock(channels []model.Channel, first int, chMask uint16) bool {
+	for i := 0; i < 16; i++ {
+		enabled := chMask&(1<<uint(i)) != 0
+		if first+i >= len(channels) || channels[first+i].Frequency == 0 {
+			if enabled {
+				return false
+			}
+			continue
+		}
+		channels[first+i].Enabled = enabled
+	}
+	return true
+}
+
+//RX1Frequency return the frequency in Hz of the RX1 window opened by an uplink on this channel and frequency
+func (r *Region) RX1Frequency(uplinkChannel int, uplinkFrequency int) int {
+	if len(r.DownlinkChannels) == 0 {
+		return uplinkFrequency
+	}
+	return r.DownlinkChannels[uplinkChannel%len(r.DownlinkChannels)].Frequency
+}
+
+//RX1DataRate return the data rate of the RX1 window opened by an uplink at this data rate, -1 if the offset is not valid for it
+//offsets raising the data rate (6 and 7 in AS923 and IN865) are not supported
+func (r *Region) RX1DataRate(uplinkDataRate int, rx1DROffset int) int {
+	if len(r.RX1DataRates) == 0 {
+		if uplinkDataRate < rx1DROffset {
+			return 0
+		}
+		return uplinkDataRate - rx1DROffset
+	}
+	if uplinkDataRate < 0 || uplinkDataRate >= len(r.RX1DataRates) || rx1DROffset < 0 || rx1DROffset >= len(r.RX1DataRates[uplinkDataRate]) {
+		return -1
+	}
+	return r.RX1DataRates[uplinkDataRate][rx1DROffset]
+}
+
+//BeaconSize return the size in bytes of the class B beacons of the region
+func (r *Region) BeaconSize() int {
+	// RFU, time (4), CRC (2), gateway specific (7), RFU, CRC (2)
+	return r.BeaconRFU[0] + 4 + 2 + 7 + r.BeaconRFU[1] + 2
+}
+
+//BeaconTime return the GPS time in seconds of a class B beacon, false if it has not the beacon size of the region
+func (r *Region) BeaconTime(beacon []byte) (uint32, bool) {
+	if len(beacon) != r.BeaconSize() {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(beacon[r.BeaconRFU[0]:]), true
+}
+
+//BeaconFrequency return the frequency in Hz of the beacon sent at this GPS time in seconds
+func (r *Region) BeaconFrequency(beaconTime uint32) int {
+	return r.BeaconFrequencies[int(beaconTime/128)%len(r.BeaconFrequencies)]
+}
+
+//PingSlotFrequency return the default frequency in Hz of the ping slots of the device after the beacon sent at this GPS time in seconds
+func (r *Region) PingSlotFrequency(beaconTime uint32, devAddr uint32) int {
+	return r.BeaconFrequencies[int((uint64(beaconTime/128)+uint64(devAddr))%uint64(len(r.BeaconFrequencies)))]
+}
+
+//CheckDataRate return an error if the data rate doesn't exist in the region or can't be used on any enabled channel
+func (r *Region) CheckDataRate(dataRate int, channels []model.Channel) error {
+	if !r.IsValidDataRate(dataRate) {
+		return fmt.Errorf("data rate %d doesn't exist in region %s", dataRate, r.Name)
+	}
+	for _, channel := range channels {
+		if channel.Enabled && channel.MinDR <= dataRate && dataRate <= channel.MaxDR {
+			return nil
+		}
+	}
+	return fmt.Errorf("no enabled channel of region %s allows data rate %d", r.Name, dataRate)
+}
+
+//Validate return an error if the region configuration can't be used by nodes
+func Validate(config model.Region) error {
+	region, err := Get(config.Name)
+	if err != nil {
+		return err
+	}
+	channels, err := region.NodeChannels(config.SubBands)
+	if err != nil {
+		return err
+	}
+	for _, dataRate := range config.DataRates {
+		if err := region.CheckDataRate(dataRate, channels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
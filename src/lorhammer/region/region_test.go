@@ -0,0 +1,201 @@
+package region
+
+import (
+	"lorhammer/src/model"
+	"testing"
+	"time"
+)
+
+func TestGetDefaultRegion(t *testing.T) {
+	region, err := Get("")
+	if err != nil || region.Name != "EU868" {
+		t.Fatal("EU868 must be the default region")
+	}
+}
+
+func TestGetUnknownRegion(t *testing.T) {
+	if _, err := Get("XX123"); err == nil {
+		t.Fatal("Error expected on unknown region")
+	}
+}
+
+func TestRegionsDefaultDataRate(t *testing.T) {
+	for name, region := range regions {
+		if err := region.CheckDataRate(region.DefaultDataRate, region.Channels); err != nil {
+			t.Fatalf("Default data rate of %s must be usable : %s", name, err)
+		}
+	}
+}
+
+func TestDataRateString(t *testing.T) {
+	region, _ := Get("US915")
+	if region.DataRates[3].String() != "SF7BW125" || region.DataRates[4].String() != "SF8BW500" {
+		t.Fatal("LoRa data rate must be written like SF7BW125")
+	}
+	region, _ = Get("EU868")
+	if region.DataRates[7].Modulation() != "FSK" || region.DataRates[7].String() != "50000" {
+		t.Fatal("FSK data rate must be written as its bit rate")
+	}
+}
+
+func TestDataRateIndex(t *testing.T) {
+	region, _ := Get("US915")
+	if region.DataRateIndex("SF8BW500", 0) != 4 || region.DataRateIndex("SF10BW125", 0) != 0 {
+		t.Fatal("Uplink data rate index expected")
+	}
+	region, _ = Get("EU868")
+	if region.DataRateIndex("", 50000) != 7 || region.DataRateIndex("SF7BW500", 0) != -1 {
+		t.Fatal("FSK data rate index expected and -1 for unknown data rate")
+	}
+}
+
+func TestTimeOnAir(t *testing.T) {
+	region, _ := Get("EU868")
+	if toa := region.DataRates[5].TimeOnAir(13, "4/5", true); toa.Round(100*time.Microsecond) != 46300*time.Microsecond {
+		t.Fatalf("SF7BW125 time on air of 13 bytes must be 46.3ms, got %s", toa)
+	}
+	if toa := region.DataRates[0].TimeOnAir(13, "4/5", true); toa.Round(100*time.Microsecond) != 1155100*time.Microsecond {
+		t.Fatalf("SF12BW125 time on air of 13 bytes must be 1155.1ms with low data rate optimize, got %s", toa)
+	}
+	if region.DataRates[5].TimeOnAir(13, "4/8", true) <= region.DataRates[5].TimeOnAir(13, "4/5", true) || region.DataRates[5].TimeOnAir(13, "4/5", false) >= region.DataRates[5].TimeOnAir(13, "4/5", true) {
+		t.Fatal("Time on air must grow with the coding rate and the CRC")
+	}
+	if toa := region.DataRates[7].TimeOnAir(13, "", true); toa != 3840*time.Microsecond {
+		t.Fatalf("FSK time on air of 13 bytes must be 3.84ms, got %s", toa)
+	}
+}
+
+func TestDutyCycleBand(t *testing.T) {
+	region, _ := Get("EU868")
+	if band := region.DutyCycleBand(868100000); band < 0 || region.DutyCycleBands[band].DutyCycle != 0.01 {
+		t.Fatal("EU868 default channels must be in a 1% band")
+	}
+	if band := region.DutyCycleBand(869525000); band < 0 || region.DutyCycleBands[band].DutyCycle != 0.1 {
+		t.Fatal("EU868 RX2 frequency must be in the 10% band")
+	}
+	region, _ = Get("US915")
+	if region.DutyCycleBand(902300000) != -1 {
+		t.Fatal("US915 has no duty-cycle")
+	}
+}
+
+func TestNodeChannelsUS915SubBand(t *testing.T) {
+	region, _ := Get("US915")
+	channels, err := region.NodeChannels([]int{2})
+	if err != nil {
+		t.Fatal("US915 sub-band 2 must exist")
+	}
+	var enabled []model.Channel
+	for _, channel := range channels {
+		if channel.Enabled {
+			enabled = append(enabled, channel)
+		}
+	}
+	if len(enabled) != 9 {
+		t.Fatalf("US915 sub-band must have 8 125kHz channels and one 500kHz channel, got %d channels", len(enabled))
+	}
+	if enabled[0].Frequency != 903900000 || enabled[7].Frequency != 905300000 {
+		t.Fatal("US915 sub-band 2 125kHz channels must be 903.9MHz to 905.3MHz")
+	}
+	if enabled[8].Frequency != 904600000 || enabled[8].MinDR != 4 {
+		t.Fatal("US915 sub-band 2 500kHz channel must be 904.6MHz DR4")
+	}
+	if !region.Channels[0].Enabled {
+		t.Fatal("Region channels must not be modified")
+	}
+}
+
+func TestNodeChannelsWrongSubBand(t *testing.T) {
+	region, _ := Get("US915")
+	if _, err := region.NodeChannels([]int{9}); err == nil {
+		t.Fatal("Error expected on sub-band 9 in US915")
+	}
+	region, _ = Get("EU868")
+	if _, err := region.NodeChannels([]int{1}); err == nil {
+		t.Fatal("Error expected on sub-band in a region without sub-bands")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(model.Region{}); err != nil {
+		t.Fatal("Empty region config must be valid")
+	}
+	if err := Validate(model.Region{Name: "US915", SubBands: []int{1}, DataRates: []int{0, 4}}); err != nil {
+		t.Fatal("US915 DR0 and DR4 must be usable in sub-band 1")
+	}
+	if err := Validate(model.Region{Name: "US915", DataRates: []int{8}}); err == nil {
+		t.Fatal("Error expected on US915 downlink only data rate")
+	}
+	if err := Validate(model.Region{Name: "IN865", DataRates: []int{6}}); err == nil {
+		t.Fatal("Error expected on reserved data rate")
+	}
+}
+
+func TestApplyChannelMaskUS915(t *testing.T) {
+	region, _ := Get("US915")
+
+	// all 125kHz channels on, only the first 500kHz channel
+	channels, ok := region.ApplyChannelMask(region.Channels, 6, 0x0001)
+	if !ok {
+		t.Fatal("ChMaskCntl 6 must be valid in US915")
+	}
+	for i, channel := range channels {
+		if channel.Enabled != (i <= 64) {
+			t.Fatalf("Channel %d enabled must be %t", i, i <= 64)
+		}
+	}
+
+	if _, ok := region.ApplyChannelMask(region.Channels, 4, 0x0100); ok {
+		t.Fatal("Mask enabling an undefined channel must not be valid")
+	}
+	if _, ok := region.ApplyChannelMask(region.Channels, 5, 0x0001); ok {
+		t.Fatal("ChMaskCntl 5 is RFU in US915")
+	}
+}
+
+func TestRX1Frequency(t *testing.T) {
+	region, _ := Get("EU868")
+	if region.RX1Frequency(1, 868300000) != 868300000 {
+		t.Fatal("RX1 must use the uplink frequency in EU868")
+	}
+	region, _ = Get("US915")
+	if region.RX1Frequency(9, 904100000) != 923900000 || region.RX1Frequency(65, 904600000) != 923900000 {
+		t.Fatal("RX1 must use the downlink channel of the uplink channel modulo 8 in US915")
+	}
+	region, _ = Get("CN470")
+	if region.RX1Frequency(50, 480300000) != 500700000 {
+		t.Fatal("RX1 must use the downlink channel of the uplink channel modulo 48 in CN470")
+	}
+}
+
+func TestRX1DataRate(t *testing.T) {
+	region, _ := Get("EU868")
+	if region.RX1DataRate(5, 2) != 3 || region.RX1DataRate(1, 3) != 0 {
+		t.Fatal("RX1 data rate must be the uplink data rate minus the offset in EU868")
+	}
+	region, _ = Get("US915")
+	if region.RX1DataRate(0, 0) != 10 || region.RX1DataRate(4, 1) != 13 || region.RX1DataRate(3, 3) != 10 {
+		t.Fatal("RX1 data rate must be a 500kHz data rate in US915")
+	}
+	if region.RX1DataRate(3, 4) != -1 || region.RX1DataRate(8, 0) != -1 {
+		t.Fatal("RX1 data rate must be -1 for an unknown offset or uplink data rate")
+	}
+}
+
+func TestBeacon(t *testing.T) {
+	region, _ := Get("EU868")
+	beacon := []byte{0, 0, 0x80, 0x96, 0x98, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if beaconTime, ok := region.BeaconTime(beacon); !ok || beaconTime != 10000000 {
+		t.Fatal("Beacon time must be read after the RFU bytes")
+	}
+	if _, ok := region.BeaconTime(beacon[1:]); ok {
+		t.Fatal("Beacon time must not be read in a payload without the beacon size")
+	}
+	if region.BeaconFrequency(10000000) != 869525000 || region.PingSlotFrequency(10000000, 42) != 869525000 {
+		t.Fatal("Beacons and ping slots must use the single beacon frequency in EU868")
+	}
+	region, _ = Get("US915")
+	if region.BeaconSize() != 23 || region.BeaconFrequency(128*3) != 925100000 || region.PingSlotFrequency(128*3, 2) != 926300000 {
+		t.Fatal("Beacons and ping slots must hop over the beacon frequencies in US915")
+	}
+}
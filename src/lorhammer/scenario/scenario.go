@@ -1,6 +1,7 @@
 package scenario
 
 import (
+	"errors"
 	"lorhammer/src/lorhammer/lora"
 	"lorhammer/src/model"
 	"lorhammer/src/tools"
@@ -11,6 +12,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"lorhammer/src/lorhammer/metrics"
+	"lorhammer/src/lorhammer/region"
 )
 
 var logger = logrus.WithField("logger", "lorhammer/scenario/scenario")
@@ -25,21 +27,80 @@ type Scenario struct {
 	NbScenarioReplayLaps int
 	RxpkDate             uint64
 	WithJoin             bool
-	MessageFcnt          uint32
+	NodeSchedule         bool
+	LoadProfile          *model.LoadProfile
+	Replay               *model.Replay
 	AppsKey              string
 	Nwskey               string
 	Payloads             []model.Payload
+	stopGatewaysStatus   context.CancelFunc
 }
 
 //NewScenario provide new Scenario with param defined in model.Init
 func NewScenario(init model.Init) (*Scenario, error) {
+	if init.FCnt.Rollover != 0 && init.FCnt.Rollover != 16 && init.FCnt.Rollover != 32 {
+		return nil, errors.New("fcnt rollover must be 16 or 32")
+	}
+	if init.ConfirmedRatio != nil && (*init.ConfirmedRatio < 0 || *init.ConfirmedRatio > 1) {
+		return nil, errors.New("confirmedRatio must be between 0 and 1")
+	}
+	if err := region.Validate(init.Region); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckRadio(init.Radio); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckGatewayStatus(init.GatewayStatus); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckProtocol(init.GatewayProtocol, init.NsAddress); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckBatch(init.Batch); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckCoverage(init.Coverage, init.NbGateway); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckClassC(init.ClassC); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckClassB(init.ClassB, init.ClassC); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckLoRaWAN11(init.LoRaWAN11); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckFleet(init.Fleet); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckNodeSchedule(init.NodeSchedule); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckLoadProfile(init.LoadProfile, init.NodeSchedule); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckPayloads(init.Payloads); err != nil {
+		return nil, err
+	}
+	if err := lora.CheckReplay(init.Replay, init.NodeSchedule, init.LoadProfile); err != nil {
+		return nil, err
+	}
 	gateways := make([]*lora.LorhammerGateway, init.NbGateway)
 	for i := 0; i < len(gateways); i++ {
 		if _, err := time.ParseDuration(init.ReceiveTimeoutTime); err != nil {
 			return nil, err
 		}
-		gateways[i] = lora.NewGateway(int(tools.Random64(int64(init.NbNode[0]), int64(init.NbNode[1]))), init)
+		nbNode := int(tools.Random64(int64(init.NbNode[0]), int64(init.NbNode[1])))
+		gatewayInit := init
+		if init.Fleet != nil {
+			// each gateway get its share of the fleet devices instead of random nodes
+			gatewayInit.Fleet = lora.GatewayFleet(init.Fleet, init.NbGateway, i)
+			nbNode = len(gatewayInit.Fleet.Devices)
+		}
+		gateways[i] = lora.NewGateway(nbNode, gatewayInit)
 	}
+	lora.SetCoverage(gateways, init.Coverage)
 	scenarioSleepTimeMin, err := time.ParseDuration(init.ScenarioSleepTime[0])
 	if err != nil {
 		return nil, err
@@ -64,18 +125,26 @@ func NewScenario(init model.Init) (*Scenario, error) {
 		GatewaySleepTime:     [2]time.Duration{gatewaySleepTimeMin, gatewaySleepTimeMax},
 		NbScenarioReplayLaps: init.NbScenarioReplayLaps,
 		WithJoin:             init.WithJoin,
-		MessageFcnt:          0,
+		NodeSchedule:         init.NodeSchedule != nil,
+		LoadProfile:          init.LoadProfile,
+		Replay:               lora.ReplayWindow(init.Replay, init.Fleet),
 		Nwskey:               init.Nwskey,
 		AppsKey:              init.AppsKey,
 		Payloads:             init.Payloads,
 	}, nil
 }
 
-//Cron start scenario in go routine and start gateway every `scenario.ScenarioSleepTime`
+//Cron start scenario in go routine and start gateway every `scenario.ScenarioSleepTime`, or the node schedules, load profile or replay of the gateways
 func (p *Scenario) Cron(prometheus metrics.Prometheus) context.Context {
 	prometheus.AddGateway(p.nbGateways())
 	prometheus.AddNodes(p.nbNodes())
+	p.nodesDataRate(prometheus.AddNodesDataRate)
 	ctx, cancel := context.WithCancel(context.Background())
+	p.startGatewaysStatus(ctx, prometheus)
+	if p.isScheduled() {
+		go p.schedule(ctx, prometheus, cancel)
+		return ctx
+	}
 	go func() {
 		p.start(prometheus, cancel)
 		quit := false
@@ -83,7 +152,6 @@ func (p *Scenario) Cron(prometheus metrics.Prometheus) context.Context {
 			select {
 			case <-time.After(tools.RandomDuration(p.ScenarioSleepTime[0], p.ScenarioSleepTime[1])):
 				p.start(prometheus, cancel)
-				p.MessageFcnt++
 			case <-p.poison:
 				quit = true
 			}
@@ -99,8 +167,15 @@ func (p *Scenario) Cron(prometheus metrics.Prometheus) context.Context {
 func (p *Scenario) Stop(prometheus metrics.Prometheus) {
 	p.poison <- true
 	defer close(p.poison)
+	if p.stopGatewaysStatus != nil {
+		p.stopGatewaysStatus()
+	}
+	for _, gateway := range p.Gateways {
+		gateway.Close()
+	}
 	prometheus.SubGateway(p.nbGateways())
 	prometheus.SubNodes(p.nbNodes())
+	p.nodesDataRate(prometheus.SubNodesDataRate)
 }
 
 //Join launch all gateways join method
@@ -108,7 +183,20 @@ func (p *Scenario) Join(prometheus metrics.Prometheus) {
 	logger.WithField("nbGateways", len(p.Gateways)).Info("All gateways are joining the application server")
 
 	for _, gateway := range p.Gateways {
-		gateway.Join(prometheus, p.WithJoin)
+		// with a node schedule, a load profile or a replay, nodes send their JoinRequest at their first uplink time
+		gateway.Join(prometheus, p.WithJoin && !p.isScheduled())
+	}
+}
+
+//startGatewaysStatus launch the keepalive and stat loop of each gateway until the scenario is stopped
+func (p *Scenario) startGatewaysStatus(ctx context.Context, prometheus metrics.Prometheus) {
+	ctx, p.stopGatewaysStatus = context.WithCancel(ctx)
+	for _, gateway := range p.Gateways {
+		go func(gateway *lora.LorhammerGateway) {
+			if err := gateway.StatusLoop(ctx, prometheus); err != nil {
+				logger.WithError(err).Error("Can't start gateway keepalive and stat loop")
+			}
+		}(gateway)
 	}
 }
 
@@ -124,8 +212,46 @@ func (p *Scenario) start(prometheus metrics.Prometheus, cancelFunction context.C
 
 	for _, gateway := range p.Gateways {
 		time.Sleep(tools.RandomDuration(p.GatewaySleepTime[0], p.GatewaySleepTime[1]))
-		go gateway.Start(prometheus, p.MessageFcnt)
-		p.MessageFcnt++
+		go gateway.Start(prometheus)
+	}
+}
+
+//isScheduled return true if nodes send at their own pace, at the pace of the load profile or at their recorded times instead of gateway rounds
+func (p *Scenario) isScheduled() bool {
+	return p.NodeSchedule || p.LoadProfile != nil || p.Replay != nil
+}
+
+//schedule launch the load profile, the replay or the node schedule of each gateway and check every second if all gateways have ended, until the scenario is stopped
+func (p *Scenario) schedule(ctx context.Context, prometheus metrics.Prometheus, cancelFunction context.CancelFunc) {
+	switch {
+	case p.LoadProfile != nil:
+		logger.WithField("nbGateways", len(p.Gateways)).Info("Load profile started")
+		go lora.LoadLoop(ctx, p.Gateways, p.LoadProfile, prometheus)
+	case p.Replay != nil:
+		logger.WithField("nbGateways", len(p.Gateways)).Info("Replay started")
+		// all gateways replay the recording from the same start
+		start := time.Now()
+		for _, gateway := range p.Gateways {
+			go gateway.ReplayLoop(ctx, p.Replay, start, prometheus)
+		}
+	default:
+		logger.WithField("nbGateways", len(p.Gateways)).Info("Node schedules started")
+		for _, gateway := range p.Gateways {
+			go gateway.ScheduleLoop(ctx, prometheus)
+		}
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if doAllGatewaysHaveEnded(p) {
+				// the node schedules, the load profile and the replay stop with the context, the scenario is stopped properly by calling the stop method
+				cancelFunction()
+			}
+		case <-p.poison:
+			return
+		}
 	}
 }
 
@@ -136,7 +262,7 @@ func doAllGatewaysHaveEnded(p *Scenario) bool {
 	}
 	for _, gateway := range p.Gateways {
 		// if only one node has not reached the expected number of rounds, break the loop and return false
-		if !gateway.AllLapsCompleted {
+		if !gateway.HasEnded() {
 			return false
 		}
 	}
@@ -147,6 +273,19 @@ func (p *Scenario) nbGateways() int {
 	return len(p.Gateways)
 }
 
+//nodesDataRate call f with the number of nodes of each data rate
+func (p *Scenario) nodesDataRate(f func(dataRate int, nb int)) {
+	nbNodesDataRate := make(map[int]int)
+	for _, gateway := range p.Gateways {
+		for _, node := range gateway.Nodes {
+			nbNodesDataRate[node.DataRate]++
+		}
+	}
+	for dataRate, nb := range nbNodesDataRate {
+		f(dataRate, nb)
+	}
+}
+
 func (p *Scenario) nbNodes() int {
 	nbNode := 0
 	for _, gateway := range p.Gateways {
@@ -30,6 +30,32 @@ var models = []model.Init{
 		ScenarioSleepTime:  [2]string{"0", "0"},
 		GatewaySleepTime:   [2]string{"0", "0"},
 		ReceiveTimeoutTime: "1s",
+	}, {
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		GatewayStatus:      &model.GatewayStatus{KeepaliveInterval: "10ms", StatInterval: "10ms"},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{2, 2},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		NodeSchedule:       &model.NodeSchedule{Interval: [2]string{"10ms", "20ms"}, Jitter: "5ms"},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{2, 2},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		LoadProfile:        &model.LoadProfile{Stages: []model.LoadStage{{Duration: "1s", To: 100}}, Arrival: "poisson"},
 	},
 }
 
@@ -52,19 +78,180 @@ var wrongReceiveTimeModels = []model.Init{
 	},
 }
 
+var wrongConfirmedRatio = 1.5
+
+var wrongInitModels = []model.Init{
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		FCnt:               model.FCnt{Rollover: 8},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		ConfirmedRatio:     &wrongConfirmedRatio,
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Region:             model.Region{Name: "US915", SubBands: []int{9}},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Radio:              &model.Radio{Scope: "everywhere"},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		GatewayStatus:      &model.GatewayStatus{StatInterval: "-1s"},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		GatewayProtocol:    "basicstation",
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Batch:              &model.Batch{Window: "100ms", MaxSize: 1000},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          2,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Coverage:           &model.Coverage{NbGateways: [2]int{1, 3}},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		ClassC:             &model.ClassC{Ratio: 1.5},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		ClassC:             &model.ClassC{Ratio: 0.5},
+		ClassB:             &model.ClassB{Ratio: 0.6},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		LoRaWAN11:          &model.LoRaWAN11{Ratio: 1, RejoinType: 3},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Fleet:              &model.Fleet{Devices: []model.Device{{DevEUI: "0102"}}},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		NodeSchedule:       &model.NodeSchedule{Interval: [2]string{"1s", "2s"}, Jitter: "1s"},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		LoadProfile:        &model.LoadProfile{Stages: []model.LoadStage{{Duration: "1m", To: -1}}},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Payloads:           []model.Payload{{Template: []model.PayloadField{{Kind: "lpp", Type: "unknown"}}}},
+	},
+	{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          1,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Replay:             &model.Replay{Speed: -1},
+	},
+}
+
 type fakePrometheus struct {
 	nbGateway chan int
 	nbNodes   chan int
 }
 
-func (prom *fakePrometheus) StartPushAckTimer() func()     { return nil }
-func (prom *fakePrometheus) StartPullRespTimer() func()    { return nil }
-func (prom *fakePrometheus) AddGateway(nb int)             { go func() { prom.nbGateway <- nb }() }
-func (prom *fakePrometheus) SubGateway(nb int)             { go func() { prom.nbGateway <- nb }() }
-func (prom *fakePrometheus) AddNodes(nb int)               { go func() { prom.nbNodes <- nb }() }
-func (prom *fakePrometheus) SubNodes(nb int)               { go func() { prom.nbNodes <- nb }() }
-func (prom *fakePrometheus) AddPushAckLongRequest(nb int)  {}
-func (prom *fakePrometheus) AddPullRespLongRequest(nb int) {}
+func (prom *fakePrometheus) StartPushAckTimer() func()                            { return nil }
+func (prom *fakePrometheus) StartPullRespTimer() func()                           { return nil }
+func (prom *fakePrometheus) AddGateway(nb int)                                    { go func() { prom.nbGateway <- nb }() }
+func (prom *fakePrometheus) SubGateway(nb int)                                    { go func() { prom.nbGateway <- nb }() }
+func (prom *fakePrometheus) AddNodes(nb int)                                      { go func() { prom.nbNodes <- nb }() }
+func (prom *fakePrometheus) SubNodes(nb int)                                      { go func() { prom.nbNodes <- nb }() }
+func (prom *fakePrometheus) AddPushAckLongRequest(nb int)                         {}
+func (prom *fakePrometheus) AddPullRespLongRequest(nb int)                        {}
+func (prom *fakePrometheus) AddConfirmedUplink(nb int)                            {}
+func (prom *fakePrometheus) AddUplinkAck(nb int)                                  {}
+func (prom *fakePrometheus) AddRetransmission(nb int)                             {}
+func (prom *fakePrometheus) AddNodesDataRate(dataRate int, nb int)                {}
+func (prom *fakePrometheus) SubNodesDataRate(dataRate int, nb int)                {}
+func (prom *fakePrometheus) AddDownlinkRxWindow(window string, nb int)            {}
+func (prom *fakePrometheus) AddDownlinkTiming(result string, nb int)              {}
+func (prom *fakePrometheus) ObserveDownlinkEnqueueDelay(delay time.Duration)      {}
+func (prom *fakePrometheus) AddClassBDownlink(kind string, result string, nb int) {}
+func (prom *fakePrometheus) AddDutyCycle(scope string, result string, nb int)     {}
+func (prom *fakePrometheus) AddLoadSkippedArrival(nb int)                         {}
 
 type fakeWriter struct{}
 
@@ -169,3 +356,79 @@ func TestWrongReceiveTimeCreation(t *testing.T) {
 		}
 	}
 }
+
+func TestWrongInitCreation(t *testing.T) {
+	logrus.SetOutput(fakeWriter{}) // shut up logrus 🙊
+
+	for _, init := range wrongInitModels {
+
+		sc, err := NewScenario(init)
+
+		if err == nil {
+			t.Fatal("Error expected on wrong fcnt rollover, confirmed ratio, region, radio, gateway status, gateway protocol, batch, coverage, class C, class B, LoRaWAN 1.1, fleet, node schedule, load profile, payload template or replay")
+		}
+
+		if sc != nil {
+			t.Fatal("Nil scenario expected on wrong fcnt rollover, confirmed ratio, region, radio, gateway status, gateway protocol, batch, coverage, class C, class B, LoRaWAN 1.1, fleet, node schedule, load profile, payload template or replay")
+		}
+	}
+}
+
+func TestNewScenarioCoverage(t *testing.T) {
+	sc, err := NewScenario(model.Init{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          3,
+		NbNode:             [2]int{1, 1},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Coverage:           &model.Coverage{NbGateways: [2]int{2, 3}, Jitter: [2]string{"0", "10ms"}},
+	})
+	if err != nil || sc.nbGateways() != 3 || sc.nbNodes() != 3 {
+		t.Fatal("Valid coverage must not change the gateways and nodes of the scenario")
+	}
+}
+
+func TestNewScenarioFleet(t *testing.T) {
+	devices := []model.Device{{DevEUI: "0000000000000001"}, {DevEUI: "0000000000000002"}, {DevEUI: "0000000000000003"}}
+	sc, err := NewScenario(model.Init{
+		NsAddress:          "127.0.0.1:0",
+		NbGateway:          2,
+		NbNode:             [2]int{10, 10},
+		ScenarioSleepTime:  [2]string{"0", "0"},
+		GatewaySleepTime:   [2]string{"0", "0"},
+		ReceiveTimeoutTime: "1s",
+		Fleet:              &model.Fleet{Devices: devices},
+	})
+	if err != nil || sc.nbNodes() != 3 || len(sc.Gateways[0].Nodes) != 1 {
+		t.Fatal("Fleet devices must be split between the gateways instead of random nodes")
+	}
+	if sc.Gateways[1].Nodes[1].DevEUI.String() != "0000000000000003" {
+		t.Fatal("Nodes must have the DevEUI of their device")
+	}
+}
+
+func TestNewScenarioReplay(t *testing.T) {
+	devices := []model.Device{
+		{DevEUI: "0000000000000001", Payloads: []model.Payload{{Value: "01", Date: 1000}, {Value: "02", Date: 1060}}},
+		{DevEUI: "0000000000000002"},
+	}
+	sc, err := NewScenario(model.Init{
+		NsAddress:            "127.0.0.1:0",
+		NbGateway:            1,
+		NbNode:               [2]int{10, 10},
+		ScenarioSleepTime:    [2]string{"0", "0"},
+		GatewaySleepTime:     [2]string{"0", "0"},
+		ReceiveTimeoutTime:   "1s",
+		NbScenarioReplayLaps: 1,
+		Payloads:             []model.Payload{{Value: "03"}},
+		Fleet:                &model.Fleet{Devices: devices},
+		Replay:               &model.Replay{Speed: 60},
+	})
+	if err != nil || !sc.isScheduled() || sc.Replay.From != 1000000 || sc.Replay.To != 1060000 {
+		t.Fatal("Replay window must be the times of the first and last recorded payloads")
+	}
+	if len(sc.Gateways[0].Nodes[0].Payloads) != 2 || sc.Gateways[0].Nodes[1].Payloads != nil {
+		t.Fatal("Nodes must replay the series of their device only")
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"sync"
 	"time"
 
 	"github.com/brocaar/lorawan"
@@ -19,16 +20,101 @@ type Gateway struct {
 
 //Node represent a lorawan sensor
 type Node struct {
-	DevAddr           lorawan.DevAddr
-	DevEUI            lorawan.EUI64
-	AppEUI            lorawan.EUI64
-	AppKey            lorawan.AES128Key
-	AppSKey           lorawan.AES128Key
-	NwSKey            lorawan.AES128Key
-	JoinedNetwork     bool
-	Payloads          []Payload
-	NextPayload       int
-	PayloadsReplayLap int
-	RandomPayloads    bool
-	Description       string
+	sync.Mutex         `json:"-"` // held while an uplink of the node is created or a downlink is given to it
+	DevAddr            lorawan.DevAddr
+	DevEUI             lorawan.EUI64
+	JoinEUI            lorawan.EUI64 // AppEUI in LoRaWAN 1.0
+	AppKey             lorawan.AES128Key
+	NwkKey             lorawan.AES128Key // root key of the network session keys in LoRaWAN 1.1, the AppKey in LoRaWAN 1.0
+	AppSKey            lorawan.AES128Key
+	NwSKey             lorawan.AES128Key // NwkSKey in LoRaWAN 1.0, FNwkSIntKey in LoRaWAN 1.1
+	SNwkSIntKey        lorawan.AES128Key // the NwSKey in LoRaWAN 1.0
+	NwkSEncKey         lorawan.AES128Key // the NwSKey in LoRaWAN 1.0
+	LoRaWAN11          bool
+	NetID              lorawan.NetID
+	DevNonce           [2]byte
+	FCntUp             uint32
+	FCnt               FCnt
+	NbUplinks          int
+	UplinkInterval     time.Duration // with a node schedule, delay between two uplinks of the node
+	UplinkJitter       time.Duration
+	ConfirmedRatio     float64
+	Retransmit         bool // confirmed uplinks without ACK are sent again, only when the scenario sets the confirmed ratio
+	PendingUplink      []byte
+	PendingUplinkDate  int64
+	PendingUplinkTx    int
+	RepeatedUplink     []byte // unconfirmed uplink sent NbTrans times, until a downlink is received
+	RepeatedUplinkDate int64
+	RepeatedUplinkTx   int
+	AckDownlink        bool
+	ConfFCntDown       uint32 // frame counter of the last confirmed downlink, in the LoRaWAN 1.1 MIC of the uplink acknowledging it
+	DataRate           int
+	Channels           []Channel `json:"-"`
+	RadioConditions    RadioConditions
+	LastSnr            float64
+	TxPower            int
+	NbTrans            int
+	MaxDutyCycle       int               // aggregated duty-cycle of 1/2^MaxDutyCycle set by DutyCycleReq
+	DutyCycleOff       map[int]time.Time `json:"-"` // end of the time off of each duty-cycle band of the region
+	AggregatedOff      time.Time         // end of the time off of the aggregated duty-cycle
+	RX1DROffset        int
+	RX2DataRate        int
+	RX2Frequency       int
+	RXDelay            int
+	ClassC             bool
+	NbClassCDownlinks  int
+	ClassB             bool
+	PingSlot           PingSlot
+	MacAnswers         [][]byte `json:"-"`
+	StickyMacAnswers   [][]byte `json:"-"`
+	Adr                bool
+	AdrAckCnt          int
+	JoinedNetwork      bool
+	SessionConfirmed   bool // LoRaWAN 1.1 RekeyConf or ResetConf received
+	Rejoin             Rejoin
+	Payloads           []Payload
+	NextPayload        int
+	PayloadCounter     uint64 // templated payloads generated by the node
+	PayloadsReplayLap  int
+	RandomPayloads     bool
+	Description        string
+	Provisioned        bool // exists on the network server before the scenario, not provisioned again
+}
+
+//PingSlot represent the class B state of a node
+type PingSlot struct {
+	Periodicity      int
+	Frequency        int // in Hz, 0 for the default frequencies of the region
+	DataRate         int
+	DeviceTimeSynced bool // DeviceTimeAns received
+	InfoAcked        bool // PingSlotInfoAns received
+	NbDownlinks      int
+}
+
+//Rejoin represent the LoRaWAN 1.1 rejoin requests state of a node
+type Rejoin struct {
+	Type         int
+	Every        int // uplinks between two rejoin requests, 0 to send them only when the network server forces it
+	NbUplinks    int // uplinks since the last rejoin request
+	Forced       bool
+	Count0       uint16 // RJcount0 of rejoin requests of type 0 and 2
+	Count1       uint16 // RJcount1 of rejoin requests of type 1
+	Pending      bool   // a rejoin request waits for its JoinAccept
+	PendingType  int
+	PendingCount uint16
+}
+
+//Channel represent an uplink channel of a node, frequency in Hz and allowed data rates
+type Channel struct {
+	Frequency int
+	MinDR     int
+	MaxDR     int
+	Enabled   bool
+}
+
+//RadioConditions represent the fixed RSSI (dBm) and SNR (dB), or the distance (meters) to gateways, of a node or a gateway uplinks
+type RadioConditions struct {
+	Rssi     float64
+	Snr      float64
+	Distance float64
 }
@@ -12,27 +12,212 @@ type CMD struct {
 
 //Init is the struc send by orchestrator to lorhammer
 type Init struct {
-	NsAddress            string    `json:"nsAddress"`
-	NbGateway            int       `json:"nbGatewayPerLorhammer"`
-	NbNode               [2]int    `json:"nbNodePerGateway"`
-	NbScenarioReplayLaps int       `json:"nbScenarioReplayLaps"`
-	ScenarioSleepTime    [2]string `json:"scenarioSleepTime"`
-	GatewaySleepTime     [2]string `json:"gatewaySleepTime"`
-	AppsKey              string    `json:"appskey"`
-	Nwskey               string    `json:"nwskey"`
-	WithJoin             bool      `json:"withJoin"`
-	Payloads             []Payload `json:"payloads"`
-	RxpkDate             int64     `json:"rxpkDate"`
-	ReceiveTimeoutTime   string    `json:"receiveTimeoutTime"`
-	Description          string    `json:"description"`
-	RandomPayloads       bool      `json:"randomPayloads"`
-}
-
-// Payload struct define a payload with timestamp date attached
-// { "value": "a string", "date": <timestamp>}
+	NsAddress            string         `json:"nsAddress"`
+	NbGateway            int            `json:"nbGatewayPerLorhammer"`
+	NbNode               [2]int         `json:"nbNodePerGateway"`
+	NbScenarioReplayLaps int            `json:"nbScenarioReplayLaps"`
+	ScenarioSleepTime    [2]string      `json:"scenarioSleepTime"`
+	GatewaySleepTime     [2]string      `json:"gatewaySleepTime"`
+	AppsKey              string         `json:"appskey"`
+	Nwskey               string         `json:"nwskey"`
+	WithJoin             bool           `json:"withJoin"`
+	Payloads             []Payload      `json:"payloads"`
+	RxpkDate             int64          `json:"rxpkDate"`
+	ReceiveTimeoutTime   string         `json:"receiveTimeoutTime"`
+	Description          string         `json:"description"`
+	RandomPayloads       bool           `json:"randomPayloads"`
+	FCnt                 FCnt           `json:"fcnt"`
+	ConfirmedRatio       *float64       `json:"confirmedRatio,omitempty"`
+	Region               Region         `json:"region"`
+	Radio                *Radio         `json:"radio,omitempty"`
+	Adr                  bool           `json:"adr"`
+	GatewayStatus        *GatewayStatus `json:"gatewayStatus,omitempty"`
+	GatewayProtocol      string         `json:"gatewayProtocol"`
+	Batch                *Batch         `json:"batch,omitempty"`
+	Coverage             *Coverage      `json:"coverage,omitempty"`
+	GpsTime              bool           `json:"gpsTime"`
+	FineTimestamp        bool           `json:"fineTimestamp"`
+	ClassC               *ClassC        `json:"classC,omitempty"`
+	ClassB               *ClassB        `json:"classB,omitempty"`
+	LoRaWAN11            *LoRaWAN11     `json:"lorawan11,omitempty"`
+	Fleet                *Fleet         `json:"fleet,omitempty"`
+	NodeSchedule         *NodeSchedule  `json:"nodeSchedule,omitempty"`
+	LoadProfile          *LoadProfile   `json:"loadProfile,omitempty"`
+	DutyCycle            *DutyCycle     `json:"dutyCycle,omitempty"`
+	Replay               *Replay        `json:"replay,omitempty"`
+}
+
+// Replay struct define the replay of a recording of real traffic, each fleet device sends its own payloads at their recorded times
+// { "file": "traffic.csv", "speed": 60 }
+type Replay struct {
+	File  string  `json:"file"`            // CSV or JSONL recording of devEui, timestamp, payload and fport, read by the orchestrator
+	Speed float64 `json:"speed,omitempty"` // time compression, 60 replays an hour in a minute, real time if not set
+	From  int64   `json:"from,omitempty"`  // unix time in milliseconds of the first and last records, set by the orchestrator so all lorhammers replay together
+	To    int64   `json:"to,omitempty"`
+}
+
+// DutyCycle struct define if the time on air of nodes and gateways over the duty-cycle of the region is reported or not emitted
+// { "enforce": true }
+type DutyCycle struct {
+	Enforce bool `json:"enforce"` // frames over the duty-cycle are not emitted instead of being emitted and reported
+}
+
+// LoadProfile struct define the target uplinks per second of the lorhammer over time, its nodes send in turn to follow it
+// { "stages": [{"duration": "30m", "from": 100, "to": 10000}, {"duration": "10m", "to": 10000}], "arrival": "poisson" }
+type LoadProfile struct {
+	Stages  []LoadStage `json:"stages"`  // played in order, the rate at the end of the last stage is kept after it
+	Arrival string      `json:"arrival"` // constant (default) for evenly spaced uplinks, poisson for exponential inter-arrival times
+}
+
+// LoadStage struct define a linear change of the rate during the stage
+// { "duration": "30m", "from": 100, "to": 10000 }
+type LoadStage struct {
+	Duration string   `json:"duration"`
+	From     *float64 `json:"from,omitempty"` // uplinks per second at the start, the rate at the end of the previous stage (0 for the first) if not set
+	To       float64  `json:"to"`             // uplinks per second at the end
+}
+
+// NodeSchedule struct define the uplink interval of each node, nodes send at their own pace instead of in gateway rounds
+// { "interval": ["30s", "60s"], "jitter": "5s" }
+type NodeSchedule struct {
+	Interval [2]string `json:"interval"` // each node draws its uplink interval in this range
+	Jitter   string    `json:"jitter"`   // each uplink is sent up to jitter before or after the node interval
+}
+
+// Fleet struct define existing devices used by the nodes instead of random identities and keys
+// { "file": "devices.csv", "skipProvisioning": true }
+type Fleet struct {
+	File             string   `json:"file"`             // CSV or JSON device list read by the orchestrator, split between lorhammers
+	Devices          []Device `json:"devices"`          // devices of the lorhammer, split between its gateways
+	SkipProvisioning bool     `json:"skipProvisioning"` // devices already exist on the network server
+}
+
+// Device struct define an existing device, keys in hex, optional session state if the device has joined
+// { "devEui": "<hex>", "lorawan11": true, "joinEui": "<hex>", "appKey": "<hex>", "devAddr": "<hex>", "appSKey": "<hex>", "nwkSKey": "<hex>", "fCntUp": 42, "devNonce": 12 }
+type Device struct {
+	DevEUI      string    `json:"devEui"`
+	JoinEUI     string    `json:"joinEui"`
+	AppKey      string    `json:"appKey"`
+	LoRaWAN11   *bool     `json:"lorawan11,omitempty"` // LoRaWAN 1.1 if true, 1.0 if false, by the ratio of the lorawan11 config if not set
+	NwkKey      string    `json:"nwkKey"`              // LoRaWAN 1.1 root key, the appKey if not set
+	DevAddr     string    `json:"devAddr"`             // with join, the node continues this session instead of joining if set
+	AppSKey     string    `json:"appSKey"`             // the appskey of the scenario if not set
+	NwkSKey     string    `json:"nwkSKey"`             // the nwskey of the scenario if not set, FNwkSIntKey in LoRaWAN 1.1
+	SNwkSIntKey string    `json:"sNwkSIntKey"`         // LoRaWAN 1.1, the nwkSKey if not set
+	NwkSEncKey  string    `json:"nwkSEncKey"`          // LoRaWAN 1.1, the nwkSKey if not set
+	FCntUp      *uint32   `json:"fCntUp,omitempty"`    // next uplink frame counter of the session, the fcnt start if not set
+	DevNonce    *uint16   `json:"devNonce,omitempty"`  // LoRaWAN 1.1, last DevNonce used by the device, the next JoinRequest uses the next one
+	Payloads    []Payload `json:"payloads,omitempty"`  // payloads of the node instead of the ones of the scenario, the recorded series with a replay
+}
+
+// LoRaWAN11 struct define the nodes using LoRaWAN 1.1, the others use LoRaWAN 1.0
+// { "ratio": 0.5, "sNwkSIntKey": "<hex>", "nwkSEncKey": "<hex>", "rejoinType": 0, "rejoinEvery": 100 }
+type LoRaWAN11 struct {
+	Ratio       float64 `json:"ratio"`       // share of the nodes of each gateway using LoRaWAN 1.1
+	SNwkSIntKey string  `json:"sNwkSIntKey"` // serving network session integrity key of ABP nodes, the nwskey is their forwarding one
+	NwkSEncKey  string  `json:"nwkSEncKey"`  // network session encryption key of ABP nodes
+	RejoinType  int     `json:"rejoinType"`  // 0, 1 or 2
+	RejoinEvery int     `json:"rejoinEvery"` // uplinks between two rejoin requests, no periodic rejoin request if 0
+}
+
+// ClassB struct define the nodes listening to downlinks in ping slots synchronized by the gateway beacons
+// { "ratio": 0.5, "pingSlotPeriodicity": 3 }
+type ClassB struct {
+	Ratio               float64 `json:"ratio"`               // share of the nodes of each gateway in class B, the ratio of class C nodes included must not exceed 1
+	PingSlotPeriodicity int     `json:"pingSlotPeriodicity"` // from 0 (a ping slot every second) to 7 (every 128 seconds)
+}
+
+// ClassC struct define the nodes listening to downlinks at any time on the RX2 parameters
+// { "ratio": 0.5, "enqueueTimePort": 10 }
+type ClassC struct {
+	Ratio           float64 `json:"ratio"`           // share of the nodes of each gateway in class C, the others are in class A
+	EnqueueTimePort int     `json:"enqueueTimePort"` // application port of the downlinks starting with their enqueue time, 0 if none
+}
+
+// Coverage struct define how many gateways hear the uplinks of each node, to test the deduplication of the network server
+// { "nbGateways": [1, 3], "jitter": ["0", "20ms"], "rssiOffset": [-20, 0], "snrOffset": [-10, 0] }
+type Coverage struct {
+	NbGateways [2]int     `json:"nbGateways"` // number of gateways hearing each node, its own gateway included
+	Jitter     [2]string  `json:"jitter"`     // delay of the uplink copies sent by the other gateways
+	RssiOffset [2]float64 `json:"rssiOffset"` // added to the RSSI of the node gateway for each other gateway
+	SnrOffset  [2]float64 `json:"snrOffset"`  // added to the SNR of the node gateway for each other gateway
+}
+
+// Batch struct define how each gateway groups the uplinks of its nodes in PUSH_DATA packets
+// { "window": "100ms", "maxSize": 8 }
+type Batch struct {
+	Window  string `json:"window"`  // delay between two PUSH_DATA of a gateway, frames received in a window are sent together
+	MaxSize int    `json:"maxSize"` // max number of rxpk in one PUSH_DATA
+}
+
+// GatewayStatus struct define the keepalive PULL_DATA and the stat PUSH_DATA periodically sent by each gateway
+// { "keepaliveInterval": "10s", "statInterval": "30s", "latitude": [48.8, 48.9], "longitude": [2.2, 2.4], "altitude": 35 }
+type GatewayStatus struct {
+	KeepaliveInterval string     `json:"keepaliveInterval"` // PULL_DATA interval, no keepalive if not set
+	StatInterval      string     `json:"statInterval"`      // stat interval, no stat if not set
+	Latitude          [2]float64 `json:"latitude"`          // each gateway get a random position in the latitude and longitude ranges
+	Longitude         [2]float64 `json:"longitude"`         // no GPS coordinates are sent if both ranges are not set
+	Altitude          int32      `json:"altitude"`          // altitude in meters
+}
+
+// Region struct define the LoRaWAN regional parameters used by nodes
+// { "name": "US915", "subBands": [2], "dataRates": [3, 4] }
+type Region struct {
+	Name      string `json:"name"`      // EU868, US915, AS923, AU915, CN470 or IN865, EU868 if not set
+	SubBands  []int  `json:"subBands"`  // enabled sub-bands of 8 channels (from 1) for US915, AU915 and CN470, all channels if not set
+	DataRates []int  `json:"dataRates"` // each node get one of these data rates, the region default data rate if not set
+}
+
+// FCnt struct define how nodes handle their own uplink frame counter to test network server counter checks
+// { "start": 0, "rollover": 32, "resetEvery": 0, "replayEvery": 0 }
+type FCnt struct {
+	Start       uint32 `json:"start"`       // first uplink frame counter of each node
+	Rollover    int    `json:"rollover"`    // 16 or 32, the counter size in bits, 32 if not set
+	ResetEvery  int    `json:"resetEvery"`  // reset the counter to start every resetEvery uplinks, 0 to never reset
+	ReplayEvery int    `json:"replayEvery"` // send the previous counter again every replayEvery uplinks, 0 to never replay
+}
+
+// Payload struct define a payload with timestamp date and fport attached
+// { "value": "a string", "date": <timestamp>, "fport": <port>}
+// fport is 1 if not set, fport 0 means the value contains only mac commands
 type Payload struct {
-	Value string `json:"value"`
-	Date  int64  `json:"date"`
+	Value    string         `json:"value"`
+	Date     int64          `json:"date"`
+	Time     int64          `json:"time,omitempty"` // replay : unix time in milliseconds of the recorded uplink, the date if not set
+	FPort    *uint8         `json:"fport,omitempty"`
+	Template []PayloadField `json:"template,omitempty"` // if set, the payload is generated at each uplink instead of being the value
+}
+
+// PayloadField struct define a part of a templated payload, generated at each uplink
+// { "kind": "random", "size": 2, "range": [0, 1000] } or { "kind": "lpp", "channel": 1, "type": "temperature", "range": [-10, 40] }
+type PayloadField struct {
+	Kind         string     `json:"kind"`                   // hex, counter, timestamp, random, float, devEui, devAddr or lpp
+	Value        string     `json:"value,omitempty"`        // hex : the bytes of the field
+	Size         int        `json:"size,omitempty"`         // bytes of counter, timestamp, random (1 to 8) and float (4 or 8) fields
+	Range        [2]float64 `json:"range"`                  // random, float and lpp : the value is drawn between min and max
+	Unit         string     `json:"unit,omitempty"`         // timestamp : s (default) or ms since the unix epoch
+	LittleEndian bool       `json:"littleEndian,omitempty"` // byte order of counter, timestamp, random and float fields, big endian if false
+	Channel      uint8      `json:"channel,omitempty"`      // lpp : data channel
+	Type         string     `json:"type,omitempty"`         // lpp : data type, like temperature or humidity
+}
+
+// Radio struct define the RSSI and SNR of uplinks received by gateways, -35dBm and 5.1dB if not set
+// { "scope": "node", "rssi": [-120, -40], "snr": [-10, 10] } or { "scope": "node", "pathLoss": { "distance": [100, 5000] } }
+type Radio struct {
+	Scope    string     `json:"scope"`              // uplink, node or gateway : values are drawn at each uplink, once per node or once per gateway, uplink if not set
+	Rssi     [2]float64 `json:"rssi"`               // RSSI range in dBm, a fixed value if min equals max
+	Snr      [2]float64 `json:"snr"`                // SNR range in dB, a fixed value if min equals max
+	PathLoss *PathLoss  `json:"pathLoss,omitempty"` // if set, RSSI and SNR are computed from a distance instead of rssi and snr ranges
+}
+
+// PathLoss struct define a log-distance path loss model, the node data rate is the fastest one allowed by the link budget
+// RSSI = txPower - referenceLoss - 10 * exponent * log10(distance) + shadowing
+type PathLoss struct {
+	Distance      [2]float64 `json:"distance"`      // distance range between nodes and gateways in meters
+	TxPower       float64    `json:"txPower"`       // node transmit power in dBm, 14 if not set
+	ReferenceLoss float64    `json:"referenceLoss"` // loss at 1 meter in dB, 32 if not set
+	Exponent      float64    `json:"exponent"`      // path loss exponent, 2.7 if not set
+	Shadowing     float64    `json:"shadowing"`     // standard deviation in dB of the random shadowing of each uplink, 0 if not set
 }
 
 //Register struct is the command send by lorhammer to orchestrator for register gateway and sensors to network-server
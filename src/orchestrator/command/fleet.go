@@ -0,0 +1,153 @@
+package command
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lorhammer/src/model"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//splitFleets replace each init with a fleet by one init per lorhammer, each with its share of the fleet devices
+//devices of the fleet file are added to the devices of the init
+func splitFleets(inits []model.Init, nbLorhammer int) ([]model.Init, error) {
+	var res []model.Init
+	for _, init := range inits {
+		if init.Fleet == nil {
+			res = append(res, init)
+			continue
+		}
+		devices := init.Fleet.Devices
+		if init.Fleet.File != "" {
+			fileDevices, err := loadFleet(init.Fleet.File)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(append([]model.Device{}, devices...), fileDevices...)
+		}
+		// each lorhammer only checks its own share of the devices
+		if err := checkDuplicateDevices(devices); err != nil {
+			return nil, err
+		}
+		for i := 0; i < nbLorhammer; i++ {
+			lorhammerDevices := devices[i*len(devices)/nbLorhammer : (i+1)*len(devices)/nbLorhammer]
+			if len(lorhammerDevices) == 0 {
+				continue
+			}
+			lorhammerInit := init
+			lorhammerInit.Fleet = &model.Fleet{Devices: lorhammerDevices, SkipProvisioning: init.Fleet.SkipProvisioning}
+			res = append(res, lorhammerInit)
+		}
+	}
+	return res, nil
+}
+
+//checkDuplicateDevices return an error if two devices have the same devEui
+func checkDuplicateDevices(devices []model.Device) error {
+	devEUIs := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		devEUI := strings.ToLower(device.DevEUI)
+		if devEUIs[devEUI] {
+			return fmt.Errorf("fleet devEui %s is used by several devices", device.DevEUI)
+		}
+		devEUIs[devEUI] = true
+	}
+	return nil
+}
+
+//loadFleet read the devices of a JSON file, an array of devices, or of a CSV file with a header of device fields
+func loadFleet(file string) ([]model.Device, error) {
+	if strings.ToLower(filepath.Ext(file)) != ".csv" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var devices []model.Device
+		if err := json.Unmarshal(data, &devices); err != nil {
+			return nil, err
+		}
+		return devices, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("fleet file %s must have a header", file)
+	}
+	devices := make([]model.Device, len(records)-1)
+	for i, record := range records[1:] {
+		if devices[i], err = csvDevice(records[0], record); err != nil {
+			return nil, fmt.Errorf("fleet file %s line %d : %s", file, i+2, err)
+		}
+	}
+	return devices, nil
+}
+
+//csvDevice return the device of a CSV record, the header columns are the JSON fields of the device
+func csvDevice(header []string, record []string) (model.Device, error) {
+	device := model.Device{}
+	columns := map[string]*string{
+		"devEui":      &device.DevEUI,
+		"joinEui":     &device.JoinEUI,
+		"appKey":      &device.AppKey,
+		"nwkKey":      &device.NwkKey,
+		"devAddr":     &device.DevAddr,
+		"appSKey":     &device.AppSKey,
+		"nwkSKey":     &device.NwkSKey,
+		"sNwkSIntKey": &device.SNwkSIntKey,
+		"nwkSEncKey":  &device.NwkSEncKey,
+	}
+	for i, column := range header {
+		switch column {
+		case "fCntUp":
+			if record[i] == "" {
+				continue
+			}
+			fCntUp, err := strconv.ParseUint(record[i], 10, 32)
+			if err != nil {
+				return device, err
+			}
+			fCnt := uint32(fCntUp)
+			device.FCntUp = &fCnt
+		case "lorawan11":
+			if record[i] == "" {
+				continue
+			}
+			lorawan11, err := strconv.ParseBool(record[i])
+			if err != nil {
+				return device, err
+			}
+			device.LoRaWAN11 = &lorawan11
+		case "devNonce":
+			if record[i] == "" {
+				continue
+			}
+			devNonce, err := strconv.ParseUint(record[i], 10, 16)
+			if err != nil {
+				return device, err
+			}
+			nonce := uint16(devNonce)
+			device.DevNonce = &nonce
+		default:
+			value, ok := columns[column]
+			if !ok {
+				return device, fmt.Errorf("unknown column %s", column)
+			}
+			*value = record[i]
+		}
+	}
+	return device, nil
+}
@@ -0,0 +1,73 @@
+package command
+
+import (
+	"io/ioutil"
+	"lorhammer/src/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFleetFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadFleetCSV(t *testing.T) {
+	file := writeFleetFile(t, "devices.csv", "devEui, lorawan11, appKey, devAddr, fCntUp, devNonce\n0102030405060708,true,19842bd94743246b367c2e90942a1f73,,,12\n0102030405060709,,19842bd94743246b367c2e90942a1f73,01020304,42,\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	devices, err := loadFleet(file)
+	if err != nil || len(devices) != 2 {
+		t.Fatal("Valid CSV fleet must return its devices")
+	}
+	if devices[0].DevEUI != "0102030405060708" || devices[0].DevAddr != "" || devices[0].FCntUp != nil || devices[0].DevNonce == nil || *devices[0].DevNonce != 12 || devices[0].LoRaWAN11 == nil || !*devices[0].LoRaWAN11 {
+		t.Fatal("Device must have the fields of its line")
+	}
+	if devices[1].DevAddr != "01020304" || devices[1].FCntUp == nil || *devices[1].FCntUp != 42 || devices[1].DevNonce != nil || devices[1].LoRaWAN11 != nil {
+		t.Fatal("Device must have the session of its line")
+	}
+}
+
+func TestLoadFleetError(t *testing.T) {
+	file := writeFleetFile(t, "devices.csv", "devEui,unknown\n0102030405060708,1\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	if _, err := loadFleet(file); err == nil {
+		t.Fatal("Error expected on unknown CSV column")
+	}
+	if _, err := loadFleet(filepath.Join(filepath.Dir(file), "none.json")); err == nil {
+		t.Fatal("Error expected on missing fleet file")
+	}
+}
+
+func TestSplitFleets(t *testing.T) {
+	file := writeFleetFile(t, "devices.json", `[{"devEui":"0102030405060708"},{"devEui":"0102030405060709"},{"devEui":"010203040506070a"}]`)
+	defer os.RemoveAll(filepath.Dir(file))
+	inits := []model.Init{{Description: "random"}, {Description: "fleet", Fleet: &model.Fleet{File: file, SkipProvisioning: true}}}
+
+	res, err := splitFleets(inits, 2)
+	if err != nil || len(res) != 3 {
+		t.Fatal("Init with fleet must be split between lorhammers")
+	}
+	if res[0].Fleet != nil || len(res[1].Fleet.Devices) != 1 || len(res[2].Fleet.Devices) != 2 || res[2].Fleet.Devices[1].DevEUI != "010203040506070a" {
+		t.Fatal("Each lorhammer must get its share of the fleet devices")
+	}
+	if res[1].Fleet.File != "" || !res[1].Fleet.SkipProvisioning || res[1].Description != "fleet" {
+		t.Fatal("Split inits must keep the init and the fleet config without the file")
+	}
+
+	if res, _ := splitFleets([]model.Init{{Fleet: &model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708"}}}}}, 3); len(res) != 1 {
+		t.Fatal("Lorhammers without device must not get an init")
+	}
+	if _, err := splitFleets([]model.Init{{Fleet: &model.Fleet{File: file, Devices: []model.Device{{DevEUI: "010203040506070A"}}}}}, 2); err == nil {
+		t.Fatal("Error expected on devices with the same devEui given to different lorhammers")
+	}
+}
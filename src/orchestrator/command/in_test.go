@@ -68,6 +68,7 @@ func (m *fakeMqtt) Connect() error
 func (m *fakeMqtt) Disconnect()                                                 {}
 func (m *fakeMqtt) Handle(topics []string, handle func(messgae []byte)) error   { return nil }
 func (m *fakeMqtt) HandleCmd(topics []string, handle func(cmd model.CMD)) error { return nil }
+func (m *fakeMqtt) Publish(topic string, message []byte) error                  { return nil }
 func (m *fakeMqtt) PublishCmd(topic string, cmdName model.CommandName) error {
 	if m.test.publishError {
 		return errors.New("Error")
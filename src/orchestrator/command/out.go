@@ -27,10 +27,19 @@ func NbLorhammer() int {
 	return len(lorhammers)
 }
 
-//LaunchScenario emit a model.INIT command for lorhammers over mqtt
+//LaunchScenario emit a model.INIT command for lorhammers over mqtt, inits with a fleet are split between all lorhammers
+//recorded series of the replay files are given to their fleet devices first
 func LaunchScenario(mqttClient tools.Mqtt, inits []model.Init) error {
 	muLorhammers.Lock()
 	defer muLorhammers.Unlock()
+	inits, err := loadReplays(inits)
+	if err != nil {
+		return err
+	}
+	inits, err = splitFleets(inits, len(lorhammers))
+	if err != nil {
+		return err
+	}
 	currentLorhammer := 0
 	for _, init := range inits {
 		lorhammer := lorhammers[currentLorhammer]
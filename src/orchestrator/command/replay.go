@@ -0,0 +1,219 @@
+package command
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lorhammer/src/model"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//record is a recorded uplink of a device
+type record struct {
+	DevEUI    string      `json:"devEui"`
+	Timestamp interface{} `json:"timestamp"` // unix time in seconds, with milliseconds as decimals, or RFC 3339
+	Payload   string      `json:"payload"`   // hex
+	FPort     *uint8      `json:"fport"`
+}
+
+//loadReplays give each device of the inits with a replay file its recorded payloads, devices not in the fleet are added to it
+//the fleet file is loaded first so recorded devices keep their keys, and the replay window is set for all lorhammers
+func loadReplays(inits []model.Init) ([]model.Init, error) {
+	res := make([]model.Init, len(inits))
+	for i, init := range inits {
+		res[i] = init
+		if init.Replay == nil || init.Replay.File == "" {
+			continue
+		}
+		fleet := model.Fleet{}
+		if init.Fleet != nil {
+			fleet = *init.Fleet
+		}
+		if fleet.File != "" {
+			fileDevices, err := loadFleet(fleet.File)
+			if err != nil {
+				return nil, err
+			}
+			fleet.Devices, fleet.File = append(append([]model.Device{}, fleet.Devices...), fileDevices...), ""
+		}
+		series, err := loadRecords(init.Replay.File)
+		if err != nil {
+			return nil, err
+		}
+		replay := *init.Replay
+		replay.File = ""
+		fleet.Devices, replay.From, replay.To = addSeries(fleet.Devices, series)
+		res[i].Fleet, res[i].Replay = &fleet, &replay
+	}
+	return res, nil
+}
+
+//addSeries return the devices with the payloads of their series, and the times in milliseconds of the first and last payloads
+func addSeries(devices []model.Device, series map[string][]model.Payload) ([]model.Device, int64, int64) {
+	devices = append([]model.Device{}, devices...)
+	devEUIs := make([]string, 0, len(series))
+	for devEUI := range series {
+		devEUIs = append(devEUIs, devEUI)
+	}
+	sort.Strings(devEUIs)
+
+	var from, to int64
+	for i, devEUI := range devEUIs {
+		payloads := series[devEUI]
+		if i == 0 || payloads[0].Time < from {
+			from = payloads[0].Time
+		}
+		if i == 0 || payloads[len(payloads)-1].Time > to {
+			to = payloads[len(payloads)-1].Time
+		}
+		found := false
+		for j := range devices {
+			if strings.EqualFold(devices[j].DevEUI, devEUI) {
+				devices[j].Payloads, found = payloads, true
+			}
+		}
+		if !found {
+			devices = append(devices, model.Device{DevEUI: devEUI, Payloads: payloads})
+		}
+	}
+	return devices, from, to
+}
+
+//loadRecords read a CSV file with a header of record fields, or a JSONL file with a record object by line
+//it return the payloads of each devEui sorted by time
+func loadRecords(file string) (map[string][]model.Payload, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []record
+	if strings.ToLower(filepath.Ext(file)) == ".csv" {
+		records, err = readCSVRecords(f)
+	} else {
+		records, err = readJSONLRecords(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replay file %s : %s", file, err)
+	}
+
+	series := make(map[string][]model.Payload)
+	for i, r := range records {
+		payload, err := recordPayload(r)
+		if err != nil {
+			return nil, fmt.Errorf("replay file %s record %d : %s", file, i+1, err)
+		}
+		devEUI := strings.ToLower(r.DevEUI)
+		series[devEUI] = append(series[devEUI], payload)
+	}
+	for _, payloads := range series {
+		sort.SliceStable(payloads, func(i, j int) bool { return payloads[i].Time < payloads[j].Time })
+	}
+	return series, nil
+}
+
+func readCSVRecords(r io.Reader) ([]record, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("a header is expected")
+	}
+	records := make([]record, len(lines)-1)
+	for i, line := range lines[1:] {
+		for j, column := range lines[0] {
+			switch column {
+			case "devEui":
+				records[i].DevEUI = line[j]
+			case "timestamp":
+				records[i].Timestamp = line[j]
+			case "payload":
+				records[i].Payload = line[j]
+			case "fport":
+				if line[j] == "" {
+					continue
+				}
+				fport, err := strconv.ParseUint(line[j], 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("line %d : %s", i+2, err)
+				}
+				records[i].FPort = new(uint8)
+				*records[i].FPort = uint8(fport)
+			default:
+				return nil, fmt.Errorf("unknown column %s", column)
+			}
+		}
+	}
+	return records, nil
+}
+
+func readJSONLRecords(r io.Reader) ([]record, error) {
+	var records []record
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d : %s", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+//recordTimes are the first and last plausible times of a record, a unix time in milliseconds read as seconds is after them
+var recordTimes = [2]time.Time{time.Date(1990, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)}
+
+//recordPayload return the payload of the record, with the unix time in milliseconds of its timestamp
+//the payload has no date so the replayed uplink is dated with the time it is emitted
+func recordPayload(r record) (model.Payload, error) {
+	if r.DevEUI == "" {
+		return model.Payload{}, fmt.Errorf("devEui is mandatory")
+	}
+	if _, err := hex.DecodeString(r.Payload); err != nil {
+		return model.Payload{}, fmt.Errorf("payload %s", err)
+	}
+	recorded, err := recordTime(r.Timestamp)
+	if err != nil {
+		return model.Payload{}, err
+	}
+	return model.Payload{Value: r.Payload, Time: recorded, FPort: r.FPort}, nil
+}
+
+//recordTime return the unix time in milliseconds of a timestamp in unix seconds, with milliseconds as decimals, or in RFC 3339
+func recordTime(timestamp interface{}) (int64, error) {
+	var seconds float64
+	switch value := timestamp.(type) {
+	case float64:
+		seconds = value
+	case string:
+		var err error
+		if seconds, err = strconv.ParseFloat(value, 64); err != nil {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return 0, fmt.Errorf("timestamp %s must be unix seconds or RFC 3339", value)
+			}
+			seconds = float64(t.UnixNano()) / float64(time.Second)
+		}
+	default:
+		return 0, fmt.Errorf("timestamp is mandatory")
+	}
+	if seconds < float64(recordTimes[0].Unix()) || seconds >= float64(recordTimes[1].Unix()) {
+		return 0, fmt.Errorf("timestamp %v must be between %d and %d, unix seconds and not milliseconds", timestamp, recordTimes[0].Year(), recordTimes[1].Year())
+	}
+	return int64(math.Floor(seconds*1000 + 0.5)), nil
+}
@@ -0,0 +1,77 @@
+package command
+
+import (
+	"lorhammer/src/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRecordsCSV(t *testing.T) {
+	file := writeFleetFile(t, "traffic.csv", "devEui, timestamp, payload, fport\n0102030405060708,2017-03-08T00:01:00Z,02,\n0102030405060708,1488931200,01,2\n0102030405060709,1488931230.5,03,\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	series, err := loadRecords(file)
+	if err != nil || len(series) != 2 {
+		t.Fatal("Valid CSV recording must return the series of each device")
+	}
+	first := series["0102030405060708"]
+	if len(first) != 2 || first[0].Value != "01" || first[0].Time != 1488931200000 || first[0].Date != 0 || first[0].FPort == nil || *first[0].FPort != 2 {
+		t.Fatal("Series must be sorted by time with the fport of the records")
+	}
+	if first[1].Time != 1488931260000 || first[1].FPort != nil {
+		t.Fatal("RFC 3339 timestamp must be parsed")
+	}
+	if series["0102030405060709"][0].Time != 1488931230500 {
+		t.Fatal("Milliseconds of the timestamp must be kept")
+	}
+}
+
+func TestLoadRecordsJSONL(t *testing.T) {
+	file := writeFleetFile(t, "traffic.jsonl", `{"devEui":"0102030405060708","timestamp":1488931200,"payload":"01","fport":3}`+"\n\n"+`{"devEui":"0102030405060708","timestamp":"2017-03-08T00:00:00.250Z","payload":"02"}`+"\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	series, err := loadRecords(file)
+	if err != nil || len(series["0102030405060708"]) != 2 || *series["0102030405060708"][0].FPort != 3 || series["0102030405060708"][1].Time != 1488931200250 {
+		t.Fatal("Valid JSONL recording must return the series of each device")
+	}
+}
+
+func TestLoadRecordsError(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown.csv":   "devEui,unknown\n0102030405060708,1\n",
+		"payload.csv":   "devEui,timestamp,payload\n0102030405060708,1488931200,zz\n",
+		"timestamp.csv": "devEui,timestamp,payload\n0102030405060708,yesterday,01\n",
+		"devEui.jsonl":  `{"timestamp":1488931200,"payload":"01"}`,
+		"millis.jsonl":  `{"devEui":"0102030405060708","timestamp":1488931200000,"payload":"01"}`,
+		"zero.csv":      "devEui,timestamp,payload\n0102030405060708,0,01\n",
+	} {
+		file := writeFleetFile(t, name, content)
+		defer os.RemoveAll(filepath.Dir(file))
+		if _, err := loadRecords(file); err == nil {
+			t.Fatalf("Error expected on wrong recording %s", name)
+		}
+	}
+}
+
+func TestLoadReplays(t *testing.T) {
+	file := writeFleetFile(t, "traffic.csv", "devEui,timestamp,payload\n0102030405060708,1488931200,01\n0102030405060709,1488931260,02\n")
+	defer os.RemoveAll(filepath.Dir(file))
+	fleet := &model.Fleet{Devices: []model.Device{{DevEUI: "0102030405060708", AppKey: "19842bd94743246b367c2e90942a1f73"}}, SkipProvisioning: true}
+	inits := []model.Init{{Description: "random"}, {Fleet: fleet, Replay: &model.Replay{File: file, Speed: 60}}}
+
+	res, err := loadReplays(inits)
+	if err != nil || res[0].Fleet != nil || res[0].Replay != nil {
+		t.Fatal("Init without replay must be kept")
+	}
+	devices := res[1].Fleet.Devices
+	if len(devices) != 2 || devices[0].AppKey == "" || devices[0].Payloads[0].Value != "01" || devices[1].DevEUI != "0102030405060709" || !res[1].Fleet.SkipProvisioning {
+		t.Fatal("Recorded series must be given to the fleet devices, unknown devices are added")
+	}
+	if replay := res[1].Replay; replay.File != "" || replay.Speed != 60 || replay.From != 1488931200000 || replay.To != 1488931260000 {
+		t.Fatal("Replay must be sent without its file and with the window of the recording")
+	}
+	if len(fleet.Devices[0].Payloads) != 0 {
+		t.Fatal("Fleet of the init must not be modified")
+	}
+}
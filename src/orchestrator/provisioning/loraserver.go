@@ -39,12 +39,33 @@ type loraserver struct {
 	ServiceProfileID      string `json:"serviceProfileID"`
 	AppID                 string `json:"appId"`
 	DeviceProfileID       string `json:"deviceProfileId"`
+	DeviceProfileID11     string `json:"deviceProfileId11"`
+	DeviceProfileIDClassC string `json:"deviceProfileIdClassC"`
+	DeviceProfileIDClassB string `json:"deviceProfileIdClassB"`
 	Abp                   bool   `json:"abp"`
 	NbProvisionerParallel int    `json:"nbProvisionerParallel"`
 	DeleteOrganization    bool   `json:"deleteOrganization"`
 	DeleteApplication     bool   `json:"deleteApplication"`
 
-	httpClient httpClientSender
+	deviceProfileIDs map[deviceProfile]string // device profile of each kind of node, set before provisioning nodes
+	httpClient       httpClientSender
+}
+
+//deviceProfile is the kind of device profile needed by a node, by its LoRaWAN version and its class
+type deviceProfile struct {
+	lorawan11 bool
+	class     string // A, B or C
+}
+
+func nodeDeviceProfile(node *model.Node) deviceProfile {
+	profile := deviceProfile{lorawan11: node.LoRaWAN11, class: "A"}
+	switch {
+	case node.ClassC:
+		profile.class = "C"
+	case node.ClassB:
+		profile.class = "B"
+	}
+	return profile
 }
 
 func newLoraserver(rawConfig json.RawMessage) (provisioner, error) {
@@ -109,6 +130,10 @@ func (loraserver *loraserver) Provision(sensorsToRegister model.Register) error
 		return err
 	}
 
+	if err := loraserver.initDeviceProfiles(sensorsToRegister); err != nil {
+		return err
+	}
+
 	nbNodeToProvision := 0
 	for _, gateway := range sensorsToRegister.Gateways {
 		for range gateway.Nodes {
@@ -387,70 +412,117 @@ func (loraserver *loraserver) initApplication() error {
 
 func (loraserver *loraserver) initDeviceProfile() error {
 	if loraserver.DeviceProfileID == "" {
-		req := struct {
-			DeviceProfile struct {
-				Name            string `json:"name"`
-				OrganizationID  string `json:"organizationID"`
-				NetworkServerID string `json:"networkServerID"`
-				RxDROffset1     int    `json:"rxDROffset1"`
-				RxDataRate2     int    `json:"rxDataRate2"`
-				RxDelay1        int    `json:"rxDelay1"`
-				// ClassBTimeout           int    `json:"classBTimeout"`
-				// ClassCTimeout           int    `json:"classCTimeout"`
-				// FactoryPresetFreqs      []int  `json:"factoryPresetFreqs"`
-				// MacVersion              string `json:"macVersion"`
-				// MaxDutyCycle            int    `json:"maxDutyCycle"`
-				// MaxEIRP                 int    `json:"maxEIRP"`
-				// PingSlotDR              int    `json:"pingSlotDR"`
-				// PingSlotFreq            int    `json:"pingSlotFreq"`
-				// PingSlotPeriod          int    `json:"pingSlotPeriod"`
-				// RegParamsRevisionstring string `json:"regParamsRevisionstring"`
-				// RfRegionstring          string `json:"rfRegionstring"`
-				// RxFreq2           int  `json:"rxFreq2"`
-				// Supports32bitFCnt bool `json:"supports32bitFCnt"`
-				// SupportsClassB    bool `json:"supportsClassB"`
-				// SupportsClassC    bool `json:"supportsClassC"`
-				// SupportsJoin      bool `json:"supportsJoin"`
-				// TODO find description and meaning of all fields
-			} `json:"deviceProfile"`
-		}{
-			DeviceProfile: struct {
-				Name            string `json:"name"`
-				OrganizationID  string `json:"organizationID"`
-				NetworkServerID string `json:"networkServerID"`
-				RxDROffset1     int    `json:"rxDROffset1"`
-				RxDataRate2     int    `json:"rxDataRate2"`
-				RxDelay1        int    `json:"rxDelay1"`
-			}{
-				Name:            "LorhammerDeviceProfile",
-				OrganizationID:  loraserver.OrganizationID,
-				NetworkServerID: loraserver.NetworkServerID,
-				RxDROffset1:     0,
-				RxDataRate2:     0,
-				RxDelay1:        0,
-			},
-		}
-
-		resp := struct {
-			ID string `json:"id"`
-		}{}
-
-		err := loraserver.doRequest(loraserver.APIURL+"/api/device-profiles", "POST", req, &resp)
+		id, err := loraserver.createDeviceProfile(deviceProfile{class: "A"})
 		if err != nil {
 			return err
 		}
+		loraserver.DeviceProfileID = id
+	}
+	return nil
+}
 
-		loraserver.DeviceProfileID = resp.ID
+//initDeviceProfiles set the device profile of each kind of node to provision, the one of the config or a new one
+//class B and C nodes need a device profile supporting their class, LoRaWAN 1.1 nodes one with the mac version 1.1.0
+func (loraserver *loraserver) initDeviceProfiles(sensorsToRegister model.Register) error {
+	if loraserver.deviceProfileIDs == nil {
+		loraserver.deviceProfileIDs = map[deviceProfile]string{
+			{class: "A"}:                  loraserver.DeviceProfileID,
+			{lorawan11: true, class: "A"}: loraserver.DeviceProfileID11,
+			{class: "C"}:                  loraserver.DeviceProfileIDClassC,
+			{class: "B"}:                  loraserver.DeviceProfileIDClassB,
+		}
+	}
+	for _, gateway := range sensorsToRegister.Gateways {
+		for _, sensor := range gateway.Nodes {
+			profile := nodeDeviceProfile(sensor)
+			if loraserver.deviceProfileIDs[profile] != "" {
+				continue
+			}
+			id, err := loraserver.createDeviceProfile(profile)
+			if err != nil {
+				return err
+			}
+			loraserver.deviceProfileIDs[profile] = id
+		}
 	}
 	return nil
 }
 
+func (loraserver *loraserver) createDeviceProfile(profile deviceProfile) (string, error) {
+	name, macVersion := "LorhammerDeviceProfile", "1.0.2"
+	if profile.lorawan11 {
+		name, macVersion = name+"11", "1.1.0"
+	}
+	if profile.class != "A" {
+		name += "Class" + profile.class
+	}
+	req := struct {
+		DeviceProfile struct {
+			Name            string `json:"name"`
+			OrganizationID  string `json:"organizationID"`
+			NetworkServerID string `json:"networkServerID"`
+			RxDROffset1     int    `json:"rxDROffset1"`
+			RxDataRate2     int    `json:"rxDataRate2"`
+			RxDelay1        int    `json:"rxDelay1"`
+			SupportsClassC  bool   `json:"supportsClassC"`
+			SupportsClassB  bool   `json:"supportsClassB"`
+			MacVersion      string `json:"macVersion"`
+			// ClassBTimeout           int    `json:"classBTimeout"`
+			// ClassCTimeout           int    `json:"classCTimeout"`
+			// FactoryPresetFreqs      []int  `json:"factoryPresetFreqs"`
+			// MaxDutyCycle            int    `json:"maxDutyCycle"`
+			// MaxEIRP                 int    `json:"maxEIRP"`
+			// PingSlotDR              int    `json:"pingSlotDR"`
+			// PingSlotFreq            int    `json:"pingSlotFreq"`
+			// PingSlotPeriod          int    `json:"pingSlotPeriod"`
+			// RegParamsRevisionstring string `json:"regParamsRevisionstring"`
+			// RfRegionstring          string `json:"rfRegionstring"`
+			// RxFreq2           int  `json:"rxFreq2"`
+			// Supports32bitFCnt bool `json:"supports32bitFCnt"`
+			// SupportsJoin      bool `json:"supportsJoin"`
+			// TODO find description and meaning of all fields
+		} `json:"deviceProfile"`
+	}{
+		DeviceProfile: struct {
+			Name            string `json:"name"`
+			OrganizationID  string `json:"organizationID"`
+			NetworkServerID string `json:"networkServerID"`
+			RxDROffset1     int    `json:"rxDROffset1"`
+			RxDataRate2     int    `json:"rxDataRate2"`
+			RxDelay1        int    `json:"rxDelay1"`
+			SupportsClassC  bool   `json:"supportsClassC"`
+			SupportsClassB  bool   `json:"supportsClassB"`
+			MacVersion      string `json:"macVersion"`
+		}{
+			Name:            name,
+			OrganizationID:  loraserver.OrganizationID,
+			NetworkServerID: loraserver.NetworkServerID,
+			RxDROffset1:     0,
+			RxDataRate2:     0,
+			RxDelay1:        0,
+			SupportsClassC:  profile.class == "C",
+			SupportsClassB:  profile.class == "B",
+			MacVersion:      macVersion,
+		},
+	}
+
+	resp := struct {
+		ID string `json:"id"`
+	}{}
+
+	if err := loraserver.doRequest(loraserver.APIURL+"/api/device-profiles", "POST", req, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
 func (loraserver *loraserver) provisionSensorAsync(sensorChan chan *model.Node, poison chan bool, errorChan chan error, sensorFinishChan chan *model.Node) {
 	exit := false
 	for {
 		select {
 		case sensor := <-sensorChan:
 			if sensor != nil { // Why sensor is nil sometimes !?
+				deviceProfileID := loraserver.deviceProfileIDs[nodeDeviceProfile(sensor)]
 				req := struct {
 					Device struct {
 						Name            string `json:"name"`
@@ -470,7 +542,7 @@ func (loraserver *loraserver) provisionSensorAsync(sensorChan chan *model.Node,
 						Name:            "STRESSNODE_" + sensor.DevEUI.String(),
 						Description:     sensor.Description,
 						ApplicationID:   loraserver.AppID,
-						DeviceProfileID: loraserver.DeviceProfileID,
+						DeviceProfileID: deviceProfileID,
 						DevEUI:          sensor.DevEUI.String(),
 					},
 				}
@@ -499,7 +571,7 @@ func (loraserver *loraserver) provisionSensorAsync(sensorChan chan *model.Node,
 					}{
 						DevEUI: sensor.DevEUI.String(),
 						AppKey: sensor.AppKey.String(),
-						NwkKey: sensor.AppKey.String(),
+						NwkKey: sensor.NwkKey.String(),
 					},
 				}
 
@@ -520,8 +592,8 @@ func (loraserver *loraserver) provisionSensorAsync(sensorChan chan *model.Node,
 							FCntUp        int    `json:"fCntUp"`
 							NwkSKeystring string `json:"nwkSKey"`
 							NwkSEncKey    string `json:"nwkSEncKey"`
-							SNwkSEncKey   string `json:"sNwkSIntKey"`
-							FNwkSEncKey   string `json:"fNwkSIntKey"`
+							SNwkSIntKey   string `json:"sNwkSIntKey"`
+							FNwkSIntKey   string `json:"fNwkSIntKey"`
 							SkipFCntCheck bool   `json:"skipFCntCheck"`
 						} `json:"deviceActivation"`
 					}{
@@ -533,19 +605,19 @@ func (loraserver *loraserver) provisionSensorAsync(sensorChan chan *model.Node,
 							FCntUp        int    `json:"fCntUp"`
 							NwkSKeystring string `json:"nwkSKey"`
 							NwkSEncKey    string `json:"nwkSEncKey"`
-							SNwkSEncKey   string `json:"sNwkSIntKey"`
-							FNwkSEncKey   string `json:"fNwkSIntKey"`
+							SNwkSIntKey   string `json:"sNwkSIntKey"`
+							FNwkSIntKey   string `json:"fNwkSIntKey"`
 							SkipFCntCheck bool   `json:"skipFCntCheck"`
 						}{
 							AppSKeystring: sensor.AppSKey.String(),
 							DevAddrstring: sensor.DevAddr.String(),
 							DevEUIstring:  sensor.DevEUI.String(),
 							FCntDown:      0,
-							FCntUp:        0,
+							FCntUp:        int(sensor.FCntUp),
 							NwkSKeystring: sensor.NwSKey.String(),
-							NwkSEncKey:    sensor.NwSKey.String(),
-							SNwkSEncKey:   sensor.NwSKey.String(),
-							FNwkSEncKey:   sensor.NwSKey.String(),
+							NwkSEncKey:    sensor.NwkSEncKey.String(),
+							SNwkSIntKey:   sensor.SNwkSIntKey.String(),
+							FNwkSIntKey:   sensor.NwSKey.String(),
 							SkipFCntCheck: false,
 						},
 					}
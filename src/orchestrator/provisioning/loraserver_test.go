@@ -40,7 +40,7 @@ func newNodes(nb int) []*model.Node {
 		nodes[i] = &model.Node{
 			DevAddr:        tools.Random4Bytes(),
 			DevEUI:         tools.Random8Bytes(),
-			AppEUI:         tools.Random8Bytes(),
+			JoinEUI:        tools.Random8Bytes(),
 			AppKey:         tools.Random16Bytes(),
 			AppSKey:        tools.Random16Bytes(),
 			NwSKey:         tools.Random16Bytes(),
@@ -295,3 +295,45 @@ func TestDeprovisioningLoraserver(t *testing.T) {
 		t.Fatal("Deprovsion should not throw error")
 	}
 }
+
+func TestProvisioningLoRaWAN11DeviceProfile(t *testing.T) {
+	fakeData := append([]fakeHTTPClientData{
+		{url: regexp.MustCompile(`/api/device-profiles`), method: "POST", err: nil, body: `{"id":"2"}`},
+	}, data[0].data...)
+
+	l := newDefautlLoraserver()
+	l.httpClient = fakeHTTPClient{data: fakeData}
+	if err := l.Provision(model.Register{Gateways: newGateways(2, 1)}); err != nil || l.deviceProfileIDs[deviceProfile{lorawan11: true, class: "A"}] != "" {
+		t.Fatal("LoRaWAN 1.1 device profile must not be created without LoRaWAN 1.1 nodes")
+	}
+
+	l = newDefautlLoraserver()
+	l.httpClient = fakeHTTPClient{data: fakeData}
+	gateways := newGateways(2, 1)
+	gateways[0].Nodes[0].LoRaWAN11 = true
+	if err := l.Provision(model.Register{Gateways: gateways}); err != nil || l.deviceProfileIDs[deviceProfile{lorawan11: true, class: "A"}] != "2" {
+		t.Fatal("LoRaWAN 1.1 device profile must be created for LoRaWAN 1.1 nodes")
+	}
+}
+
+func TestProvisioningClassDeviceProfiles(t *testing.T) {
+	fakeData := append([]fakeHTTPClientData{
+		{url: regexp.MustCompile(`/api/device-profiles`), method: "POST", err: nil, body: `{"id":"3"}`},
+	}, data[0].data...)
+
+	l := newDefautlLoraserver()
+	l.DeviceProfileID, l.DeviceProfileIDClassB = "1", "4"
+	l.httpClient = fakeHTTPClient{data: fakeData}
+	gateways := newGateways(2, 2)
+	gateways[0].Nodes[0].ClassC = true
+	gateways[1].Nodes[0].ClassB = true
+	if err := l.Provision(model.Register{Gateways: gateways}); err != nil {
+		t.Fatal("Nodes of several classes must be provisioned")
+	}
+	if l.deviceProfileIDs[nodeDeviceProfile(gateways[0].Nodes[0])] != "3" || l.deviceProfileIDs[nodeDeviceProfile(gateways[1].Nodes[0])] != "4" {
+		t.Fatal("Class C nodes must have a new class C device profile and class B nodes the one of the config")
+	}
+	if l.deviceProfileIDs[nodeDeviceProfile(gateways[0].Nodes[1])] != "1" {
+		t.Fatal("Class A nodes must keep the device profile of the config")
+	}
+}
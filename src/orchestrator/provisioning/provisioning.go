@@ -42,11 +42,27 @@ func Provision(uuid string, provisioning Model, sensorsToRegister model.Register
 			}
 			instances.Store(uuid, instance)
 		}
-		return instance.(provisioner).Provision(sensorsToRegister)
+		return instance.(provisioner).Provision(withoutProvisioned(sensorsToRegister))
 	}
 	return err
 }
 
+//withoutProvisioned return the register without the nodes which already exist on the network server
+func withoutProvisioned(sensorsToRegister model.Register) model.Register {
+	gateways := make([]model.Gateway, len(sensorsToRegister.Gateways))
+	for i, gateway := range sensorsToRegister.Gateways {
+		gateways[i] = gateway
+		gateways[i].Nodes = nil
+		for _, node := range gateway.Nodes {
+			if !node.Provisioned {
+				gateways[i].Nodes = append(gateways[i].Nodes, node)
+			}
+		}
+	}
+	sensorsToRegister.Gateways = gateways
+	return sensorsToRegister
+}
+
 //DeProvision delete all references of a previous Provision()
 func DeProvision(uuid string) error {
 	if instance, ok := instances.Load(uuid); ok {
@@ -110,3 +110,29 @@ func TestCleanAfterDeProvision(t *testing.T) {
 		t.Fatal("After DeProvision instances should be cleaned")
 	}
 }
+
+type fakeProvisioner struct {
+	sensorsToRegister model.Register
+}
+
+func (f *fakeProvisioner) Provision(sensorsToRegister model.Register) error {
+	f.sensorsToRegister = sensorsToRegister
+	return nil
+}
+
+func (f *fakeProvisioner) DeProvision() error { return nil }
+
+func TestSkipProvisioned(t *testing.T) {
+	fake := &fakeProvisioner{}
+	provisioners["fakeProvisioner"] = func(conf json.RawMessage) (provisioner, error) {
+		return fake, nil
+	}
+	nodes := []*model.Node{{Provisioned: true}, {}}
+
+	if err := Provision("6", Model{Type: "fakeProvisioner"}, model.Register{Gateways: []model.Gateway{{Nodes: nodes}}}); err != nil {
+		t.Fatal("Fake provisioner should not return an error")
+	}
+	if len(fake.sensorsToRegister.Gateways) != 1 || len(fake.sensorsToRegister.Gateways[0].Nodes) != 1 || fake.sensorsToRegister.Gateways[0].Nodes[0] != nodes[1] {
+		t.Fatal("Nodes existing on the network server should not be provisioned")
+	}
+}
@@ -17,6 +17,7 @@ func (*fakeMqtt) Connect() error                                              {
 func (*fakeMqtt) Disconnect()                                                 {}
 func (*fakeMqtt) Handle(topics []string, handle func(message []byte)) error   { return nil }
 func (*fakeMqtt) HandleCmd(topics []string, handle func(cmd model.CMD)) error { return nil }
+func (*fakeMqtt) Publish(topic string, message []byte) error                  { return nil }
 func (f *fakeMqtt) PublishCmd(topic string, cmdName model.CommandName) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -23,6 +23,7 @@ type Mqtt interface {
 	GetAddress() string
 	Handle(topics []string, handle func(message []byte)) error
 	HandleCmd(topics []string, handle func(cmd model.CMD)) error
+	Publish(topic string, message []byte) error
 	PublishCmd(topic string, cmdName model.CommandName) error
 	PublishSubCmd(topic string, cmdName model.CommandName, subCmd interface{}) error
 }
@@ -96,7 +97,7 @@ func (mqtt *mqttImpl) HandleCmd(topics []string, handle func(cmd model.CMD)) err
 	})
 }
 
-func (mqtt *mqttImpl) publish(topic string, message []byte) error {
+func (mqtt *mqttImpl) Publish(topic string, message []byte) error {
 	mqtt.client.Publish(topic, 0, false, message)
 	return nil
 }
@@ -107,7 +108,7 @@ func (mqtt *mqttImpl) publishFullCmd(topic string, cmd model.CMD) error {
 		return err
 	}
 	logMqtt.WithField("topic", topic).WithField("cmd", cmd.CmdName).Info("Send mqtt cmd")
-	return mqtt.publish(topic, message)
+	return mqtt.Publish(topic, message)
 }
 
 func (mqtt *mqttImpl) PublishCmd(topic string, cmdName model.CommandName) error {
@@ -4,18 +4,23 @@ import (
 	"crypto/rand"
 	"math"
 	rmath "math/rand"
+	"sync"
 	"time"
 )
 
+//source is seeded once and shared by the random functions, a math/rand source is not safe for concurrent use
+var source = struct {
+	sync.Mutex
+	rand *rmath.Rand
+}{rand: rmath.New(rmath.NewSource(time.Now().UnixNano()))}
+
 //Random generate random int between min and max
 //Deprecated: use Random64 instead
 func Random(min, max int) int {
 	if min == max {
 		return min
 	}
-	s1 := rmath.NewSource(time.Now().UnixNano())
-	r1 := rmath.New(s1)
-	res := math.Floor(r1.Float64()*float64(max-min+1)) + float64(min)
+	res := math.Floor(RandomFloat64()*float64(max-min+1)) + float64(min)
 	return int(res)
 }
 
@@ -24,12 +29,31 @@ func Random64(min, max int64) int64 {
 	if min == max {
 		return min
 	}
-	s1 := rmath.NewSource(time.Now().UnixNano())
-	r1 := rmath.New(s1)
-	res := math.Floor(r1.Float64()*float64(max-min+1)) + float64(min)
+	res := math.Floor(RandomFloat64()*float64(max-min+1)) + float64(min)
 	return int64(res)
 }
 
+//RandomFloat64 generate random float64 between 0.0 (included) and 1.0 (excluded)
+func RandomFloat64() float64 {
+	source.Lock()
+	defer source.Unlock()
+	return source.rand.Float64()
+}
+
+//RandomNormFloat64 generate random float64 normally distributed with mean 0 and standard deviation 1
+func RandomNormFloat64() float64 {
+	source.Lock()
+	defer source.Unlock()
+	return source.rand.NormFloat64()
+}
+
+//RandomExpFloat64 generate random float64 exponentially distributed with rate 1
+func RandomExpFloat64() float64 {
+	source.Lock()
+	defer source.Unlock()
+	return source.rand.ExpFloat64()
+}
+
 //RandomBytes generate random int64 between min and max
 func RandomBytes(nb int) []byte {
 	b := make([]byte, nb)
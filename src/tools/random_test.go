@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"sync"
 	"testing"
 	"time"
 )
@@ -59,6 +60,44 @@ func TestRandomDuration(t *testing.T) {
 	}
 }
 
+func TestRandomFloat64(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		res := RandomFloat64()
+		if res < 0 || res >= 1 {
+			t.Fatalf("RandomFloat64 give %f but it outside of [0, 1)", res)
+		}
+	}
+}
+
+func TestRandomFloat64Concurrent(t *testing.T) {
+	values := make(chan float64, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values <- RandomFloat64()
+		}()
+	}
+	wg.Wait()
+	close(values)
+	distinct := make(map[float64]bool)
+	for value := range values {
+		distinct[value] = true
+	}
+	if len(distinct) < 99 {
+		t.Fatalf("RandomFloat64 called at the same time must give different values, got %d distinct values", len(distinct))
+	}
+}
+
+func TestRandomExpFloat64(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if res := RandomExpFloat64(); res < 0 {
+			t.Fatalf("RandomExpFloat64 give %f but it must be positive", res)
+		}
+	}
+}
+
 var toTestsBytes = []int{1, 10, 100}
 
 func TestRandomBytes(t *testing.T) {